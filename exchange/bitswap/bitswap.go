@@ -348,6 +348,19 @@ func (bs *Bitswap) ReceiveMessage(ctx context.Context, p peer.ID, incoming bsmsg
 	// TODO: this is bad, and could be easily abused.
 	// Should only track *useful* messages in ledger
 
+	bs.wm.PeerWantlistReceived(p, incoming)
+
+	// stop sending the blocks the peer no longer wants
+	var cancelled []*cid.Cid
+	for _, e := range incoming.Wantlist() {
+		if e.Cancel {
+			cancelled = append(cancelled, e.Cid)
+		}
+	}
+	if len(cancelled) > 0 {
+		bs.wm.PeerCancelled(p, cancelled)
+	}
+
 	iblocks := incoming.Blocks()
 
 	if len(iblocks) == 0 {
@@ -355,15 +368,19 @@ func (bs *Bitswap) ReceiveMessage(ctx context.Context, p peer.ID, incoming bsmsg
 	}
 
 	// quickly send out cancels, reduces chances of duplicate block receives
-	var keys []*cid.Cid
+	var keys, unwanted []*cid.Cid
 	for _, block := range iblocks {
 		if _, found := bs.wm.wl.Contains(block.Cid()); !found {
 			log.Infof("received un-asked-for %s from %s", block, p)
+			unwanted = append(unwanted, block.Cid())
 			continue
 		}
 		keys = append(keys, block.Cid())
 	}
-	bs.wm.CancelWants(keys)
+	bs.wm.ReceivedBlocks(keys, p)
+	if len(unwanted) > 0 {
+		bs.wm.ReceivedUnwanted(unwanted, p)
+	}
 
 	wg := sync.WaitGroup{}
 	for _, block := range iblocks {
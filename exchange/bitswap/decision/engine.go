@@ -63,6 +63,11 @@ type Envelope struct {
 
 	// A callback to notify the decision queue that the task is complete
 	Sent func()
+
+	// Failed is called instead of Sent when the block could not be sent,
+	// if the sender distinguishes the two. It may be nil, in which case
+	// Sent is called either way
+	Failed func()
 }
 
 type Engine struct {
@@ -178,18 +183,20 @@ func (e *Engine) nextEnvelope(ctx context.Context) (*Envelope, error) {
 			continue
 		}
 
+		done := func() {
+			nextTask.Done()
+			select {
+			case e.workSignal <- struct{}{}:
+				// work completing may mean that our queue will provide new
+				// work to be done.
+			default:
+			}
+		}
 		return &Envelope{
-			Peer:  nextTask.Target,
-			Block: block,
-			Sent: func() {
-				nextTask.Done()
-				select {
-				case e.workSignal <- struct{}{}:
-					// work completing may mean that our queue will provide new
-					// work to be done.
-				default:
-				}
-			},
+			Peer:   nextTask.Target,
+			Block:  block,
+			Sent:   done,
+			Failed: done,
 		}, nil
 	}
 }
@@ -1,8 +1,11 @@
 package message
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"sort"
+	"sync"
 
 	blocks "github.com/ipfs/go-ipfs/blocks"
 	pb "github.com/ipfs/go-ipfs/exchange/bitswap/message/pb"
@@ -28,6 +31,9 @@ type BitSwapMessage interface {
 	// AddEntry adds an entry to the Wantlist.
 	AddEntry(key *cid.Cid, priority int)
 
+	// AddAnnotatedEntry adds an entry carrying flags to the Wantlist.
+	AddAnnotatedEntry(key *cid.Cid, priority int, flags uint8)
+
 	Cancel(key *cid.Cid)
 
 	Empty() bool
@@ -48,6 +54,45 @@ type Exportable interface {
 	ToNetV1(w io.Writer) error
 }
 
+// Encoding names a wire format for bitswap messages.
+type Encoding string
+
+// EncodingProtobuf is the default, length delimited protobuf, encoding.
+const EncodingProtobuf Encoding = "protobuf"
+
+// Encoder writes a message to w in a particular wire format.
+type Encoder func(m BitSwapMessage, w io.Writer) error
+
+var ErrUnknownEncoding = errors.New("unknown bitswap message encoding")
+
+var (
+	encodersLk sync.RWMutex
+	encoders   = map[Encoding]Encoder{
+		EncodingProtobuf: func(m BitSwapMessage, w io.Writer) error {
+			return m.ToNetV1(w)
+		},
+	}
+)
+
+// RegisterEncoder makes enc available to Encode, replacing any encoder
+// previously registered under the same name.
+func RegisterEncoder(name Encoding, enc Encoder) {
+	encodersLk.Lock()
+	defer encodersLk.Unlock()
+	encoders[name] = enc
+}
+
+// Encode writes m to w using the encoder registered for enc.
+func Encode(m BitSwapMessage, enc Encoding, w io.Writer) error {
+	encodersLk.RLock()
+	encoder, ok := encoders[enc]
+	encodersLk.RUnlock()
+	if !ok {
+		return ErrUnknownEncoding
+	}
+	return encoder(m, w)
+}
+
 type impl struct {
 	full     bool
 	wantlist map[string]Entry
@@ -71,6 +116,22 @@ type Entry struct {
 	Cancel bool
 }
 
+// entrySlice orders entries the way they are put on the wire: cancels
+// first, then wants from the highest to the lowest priority.
+type entrySlice []Entry
+
+func (es entrySlice) Len() int      { return len(es) }
+func (es entrySlice) Swap(i, j int) { es[i], es[j] = es[j], es[i] }
+func (es entrySlice) Less(i, j int) bool {
+	if es[i].Cancel != es[j].Cancel {
+		return es[i].Cancel
+	}
+	if es[i].Priority != es[j].Priority {
+		return es[i].Priority > es[j].Priority
+	}
+	return es[i].Cid.KeyString() < es[j].Cid.KeyString()
+}
+
 func newMessageFromProto(pbm pb.Message) (BitSwapMessage, error) {
 	m := newMsg(pbm.GetWantlist().GetFull())
 	for _, e := range pbm.GetWantlist().GetEntries() {
@@ -78,7 +139,7 @@ func newMessageFromProto(pbm pb.Message) (BitSwapMessage, error) {
 		if err != nil {
 			return nil, fmt.Errorf("incorrectly formatted cid in wantlist: %s", err)
 		}
-		m.addEntry(c, int(e.GetPriority()), e.GetCancel())
+		m.addEntry(c, int(e.GetPriority()), uint8(e.GetFlags()), e.GetCancel())
 	}
 
 	// deprecated
@@ -127,6 +188,17 @@ func (m *impl) Wantlist() []Entry {
 	return out
 }
 
+// sortedWantlist returns the wantlist in wire order, so that a peer reading
+// the message front to back acts on the most important entries first.
+func (m *impl) sortedWantlist() []Entry {
+	es := make(entrySlice, 0, len(m.wantlist))
+	for _, e := range m.wantlist {
+		es = append(es, e)
+	}
+	sort.Sort(es)
+	return es
+}
+
 func (m *impl) Blocks() []blocks.Block {
 	bs := make([]blocks.Block, 0, len(m.blocks))
 	for _, block := range m.blocks {
@@ -137,24 +209,30 @@ func (m *impl) Blocks() []blocks.Block {
 
 func (m *impl) Cancel(k *cid.Cid) {
 	delete(m.wantlist, k.KeyString())
-	m.addEntry(k, 0, true)
+	m.addEntry(k, 0, 0, true)
 }
 
 func (m *impl) AddEntry(k *cid.Cid, priority int) {
-	m.addEntry(k, priority, false)
+	m.addEntry(k, priority, 0, false)
 }
 
-func (m *impl) addEntry(c *cid.Cid, priority int, cancel bool) {
+func (m *impl) AddAnnotatedEntry(k *cid.Cid, priority int, flags uint8) {
+	m.addEntry(k, priority, flags, false)
+}
+
+func (m *impl) addEntry(c *cid.Cid, priority int, flags uint8, cancel bool) {
 	k := c.KeyString()
 	e, exists := m.wantlist[k]
 	if exists {
 		e.Priority = priority
+		e.Flags = flags
 		e.Cancel = cancel
 	} else {
 		m.wantlist[k] = Entry{
 			Entry: &wantlist.Entry{
 				Cid:      c,
 				Priority: priority,
+				Flags:    flags,
 			},
 			Cancel: cancel,
 		}
@@ -165,6 +243,49 @@ func (m *impl) AddBlock(b blocks.Block) {
 	m.blocks[b.Cid().KeyString()] = b
 }
 
+// EstimateSize returns the size m takes on the wire in the default
+// protobuf encoding, length prefix included, without encoding it. Wantlist
+// changes to the same cid are counted once, as in the encoded message.
+func EstimateSize(m BitSwapMessage) int {
+	var wl int
+	for _, e := range m.Wantlist() {
+		wl += fieldSize(entrySize(e))
+	}
+	wl += 2 // full
+
+	n := fieldSize(wl)
+	for _, b := range m.Blocks() {
+		n += fieldSize(fieldSize(len(b.Cid().Prefix().Bytes())) + fieldSize(len(b.RawData())))
+	}
+	return uvarintSize(uint64(n)) + n
+}
+
+// entrySize is the size of the encoded wantlist entry e.
+func entrySize(e Entry) int {
+	// cancel takes a key and value byte
+	n := fieldSize(len(e.Cid.KeyString())) + 1 + uvarintSize(uint64(int32(e.Priority))) + 2
+	if e.Flags != 0 {
+		n += 1 + uvarintSize(uint64(e.Flags))
+	}
+	return n
+}
+
+// fieldSize is the size of a length delimited field of n bytes with a
+// single byte key.
+func fieldSize(n int) int {
+	return 1 + uvarintSize(uint64(n)) + n
+}
+
+// uvarintSize is the number of bytes x takes as a protobuf varint.
+func uvarintSize(x uint64) int {
+	n := 1
+	for x >= 0x80 {
+		x >>= 7
+		n++
+	}
+	return n
+}
+
 func FromNet(r io.Reader) (BitSwapMessage, error) {
 	pbr := ggio.NewDelimitedReader(r, inet.MessageSizeMax)
 	return FromPBReader(pbr)
@@ -179,15 +300,25 @@ func FromPBReader(pbr ggio.Reader) (BitSwapMessage, error) {
 	return newMessageFromProto(*pb)
 }
 
+// protoEntry converts e for the wire. Flags are left out unless set, so
+// unannotated entries encode as they always did.
+func protoEntry(e Entry) *pb.Message_Wantlist_Entry {
+	pe := &pb.Message_Wantlist_Entry{
+		Block:    proto.String(e.Cid.KeyString()),
+		Priority: proto.Int32(int32(e.Priority)),
+		Cancel:   proto.Bool(e.Cancel),
+	}
+	if e.Flags != 0 {
+		pe.Flags = proto.Uint32(uint32(e.Flags))
+	}
+	return pe
+}
+
 func (m *impl) ToProtoV0() *pb.Message {
 	pbm := new(pb.Message)
 	pbm.Wantlist = new(pb.Message_Wantlist)
-	for _, e := range m.wantlist {
-		pbm.Wantlist.Entries = append(pbm.Wantlist.Entries, &pb.Message_Wantlist_Entry{
-			Block:    proto.String(e.Cid.KeyString()),
-			Priority: proto.Int32(int32(e.Priority)),
-			Cancel:   proto.Bool(e.Cancel),
-		})
+	for _, e := range m.sortedWantlist() {
+		pbm.Wantlist.Entries = append(pbm.Wantlist.Entries, protoEntry(e))
 	}
 	pbm.Wantlist.Full = proto.Bool(m.full)
 	for _, b := range m.Blocks() {
@@ -199,12 +330,8 @@ func (m *impl) ToProtoV0() *pb.Message {
 func (m *impl) ToProtoV1() *pb.Message {
 	pbm := new(pb.Message)
 	pbm.Wantlist = new(pb.Message_Wantlist)
-	for _, e := range m.wantlist {
-		pbm.Wantlist.Entries = append(pbm.Wantlist.Entries, &pb.Message_Wantlist_Entry{
-			Block:    proto.String(e.Cid.KeyString()),
-			Priority: proto.Int32(int32(e.Priority)),
-			Cancel:   proto.Bool(e.Cancel),
-		})
+	for _, e := range m.sortedWantlist() {
+		pbm.Wantlist.Entries = append(pbm.Wantlist.Entries, protoEntry(e))
 	}
 	pbm.Wantlist.Full = proto.Bool(m.full)
 	for _, b := range m.Blocks() {
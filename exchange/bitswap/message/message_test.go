@@ -2,6 +2,7 @@ package message
 
 import (
 	"bytes"
+	"fmt"
 	"testing"
 
 	proto "gx/ipfs/QmZ4Qi3GaRbjcx28Sme5eMH7RQjGkt8wHxt2a65oLaeFEV/gogo-protobuf/proto"
@@ -198,3 +199,142 @@ func TestDuplicates(t *testing.T) {
 		t.Fatal("Duplicate in BitSwapMessage")
 	}
 }
+
+func TestWantlistSerializedInPriorityOrder(t *testing.T) {
+	m := New(false)
+	m.AddEntry(mkFakeCid("low"), 1)
+	m.Cancel(mkFakeCid("cancelled"))
+	m.AddEntry(mkFakeCid("high"), 10)
+	m.AddEntry(mkFakeCid("mid"), 5)
+	m.Cancel(mkFakeCid("also cancelled"))
+
+	for _, pbm := range []*pb.Message{m.ToProtoV0(), m.ToProtoV1()} {
+		entries := pbm.GetWantlist().GetEntries()
+		if len(entries) != 5 {
+			t.Fatalf("expected 5 entries, got %d", len(entries))
+		}
+
+		if !entries[0].GetCancel() || !entries[1].GetCancel() {
+			t.Fatal("expected cancels to come first")
+		}
+
+		expected := []string{"high", "mid", "low"}
+		for i, e := range entries[2:] {
+			if e.GetCancel() {
+				t.Fatal("cancel found after wants")
+			}
+			if e.GetBlock() != mkFakeCid(expected[i]).KeyString() {
+				t.Fatalf("entry %d out of priority order", i+2)
+			}
+		}
+	}
+}
+
+func TestEncodeProtobuf(t *testing.T) {
+	m := New(true)
+	m.AddEntry(mkFakeCid("foo"), 1)
+
+	var expected, actual bytes.Buffer
+	if err := m.ToNetV1(&expected); err != nil {
+		t.Fatal(err)
+	}
+	if err := Encode(m, EncodingProtobuf, &actual); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expected.Bytes(), actual.Bytes()) {
+		t.Fatal("protobuf encoding differs from ToNetV1")
+	}
+
+	if err := Encode(m, Encoding("nope"), &actual); err != ErrUnknownEncoding {
+		t.Fatalf("expected unknown encoding error, got %v", err)
+	}
+}
+
+func TestEstimateSize(t *testing.T) {
+	big := make([]byte, 20000)
+	cases := map[string]func() BitSwapMessage{
+		"empty": func() BitSwapMessage { return New(true) },
+		"wants": func() BitSwapMessage {
+			m := New(false)
+			for i, p := range []int{0, 1, 127, 128, 1 << 20, -5} {
+				m.AddEntry(mkFakeCid(fmt.Sprint("want", i)), p)
+			}
+			m.AddAnnotatedEntry(mkFakeCid("flagged"), 1, 0xff)
+			return m
+		},
+		"cancels": func() BitSwapMessage {
+			m := New(false)
+			m.Cancel(mkFakeCid("foo"))
+			m.Cancel(mkFakeCid("bar"))
+			return m
+		},
+		"blocks": func() BitSwapMessage {
+			m := New(false)
+			m.AddBlock(blocks.NewBlock([]byte("small")))
+			m.AddBlock(blocks.NewBlock(big))
+			return m
+		},
+		"mixed": func() BitSwapMessage {
+			m := New(true)
+			m.AddEntry(mkFakeCid("foo"), 3)
+			m.Cancel(mkFakeCid("bar"))
+			m.AddBlock(blocks.NewBlock(big[:300]))
+			return m
+		},
+	}
+
+	for name, mk := range cases {
+		m := mk()
+		var buf bytes.Buffer
+		if err := m.ToNetV1(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if est := EstimateSize(m); est != buf.Len() {
+			t.Errorf("%s: estimated %d bytes, encoded %d", name, est, buf.Len())
+		}
+	}
+}
+
+func TestAnnotatedEntry(t *testing.T) {
+	flagged := mkFakeCid("flagged")
+	plain := mkFakeCid("plain")
+
+	m := New(false)
+	m.AddAnnotatedEntry(flagged, 5, 3)
+	m.AddEntry(plain, 4)
+
+	// combining keeps the latest flags, like the priority
+	m.AddAnnotatedEntry(plain, 4, 1)
+	m.AddEntry(plain, 4)
+
+	var buf bytes.Buffer
+	if err := m.ToNetV1(&buf); err != nil {
+		t.Fatal(err)
+	}
+	received, err := FromNet(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flags := make(map[string]uint8)
+	for _, e := range received.Wantlist() {
+		flags[e.Cid.KeyString()] = e.Flags
+	}
+	if len(flags) != 2 || flags[flagged.KeyString()] != 3 || flags[plain.KeyString()] != 0 {
+		t.Fatalf("expected flags to round trip, got %v", flags)
+	}
+
+	// unannotated entries are encoded as before
+	for _, e := range m.ToProtoV1().GetWantlist().GetEntries() {
+		if (e.Flags != nil) != (e.GetBlock() == flagged.KeyString()) {
+			t.Fatal("expected flags on the wire only when set")
+		}
+	}
+
+	m.Cancel(flagged)
+	for _, e := range m.Wantlist() {
+		if e.Cancel && e.Flags != 0 {
+			t.Fatal("expected a cancel to drop the flags")
+		}
+	}
+}
@@ -82,6 +82,7 @@ type Message_Wantlist_Entry struct {
 	Block            *string `protobuf:"bytes,1,opt,name=block" json:"block,omitempty"`
 	Priority         *int32  `protobuf:"varint,2,opt,name=priority" json:"priority,omitempty"`
 	Cancel           *bool   `protobuf:"varint,3,opt,name=cancel" json:"cancel,omitempty"`
+	Flags            *uint32 `protobuf:"varint,4,opt,name=flags" json:"flags,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -110,6 +111,13 @@ func (m *Message_Wantlist_Entry) GetCancel() bool {
 	return false
 }
 
+func (m *Message_Wantlist_Entry) GetFlags() uint32 {
+	if m != nil && m.Flags != nil {
+		return *m.Flags
+	}
+	return 0
+}
+
 type Message_Block struct {
 	Prefix           []byte `protobuf:"bytes,1,opt,name=prefix" json:"prefix,omitempty"`
 	Data             []byte `protobuf:"bytes,2,opt,name=data" json:"data,omitempty"`
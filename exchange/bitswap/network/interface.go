@@ -42,6 +42,43 @@ type MessageSender interface {
 	Close() error
 }
 
+// EncodingMessageSender is implemented by MessageSenders whose peer prefers
+// a specific wire encoding. Messages for such senders are encoded with
+// bsmsg.Encode by the caller and handed over as raw bytes.
+type EncodingMessageSender interface {
+	MessageSender
+
+	// Encoding returns the encoding the peer wants messages in
+	Encoding() bsmsg.Encoding
+
+	// SendEncoded sends a message that was already encoded
+	SendEncoded(context.Context, []byte) error
+}
+
+// PeerCapabilities describes what a peer is willing to receive from us.
+type PeerCapabilities struct {
+	// NoFullWantlist asks us to send our wantlist in small increments
+	// rather than all at once
+	NoFullWantlist bool
+
+	// Codecs, if not empty, are the only cid codecs the peer wants to hear
+	// about
+	Codecs []uint64
+
+	// WantlistAcks tells that the peer acknowledges the wantlist messages
+	// it receives, so it need not be sent our full wantlist periodically
+	WantlistAcks bool
+}
+
+// CapabilityMessageSender is implemented by MessageSenders whose peer
+// advertised its capabilities.
+type CapabilityMessageSender interface {
+	MessageSender
+
+	// Capabilities returns what the peer is willing to receive
+	Capabilities() PeerCapabilities
+}
+
 // Implement Receiver to receive messages from the BitSwapNetwork
 type Receiver interface {
 	ReceiveMessage(
@@ -0,0 +1,49 @@
+package network
+
+import (
+	"context"
+
+	bsmsg "github.com/ipfs/go-ipfs/exchange/bitswap/message"
+	cid "gx/ipfs/QmYhQaCYEcaPPjxJX7YcPcVKkQfRy6sJ7B3XmGFk82XYdQ/go-cid"
+	peer "gx/ipfs/QmdS9KpbDyPrieswibZhkod1oXqRwZJrUPzxCofAMWpFGq/go-libp2p-peer"
+)
+
+// NoopNetwork is a BitSwapNetwork that drops every message it is given and
+// never finds any providers, for tests that have no use for a real network.
+type NoopNetwork struct{}
+
+var _ BitSwapNetwork = NoopNetwork{}
+
+func (NoopNetwork) SendMessage(context.Context, peer.ID, bsmsg.BitSwapMessage) error {
+	return nil
+}
+
+func (NoopNetwork) SetDelegate(Receiver) {}
+
+func (NoopNetwork) ConnectTo(context.Context, peer.ID) error {
+	return nil
+}
+
+func (NoopNetwork) NewMessageSender(context.Context, peer.ID) (MessageSender, error) {
+	return noopSender{}, nil
+}
+
+func (NoopNetwork) FindProvidersAsync(context.Context, *cid.Cid, int) <-chan peer.ID {
+	out := make(chan peer.ID)
+	close(out)
+	return out
+}
+
+func (NoopNetwork) Provide(context.Context, *cid.Cid) error {
+	return nil
+}
+
+type noopSender struct{}
+
+func (noopSender) SendMsg(context.Context, bsmsg.BitSwapMessage) error {
+	return nil
+}
+
+func (noopSender) Close() error {
+	return nil
+}
@@ -23,6 +23,10 @@ type Entry struct {
 	Cid      *cid.Cid
 	Priority int
 
+	// Flags annotate the want for the peers it is sent to, e.g. to mark
+	// it speculative. Zero means no annotation.
+	Flags uint8
+
 	RefCnt int
 }
 
@@ -80,6 +84,20 @@ func (w *ThreadSafe) SortedEntries() []*Entry {
 	return w.Wantlist.SortedEntries()
 }
 
+// SortedCopies returns copies of the entries, highest priority first. The
+// copies are taken under the lock, so unlike the entries returned by
+// SortedEntries they do not change along with the wantlist.
+func (w *ThreadSafe) SortedCopies() []Entry {
+	w.lk.RLock()
+	defer w.lk.RUnlock()
+	es := w.Wantlist.SortedEntries()
+	out := make([]Entry, len(es))
+	for i, e := range es {
+		out[i] = *e
+	}
+	return out
+}
+
 func (w *ThreadSafe) Len() int {
 	w.lk.RLock()
 	defer w.lk.RUnlock()
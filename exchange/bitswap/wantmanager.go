@@ -1,364 +1,6318 @@
 package bitswap
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"io"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	blocks "github.com/ipfs/go-ipfs/blocks"
 	engine "github.com/ipfs/go-ipfs/exchange/bitswap/decision"
 	bsmsg "github.com/ipfs/go-ipfs/exchange/bitswap/message"
+	pb "github.com/ipfs/go-ipfs/exchange/bitswap/message/pb"
 	bsnet "github.com/ipfs/go-ipfs/exchange/bitswap/network"
 	wantlist "github.com/ipfs/go-ipfs/exchange/bitswap/wantlist"
+	delay "github.com/ipfs/go-ipfs/thirdparty/delay"
 
 	metrics "gx/ipfs/QmRg1gKTHzc3CZXSKzem8aR4E3TubFhbgXwfVuWnSK5CC5/go-metrics-interface"
 	cid "gx/ipfs/QmYhQaCYEcaPPjxJX7YcPcVKkQfRy6sJ7B3XmGFk82XYdQ/go-cid"
+	ggio "gx/ipfs/QmZ4Qi3GaRbjcx28Sme5eMH7RQjGkt8wHxt2a65oLaeFEV/gogo-protobuf/io"
+	proto "gx/ipfs/QmZ4Qi3GaRbjcx28Sme5eMH7RQjGkt8wHxt2a65oLaeFEV/gogo-protobuf/proto"
 	peer "gx/ipfs/QmdS9KpbDyPrieswibZhkod1oXqRwZJrUPzxCofAMWpFGq/go-libp2p-peer"
 )
 
+// WantManager keeps our wantlist and tells connected peers about it.
+//
+// Wantlist changes made by one goroutine, through WantBlocks, CancelWants
+// and the other calls changing the wantlist, are applied in the order they
+// were made: a cancel never overtakes the add it follows. Every change is
+// numbered as it is queued, see Operation.Seq, and all changes pass through
+// a single channel to the Run loop. Changes made concurrently by different
+// goroutines are applied in no particular order.
 type WantManager struct {
+	// the number of the last wantSet queued, accessed atomically. First
+	// in the struct to be 64-bit aligned
+	wantSeq uint64
+
 	// sync channels for Run loop
-	incoming   chan []*bsmsg.Entry
+	incoming   chan *wantSet
 	connect    chan peer.ID        // notification channel for new peers connecting
 	disconnect chan peer.ID        // notification channel for peers disconnecting
 	peerReqs   chan chan []peer.ID // channel to request connected peers on
+	runReqs    chan func()         // queries executed inside the Run loop
 
 	// synchronized by Run loop, only touch inside there
 	peers map[peer.ID]*msgQueue
-	wl    *wantlist.ThreadSafe
+	wl    WantlistBackend
+
+	// last snapshot taken of wl, dropped whenever wl changes
+	snapshot *WantlistSnapshot
+
+	// bumped whenever wl changes
+	version uint64
+
+	// peers likely to have the blocks we want, keyed by cid
+	hints map[string][]peer.ID
+
+	// when each peer was last sent our full wantlist, and at which version.
+	// A peer reconnecting within reseedWindow is not sent it again if the
+	// wantlist did not change since
+	lastSeed     map[peer.ID]seedRecord
+	reseedWindow time.Duration
+
+	// when each entry of wl was added, keyed by cid
+	wantAdded map[string]time.Time
+
+	// how many wants were ever added to and removed from wl
+	wantsAdded     uint64
+	wantsCancelled uint64
+
+	// how the last wants to leave wl went, see SatisfactionRate. A ring
+	// of up to outcomeSamples, outcomeNext is where the next one goes
+	outcomes    []wantOutcome
+	outcomeNext int
+
+	// how many times each entry of wl was queued for a peer, keyed by cid
+	sendAttempts map[string]int
+
+	// wants added with PinWant, keyed by cid. The pin holds a reference
+	// that only UnpinWant drops
+	pinned map[string]struct{}
+
+	// queues opened ahead of time by WarmPeer, adopted on connect
+	warm map[peer.ID]*msgQueue
+
+	// queues of disconnected peers kept around for linger in case the peer
+	// comes right back, with when they are due to be torn down.
+	// lingerTimer fires when the earliest of them is due
+	linger      time.Duration
+	lingering   map[peer.ID]*lingeringQueue
+	lingerTimer <-chan time.Time
+
+	// how long tearing down a queue waits for the send in progress
+	teardownGrace time.Duration
+
+	// how long a peer queue may sit idle before it is parked, zero keeps
+	// queues running
+	idleTimeout time.Duration
+
+	// connects beyond admissionRate per second wait in admitting, in the
+	// order they came in, and are taken in one at a time as admitTimer
+	// fires. lastAdmit is when a peer was last taken in
+	admissionRate int
+	admitting     []peer.ID
+	admitTimer    <-chan time.Time
+	lastAdmit     time.Time
+
+	// peers rebroadcast to on their own schedule rather than with everyone
+	// else, see SetPeerRebroadcastInterval. rebroadcastTimer fires when
+	// the earliest of them is due
+	peerRebroadcast  map[peer.ID]time.Duration
+	rebroadcastTimer <-chan time.Time
+
+	// the group each peer was assigned to, see AssignPeerGroup
+	peerGroups map[peer.ID]string
+
+	// the tier of the peers not in PeerTierNormal, see SetPeerTier
+	peerTiers map[peer.ID]PeerTier
 
 	network bsnet.BitSwapNetwork
-	ctx     context.Context
-	cancel  func()
+
+	// replaced by Restart, read through runCtx. protected by ctxLk
+	ctxLk  sync.RWMutex
+	ctx    context.Context
+	cancel func()
+
+	// held by Run while it runs, so Restart can wait for it to return,
+	// and by Restart so only one call brings the WantManager back
+	runLk     sync.Mutex
+	restartLk sync.Mutex
+
+	// opens the senders of peer queues instead of network, if set
+	senderFactory SenderFactory
+
+	// call env.Failed rather than env.Sent for blocks that failed to send
+	strictSendAccounting bool
+
+	// scope the metrics are created in, below that of the context given to
+	// NewWantManager
+	metricsLabel string
 
 	wantlistGauge metrics.Gauge
 	sentHistogram metrics.Histogram
-}
+	refcntGauge   metrics.Gauge
 
-func NewWantManager(ctx context.Context, network bsnet.BitSwapNetwork) *WantManager {
-	ctx, cancel := context.WithCancel(ctx)
-	wantlistGauge := metrics.NewCtx(ctx, "wantlist_total",
-		"Number of items in wantlist.").Gauge()
-	sentHistogram := metrics.NewCtx(ctx, "sent_all_blocks_bytes", "Histogram of blocks sent by"+
-		" this bitswap").Histogram(metricsBuckets)
-	return &WantManager{
-		incoming:      make(chan []*bsmsg.Entry, 10),
-		connect:       make(chan peer.ID, 10),
-		disconnect:    make(chan peer.ID, 10),
-		peerReqs:      make(chan chan []peer.ID),
-		peers:         make(map[peer.ID]*msgQueue),
-		wl:            wantlist.NewThreadSafe(),
-		network:       network,
-		ctx:           ctx,
-		cancel:        cancel,
-		wantlistGauge: wantlistGauge,
-		sentHistogram: sentHistogram,
-	}
-}
+	connectedCounter    metrics.Counter
+	disconnectedCounter metrics.Counter
+	peersGauge          metrics.Gauge
+	oscillationCounter  metrics.Counter
+	sendErrCounter      metrics.Counter
+	lostCancelCounter   metrics.Counter
+	shedCounter         metrics.Counter
+	incomingGauge       metrics.Gauge
+	seedHistogram       metrics.Histogram
 
-type msgPair struct {
-	to  peer.ID
-	msg bsmsg.BitSwapMessage
-}
+	// values of the metrics above, kept for MetricsSnapshot
+	stats *wmStats
 
-type cancellation struct {
-	who peer.ID
-	blk *cid.Cid
-}
+	// when the WantManager was created
+	started time.Time
 
-type msgQueue struct {
-	p peer.ID
+	// buckets used for all histograms of the WantManager
+	histBuckets []float64
 
-	outlk   sync.Mutex
-	out     bsmsg.BitSwapMessage
-	network bsnet.BitSwapNetwork
+	// thresholds used by LeakedPeers, zero disables the check
+	leakRefcnt int
+	leakIdle   time.Duration
 
-	sender bsnet.MessageSender
+	// broadcast targeted wants when none of their targets are connected
+	targetFallback bool
 
-	refcnt int
+	// wants below broadcastFloor are only sent to the peers they are
+	// targeted at, if hasBroadcastFloor is set
+	broadcastFloor    int
+	hasBroadcastFloor bool
 
-	work chan struct{}
-	done chan struct{}
+	// with initialFanout set, new wants are broadcast to that many peers
+	// only, and to more on every rebroadcast. fanout holds the wants that
+	// did not reach all peers yet, keyed by cid
+	initialFanout int
+	fanout        map[string]*fanoutWant
+
+	// decides what doWork does when a send fails
+	errorClassifier ErrorClassifier
+
+	// how many messages may be in flight to a single peer
+	sendConcurrency int
+
+	// how long queues wait for more changes before sending a message
+	batchWindow time.Duration
+
+	// bounds the size of the messages queued for all peers, nil for no
+	// bound
+	pendingBudget *pendingBudget
+
+	// resend the wants of disconnecting peers to the remaining ones
+	requeueOnDisconnect bool
+
+	// limits how many queues may be opening a sender at once, nil for no
+	// limit
+	dials chan struct{}
+
+	// limits how many blocks may be sent at once, nil for no limit
+	blockSlots chan struct{}
+
+	// consulted before sending a block, may be nil
+	sendGate SendGate
+
+	// the blocks being sent, aborted by PeerCancelled. protected by
+	// blockLk
+	blockLk    sync.Mutex
+	blockSends map[blockSend][]*blockAbort
+
+	// blocks of the same priority are sent to a peer side by side, those
+	// of another priority wait their turn here. protected by blockLk
+	blockLines map[peer.ID]*blockLine
+
+	// how many blocks SendBlockAsync has in flight to each peer, and a
+	// channel closed, and replaced, whenever one of them is done.
+	// protected by blockLk
+	asyncBlocks map[peer.ID]int
+	asyncFreed  chan struct{}
+
+	// the wants peers sent us, keyed by cid, see NetworkDemand. protected
+	// by demandLk
+	demandLk  sync.Mutex
+	peerWants map[peer.ID]map[string]*cid.Cid
+
+	// the wants of the messages given up on, the latest failedCap of them,
+	// see FailedSends. protected by failedLk
+	failedLk    sync.Mutex
+	failedSends []FailedSend
+	failedCap   int
+
+	// send wants that came with a deadline ahead of other queued changes
+	deadlineOrdering bool
+
+	// the peer our full wantlist is mirrored to on every change, and the
+	// queue doing it, nil without a mirror peer
+	mirrorPeer peer.ID
+	mirror     *msgQueue
+
+	// with maxQueueGoroutines set, queues started once that many have a
+	// goroutine of their own are run by the shared workers of pool.
+	// queueGoroutines counts the queues with their own goroutine and is
+	// accessed atomically
+	maxQueueGoroutines int
+	queueGoroutines    int32
+	pool               *queuePool
+
+	// set while PauseAll holds back the sends of every queue, accessed
+	// atomically
+	paused int32
+
+	// recent wantlist changes and peer events, nil unless enabled with
+	// WithOperationLog
+	opLog *operationLog
+
+	// tracer is told about every stage of every want through traces, so
+	// a slow tracer does not hold up the Run loop or the queues
+	tracer WantTracer
+	traces chan WantTrace
+
+	// queues stop sending for quarantine after errorThreshold sends in a
+	// row failed, zero disables it
+	errorThreshold int
+	quarantine     time.Duration
+
+	// callbacks set through OnWantSatisfied, OnBackpressure,
+	// OnSenderEvent, OnPeerQuarantined, OnPeerSeeded and
+	// OnOversizedEntry, and the number of callers blocked on a full
+	// incoming channel, all protected by hookLk
+	hookLk         sync.Mutex
+	onSatisfied    func(c *cid.Cid, from peer.ID, latency time.Duration)
+	onBackpressure func(count int)
+	onSenderEvent  func(p peer.ID, event SenderEvent)
+	onQuarantined  func(p peer.ID, until time.Time)
+	onSeeded       func(p peer.ID)
+	onOversized    func(p peer.ID, c *cid.Cid, size int)
+	blocked        int
+
+	// how long a caller may block on a full incoming channel before
+	// onBackpressure is called, zero disables the check
+	backpressureThreshold time.Duration
+
+	// how often to check for peer queues that stopped running, zero
+	// disables the check
+	watchdogInterval time.Duration
+
+	// how long a queue waits after a failed send for a disconnect to show
+	// up. departing holds a channel per peer that is closed as soon as
+	// Disconnected is called for it, so queues can stop waiting early
+	disconnectDelay time.Duration
+	departLk        sync.Mutex
+	departing       map[peer.ID]chan struct{}
+
+	// when each cid was last added or cancelled, to spot wants that flip
+	// back and forth. With a debounce window set, changes to flipping cids
+	// are held back in debounced until they settle, and settle fires when
+	// the earliest of them is due
+	lastChange map[string]changeTimes
+	debounce   time.Duration
+	debounced  map[string]*debouncedEntry
+	settle     <-chan time.Time
+
+	// what to do with wants targeted at peers we are not connected to,
+	// and the wants held back for those peers under UnknownTargetQueue
+	unknownTarget UnknownTargetPolicy
+	pending       map[peer.ID][]*bsmsg.Entry
+
+	// how targeted wants are sent when some targets are missing, and the
+	// wants held back under AllOrNothing
+	targetDelivery TargetDeliveryMode
+	deferred       []*deferredWants
+
+	// how long Run keeps applying buffered wantlist changes after the
+	// context is cancelled, zero disables draining
+	drainTimeout time.Duration
+
+	// number of entries resent on each rebroadcast, zero resends the
+	// whole wantlist. The cursor is where the next chunk starts.
+	rebroadcastChunk  int
+	rebroadcastCursor int
+
+	// most peers sent the whole wantlist on each rebroadcast, zero means
+	// all of them. The peers take turns in ID order, lastRebroadcast is
+	// the last one whose turn it was
+	rebroadcastFanoutCap int
+	lastRebroadcast      peer.ID
+
+	// decides what each peer is sent on a rebroadcast, may be nil
+	rebroadcastHook RebroadcastHook
+
+	// whether our wantlist is rebroadcast periodically, see RebroadcastMode
+	rebroadcastMode RebroadcastMode
+
+	// how queues merge a want with one for the same cid not sent yet
+	combine CombineStrategy
+
+	// the largest wantlist message sent to a peer in bytes, zero means no
+	// limit, and what is done with entries too large for any message
+	maxMessageSize  int
+	oversizedPolicy OversizedEntryPolicy
+
+	// maximum number of entries sent in each message when seeding the
+	// wantlist of a newly connected peer, zero means no limit
+	seedChunkSize int
+
+	// how many peers are expected to connect, the maps kept per peer are
+	// presized for them
+	expectedPeers int
+
+	// broadcast to peers in peer ID order rather than map order
+	sortedBroadcast bool
 }
 
-func (pm *WantManager) WantBlocks(ctx context.Context, ks []*cid.Cid) {
-	log.Infof("want blocks: %s", ks)
-	pm.addEntries(ctx, ks, false)
+const (
+	// defaultSeedChunkSize is the default number of wantlist entries sent
+	// per message when seeding a newly connected peer.
+	defaultSeedChunkSize = 1024
+
+	// defaultLeakRefcnt is the refcnt above which a peer is reported by
+	// LeakedPeers.
+	defaultLeakRefcnt = 16
+
+	// defaultDisconnectDelay is how long a queue waits after a failed send,
+	// in case the failure was due to a disconnect we did not hear about yet.
+	defaultDisconnectDelay = time.Millisecond * 100
+)
+
+// WantManagerOption configures optional behaviour of a WantManager.
+type WantManagerOption func(*WantManager)
+
+// WithSeedChunkSize sets the maximum number of entries per message used
+// when sending our wantlist to a newly connected peer. The highest priority
+// chunk is sent first. A size of zero sends the whole wantlist at once.
+func WithSeedChunkSize(n int) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.seedChunkSize = n
+	}
 }
 
-func (pm *WantManager) CancelWants(ks []*cid.Cid) {
-	log.Infof("cancel wants: %s", ks)
-	pm.addEntries(context.TODO(), ks, true)
+// WithLeakThresholds sets when LeakedPeers reports a peer: once its
+// connection refcnt exceeds maxRefcnt, or once nothing has been sent to it
+// for longer than maxIdle. A zero value disables the respective check.
+func WithLeakThresholds(maxRefcnt int, maxIdle time.Duration) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.leakRefcnt = maxRefcnt
+		pm.leakIdle = maxIdle
+	}
 }
 
-func (pm *WantManager) addEntries(ctx context.Context, ks []*cid.Cid, cancel bool) {
-	var entries []*bsmsg.Entry
-	for i, k := range ks {
-		entries = append(entries, &bsmsg.Entry{
-			Cancel: cancel,
-			Entry: &wantlist.Entry{
-				Cid:      k,
-				Priority: kMaxPriority - i,
-				RefCnt:   1,
-			},
-		})
+// WithTargetFallbackBroadcast makes wants that are targeted at specific
+// peers go out to every connected peer when none of the targets are
+// connected, instead of waiting for the next rebroadcast.
+func WithTargetFallbackBroadcast() WantManagerOption {
+	return func(pm *WantManager) {
+		pm.targetFallback = true
 	}
-	select {
-	case pm.incoming <- entries:
-	case <-pm.ctx.Done():
-	case <-ctx.Done():
+}
+
+// WithBroadcastPriorityFloor keeps wants with a priority below floor from
+// being broadcast, rebroadcast or sent to newly connected peers. They are
+// still added to our wantlist and sent to the peers they are targeted at.
+func WithBroadcastPriorityFloor(floor int) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.broadcastFloor = floor
+		pm.hasBroadcastFloor = true
 	}
 }
 
-func (pm *WantManager) ConnectedPeers() []peer.ID {
-	resp := make(chan []peer.ID)
-	pm.peerReqs <- resp
-	return <-resp
+// WithInitialFanout broadcasts new wants to only k peers at first, those
+// with the least pending work. Every rebroadcast then doubles the number of
+// peers told about each want still in our wantlist, until all peers are.
+func WithInitialFanout(k int) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.initialFanout = k
+	}
 }
 
-func (pm *WantManager) SendBlock(ctx context.Context, env *engine.Envelope) {
-	// Blocks need to be sent synchronously to maintain proper backpressure
-	// throughout the network stack
-	defer env.Sent()
+// UnknownTargetPolicy decides what happens to wants targeted at a peer we
+// are not connected to.
+type UnknownTargetPolicy int
 
-	pm.sentHistogram.Observe(float64(len(env.Block.RawData())))
+const (
+	// UnknownTargetDrop does not send the wants to the peer.
+	UnknownTargetDrop UnknownTargetPolicy = iota
 
-	msg := bsmsg.New(false)
-	msg.AddBlock(env.Block)
-	log.Infof("Sending block %s to %s", env.Block, env.Peer)
-	err := pm.network.SendMessage(ctx, env.Peer, msg)
-	if err != nil {
-		log.Infof("sendblock error: %s", err)
+	// UnknownTargetConnect starts a queue for the peer right away, which
+	// dials it to send the wants. The queue is not counted as a connection
+	// until the peer shows up through Connected.
+	UnknownTargetConnect
+
+	// UnknownTargetQueue holds the wants back and sends them to the peer
+	// first thing once it connects.
+	UnknownTargetQueue
+)
+
+// WithUnknownTargetPolicy sets what is done with wants targeted at peers we
+// are not connected to. The default is UnknownTargetDrop.
+func WithUnknownTargetPolicy(policy UnknownTargetPolicy) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.unknownTarget = policy
 	}
 }
 
-func (pm *WantManager) startPeerHandler(p peer.ID) *msgQueue {
-	mq, ok := pm.peers[p]
-	if ok {
-		mq.refcnt++
-		return nil
+// TargetDeliveryMode decides how wants targeted at several peers are sent
+// when only some of those peers are connected.
+type TargetDeliveryMode int
+
+const (
+	// BestEffort sends the wants to the connected targets, the others are
+	// handled according to the UnknownTargetPolicy.
+	BestEffort TargetDeliveryMode = iota
+
+	// AllOrNothing holds the wants back until every target is connected,
+	// then sends them to all targets at once.
+	AllOrNothing
+)
+
+// WithTargetDeliveryMode sets how wants targeted at several peers are sent.
+// The default is BestEffort.
+func WithTargetDeliveryMode(mode TargetDeliveryMode) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.targetDelivery = mode
 	}
+}
 
-	mq = pm.newMsgQueue(p)
+// RetryDecision is what a message queue does after failing to send a
+// message to its peer.
+type RetryDecision int
 
-	// new peer, we will want to give them our full wantlist
-	fullwantlist := bsmsg.New(true)
-	for _, e := range pm.wl.Entries() {
-		fullwantlist.AddEntry(e.Cid, e.Priority)
+const (
+	// SendRetry reopens the sender and sends the message again.
+	SendRetry RetryDecision = iota
+
+	// SendGiveUp drops the message and keeps the sender.
+	SendGiveUp
+
+	// SendResetSender drops the message and closes the sender, a new one
+	// is opened for the next message.
+	SendResetSender
+)
+
+// ErrorClassifier maps a send error to the RetryDecision for it.
+type ErrorClassifier func(error) RetryDecision
+
+// WithErrorClassifier sets how send errors are handled. By default every
+// failed send is retried, which is wasted effort for errors that will never
+// go away, like a message that is too large.
+func WithErrorClassifier(classify ErrorClassifier) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.errorClassifier = classify
 	}
-	mq.out = fullwantlist
-	mq.work <- struct{}{}
+}
 
-	pm.peers[p] = mq
-	go mq.runQueue(pm.ctx)
-	return mq
+// WithExpectedPeers presizes the maps kept per connected peer for n peers,
+// sparing nodes that connect to thousands of peers right away from growing
+// them over and over. It is only a hint, more peers can connect.
+func WithExpectedPeers(n int) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.expectedPeers = n
+	}
 }
 
-func (pm *WantManager) stopPeerHandler(p peer.ID) {
-	pq, ok := pm.peers[p]
-	if !ok {
-		// TODO: log error?
-		return
+// WithDeterministicBroadcastOrder queues broadcast wantlist changes for
+// peers in peer ID order, rather than in whatever order the peers map has,
+// for reproducible tests and so the same peers are not always favoured by
+// chance. Each broadcast then costs a sort of the connected peers.
+func WithDeterministicBroadcastOrder() WantManagerOption {
+	return func(pm *WantManager) {
+		pm.sortedBroadcast = true
 	}
+}
 
-	pq.refcnt--
-	if pq.refcnt > 0 {
-		return
+// WithFailedSendCapture keeps the wants of up to the last n messages
+// dropped after a send error, see FailedSends. By default they are only
+// logged.
+func WithFailedSendCapture(n int) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.failedCap = n
 	}
+}
 
-	close(pq.done)
-	delete(pm.peers, p)
+// WithPeerErrorThreshold stops sending to a peer for cooldown once
+// threshold sends to it failed in a row, instead of retrying all along. The
+// message that failed last is kept, along with the changes queued
+// meanwhile, and sent once the cooldown is over.
+func WithPeerErrorThreshold(threshold int, cooldown time.Duration) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.errorThreshold = threshold
+		pm.quarantine = cooldown
+	}
 }
 
-func (mq *msgQueue) runQueue(ctx context.Context) {
-	defer func() {
-		if mq.sender != nil {
-			mq.sender.Close()
-		}
-	}()
-	for {
-		select {
-		case <-mq.work: // there is work to be done
-			mq.doWork(ctx)
-		case <-mq.done:
-			return
-		case <-ctx.Done():
-			return
-		}
+// WithPerPeerSendConcurrency allows up to k messages to be in flight to a
+// peer at once, each over a sender of its own. A message still waits for
+// earlier messages about the same cids, so cancels never overtake the wants
+// they cancel. Queues sending concurrently only open senders once they have
+// something to send, so WarmPeer has no effect for them.
+func WithPerPeerSendConcurrency(k int) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.sendConcurrency = k
 	}
 }
 
-func (mq *msgQueue) doWork(ctx context.Context) {
-	if mq.sender == nil {
-		err := mq.openSender(ctx)
-		if err != nil {
-			log.Infof("cant open message sender to peer %s: %s", mq.p, err)
-			// TODO: cant connect, what now?
-			return
-		}
+// WithWantDebounce holds back changes to wants that flip between wanted and
+// cancelled more than once per window, and only sends their net state once
+// they have not changed for a full window.
+func WithWantDebounce(window time.Duration) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.debounce = window
 	}
+}
 
-	// grab outgoing message
-	mq.outlk.Lock()
-	wlm := mq.out
-	if wlm == nil || wlm.Empty() {
-		mq.outlk.Unlock()
-		return
+// WithPerPeerBatchWindow makes each peer queue wait up to d after a change
+// is queued for more changes, so they go out together in one message.
+// Cancels are held back for at most maxCancelBatchDelay.
+func WithPerPeerBatchWindow(d time.Duration) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.batchWindow = d
 	}
-	mq.out = nil
-	mq.outlk.Unlock()
+}
 
-	// send wantlist updates
-	for { // try to send this message until we fail.
-		err := mq.sender.SendMsg(ctx, wlm)
-		if err == nil {
-			return
-		}
+// WithMaxPendingBytes bounds the total size of the wantlist changes queued
+// for all peers to roughly n bytes, counting the cids of the queued entries.
+// Once the bound is reached, the lowest priority wants queued for a peer are
+// dropped as more are added. Dropped wants reach the peer with the next
+// rebroadcast. Cancels are never dropped.
+func WithMaxPendingBytes(n int) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.pendingBudget = &pendingBudget{max: int64(n)}
+	}
+}
 
-		log.Infof("bitswap send error: %s", err)
-		mq.sender.Close()
-		mq.sender = nil
+// WithRequeueOnDisconnect makes the wants we sent to a peer go out to the
+// other peers as soon as it disconnects, so they do not stall until the next
+// rebroadcast if the peer left before delivering.
+func WithRequeueOnDisconnect() WantManagerOption {
+	return func(pm *WantManager) {
+		pm.requeueOnDisconnect = true
+	}
+}
 
-		select {
-		case <-mq.done:
-			return
-		case <-ctx.Done():
-			return
-		case <-time.After(time.Millisecond * 100):
-			// wait 100ms in case disconnect notifications are still propogating
-			log.Warning("SendMsg errored but neither 'done' nor context.Done() were set")
-		}
+// WithMaxConcurrentDials limits how many peers we may be dialing at once to
+// send them wants, so that many peers connecting at once do not cause a
+// storm of lookups and dials.
+func WithMaxConcurrentDials(n int) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.dials = make(chan struct{}, n)
+	}
+}
 
-		err = mq.openSender(ctx)
-		if err != nil {
-			log.Errorf("couldnt open sender again after SendMsg(%s) failed: %s", mq.p, err)
-			// TODO(why): what do we do now?
-			// I think the *right* answer is to probably put the message we're
-			// trying to send back, and then return to waiting for new work or
-			// a disconnect.
-			return
-		}
+// WithMaxConcurrentBlockSends limits how many blocks may be sent at once,
+// to all peers together, so bursts of blocks do not saturate our upload
+// bandwidth. Sends beyond the limit wait for one to finish.
+func WithMaxConcurrentBlockSends(n int) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.blockSlots = make(chan struct{}, n)
+	}
+}
 
-		// TODO: Is this the same instance for the remote peer?
-		// If its not, we should resend our entire wantlist to them
-		/*
-			if mq.sender.InstanceID() != mq.lastSeenInstanceID {
-				wlm = mq.getFullWantlistMessage()
-			}
-		*/
+// WithReseedWindow stops peers that reconnect within window of being sent
+// our full wantlist from being sent it again, as long as the wantlist did
+// not change in between. This keeps flapping peers from being flooded.
+func WithReseedWindow(window time.Duration) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.reseedWindow = window
 	}
 }
 
-func (mq *msgQueue) openSender(ctx context.Context) error {
-	// allow ten minutes for connections this includes looking them up in the
-	// dht dialing them, and handshaking
-	conctx, cancel := context.WithTimeout(ctx, time.Minute*10)
-	defer cancel()
+type seedRecord struct {
+	version uint64
+	at      time.Time
+}
 
-	err := mq.network.ConnectTo(conctx, mq.p)
-	if err != nil {
-		return err
-	}
+// SendGate lets an outside policy hold back blocks we are about to send.
+type SendGate interface {
+	// Allow returns whether env may be sent now. Envelopes that are not
+	// allowed are offered again later.
+	Allow(env *engine.Envelope) bool
+}
 
-	nsender, err := mq.network.NewMessageSender(ctx, mq.p)
-	if err != nil {
-		return err
+// WithSendGate makes SendBlock wait until gate allows each block to be
+// sent.
+func WithSendGate(gate SendGate) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.sendGate = gate
 	}
+}
 
-	mq.sender = nsender
-	return nil
+// WithDeadlineOrdering makes wants added with a context that has a deadline
+// jump ahead of the wantlist changes already queued for each peer, so that
+// time-sensitive wants go out first. Other changes follow in the next
+// message.
+func WithDeadlineOrdering() WantManagerOption {
+	return func(pm *WantManager) {
+		pm.deadlineOrdering = true
+	}
 }
 
-func (pm *WantManager) Connected(p peer.ID) {
-	select {
-	case pm.connect <- p:
-	case <-pm.ctx.Done():
+// WithMirrorPeer mirrors our wantlist to p, for instance a backup node that
+// should know what we were fetching should we go away. Every change to our
+// wantlist, whoever it is targeted at, sends p our full wantlist over a
+// queue of its own, separate from the one p gets if it connects as a
+// regular peer.
+func WithMirrorPeer(p peer.ID) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.mirrorPeer = p
 	}
 }
 
-func (pm *WantManager) Disconnected(p peer.ID) {
-	select {
-	case pm.disconnect <- p:
-	case <-pm.ctx.Done():
+// WithMaxQueueGoroutines caps the number of peer queues running in a
+// goroutine of their own at n. Queues of further peers share a pool of
+// queuePoolWorkers goroutines, which send their messages in turn. So that
+// unreachable peers do not hold up the others, up to queuePoolWorkers pooled
+// queues that have to dial their peer or wait for a batch window or a free
+// send slot do so in a goroutine of their own, further ones wait on the
+// worker. Pooled queues wait to retry a failed send on a timer.
+func WithMaxQueueGoroutines(n int) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.maxQueueGoroutines = n
 	}
 }
 
-// TODO: use goprocess here once i trust it
+// WithOperationLog keeps the last capacity wantlist changes and peer
+// connects and disconnects, to be read with OperationLog.
+func WithOperationLog(capacity int) WantManagerOption {
+	return func(pm *WantManager) {
+		if capacity > 0 {
+			pm.opLog = &operationLog{ops: make([]Operation, capacity)}
+		}
+	}
+}
+
+// WithWantTracer makes the WantManager report every stage a want goes
+// through to tracer. Traces are buffered and delivered from a goroutine of
+// their own; they are dropped while the buffer is full.
+func WithWantTracer(tracer WantTracer) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.tracer = tracer
+		pm.traces = make(chan WantTrace, wantTraceBuffer)
+	}
+}
+
+// WithBackpressureThreshold makes callers that block for longer than
+// threshold because too many wantlist changes are buffered report it to the
+// callback set with OnBackpressure.
+func WithBackpressureThreshold(threshold time.Duration) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.backpressureThreshold = threshold
+	}
+}
+
+// WithDisconnectLinger keeps the queue of a disconnected peer around for d
+// before tearing it down. If the peer reconnects meanwhile, the queue is
+// reused and only told about the wantlist changes it missed, instead of
+// being sent the full wantlist again.
+func WithDisconnectLinger(d time.Duration) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.linger = d
+	}
+}
+
+// WithConnectAdmissionRate starts at most perSec new peer queues a second,
+// so a burst of connects does not have every new peer seeded with our full
+// wantlist at once. The connects beyond the rate are held back and taken in
+// one at a time, in the order they came in.
+func WithConnectAdmissionRate(perSec int) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.admissionRate = perSec
+	}
+}
+
+// WithPeerIdleTimeout parks the queue of a peer that had nothing to send for
+// d: its goroutine returns and its senders are closed, while the peer stays
+// connected. The next wantlist change for the peer starts the queue again,
+// and the peer is sent our full wantlist. Queues run on the shared workers,
+// see WithMaxQueueGoroutines, are not parked.
+func WithPeerIdleTimeout(d time.Duration) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.idleTimeout = d
+	}
+}
+
+// WithPeerTeardownGrace makes tearing down the queue of a disconnected peer
+// wait up to d for the send in progress to finish, rather than shutting the
+// queue down under it. Teardown happens on the WantManager's event loop, so
+// d should be kept short.
+func WithPeerTeardownGrace(d time.Duration) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.teardownGrace = d
+	}
+}
+
+// WithDisconnectPropagationDelay sets how long a queue waits after a failed
+// send before retrying, in case the peer is disconnecting. The wait ends
+// early once the peer is reported disconnected.
+func WithDisconnectPropagationDelay(d time.Duration) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.disconnectDelay = d
+	}
+}
+
+// WithQueueWatchdog checks every interval that the queue of each peer is
+// still running, and restarts the queues that stopped, sending the peer our
+// full wantlist again. Queues only recover from panics with the watchdog
+// set, without it a panic in a queue is not caught.
+func WithQueueWatchdog(interval time.Duration) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.watchdogInterval = interval
+	}
+}
+
+// WithShutdownDrain makes Run apply the wantlist changes still buffered
+// when the WantManager's context is cancelled, and send what is queued for
+// the connected peers, spending at most timeout on it, instead of dropping
+// them.
+func WithShutdownDrain(timeout time.Duration) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.drainTimeout = timeout
+	}
+}
+
+// WithMetricsLabel creates the metrics of the WantManager in the sub-scope
+// name of the metrics scope of the context given to NewWantManager, so that
+// several WantManagers, e.g. one per network, report separate metrics.
+func WithMetricsLabel(name string) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.metricsLabel = name
+	}
+}
+
+// WithSentHistogramBuckets overrides the buckets of the histograms the
+// WantManager reports, which default to metricsBuckets. Nodes dealing in
+// very large blocks may want coarser buckets.
+func WithSentHistogramBuckets(buckets []float64) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.histBuckets = buckets
+	}
+}
+
+// WithRebroadcastChunkSize limits every periodic rebroadcast to n entries.
+// Each rebroadcast sends the next n entries in priority order, wrapping
+// around, so the whole wantlist gets refreshed over several rebroadcasts
+// instead of in one large burst.
+func WithRebroadcastChunkSize(n int) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.rebroadcastChunk = n
+	}
+}
+
+// WithRebroadcastFanoutCap limits every periodic rebroadcast of the whole
+// wantlist to m peers. The peers take turns, so each of them is refreshed
+// once every few rebroadcasts instead of all of them in one burst. Peers
+// with their own rebroadcast interval are not counted.
+func WithRebroadcastFanoutCap(m int) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.rebroadcastFanoutCap = m
+	}
+}
+
+// RebroadcastHook decides what p is sent when our whole wantlist is
+// rebroadcast to it, given the entries it would be sent otherwise. It may
+// drop, reorder or change the entries it is passed, which are copies.
+type RebroadcastHook func(p peer.ID, entries []*bsmsg.Entry) []*bsmsg.Entry
+
+// WithRebroadcastHook has hook decide what each peer is sent on periodic
+// rebroadcasts of the whole wantlist, both the global ones and those of
+// peers with their own interval. As the hook may leave wants out, peers are
+// then sent what it returns on top of what they were told before, rather
+// than a full wantlist replacing it. Chunked rebroadcasts, see
+// WithRebroadcastChunkSize, do not go through the hook.
+func WithRebroadcastHook(hook RebroadcastHook) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.rebroadcastHook = hook
+	}
+}
+
+// RebroadcastMode decides when our wantlist is resent to peers that were
+// already sent it.
+type RebroadcastMode int
+
+const (
+	// RebroadcastPeriodic resends the wantlist to every peer on each
+	// rebroadcast tick.
+	RebroadcastPeriodic RebroadcastMode = iota
+
+	// RebroadcastOnReconnectOnly never rebroadcasts on a timer. Instead
+	// the whole wantlist is resent to a peer whose sender was reset, and
+	// to a peer reconnecting while its queue lingered, which would
+	// otherwise only be sent the changes it missed.
+	RebroadcastOnReconnectOnly
+
+	// RebroadcastOff never resends the wantlist. Peers are sent it when
+	// they connect and the changes to it afterwards.
+	RebroadcastOff
+)
+
+// WithRebroadcastMode sets when our wantlist is resent to peers. The
+// default is RebroadcastPeriodic. Intervals set with
+// SetPeerRebroadcastInterval apply in every mode.
+func WithRebroadcastMode(mode RebroadcastMode) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.rebroadcastMode = mode
+	}
+}
+
+// CombineStrategy decides how a want queued for a peer merges with a want
+// for the same cid that is still waiting to be sent to it. Whatever the
+// strategy, the priority that wins replaces the one of the pending want,
+// including a want still waiting in the initial wantlist, and is what the
+// peer is taken to have been told.
+type CombineStrategy int
+
+const (
+	// CombineLatest sends the priority of the newest want.
+	CombineLatest CombineStrategy = iota
+
+	// CombineMaxPriority sends the highest priority of the two.
+	CombineMaxPriority
+
+	// CombineRejectDowngrade drops wants with a lower priority than the
+	// peer was sent, or is about to be sent, for the cid.
+	CombineRejectDowngrade
+)
+
+// WithCombineStrategy sets how a want merges with a pending want for the
+// same cid. The default is CombineLatest.
+func WithCombineStrategy(strategy CombineStrategy) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.combine = strategy
+	}
+}
+
+// WithMaxMessageSize splits the wantlist changes queued for a peer into
+// messages of at most n bytes. A full wantlist is sent as a full message
+// followed by the entries that did not fit.
+func WithMaxMessageSize(n int) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.maxMessageSize = n
+	}
+}
+
+// OversizedEntryPolicy decides what happens to a wantlist entry that makes
+// a message larger than the maximum message size on its own.
+type OversizedEntryPolicy int
+
+const (
+	// OversizedDrop logs the entry and does not send it.
+	OversizedDrop OversizedEntryPolicy = iota
+
+	// OversizedSendAnyway sends the entry in a message of its own.
+	OversizedSendAnyway
+
+	// OversizedReport does not send the entry and reports it to the
+	// function set with OnOversizedEntry.
+	OversizedReport
+)
+
+// WithOversizedEntryPolicy sets what is done with entries too large for
+// the size set with WithMaxMessageSize. The default is OversizedDrop.
+// Entries that are not sent are forgotten for the peer, so they are tried
+// again with the next rebroadcast.
+func WithOversizedEntryPolicy(policy OversizedEntryPolicy) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.oversizedPolicy = policy
+	}
+}
+
+// SenderFactory opens a sender to p. It is called for every attempt a peer
+// queue makes, so it can decide how each attempt goes.
+type SenderFactory func(p peer.ID) (bsnet.MessageSender, error)
+
+// WithSenderFactory opens the senders of peer queues with factory rather
+// than through the network, which is then neither asked to connect to the
+// peer nor for a sender. This is mainly meant for testing how queues cope
+// with failing senders.
+func WithSenderFactory(factory SenderFactory) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.senderFactory = factory
+	}
+}
+
+// WithStrictSendAccounting has SendBlock call env.Failed, rather than
+// env.Sent, for blocks that could not be sent, so that only blocks that left
+// the node are accounted as sent. Envelopes without Failed still have Sent
+// called.
+func WithStrictSendAccounting() WantManagerOption {
+	return func(pm *WantManager) {
+		pm.strictSendAccounting = true
+	}
+}
+
+// WantlistBackend stores the wantlist of a WantManager. It must be safe for
+// concurrent use, as the wantlist is read outside of the Run loop.
+type WantlistBackend interface {
+	Add(c *cid.Cid, priority int) bool
+	AddEntry(e *wantlist.Entry) bool
+	Remove(c *cid.Cid) bool
+	Contains(c *cid.Cid) (*wantlist.Entry, bool)
+	Entries() []*wantlist.Entry
+	SortedEntries() []*wantlist.Entry
+	Len() int
+}
+
+// WithWantlistBackend stores the wantlist in b instead of a
+// wantlist.ThreadSafe, e.g. to use a structure better suited to very large
+// wantlists. b should be empty.
+func WithWantlistBackend(b WantlistBackend) WantManagerOption {
+	return func(pm *WantManager) {
+		pm.wl = b
+	}
+}
+
+// NewWantManager returns a WantManager sending through network. It panics if
+// network is nil; network.NoopNetwork can stand in where nothing should be
+// sent.
+func NewWantManager(ctx context.Context, network bsnet.BitSwapNetwork, opts ...WantManagerOption) *WantManager {
+	if network == nil {
+		panic("bitswap: NewWantManager called with a nil network")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	pm := &WantManager{
+		incoming:      make(chan *wantSet, 10),
+		connect:       make(chan peer.ID, 10),
+		disconnect:    make(chan peer.ID, 10),
+		peerReqs:      make(chan chan []peer.ID),
+		runReqs:       make(chan func()),
+		peers:         make(map[peer.ID]*msgQueue),
+		wl:            wantlist.NewThreadSafe(),
+		warm:          make(map[peer.ID]*msgQueue),
+		lingering:     make(map[peer.ID]*lingeringQueue),
+		fanout:        make(map[string]*fanoutWant),
+		pending:       make(map[peer.ID][]*bsmsg.Entry),
+		wantAdded:     make(map[string]time.Time),
+		sendAttempts:  make(map[string]int),
+		lastSeed:      make(map[peer.ID]seedRecord),
+		hints:         make(map[string][]peer.ID),
+		departing:     make(map[peer.ID]chan struct{}),
+		stats:         new(wmStats),
+		lastChange:    make(map[string]changeTimes),
+		debounced:     make(map[string]*debouncedEntry),
+		network:       network,
+		ctx:           ctx,
+		cancel:        cancel,
+		histBuckets:   metricsBuckets,
+		leakRefcnt:    defaultLeakRefcnt,
+		seedChunkSize: defaultSeedChunkSize,
+
+		disconnectDelay: defaultDisconnectDelay,
+
+		peerRebroadcast: make(map[peer.ID]time.Duration),
+		peerGroups:      make(map[peer.ID]string),
+		peerTiers:       make(map[peer.ID]PeerTier),
+
+		pinned: make(map[string]struct{}),
+
+		started: time.Now(),
+
+		peerWants: make(map[peer.ID]map[string]*cid.Cid),
+	}
+	for _, opt := range opts {
+		opt(pm)
+	}
+	if pm.expectedPeers > 0 {
+		pm.peers = make(map[peer.ID]*msgQueue, pm.expectedPeers)
+		pm.lastSeed = make(map[peer.ID]seedRecord, pm.expectedPeers)
+		pm.peerWants = make(map[peer.ID]map[string]*cid.Cid, pm.expectedPeers)
+	}
+
+	// metrics are set up once the options are known, as some of them
+	// affect how metrics are reported
+	mctx := ctx
+	if pm.metricsLabel != "" {
+		mctx = metrics.CtxSubScope(ctx, pm.metricsLabel)
+	}
+	pm.wantlistGauge = newGauge(mctx, "wantlist_total",
+		"Number of items in wantlist.")
+	pm.sentHistogram = newHistogram(mctx, "sent_all_blocks_bytes", "Histogram of blocks sent by"+
+		" this bitswap", pm.histBuckets)
+	pm.refcntGauge = newGauge(mctx, "peer_refcnt_max",
+		"Highest connection refcount of any peer.")
+	pm.connectedCounter = newCounter(mctx, "peers_connected_total",
+		"Number of peer connect events.")
+	pm.disconnectedCounter = newCounter(mctx, "peers_disconnected_total",
+		"Number of peer disconnect events.")
+	pm.peersGauge = newGauge(mctx, "peers_current",
+		"Number of peers we are currently sending wants to.")
+	pm.oscillationCounter = newCounter(mctx, "want_oscillation_total",
+		"Number of wants added or cancelled shortly after the opposite change.")
+	pm.sendErrCounter = newCounter(mctx, "send_errors_total",
+		"Number of messages that failed to send.")
+	pm.lostCancelCounter = newCounter(mctx, "lost_cancels_resent_total",
+		"Number of cancels sent again because the peer still sent the block.")
+	pm.shedCounter = newCounter(mctx, "pending_wants_dropped_total",
+		"Number of queued wants dropped to stay within the pending bytes budget.")
+	pm.incomingGauge = newGauge(mctx, "incoming_queue_depth",
+		"Number of wantlist changes waiting to be handled by the run loop.")
+	pm.seedHistogram = newHistogram(mctx, "peer_seed_bytes", "Histogram of the full"+
+		" wantlists sent to newly connected peers", metricsBuckets)
+
+	if pm.mirrorPeer != "" {
+		pm.mirror = pm.newMsgQueue(pm.mirrorPeer)
+		pm.mirror.idleTimeout = 0
+	}
+	if pm.maxQueueGoroutines > 0 {
+		pm.pool = newQueuePool()
+	}
+	return pm
+}
+
+// newHistogram, newGauge and newCounter create the metrics used by the
+// WantManager. They are variables so tests can check how metrics are set up
+// and what they report.
+var newHistogram = func(ctx context.Context, name, help string, buckets []float64) metrics.Histogram {
+	return metrics.NewCtx(ctx, name, help).Histogram(buckets)
+}
+
+var newGauge = func(ctx context.Context, name, help string) metrics.Gauge {
+	return metrics.NewCtx(ctx, name, help).Gauge()
+}
+
+var newCounter = func(ctx context.Context, name, help string) metrics.Counter {
+	return metrics.NewCtx(ctx, name, help).Counter()
+}
+
+// wmStats shadows the values reported through metrics, so they can be read
+// without a metrics backend. Fields are accessed atomically.
+type wmStats struct {
+	// live values, left alone by ResetCounters
+	wantlist int64
+	peers    int64
+
+	// cumulative counters, zeroed by ResetCounters
+	sentBytes  int64
+	sendErrors int64
+
+	// shadow the sent histogram, see SentSizeSummary. Also zeroed by
+	// ResetSentStats
+	sentCount uint64
+	sentTotal uint64
+	sentMax   int64
+
+	// like sentCount, but not zeroed by ResetSentStats
+	blocksSent uint64
+}
+
+// MetricsSnapshot returns the current values of the WantManager's metrics,
+// keyed by metric name. It works whether or not a metrics backend is set up.
+func (pm *WantManager) MetricsSnapshot() map[string]float64 {
+	return map[string]float64{
+		"wantlist_total":          float64(atomic.LoadInt64(&pm.stats.wantlist)),
+		"sent_blocks_bytes_total": float64(atomic.LoadInt64(&pm.stats.sentBytes)),
+		"send_errors_total":       float64(atomic.LoadInt64(&pm.stats.sendErrors)),
+		"peers_current":           float64(atomic.LoadInt64(&pm.stats.peers)),
+	}
+}
+
+func (pm *WantManager) recordSendError() {
+	pm.sendErrCounter.Inc()
+	atomic.AddInt64(&pm.stats.sendErrors, 1)
+}
+
+func (pm *WantManager) recordSent(size int) {
+	pm.sentHistogram.Observe(float64(size))
+	atomic.AddInt64(&pm.stats.sentBytes, int64(size))
+
+	atomic.AddUint64(&pm.stats.sentCount, 1)
+	atomic.AddUint64(&pm.stats.sentTotal, uint64(size))
+	atomic.AddUint64(&pm.stats.blocksSent, 1)
+	for {
+		max := atomic.LoadInt64(&pm.stats.sentMax)
+		if int64(size) <= max || atomic.CompareAndSwapInt64(&pm.stats.sentMax, max, int64(size)) {
+			break
+		}
+	}
+}
+
+// SentSizeSummary returns how many blocks were sent, their total size and
+// the size of the largest one, since the WantManager was created or
+// ResetSentStats was last called.
+func (pm *WantManager) SentSizeSummary() (count uint64, totalBytes uint64, max int) {
+	count = atomic.LoadUint64(&pm.stats.sentCount)
+	totalBytes = atomic.LoadUint64(&pm.stats.sentTotal)
+	max = int(atomic.LoadInt64(&pm.stats.sentMax))
+	return count, totalBytes, max
+}
+
+// ResetSentStats zeroes the values returned by SentSizeSummary. It leaves
+// the sent histogram and MetricsSnapshot alone.
+func (pm *WantManager) ResetSentStats() {
+	atomic.StoreUint64(&pm.stats.sentCount, 0)
+	atomic.StoreUint64(&pm.stats.sentTotal, 0)
+	atomic.StoreInt64(&pm.stats.sentMax, 0)
+}
+
+// ResetCounters zeroes the cumulative counters: the wants added and
+// cancelled and the blocks sent reported by Summary, the bytes sent and send
+// errors reported by MetricsSnapshot, and SentSizeSummary. Live values, the
+// size of our wantlist and the number of peers, stay accurate. So do the
+// metrics reported to the metrics backend, which only ever count up.
+func (pm *WantManager) ResetCounters() {
+	pm.runSync(func() {
+		pm.wantsAdded = 0
+		pm.wantsCancelled = 0
+	})
+	atomic.StoreInt64(&pm.stats.sentBytes, 0)
+	atomic.StoreInt64(&pm.stats.sendErrors, 0)
+	atomic.StoreUint64(&pm.stats.blocksSent, 0)
+	pm.ResetSentStats()
+}
+
+// WantManagerSummary is an overview of a WantManager, see Summary.
+type WantManagerSummary struct {
+	// when the WantManager was created
+	Started time.Time
+
+	// wants added to and cancelled from our wantlist, and blocks sent to
+	// peers, since the WantManager was created or ResetCounters was last
+	// called
+	WantsAdded     uint64
+	WantsCancelled uint64
+	BlocksSent     uint64
+
+	// the size of our wantlist and the number of connected peers
+	Wantlist int
+	Peers    int
+}
+
+// Summary returns an overview of the WantManager's activity since it was
+// created, see ResetCounters, and its current state. Once the WantManager
+// is shut down, only Started and BlocksSent are filled in.
+func (pm *WantManager) Summary() WantManagerSummary {
+	s := WantManagerSummary{
+		Started:    pm.started,
+		BlocksSent: atomic.LoadUint64(&pm.stats.blocksSent),
+	}
+	pm.runSync(func() {
+		s.WantsAdded = pm.wantsAdded
+		s.WantsCancelled = pm.wantsCancelled
+		s.Wantlist = pm.wl.Len()
+		s.Peers = len(pm.peers)
+	})
+	return s
+}
+
+func (pm *WantManager) updatePeersGauge() {
+	pm.peersGauge.Set(float64(len(pm.peers)))
+	atomic.StoreInt64(&pm.stats.peers, int64(len(pm.peers)))
+}
+
+// wantSet is a batch of wantlist changes, sent to targets, or to every
+// connected peer if there are none.
+type wantSet struct {
+	entries []*bsmsg.Entry
+	targets []peer.ID
+
+	// numbers wantSets in the order they were queued
+	seq uint64
+
+	// peers likely to have some of the entries, keyed by cid
+	hints map[string][]peer.ID
+
+	// if set, receives the cids that were newly added to our wantlist
+	added chan []*cid.Cid
+
+	// deadline of the context the entries were added with, if any
+	deadline time.Time
+
+	// peer that sent us the blocks cancelled by entries, if any
+	from peer.ID
+
+	// entries are the whole wantlist we want, see ReplaceWants
+	replace bool
+
+	// entries are cancels for the targets only, see CancelWantsFromPeers
+	peerCancel bool
+
+	// cancel the whole wantlist, see CancelAll, or only the wants added
+	// before addedBefore if it is set, see CancelWantsOlderThan
+	cancelAll   bool
+	addedBefore time.Time
+
+	// entries are pinned or unpinned, see PinWant
+	pin, unpin bool
+
+	// the targets are the members of group, see WantBlocksToGroup
+	group string
+
+	// if set, the entries are only added with peers connected, and
+	// whether they were is sent on it, see WantBlocksIfPeers
+	ifPeers chan bool
+}
+
+type msgPair struct {
+	to  peer.ID
+	msg bsmsg.BitSwapMessage
+}
+
+type cancellation struct {
+	who peer.ID
+	blk *cid.Cid
+}
+
+type msgQueue struct {
+	p peer.ID
+
+	outlk   sync.Mutex
+	out     bsmsg.BitSwapMessage
+	network bsnet.BitSwapNetwork
+
+	// opens senders instead of network, if set
+	senderFactory SenderFactory
+
+	// the wants we have told (or are about to tell) this peer about
+	wl *wantlist.ThreadSafe
+
+	// for peers that do not take full wantlists, the wants they were told
+	// about before wl was last replaced by a full wantlist, to cancel
+	// those the full wantlist leaves out. protected by outlk
+	replaced map[string]*cid.Cid
+
+	// remainder of the initial wantlist still to be sent to this peer,
+	// highest priority first. protected by outlk
+	seed      []*wantlist.Entry
+	chunkSize int
+
+	// set from when the queue is seeded with our full wantlist until the
+	// last of it was sent, protected by outlk. onSeeded is called then,
+	// with the bytes sent to the peer meanwhile, counted in seedBytes.
+	seeding   bool
+	seedBytes int
+	onSeeded  func(size int)
+
+	// sender is only written with outlk held, so other goroutines may read
+	// it under the lock
+	sender bsnet.MessageSender
+
+	// set once the queue is shut down, protected by outlk
+	closed bool
+
+	// set once runQueue returned, protected by outlk
+	exited bool
+
+	// whether a panic while running the queue is recovered from, leaving it
+	// to the watchdog to restart the queue
+	recoverCrash bool
+
+	// with idleTimeout set, runQueue returns once the queue was idle for
+	// that long and parked is set, protected by outlk. unpark starts the
+	// queue again seeded with our full wantlist, from Run, and restart
+	// starts it again as it is
+	idleTimeout time.Duration
+	parked      bool
+	unpark      func()
+	restart     func()
+
+	// the shared workers running the queue, nil if it runs in a goroutine
+	// of its own. goroutines is decremented when that goroutine returns
+	pool       *queuePool
+	goroutines *int32
+
+	// points at the WantManager's paused flag, the queue does not send
+	// while it is set
+	paused *int32
+
+	// holds a token while doWork runs, so teardown can wait for the send
+	// in progress
+	working chan struct{}
+
+	// whether the queue is waiting for or being run by a pool worker,
+	// protected by pool.lk
+	poolState poolState
+
+	// what the peer is willing to receive, learned when a sender is
+	// opened. protected by outlk
+	caps *bsnet.PeerCapabilities
+
+	// deadlines of the wants in out that were added with one, keyed by
+	// cid. protected by outlk
+	deadlines map[string]time.Time
+
+	// closed once nothing is left to send to the peer, for DrainPeer.
+	// protected by outlk
+	drained []chan struct{}
+
+	// the cancels we sent the peer, keyed by cid. protected by outlk
+	cancelled map[string]*sentCancel
+
+	// how long to wait for more changes before sending a message
+	batchWindow time.Duration
+
+	// set, atomically, while the peer is in PeerTierLowPriority
+	lowPriority int32
+
+	// shared by all queues to bound the size of their out messages, may be
+	// nil. outBytes is the size of out accounted for in budget, protected
+	// by outlk
+	budget    *pendingBudget
+	outBytes  int64
+	onDropped func(n int)
+
+	// decides what to do when sending fails, nil retries every error
+	classify ErrorClassifier
+
+	// called with the messages dropped after a send error
+	onGiveUp func(bsmsg.BitSwapMessage, error)
+
+	// called whenever sending a message fails
+	onSendError func()
+
+	// the queue stops sending for quarantine once errorThreshold sends in
+	// a row failed. sendErrors counts them, and quarantinedUntil is set
+	// while the queue is quarantined. Both are protected by outlk
+	errorThreshold   int
+	quarantine       time.Duration
+	sendErrors       int
+	quarantinedUntil time.Time
+	onQuarantined    func(until time.Time)
+
+	// called with every want added to out by addMessage
+	onWantQueued func(*cid.Cid)
+
+	// how addMessage merges a want with one already in out
+	combine CombineStrategy
+
+	// the largest message sent in bytes, zero means no limit. Entries too
+	// large for any message are handled according to oversized.
+	maxSize     int
+	oversized   OversizedEntryPolicy
+	onOversized func(c *cid.Cid, size int)
+
+	// the oversized wants dropped already, so rebroadcasts skip them
+	// instead of handling them again, protected by outlk
+	droppedOversized map[string]struct{}
+
+	// called with each want sent to the peer, nil without a tracer
+	onWantSent func(*cid.Cid)
+
+	// the version of our wantlist out brings the peer up to, that of the
+	// last message sent, and that of the last message the peer
+	// acknowledged, if acked is set. protected by outlk
+	version      uint64
+	sentVersion  uint64
+	ackedVersion uint64
+	acked        bool
+
+	// returns the current version of our wantlist, only called from Run
+	wantlistVersion func() uint64
+
+	// called whenever a sender is opened or closed
+	onSenderEvent func(SenderEvent)
+
+	// shared by all queues to limit concurrent dials, may be nil
+	dials chan struct{}
+
+	// how long to wait for a disconnect after a failed send, and a
+	// channel closed once the peer is reported disconnected
+	disconnectDelay time.Duration
+	departed        func() <-chan struct{}
+
+	// with more than one message in flight, slots holds a sender (or nil,
+	// until one is opened) for every message that may be sent at once, and
+	// inflight maps each cid being sent to the message carrying it. Both
+	// are nil when messages are sent one at a time. inflight and stopped
+	// are protected by outlk
+	slots    chan bsnet.MessageSender
+	inflight map[string]chan struct{}
+	stopped  bool
+
+	// the wantlist messages being sent that are aborted once all their
+	// wants are cancelled. protected by outlk
+	abortable map[*abortableSend]struct{}
+
+	refcnt int
+
+	// when our wantlist is next rebroadcast to the peer, if it has its own
+	// rebroadcast interval
+	rebroadcastDue time.Time
+
+	// when the queue was started and when we last managed to send something
+	// to the peer, and how long sends to the peer take on average. lastSend
+	// and latency are protected by outlk
+	started  time.Time
+	lastSend time.Time
+	latency  time.Duration
+
+	// size of the messages sent to the peer so far, and how many there
+	// were and the largest, see PeerSendSizeStats. protected by outlk
+	bytesSent   uint64
+	msgsSent    int
+	maxSentSize int
+
+	// wants and cancels queued for the peer so far, see PeerWantBalance.
+	// protected by outlk
+	wantsQueued   int
+	cancelsQueued int
+
+	work chan struct{}
+	done chan struct{}
+}
+
+func (pm *WantManager) WantBlocks(ctx context.Context, ks []*cid.Cid) {
+	log.Infof("want blocks: %s", ks)
+	pm.addEntries(ctx, ks, nil, false)
+}
+
+// WantBlocksAnnotated is like WantBlocks, but the wants carry flags to the
+// peers they are sent to. A want already in our wantlist keeps the flags it
+// was added with.
+func (pm *WantManager) WantBlocksAnnotated(ctx context.Context, ks []*cid.Cid, flags uint8) {
+	log.Infof("want blocks: %s with flags %x", ks, flags)
+	entries := newEntries(ks, false)
+	for _, e := range entries {
+		e.Flags = flags
+	}
+	pm.queueWantSet(ctx, &wantSet{entries: entries})
+}
+
+// WantBlocksToGroup adds ks to our wantlist and sends them to the peers in
+// group only, as WantBlocksFrom would, see AssignPeerGroup. The group is
+// resolved to its members when the wants are handled. If it has none, the
+// wants are only sent to other peers with the next rebroadcast.
+func (pm *WantManager) WantBlocksToGroup(ctx context.Context, ks []*cid.Cid, group string) {
+	log.Infof("want blocks: %s from group %s", ks, group)
+	pm.queueWantSet(ctx, &wantSet{entries: newEntries(ks, false), group: group})
+}
+
+// PeerTier is how eagerly wantlist changes are sent to a peer, see
+// SetPeerTier.
+type PeerTier int
+
+const (
+	// PeerTierNormal peers are sent wantlist changes as they happen.
+	PeerTierNormal PeerTier = iota
+
+	// PeerTierLowPriority peers, e.g. ones found but not trusted yet, are
+	// only sent new wants with rebroadcasts of our wantlist, so never
+	// with RebroadcastOff. Cancels still go out to them right away,
+	// though batched for longer than those for other peers.
+	PeerTierLowPriority
+)
+
+// lowPriorityBatchWindow is how long changes for peers in
+// PeerTierLowPriority are held back for more to be batched with them, at
+// least.
+const lowPriorityBatchWindow = time.Second
+
+// SetPeerTier puts p in tier. Peers go back to PeerTierNormal when they
+// disconnect.
+func (pm *WantManager) SetPeerTier(p peer.ID, tier PeerTier) {
+	pm.runSync(func() {
+		if tier == PeerTierNormal {
+			delete(pm.peerTiers, p)
+		} else {
+			pm.peerTiers[p] = tier
+		}
+		if mq, ok := pm.peers[p]; ok {
+			mq.setTier(tier)
+		}
+	})
+}
+
+// setTier makes the queue batch changes as tier has it.
+func (mq *msgQueue) setTier(tier PeerTier) {
+	var low int32
+	if tier == PeerTierLowPriority {
+		low = 1
+	}
+	atomic.StoreInt32(&mq.lowPriority, low)
+}
+
+// AssignPeerGroup puts p in group, taking it out of the group it was in
+// before, if any. An empty group takes p out of its group. Peers leave
+// their group when they disconnect.
+func (pm *WantManager) AssignPeerGroup(p peer.ID, group string) {
+	pm.runSync(func() {
+		if group == "" {
+			delete(pm.peerGroups, p)
+		} else {
+			pm.peerGroups[p] = group
+		}
+	})
+}
+
+// groupMembers returns the peers assigned to group.
+func (pm *WantManager) groupMembers(group string) []peer.ID {
+	var members []peer.ID
+	for p, g := range pm.peerGroups {
+		if g == group {
+			members = append(members, p)
+		}
+	}
+	return members
+}
+
+// WantBlocksFrom adds ks to our wantlist, but only tells the given peers
+// about them. Other peers learn about the wants on the next rebroadcast.
+func (pm *WantManager) WantBlocksFrom(ctx context.Context, ks []*cid.Cid, peers []peer.ID) {
+	log.Infof("want blocks: %s from %s", ks, peers)
+	pm.addEntries(ctx, ks, peers, false)
+}
+
+func (pm *WantManager) CancelWants(ks []*cid.Cid) {
+	log.Infof("cancel wants: %s", ks)
+	pm.addEntries(context.TODO(), ks, nil, true)
+}
+
+// CancelWantsFromPeers cancels ks with peers only: those of them told about
+// the wants are sent cancels, while our wantlist and the other peers are
+// left alone. Wants held back for peers that are not connected yet are
+// dropped. As the wants stay in our wantlist, peers are told about them
+// again with the next rebroadcast of the whole wantlist.
+func (pm *WantManager) CancelWantsFromPeers(ks []*cid.Cid, peers []peer.ID) {
+	log.Infof("cancel wants: %s from %s", ks, peers)
+	pm.queueWantSet(context.TODO(), &wantSet{entries: newEntries(ks, true), targets: peers, peerCancel: true})
+}
+
+// CancelAll cancels every want in our wantlist, however many times it was
+// added. Pinned wants are kept.
+func (pm *WantManager) CancelAll() {
+	log.Info("cancel all wants")
+	pm.queueWantSet(context.TODO(), &wantSet{cancelAll: true})
+}
+
+// CancelWantsOlderThan cancels the wants that were added to our wantlist
+// more than d ago, however many times they were added. Pinned wants are
+// kept.
+func (pm *WantManager) CancelWantsOlderThan(d time.Duration) {
+	log.Infof("cancel wants older than %s", d)
+	before := time.Now().Add(-d)
+	pm.queueWantSet(context.TODO(), &wantSet{cancelAll: true, addedBefore: before})
+}
+
+// PinWant adds c to our wantlist so that it stays until UnpinWant is
+// called: cancels, including those from CancelAll, ReplaceWants and
+// received blocks, leave it in place. Pinning a want that is already pinned
+// does nothing.
+func (pm *WantManager) PinWant(ctx context.Context, c *cid.Cid) {
+	log.Infof("pin want: %s", c)
+	pm.queueWantSet(ctx, &wantSet{entries: newEntries([]*cid.Cid{c}, false), pin: true})
+}
+
+// UnpinWant drops the pin on c, removing it from our wantlist unless it was
+// also added with WantBlocks and not cancelled since.
+func (pm *WantManager) UnpinWant(c *cid.Cid) {
+	log.Infof("unpin want: %s", c)
+	pm.queueWantSet(context.TODO(), &wantSet{entries: newEntries([]*cid.Cid{c}, true), unpin: true})
+}
+
+// ReceivedUnwanted is told about the blocks, ks, that peer from sent us
+// although we did not want them. If we cancelled any of them at that peer,
+// the peer likely missed the cancel, so it is sent again. Cancels carry no
+// priority on the wire, so instead of escalating, each is resent at most
+// maxCancelResends times.
+func (pm *WantManager) ReceivedUnwanted(ks []*cid.Cid, from peer.ID) {
+	pm.runSync(func() {
+		mq, ok := pm.peers[from]
+		if !ok {
+			return
+		}
+		lost := mq.lostCancels(ks)
+		if len(lost) == 0 {
+			return
+		}
+		log.Infof("resending %d lost cancels to %s", len(lost), from)
+		pm.lostCancelCounter.Add(float64(len(lost)))
+		mq.addMessage(lost)
+	})
+}
+
+// ResendCancels sends p cancels for ks, whatever its queue remembers
+// telling p, to unstick a peer that keeps wanting blocks from us we already
+// cancelled. Our wantlist is left alone and the peer is not told about ks
+// again.
+func (pm *WantManager) ResendCancels(p peer.ID, ks []*cid.Cid) {
+	pm.runSync(func() {
+		mq, ok := pm.peers[p]
+		if !ok {
+			log.Infof("tried resending cancels to non-partner peer: %s", p)
+			return
+		}
+		log.Infof("resending cancels: %s to %s", ks, p)
+		mq.addMessage(newEntries(ks, true))
+	})
+}
+
+// ReceivedBlocks cancels the wants for ks, whose blocks were received from
+// peer from.
+func (pm *WantManager) ReceivedBlocks(ks []*cid.Cid, from peer.ID) {
+	log.Infof("received blocks: %s from %s", ks, from)
+	pm.queueWantSet(context.TODO(), &wantSet{entries: newEntries(ks, true), from: from})
+}
+
+// OnWantSatisfied sets fn to be called whenever the block of a want is
+// received, with the peer that sent it and how long ago the want was added.
+// fn is called from the Run loop, so it must not block or call back into the
+// WantManager.
+func (pm *WantManager) OnWantSatisfied(fn func(c *cid.Cid, from peer.ID, latency time.Duration)) {
+	pm.hookLk.Lock()
+	defer pm.hookLk.Unlock()
+	pm.onSatisfied = fn
+}
+
+// OnBackpressure sets fn to be called whenever adding or cancelling wants
+// blocked for longer than the threshold set with WithBackpressureThreshold,
+// with the number of callers blocked at that moment. fn is called from the
+// blocked caller.
+func (pm *WantManager) OnBackpressure(fn func(count int)) {
+	pm.hookLk.Lock()
+	defer pm.hookLk.Unlock()
+	pm.onBackpressure = fn
+}
+
+// SenderEvent is a change to the message sender a peer queue uses.
+type SenderEvent int
+
+const (
+	// SenderOpened is reported when a sender to the peer was opened.
+	SenderOpened SenderEvent = iota
+
+	// SenderClosed is reported when a sender was closed after a failed
+	// send, or because the queue of the peer was torn down.
+	SenderClosed
+
+	// SenderReset is reported when a sender was closed because the
+	// ErrorClassifier asked for SendResetSender.
+	SenderReset
+)
+
+// OnSenderEvent sets fn to be called whenever a sender to a peer is opened,
+// closed or reset. fn is called from the queue of the peer, without any of
+// its locks held.
+func (pm *WantManager) OnSenderEvent(fn func(p peer.ID, event SenderEvent)) {
+	pm.hookLk.Lock()
+	defer pm.hookLk.Unlock()
+	pm.onSenderEvent = fn
+}
+
+// OnPeerQuarantined sets fn to be called whenever a peer is quarantined
+// after too many failed sends, see WithPeerErrorThreshold. fn is called from
+// the queue of the peer, without any of its locks held.
+func (pm *WantManager) OnPeerQuarantined(fn func(p peer.ID, until time.Time)) {
+	pm.hookLk.Lock()
+	defer pm.hookLk.Unlock()
+	pm.onQuarantined = fn
+}
+
+func (pm *WantManager) peerQuarantined(p peer.ID, until time.Time) {
+	pm.hookLk.Lock()
+	fn := pm.onQuarantined
+	pm.hookLk.Unlock()
+	if fn != nil {
+		fn(p, until)
+	}
+}
+
+// OnPeerSeeded sets fn to be called once the full wantlist a newly started
+// peer queue is seeded with has been sent, all chunks of it included. Peers
+// that are not sent it because they were seeded recently, see
+// WithReseedWindow, are not reported. fn is called from a new goroutine.
+func (pm *WantManager) OnPeerSeeded(fn func(p peer.ID)) {
+	pm.hookLk.Lock()
+	defer pm.hookLk.Unlock()
+	pm.onSeeded = fn
+}
+
+func (pm *WantManager) peerSeeded(p peer.ID, size int) {
+	if size > 0 {
+		pm.seedHistogram.Observe(float64(size))
+	}
+
+	pm.hookLk.Lock()
+	fn := pm.onSeeded
+	pm.hookLk.Unlock()
+	if fn != nil {
+		fn(p)
+	}
+}
+
+// OnOversizedEntry sets fn to be called with every entry not sent to a peer
+// under OversizedReport, along with the size of a message holding only the
+// entry. fn is called from the queue of the peer, without any of its locks
+// held.
+func (pm *WantManager) OnOversizedEntry(fn func(p peer.ID, c *cid.Cid, size int)) {
+	pm.hookLk.Lock()
+	defer pm.hookLk.Unlock()
+	pm.onOversized = fn
+}
+
+func (pm *WantManager) oversizedEntry(p peer.ID, c *cid.Cid, size int) {
+	pm.hookLk.Lock()
+	fn := pm.onOversized
+	pm.hookLk.Unlock()
+	if fn != nil {
+		fn(p, c, size)
+	}
+}
+
+// FailedSend is a want that was in a message dropped after sending it to
+// Peer failed with Err, see WithFailedSendCapture.
+type FailedSend struct {
+	Cid  *cid.Cid
+	Peer peer.ID
+	Err  error
+	Time time.Time
+}
+
+// FailedSends drains the wants of the messages dropped after a send error
+// since the last call, oldest first, e.g. to ask other peers for them.
+// Only the latest ones are kept, as many as set by WithFailedSendCapture.
+// Cancels are left out.
+func (pm *WantManager) FailedSends() []FailedSend {
+	pm.failedLk.Lock()
+	defer pm.failedLk.Unlock()
+	failed := pm.failedSends
+	pm.failedSends = nil
+	return failed
+}
+
+func (pm *WantManager) sendGivenUp(p peer.ID, wlm bsmsg.BitSwapMessage, err error) {
+	if pm.failedCap <= 0 {
+		return
+	}
+	now := time.Now()
+	pm.failedLk.Lock()
+	defer pm.failedLk.Unlock()
+	for _, e := range wlm.Wantlist() {
+		if !e.Cancel {
+			pm.failedSends = append(pm.failedSends, FailedSend{Cid: e.Cid, Peer: p, Err: err, Time: now})
+		}
+	}
+	if over := len(pm.failedSends) - pm.failedCap; over > 0 {
+		pm.failedSends = append([]FailedSend(nil), pm.failedSends[over:]...)
+	}
+}
+
+func (pm *WantManager) senderEvent(p peer.ID, event SenderEvent) {
+	if event == SenderReset && pm.rebroadcastMode == RebroadcastOnReconnectOnly {
+		// the message that was being sent is lost, and no rebroadcast
+		// will make up for it. Run is asked from a new goroutine so the
+		// queue of p does not wait on it.
+		go pm.runSync(func() { pm.resendTo(p) })
+	}
+
+	pm.hookLk.Lock()
+	fn := pm.onSenderEvent
+	pm.hookLk.Unlock()
+	if fn != nil {
+		fn(p, event)
+	}
+}
+
+func (pm *WantManager) wantSatisfied(c *cid.Cid, from peer.ID, latency time.Duration) {
+	pm.hookLk.Lock()
+	fn := pm.onSatisfied
+	pm.hookLk.Unlock()
+	if fn != nil {
+		fn(c, from, latency)
+	}
+}
+
+// WantBlocksWithHints adds ks to our wantlist like WantBlocks, but sends the
+// wants in hints, keyed by cid, only to the hinted peers that are connected.
+// Wants without connected hinted peers are broadcast as usual. Hints are
+// forgotten once the want is cancelled.
+func (pm *WantManager) WantBlocksWithHints(ctx context.Context, ks []*cid.Cid, hints map[string][]peer.ID) {
+	log.Infof("want blocks: %s with hints", ks)
+	pm.queueWantSet(ctx, &wantSet{entries: newEntries(ks, false), hints: hints})
+}
+
+// WantBlocksReport is like WantBlocks, but returns which of ks were not
+// already in our wantlist.
+func (pm *WantManager) WantBlocksReport(ctx context.Context, ks []*cid.Cid) ([]*cid.Cid, error) {
+	log.Infof("want blocks: %s", ks)
+	ws := &wantSet{entries: newEntries(ks, false), added: make(chan []*cid.Cid, 1)}
+	pm.queueWantSet(ctx, ws)
+
+	select {
+	case added := <-ws.added:
+		return added, nil
+	case <-pm.runCtx().Done():
+		return nil, pm.runCtx().Err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// WantBlocksIfPeers is like WantBlocks, but only adds ks to our wantlist if
+// we are connected to any peer, so wants do not pile up while we are cut
+// off. It returns whether ks were added.
+func (pm *WantManager) WantBlocksIfPeers(ctx context.Context, ks []*cid.Cid) bool {
+	log.Infof("want blocks if peers: %s", ks)
+	ws := &wantSet{entries: newEntries(ks, false), ifPeers: make(chan bool, 1)}
+	pm.queueWantSet(ctx, ws)
+
+	select {
+	case registered := <-ws.ifPeers:
+		return registered
+	case <-pm.runCtx().Done():
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// ReplaceWants makes desired our wantlist: wants not in desired are
+// cancelled and the new ones are added with priorities following their order
+// in desired. Wants in both are left untouched. The changes are applied in
+// one go, so peers never see a partial replacement. Like with CancelWants,
+// wants added more than once stay in the wantlist until cancelled as many
+// times.
+func (pm *WantManager) ReplaceWants(ctx context.Context, desired []*cid.Cid) error {
+	log.Infof("replace wants: %s", desired)
+	ws := &wantSet{entries: newEntries(desired, false), replace: true, added: make(chan []*cid.Cid, 1)}
+	pm.queueWantSet(ctx, ws)
+
+	select {
+	case <-ws.added:
+		return nil
+	case <-pm.runCtx().Done():
+		return pm.runCtx().Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (pm *WantManager) addEntries(ctx context.Context, ks []*cid.Cid, targets []peer.ID, cancel bool) {
+	pm.queueWantSet(ctx, &wantSet{entries: newEntries(ks, cancel), targets: targets})
+}
+
+func newEntries(ks []*cid.Cid, cancel bool) []*bsmsg.Entry {
+	var entries []*bsmsg.Entry
+	for i, k := range ks {
+		entries = append(entries, &bsmsg.Entry{
+			Cancel: cancel,
+			Entry: &wantlist.Entry{
+				Cid:      k,
+				Priority: kMaxPriority - i,
+				RefCnt:   1,
+			},
+		})
+	}
+	return entries
+}
+
+func (pm *WantManager) queueWantSet(ctx context.Context, ws *wantSet) {
+	if d, ok := ctx.Deadline(); ok {
+		ws.deadline = d
+	}
+	ws.seq = atomic.AddUint64(&pm.wantSeq, 1)
+	if pm.backpressureThreshold > 0 {
+		select {
+		case pm.incoming <- ws:
+		default:
+			pm.queueWantSetSlow(ctx, ws)
+		}
+		return
+	}
+
+	select {
+	case pm.incoming <- ws:
+	case <-pm.runCtx().Done():
+	case <-ctx.Done():
+	}
+}
+
+// queueWantSetSlow queues ws once incoming is full, reporting backpressure
+// if that takes longer than backpressureThreshold.
+func (pm *WantManager) queueWantSetSlow(ctx context.Context, ws *wantSet) {
+	pm.hookLk.Lock()
+	pm.blocked++
+	pm.hookLk.Unlock()
+	defer func() {
+		pm.hookLk.Lock()
+		pm.blocked--
+		pm.hookLk.Unlock()
+	}()
+
+	timer := time.NewTimer(pm.backpressureThreshold)
+	defer timer.Stop()
+	select {
+	case pm.incoming <- ws:
+		return
+	case <-timer.C:
+	case <-pm.runCtx().Done():
+		return
+	case <-ctx.Done():
+		return
+	}
+
+	pm.hookLk.Lock()
+	fn, count := pm.onBackpressure, pm.blocked
+	pm.hookLk.Unlock()
+	if fn != nil {
+		fn(count)
+	}
+
+	select {
+	case pm.incoming <- ws:
+	case <-pm.runCtx().Done():
+	case <-ctx.Done():
+	}
+}
+
+func (pm *WantManager) ConnectedPeers() []peer.ID {
+	resp := make(chan []peer.ID)
+	pm.peerReqs <- resp
+	return <-resp
+}
+
+// LeakedPeers returns the peers that look like they were never properly
+// disconnected: their connection refcnt is suspiciously high, or their
+// queue has been alive for a long time without sending anything.
+func (pm *WantManager) LeakedPeers() []peer.ID {
+	var leaked []peer.ID
+	pm.runSync(func() {
+		now := time.Now()
+		for p, mq := range pm.peers {
+			if pm.leakRefcnt > 0 && mq.refcnt > pm.leakRefcnt {
+				leaked = append(leaked, p)
+				continue
+			}
+
+			if pm.leakIdle > 0 {
+				mq.outlk.Lock()
+				last := mq.lastSend
+				mq.outlk.Unlock()
+				if last.IsZero() {
+					last = mq.started
+				}
+				if now.Sub(last) > pm.leakIdle {
+					leaked = append(leaked, p)
+				}
+			}
+		}
+		pm.updateRefcntGauge()
+	})
+	return leaked
+}
+
+// OperationKind tells what an Operation did.
+type OperationKind int
+
+const (
+	// OpWant added wants to our wantlist
+	OpWant OperationKind = iota
+	// OpCancel cancelled wants
+	OpCancel
+	// OpConnect reported a peer connecting
+	OpConnect
+	// OpDisconnect reported a peer disconnecting
+	OpDisconnect
+)
+
+// Operation is an entry of the operation log.
+type Operation struct {
+	Kind OperationKind
+	Time time.Time
+
+	// Cids are the wants added or cancelled by OpWant and OpCancel, and
+	// Seq numbers the change they were part of in the order it was made
+	Cids []*cid.Cid
+	Seq  uint64
+
+	// Peer is the peer that connected or disconnected
+	Peer peer.ID
+}
+
+// operationLog is a ring buffer of the last len(ops) operations. ops[next]
+// is the oldest once full is set.
+type operationLog struct {
+	ops  []Operation
+	next int
+	full bool
+}
+
+func (l *operationLog) add(op Operation) {
+	l.ops[l.next] = op
+	l.next++
+	if l.next == len(l.ops) {
+		l.next = 0
+		l.full = true
+	}
+}
+
+// logOp records op in the operation log, if there is one.
+func (pm *WantManager) logOp(op Operation) {
+	if pm.opLog == nil {
+		return
+	}
+	op.Time = time.Now()
+	pm.opLog.add(op)
+}
+
+// logWantSet records the wants and cancels of ws in the operation log.
+func (pm *WantManager) logWantSet(ws *wantSet) {
+	if pm.opLog == nil {
+		return
+	}
+	var wants, cancels []*cid.Cid
+	for _, e := range ws.entries {
+		if e.Cancel {
+			cancels = append(cancels, e.Cid)
+		} else {
+			wants = append(wants, e.Cid)
+		}
+	}
+	if len(wants) > 0 {
+		pm.logOp(Operation{Kind: OpWant, Cids: wants, Seq: ws.seq})
+	}
+	if len(cancels) > 0 {
+		pm.logOp(Operation{Kind: OpCancel, Cids: cancels, Seq: ws.seq})
+	}
+}
+
+// OperationLog returns the operations kept by WithOperationLog, oldest
+// first. It returns nil if the log is not enabled.
+func (pm *WantManager) OperationLog() []Operation {
+	var ops []Operation
+	pm.runSync(func() {
+		l := pm.opLog
+		if l == nil {
+			return
+		}
+		if l.full {
+			ops = append(ops, l.ops[l.next:]...)
+		}
+		ops = append(ops, l.ops[:l.next]...)
+	})
+	return ops
+}
+
+// PeerQueueDump is a snapshot of the send-side state kept for a peer.
+type PeerQueueDump struct {
+	// Pending lists the entries (wants and cancels) not sent yet
+	Pending []*cid.Cid
+	// Wantlist lists the wants we have told the peer about
+	Wantlist   []*cid.Cid
+	RefCount   int
+	SenderOpen bool
+}
+
+// WantStage is a step in the life of a want, see WithWantTracer.
+type WantStage int
+
+const (
+	// WantAdded is traced when the want is added to our wantlist
+	WantAdded WantStage = iota
+	// WantSent is traced when the want was sent to a peer
+	WantSent
+	// WantRebroadcast is traced when the want is queued again for a peer
+	// that was told about it before
+	WantRebroadcast
+	// WantCancelled is traced when the want is removed from our wantlist
+	WantCancelled
+	// WantSatisfied is traced when a peer sent us the block of the want
+	WantSatisfied
+)
+
+// wantTraceBuffer is how many traces are held for a tracer that is falling
+// behind before more are dropped.
+const wantTraceBuffer = 1024
+
+// WantTrace is a stage of a want seen by a WantTracer. Peer is empty for
+// the stages that do not concern a single peer.
+type WantTrace struct {
+	Cid   *cid.Cid
+	Peer  peer.ID
+	Time  time.Time
+	Stage WantStage
+}
+
+// WantTracer follows wants through their life, see WithWantTracer.
+type WantTracer interface {
+	TraceWant(trace WantTrace)
+}
+
+// trace hands the stage of c to the tracer, if there is one. It never
+// blocks.
+func (pm *WantManager) trace(c *cid.Cid, p peer.ID, stage WantStage) {
+	if pm.traces == nil {
+		return
+	}
+	select {
+	case pm.traces <- WantTrace{Cid: c, Peer: p, Time: time.Now(), Stage: stage}:
+	default:
+	}
+}
+
+// traceEntries traces stage for the wants in es.
+func (pm *WantManager) traceEntries(es []*bsmsg.Entry, p peer.ID, stage WantStage) {
+	if pm.traces == nil {
+		return
+	}
+	for _, e := range es {
+		if !e.Cancel {
+			pm.trace(e.Cid, p, stage)
+		}
+	}
+}
+
+// wantSentTracer returns what a queue for p calls with each want it sent,
+// nil without a tracer.
+func (pm *WantManager) wantSentTracer(p peer.ID) func(*cid.Cid) {
+	if pm.traces == nil {
+		return nil
+	}
+	return func(c *cid.Cid) { pm.trace(c, p, WantSent) }
+}
+
+// deliverTraces passes the buffered traces to the tracer until ctx is
+// done.
+func (pm *WantManager) deliverTraces(ctx context.Context) {
+	for {
+		select {
+		case t := <-pm.traces:
+			pm.tracer.TraceWant(t)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// DumpPeerQueues returns the state of the queues of the given peers, or of
+// every connected peer if none are given. It is meant for debugging.
+func (pm *WantManager) DumpPeerQueues(peers ...peer.ID) map[peer.ID]PeerQueueDump {
+	out := make(map[peer.ID]PeerQueueDump)
+	pm.runSync(func() {
+		if len(peers) == 0 {
+			for p, mq := range pm.peers {
+				out[p] = mq.dump()
+			}
+			return
+		}
+
+		for _, p := range peers {
+			if mq, ok := pm.peers[p]; ok {
+				out[p] = mq.dump()
+			}
+		}
+	})
+	return out
+}
+
+// AllPeerWantlists returns the wants each connected peer was told about,
+// highest priority first, collected in one pass of the Run loop. If limit
+// is positive, only the limit highest priority wants of each peer are
+// returned, to bound the size of the result. It is meant for debugging.
+func (pm *WantManager) AllPeerWantlists(limit int) map[peer.ID][]wantlist.Entry {
+	out := make(map[peer.ID][]wantlist.Entry)
+	pm.runSync(func() {
+		for p, mq := range pm.peers {
+			es := mq.wl.SortedCopies()
+			if limit > 0 && len(es) > limit {
+				es = es[:limit]
+			}
+			out[p] = es
+		}
+	})
+	return out
+}
+
+func (mq *msgQueue) dump() PeerQueueDump {
+	d := PeerQueueDump{RefCount: mq.refcnt}
+	for _, e := range mq.wl.Entries() {
+		d.Wantlist = append(d.Wantlist, e.Cid)
+	}
+
+	mq.outlk.Lock()
+	defer mq.outlk.Unlock()
+	if mq.out != nil {
+		for _, e := range mq.out.Wantlist() {
+			d.Pending = append(d.Pending, e.Cid)
+		}
+	}
+	for _, e := range mq.seed {
+		d.Pending = append(d.Pending, e.Cid)
+	}
+	d.SenderOpen = mq.sender != nil
+	return d
+}
+
+// TotalPendingMessages returns the number of peers that have wantlist
+// changes waiting to be sent.
+func (pm *WantManager) TotalPendingMessages() int {
+	var n int
+	pm.runSync(func() {
+		for _, mq := range pm.peers {
+			if mq.pendingEntries() > 0 {
+				n++
+			}
+		}
+	})
+	return n
+}
+
+// TotalPendingEntries returns the number of wantlist entries waiting to be
+// sent, summed over all peers.
+func (pm *WantManager) TotalPendingEntries() int {
+	var n int
+	pm.runSync(func() {
+		for _, mq := range pm.peers {
+			n += mq.pendingEntries()
+		}
+	})
+	return n
+}
+
+// PeersSortedByPendingWork returns the connected peers ordered from the
+// least to the most bytes of wantlist entries waiting to be sent to them.
+// Peers with as much pending work are ordered by ID.
+func (pm *WantManager) PeersSortedByPendingWork() []peer.ID {
+	var peers []peer.ID
+	pm.runSync(func() {
+		peers = pm.peersByPendingWork()
+	})
+	return peers
+}
+
+func (pm *WantManager) peersByPendingWork() []peer.ID {
+	work := byPendingWork{pending: make(map[peer.ID]int)}
+	for p, mq := range pm.peers {
+		work.peers = append(work.peers, p)
+		work.pending[p] = mq.pendingBytes()
+	}
+	sort.Sort(work)
+	return work.peers
+}
+
+type byPendingWork struct {
+	peers   []peer.ID
+	pending map[peer.ID]int
+}
+
+func (w byPendingWork) Len() int      { return len(w.peers) }
+func (w byPendingWork) Swap(i, j int) { w.peers[i], w.peers[j] = w.peers[j], w.peers[i] }
+func (w byPendingWork) Less(i, j int) bool {
+	pi, pj := w.pending[w.peers[i]], w.pending[w.peers[j]]
+	if pi != pj {
+		return pi < pj
+	}
+	return w.peers[i] < w.peers[j]
+}
+
+// Rough sizes, in bytes, of what MemoryEstimate counts besides cids.
+const (
+	// an idle peer queue: its goroutine, channels, maps and wantlist
+	queueOverhead = 8192
+
+	// a want in a wantlist or queued message: the entry and its map slot
+	wantEntryOverhead = 128
+)
+
+// MemoryEstimate approximates how much memory, in bytes, the WantManager
+// holds for our wantlist and its peer queues: each queue's fixed cost, the
+// changes pending for the peer and the wants the peer was told about. It
+// goes by the sizes of the cids plus a fixed overhead per want, so it is
+// only good as a rough figure for budgeting, not as an exact account.
+func (pm *WantManager) MemoryEstimate() int64 {
+	var n int64
+	pm.runSync(func() {
+		n = wantlistBytes(pm.wl.Entries())
+		queue := func(mq *msgQueue) {
+			n += queueOverhead + wantlistBytes(mq.wl.Entries())
+			n += int64(mq.pendingBytes() + mq.pendingEntries()*wantEntryOverhead)
+		}
+		for _, mq := range pm.peers {
+			queue(mq)
+		}
+		for _, lq := range pm.lingering {
+			queue(lq.mq)
+		}
+		for _, mq := range pm.warm {
+			queue(mq)
+		}
+	})
+	return n
+}
+
+// wantlistBytes estimates the memory held by the entries of a wantlist.
+func wantlistBytes(entries []*wantlist.Entry) int64 {
+	var n int64
+	for _, e := range entries {
+		n += int64(len(e.Cid.Bytes()) + wantEntryOverhead)
+	}
+	return n
+}
+
+// pendingBytes estimates the size of the entries waiting to be sent by the
+// size of their cids.
+func (mq *msgQueue) pendingBytes() int {
+	mq.outlk.Lock()
+	defer mq.outlk.Unlock()
+	var n int
+	for _, e := range mq.seed {
+		n += len(e.Cid.Bytes())
+	}
+	if mq.out != nil {
+		for _, e := range mq.out.Wantlist() {
+			n += len(e.Cid.Bytes())
+		}
+	}
+	return n
+}
+
+func (mq *msgQueue) pendingEntries() int {
+	mq.outlk.Lock()
+	defer mq.outlk.Unlock()
+	n := len(mq.seed)
+	if mq.out != nil {
+		n += len(mq.out.Wantlist())
+	}
+	return n
+}
+
+// DiffPeerWantlist compares the wantlist a peer reported with the wants we
+// told it about. missing holds the wants we sent but the peer does not
+// list, extra the ones it lists but we never sent (or since cancelled).
+func (pm *WantManager) DiffPeerWantlist(p peer.ID, theirWants []*cid.Cid) (missing, extra []*cid.Cid) {
+	pm.runSync(func() {
+		missing, extra = pm.diffPeerWantlist(p, theirWants)
+	})
+	return missing, extra
+}
+
+// diffPeerWantlist is DiffPeerWantlist for use within the Run loop.
+func (pm *WantManager) diffPeerWantlist(p peer.ID, theirWants []*cid.Cid) (missing, extra []*cid.Cid) {
+	theirs := cid.NewSet()
+	for _, c := range theirWants {
+		theirs.Add(c)
+	}
+
+	ours := wantlist.NewThreadSafe()
+	if mq, ok := pm.peers[p]; ok {
+		ours = mq.wl
+	}
+
+	for _, e := range ours.Entries() {
+		if !theirs.Has(e.Cid) {
+			missing = append(missing, e.Cid)
+		}
+	}
+	for _, c := range theirs.Keys() {
+		if _, ok := ours.Contains(c); !ok {
+			extra = append(extra, c)
+		}
+	}
+	return missing, extra
+}
+
+// ReconcilePeer brings the wantlist p reports having from us, theirWants,
+// back in line with the wants we told it about, see DiffPeerWantlist. The two
+// drift apart when an update to p is lost. The wants p is missing are resent
+// and those it should no longer have are cancelled.
+func (pm *WantManager) ReconcilePeer(p peer.ID, theirWants []*cid.Cid) {
+	pm.runSync(func() {
+		mq, ok := pm.peers[p]
+		if !ok {
+			return
+		}
+
+		missing, extra := pm.diffPeerWantlist(p, theirWants)
+		var es []*bsmsg.Entry
+		for _, c := range missing {
+			e, _ := mq.wl.Contains(c)
+			es = append(es, &bsmsg.Entry{Entry: e})
+		}
+		for _, c := range extra {
+			es = append(es, &bsmsg.Entry{
+				Cancel: true,
+				Entry:  &wantlist.Entry{Cid: c, RefCnt: 1},
+			})
+		}
+		if len(es) == 0 {
+			return
+		}
+
+		log.Infof("wantlist of %s out of sync, sending %d corrections", p, len(es))
+		mq.addMessage(es)
+	})
+}
+
+// WantlistSnapshot is a frozen view of our wantlist. It does not change when
+// the wantlist does, and can be queried without going through the
+// WantManager.
+type WantlistSnapshot struct {
+	set     map[string]*wantlist.Entry
+	entries []*wantlist.Entry
+}
+
+// Len returns the number of wants in the snapshot.
+func (s *WantlistSnapshot) Len() int {
+	return len(s.entries)
+}
+
+// Contains returns whether c was wanted when the snapshot was taken.
+func (s *WantlistSnapshot) Contains(c *cid.Cid) bool {
+	_, ok := s.set[c.KeyString()]
+	return ok
+}
+
+// Entries returns the wants in the snapshot, highest priority first. The
+// entries are shared with the snapshot and must not be modified.
+func (s *WantlistSnapshot) Entries() []*wantlist.Entry {
+	return s.entries
+}
+
+// StreamWantlist writes our wantlist to w, highest priority first, as a
+// sequence of pb.Message_Wantlist_Entry messages, each preceded by its
+// length as a varint. This is the same framing used for whole messages on
+// the wire, so ggio.NewDelimitedReader reads the entries back one by one.
+//
+// The entries are collected in a single pass of the Run loop, so the stream
+// is a consistent view of the wantlist, and written once the loop is free
+// again.
+func (pm *WantManager) StreamWantlist(ctx context.Context, w io.Writer) error {
+	var entries []*wantlist.Entry
+	if !pm.runSync(func() { entries = pm.wl.SortedEntries() }) {
+		return pm.runCtx().Err()
+	}
+
+	pbw := ggio.NewDelimitedWriter(w)
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		pe := &pb.Message_Wantlist_Entry{
+			Block:    proto.String(e.Cid.KeyString()),
+			Priority: proto.Int32(int32(e.Priority)),
+		}
+		if e.Flags != 0 {
+			pe.Flags = proto.Uint32(uint32(e.Flags))
+		}
+		if err := pbw.WriteMsg(pe); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Snapshot returns a point in time view of our wantlist. Snapshots are
+// reused until the wantlist changes, so taking one is cheap when nothing
+// changed since the last.
+func (pm *WantManager) Snapshot() *WantlistSnapshot {
+	var snap *WantlistSnapshot
+	pm.runSync(func() {
+		if pm.snapshot == nil {
+			pm.snapshot = newWantlistSnapshot(pm.wl.SortedEntries())
+		}
+		snap = pm.snapshot
+	})
+	if snap == nil {
+		return newWantlistSnapshot(nil)
+	}
+	return snap
+}
+
+func newWantlistSnapshot(entries []*wantlist.Entry) *WantlistSnapshot {
+	s := &WantlistSnapshot{
+		set:     make(map[string]*wantlist.Entry, len(entries)),
+		entries: make([]*wantlist.Entry, 0, len(entries)),
+	}
+	for _, e := range entries {
+		// entries are copied, as the wantlist updates them in place
+		cp := *e
+		s.set[cp.Cid.KeyString()] = &cp
+		s.entries = append(s.entries, &cp)
+	}
+	return s
+}
+
+// PeerSendLatency returns the recent average time it took to send a message
+// to p, or zero if nothing was sent to p yet.
+func (pm *WantManager) PeerSendLatency(p peer.ID) time.Duration {
+	var latency time.Duration
+	pm.runSync(func() {
+		mq, ok := pm.peers[p]
+		if !ok {
+			return
+		}
+		mq.outlk.Lock()
+		latency = mq.latency
+		mq.outlk.Unlock()
+	})
+	return latency
+}
+
+// SizeStats sums up the sizes, in bytes, of the messages sent to a peer.
+type SizeStats struct {
+	Count int
+	Mean  float64
+	Max   int
+}
+
+// PeerSendSizeStats returns how many wantlist messages were sent to p since
+// it connected and how large they were, as encoded with the default
+// encoding. Many small messages hint that changes for p are poorly batched.
+func (pm *WantManager) PeerSendSizeStats(p peer.ID) SizeStats {
+	var stats SizeStats
+	pm.runSync(func() {
+		mq, ok := pm.peers[p]
+		if !ok {
+			return
+		}
+		mq.outlk.Lock()
+		defer mq.outlk.Unlock()
+		stats.Count = mq.msgsSent
+		stats.Max = mq.maxSentSize
+		if mq.msgsSent > 0 {
+			stats.Mean = float64(mq.bytesSent) / float64(mq.msgsSent)
+		}
+	})
+	return stats
+}
+
+// PeerWantBalance returns how many wants and cancels were queued for p
+// since it connected, the wantlist it was seeded with included. With
+// everything cancelled, a peer that keeps sending us blocks while the two
+// are far apart likely misses our cancels.
+func (pm *WantManager) PeerWantBalance(p peer.ID) (wants, cancels int) {
+	pm.runSync(func() {
+		mq, ok := pm.peers[p]
+		if !ok {
+			return
+		}
+		mq.outlk.Lock()
+		defer mq.outlk.Unlock()
+		wants, cancels = mq.wantsQueued, mq.cancelsQueued
+	})
+	return wants, cancels
+}
+
+// WantlistVersion returns the version of our wantlist, bumped with every
+// change to it.
+func (pm *WantManager) WantlistVersion() uint64 {
+	var version uint64
+	pm.runSync(func() {
+		version = pm.version
+	})
+	return version
+}
+
+// PeerWantlistVersion returns the version of our wantlist that the last
+// message sent to p, not just queued for it, brought p up to. How far it
+// is behind WantlistVersion shows how slow, or stuck, sending to p is.
+// Changes that are not sent to p, like wants targeted at other peers, also
+// leave it behind until a later message catches it up.
+func (pm *WantManager) PeerWantlistVersion(p peer.ID) uint64 {
+	var version uint64
+	pm.runSync(func() {
+		mq, ok := pm.peers[p]
+		if !ok {
+			return
+		}
+		mq.outlk.Lock()
+		defer mq.outlk.Unlock()
+		version = mq.sentVersion
+	})
+	return version
+}
+
+var errUnknownPeer = errors.New("not connected to peer")
+
+// DrainPeer sends whatever is queued for p right away, and waits until it
+// went out or ctx expires.
+func (pm *WantManager) DrainPeer(ctx context.Context, p peer.ID) error {
+	var mq *msgQueue
+	pm.runSync(func() {
+		mq = pm.peers[p]
+	})
+	if mq == nil {
+		return errUnknownPeer
+	}
+
+	drained := make(chan struct{})
+	mq.outlk.Lock()
+	if mq.parked {
+		// only idle queues are parked
+		mq.outlk.Unlock()
+		return nil
+	}
+	mq.drained = append(mq.drained, drained)
+	mq.outlk.Unlock()
+	mq.signalWork()
+
+	select {
+	case <-drained:
+		return nil
+	case <-mq.done:
+		return errQueueStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// PeerBytesSent returns the size of the wantlist messages sent to p, as
+// encoded with the default encoding, since it connected. Blocks are not
+// sent through the queue of p and are not counted.
+func (pm *WantManager) PeerBytesSent(p peer.ID) uint64 {
+	var mq *msgQueue
+	pm.runSync(func() {
+		mq = pm.peers[p]
+	})
+	if mq == nil {
+		return 0
+	}
+	mq.outlk.Lock()
+	defer mq.outlk.Unlock()
+	return mq.bytesSent
+}
+
+// ResendFullWantlist replaces whatever is queued for p with our full
+// wantlist, like a rebroadcast limited to p, e.g. when p is suspected to be
+// out of sync. It returns an error if p is not connected.
+func (pm *WantManager) ResendFullWantlist(p peer.ID) error {
+	err := errUnknownPeer
+	pm.runSync(func() {
+		if _, ok := pm.peers[p]; ok {
+			pm.resendTo(p)
+			err = nil
+		}
+	})
+	return err
+}
+
+// PauseAll stops every peer queue from sending until ResumeAll is called.
+// Sends already under way complete. Wantlist changes keep being queued and
+// are merged as usual, rebroadcasts are skipped. DrainPeer and similar
+// calls wait for the pause to end.
+func (pm *WantManager) PauseAll() {
+	atomic.StoreInt32(&pm.paused, 1)
+}
+
+// ResumeAll lets the peer queues send again after PauseAll, flushing the
+// changes queued meanwhile.
+func (pm *WantManager) ResumeAll() {
+	if atomic.SwapInt32(&pm.paused, 0) == 0 {
+		return
+	}
+	pm.runSync(func() {
+		for _, mq := range pm.peers {
+			mq.signalWork()
+		}
+		for _, lq := range pm.lingering {
+			lq.mq.signalWork()
+		}
+		if pm.mirror != nil {
+			pm.mirror.signalWork()
+		}
+	})
+}
+
+// sendsPaused returns whether PauseAll is in effect.
+func (pm *WantManager) sendsPaused() bool {
+	return atomic.LoadInt32(&pm.paused) != 0
+}
+
+// WantReach returns how many connected peers we have told about c.
+func (pm *WantManager) WantReach(c *cid.Cid) int {
+	var reach int
+	pm.runSync(func() {
+		for _, mq := range pm.peers {
+			if _, ok := mq.wl.Contains(c); ok {
+				reach++
+			}
+		}
+	})
+	return reach
+}
+
+// priorityBuckets is how many priority values PriorityHistogram reports
+// before it groups them into ranges.
+const priorityBuckets = 16
+
+// PriorityHistogram returns how many entries of our wantlist are at each
+// priority. If the priorities span more than priorityBuckets values, they
+// are grouped into priorityBuckets ranges of equal width instead, each
+// keyed by the lowest priority it covers.
+func (pm *WantManager) PriorityHistogram() map[int]int {
+	hist := make(map[int]int)
+	pm.runSync(func() {
+		entries := pm.wl.Entries()
+		if len(entries) == 0 {
+			return
+		}
+
+		min, max := int64(entries[0].Priority), int64(entries[0].Priority)
+		for _, e := range entries {
+			if p := int64(e.Priority); p < min {
+				min = p
+			} else if p > max {
+				max = p
+			}
+		}
+
+		width := int64(1)
+		if max-min >= priorityBuckets {
+			width = (max-min)/priorityBuckets + 1
+		}
+		for _, e := range entries {
+			off := (int64(e.Priority) - min) / width * width
+			hist[int(min+off)]++
+		}
+	})
+	return hist
+}
+
+// SendAttempts returns how many times the want for c was queued to be sent
+// to a peer, counting every peer and every resend. Wants that were sent many
+// times without the block turning up are likely unfindable. It returns 0
+// if c is not in our wantlist.
+func (pm *WantManager) SendAttempts(c *cid.Cid) int {
+	var n int
+	pm.runSync(func() {
+		n = pm.sendAttempts[c.KeyString()]
+	})
+	return n
+}
+
+// countSendAttempt records that the want for c was queued for a peer.
+func (pm *WantManager) countSendAttempt(c *cid.Cid) {
+	if _, ok := pm.wl.Contains(c); ok {
+		pm.sendAttempts[c.KeyString()]++
+	}
+}
+
+// WantDiag is what WantDiagnostic found out about a want.
+type WantDiag struct {
+	// Wanted is false, and the rest left zero, if the cid is not in our
+	// wantlist
+	Wanted   bool
+	Priority int
+
+	// how many peers the want is queued for, see WantReach, and how many
+	// times it was queued, see SendAttempts
+	Reach        int
+	SendAttempts int
+
+	// how long the want has been in our wantlist
+	Age time.Duration
+
+	// whether the last send to one of the peers the want is queued for
+	// failed
+	SendFailed bool
+}
+
+// WantDiagnostic gathers what is known about the want for c in one go, to
+// tell why it was not satisfied yet.
+func (pm *WantManager) WantDiagnostic(c *cid.Cid) WantDiag {
+	var diag WantDiag
+	pm.runSync(func() {
+		e, ok := pm.wl.Contains(c)
+		if !ok {
+			return
+		}
+		diag.Wanted = true
+		diag.Priority = e.Priority
+		diag.SendAttempts = pm.sendAttempts[c.KeyString()]
+		if added, ok := pm.wantAdded[c.KeyString()]; ok {
+			diag.Age = time.Since(added)
+		}
+		for _, mq := range pm.peers {
+			if _, ok := mq.wl.Contains(c); !ok {
+				continue
+			}
+			diag.Reach++
+			mq.outlk.Lock()
+			if mq.sendErrors > 0 {
+				diag.SendFailed = true
+			}
+			mq.outlk.Unlock()
+		}
+	})
+	return diag
+}
+
+// OldestPendingWant returns the want that has been in our wantlist the
+// longest, and for how long. It returns nil if the wantlist is empty.
+func (pm *WantManager) OldestPendingWant() (*cid.Cid, time.Duration) {
+	var oldest *cid.Cid
+	var since time.Time
+	pm.runSync(func() {
+		for _, e := range pm.wl.Entries() {
+			added, ok := pm.wantAdded[e.Cid.KeyString()]
+			if ok && (oldest == nil || added.Before(since)) {
+				oldest, since = e.Cid, added
+			}
+		}
+	})
+	if oldest == nil {
+		return nil, 0
+	}
+	return oldest, time.Since(since)
+}
+
+// outcomeSamples is how many of the wants to last leave our wantlist
+// SatisfactionRate looks at.
+const outcomeSamples = 1024
+
+// wantOutcome is how a want left our wantlist: satisfied by a received
+// block after latency, or abandoned by a cancel.
+type wantOutcome struct {
+	satisfied bool
+	latency   time.Duration
+}
+
+// SatisfactionRate returns the fraction of the wants to last leave our
+// wantlist whose block was received within window of adding them. Wants
+// cancelled without their block, or satisfied later than window, count
+// against it. It returns 0 if no want left the wantlist yet.
+func (pm *WantManager) SatisfactionRate(window time.Duration) float64 {
+	var met, total int
+	pm.runSync(func() {
+		for _, o := range pm.outcomes {
+			if o.satisfied && o.latency <= window {
+				met++
+			}
+		}
+		total = len(pm.outcomes)
+	})
+	if total == 0 {
+		return 0
+	}
+	return float64(met) / float64(total)
+}
+
+// recordOutcome remembers how a want left our wantlist, dropping the
+// oldest outcome once there are outcomeSamples.
+func (pm *WantManager) recordOutcome(o wantOutcome) {
+	if len(pm.outcomes) < outcomeSamples {
+		pm.outcomes = append(pm.outcomes, o)
+		return
+	}
+	pm.outcomes[pm.outcomeNext] = o
+	pm.outcomeNext = (pm.outcomeNext + 1) % outcomeSamples
+}
+
+func (pm *WantManager) updateRefcntGauge() {
+	max := 0
+	for _, mq := range pm.peers {
+		if mq.refcnt > max {
+			max = mq.refcnt
+		}
+	}
+	pm.refcntGauge.Set(float64(max))
+}
+
+// runSync runs f inside the Run loop and waits for it to return. It returns
+// false if the WantManager shut down before f could run.
+func (pm *WantManager) runSync(f func()) bool {
+	done := make(chan struct{})
+	req := func() {
+		defer close(done)
+		f()
+	}
+
+	select {
+	case pm.runReqs <- req:
+	case <-pm.runCtx().Done():
+		return false
+	}
+	<-done
+	return true
+}
+
+func (pm *WantManager) SendBlock(ctx context.Context, env *engine.Envelope) {
+	pm.SendBlockErr(ctx, env)
+}
+
+// SendBlockErr is like SendBlock, but returns the error, if any, that
+// occurred while sending the block. env.Sent is called either way, unless
+// WithStrictSendAccounting is set.
+func (pm *WantManager) SendBlockErr(ctx context.Context, env *engine.Envelope) error {
+	return pm.SendBlockWithPriority(ctx, env, defaultBlockPriority)
+}
+
+// defaultBlockPriority is the priority of the blocks sent with SendBlock.
+const defaultBlockPriority = 0
+
+// SendBlockWithPriority is like SendBlockErr, but blocks waiting to be sent
+// to the same peer go in order of priority, the highest first, instead of
+// in the order they came in. Blocks of the same priority are sent to a peer
+// side by side, a block only waits while blocks of another priority are
+// sent to the peer or wait for it.
+func (pm *WantManager) SendBlockWithPriority(ctx context.Context, env *engine.Envelope, priority int) error {
+	msg := bsmsg.New(false)
+	msg.AddBlock(env.Block)
+	return pm.sendBlockMessage(ctx, env, priority, msg)
+}
+
+// sendBlockMessage sends msg, holding env.Block, like SendBlockWithPriority
+// sends env.
+func (pm *WantManager) sendBlockMessage(ctx context.Context, env *engine.Envelope, priority int, msg bsmsg.BitSwapMessage) (err error) {
+	// Blocks need to be sent synchronously to maintain proper backpressure
+	// throughout the network stack
+	defer func() { pm.envelopeDone(env, err) }()
+
+	ctx, aborted, done := pm.trackBlockSend(ctx, env.Peer, env.Block.Cid())
+	defer done()
+
+	if err := pm.waitSendGate(ctx, env); err != nil {
+		log.Infof("gave up waiting to send block %s to %s: %s", env.Block, env.Peer, err)
+		return err
+	}
+
+	if pm.blockSlots != nil {
+		select {
+		case pm.blockSlots <- struct{}{}:
+			defer func() { <-pm.blockSlots }()
+		case <-ctx.Done():
+			log.Infof("gave up waiting to send block %s to %s: %s", env.Block, env.Peer, ctx.Err())
+			return ctx.Err()
+		}
+	}
+
+	if err := pm.waitBlockTurn(ctx, env.Peer, priority); err != nil {
+		log.Infof("gave up waiting to send block %s to %s: %s", env.Block, env.Peer, err)
+		return err
+	}
+	defer pm.passBlockTurn(env.Peer)
+
+	pm.recordSent(len(env.Block.RawData()))
+
+	log.Infof("Sending block %s to %s", env.Block, env.Peer)
+	err = pm.network.SendMessage(ctx, env.Peer, msg)
+	if err != nil && aborted() {
+		log.Infof("aborted sending block %s to %s", env.Block, env.Peer)
+	} else if err != nil {
+		log.Infof("sendblock error: %s", err)
+		pm.recordSendError()
+	}
+	return err
+}
+
+// maxAsyncBlocks is how many blocks SendBlockAsync may have in flight to a
+// peer at once.
+const maxAsyncBlocks = 16
+
+// SendBlockAsync sends env like SendBlockErr does, but in the background,
+// calling done with the result once the block was sent or given up on. Once
+// maxAsyncBlocks are in flight to env.Peer, SendBlockAsync blocks until one
+// of them is done; if ctx ends meanwhile, done is called with its error and
+// the block is not sent.
+func (pm *WantManager) SendBlockAsync(ctx context.Context, env *engine.Envelope, done func(error)) {
+	if err := pm.takeAsyncSlot(ctx, env.Peer); err != nil {
+		log.Infof("gave up waiting to send block %s to %s: %s", env.Block, env.Peer, err)
+		pm.envelopeDone(env, err)
+		done(err)
+		return
+	}
+
+	go func() {
+		err := pm.SendBlockErr(ctx, env)
+		pm.releaseAsyncSlot(env.Peer)
+		done(err)
+	}()
+}
+
+// takeAsyncSlot waits until fewer than maxAsyncBlocks blocks are sent to p
+// by SendBlockAsync, and counts one more.
+func (pm *WantManager) takeAsyncSlot(ctx context.Context, p peer.ID) error {
+	for {
+		pm.blockLk.Lock()
+		if pm.asyncBlocks == nil {
+			pm.asyncBlocks = make(map[peer.ID]int)
+			pm.asyncFreed = make(chan struct{})
+		}
+		if pm.asyncBlocks[p] < maxAsyncBlocks {
+			pm.asyncBlocks[p]++
+			pm.blockLk.Unlock()
+			return nil
+		}
+		freed := pm.asyncFreed
+		pm.blockLk.Unlock()
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// releaseAsyncSlot counts a block sent to p by SendBlockAsync as done.
+func (pm *WantManager) releaseAsyncSlot(p peer.ID) {
+	pm.blockLk.Lock()
+	defer pm.blockLk.Unlock()
+	pm.asyncBlocks[p]--
+	if pm.asyncBlocks[p] == 0 {
+		delete(pm.asyncBlocks, p)
+	}
+	close(pm.asyncFreed)
+	pm.asyncFreed = make(chan struct{})
+}
+
+// envelopeDone tells the engine env was handled. With strict send
+// accounting, env.Failed is called instead of env.Sent if sending failed.
+func (pm *WantManager) envelopeDone(env *engine.Envelope, err error) {
+	if err != nil && pm.strictSendAccounting && env.Failed != nil {
+		env.Failed()
+		return
+	}
+	env.Sent()
+}
+
+// blockSend identifies the sending of a block to a peer.
+type blockSend struct {
+	p peer.ID
+	k string
+}
+
+type blockAbort struct {
+	cancel  context.CancelFunc
+	aborted bool
+}
+
+// trackBlockSend records that the block c is being sent to p, so that
+// PeerCancelled can abort it. It returns the context to send with, a
+// function telling whether the send was aborted, and one to call once the
+// send is over.
+func (pm *WantManager) trackBlockSend(ctx context.Context, p peer.ID, c *cid.Cid) (context.Context, func() bool, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	key := blockSend{p: p, k: c.KeyString()}
+	ba := &blockAbort{cancel: cancel}
+
+	pm.blockLk.Lock()
+	if pm.blockSends == nil {
+		pm.blockSends = make(map[blockSend][]*blockAbort)
+	}
+	pm.blockSends[key] = append(pm.blockSends[key], ba)
+	pm.blockLk.Unlock()
+
+	aborted := func() bool {
+		pm.blockLk.Lock()
+		defer pm.blockLk.Unlock()
+		return ba.aborted
+	}
+	done := func() {
+		pm.blockLk.Lock()
+		sends := pm.blockSends[key]
+		for i, other := range sends {
+			if other == ba {
+				sends = append(sends[:i], sends[i+1:]...)
+				break
+			}
+		}
+		if len(sends) == 0 {
+			delete(pm.blockSends, key)
+		} else {
+			pm.blockSends[key] = sends
+		}
+		pm.blockLk.Unlock()
+		cancel()
+	}
+	return ctx, aborted, done
+}
+
+// blockLine holds the blocks waiting to be sent to a peer while blocks of
+// another priority are sent to it. sending blocks of priority are under way.
+type blockLine struct {
+	priority int
+	sending  int
+	waiting  []*blockTurn
+}
+
+type blockTurn struct {
+	priority int
+	ready    chan struct{}
+}
+
+// waitBlockTurn waits until the blocks sent to p have the given priority
+// and none wait before it. Once it returns nil, passBlockTurn must be called
+// after the block was sent.
+func (pm *WantManager) waitBlockTurn(ctx context.Context, p peer.ID, priority int) error {
+	pm.blockLk.Lock()
+	if pm.blockLines == nil {
+		pm.blockLines = make(map[peer.ID]*blockLine)
+	}
+	line, busy := pm.blockLines[p]
+	if !busy {
+		pm.blockLines[p] = &blockLine{priority: priority, sending: 1}
+		pm.blockLk.Unlock()
+		return nil
+	}
+	if line.priority == priority && len(line.waiting) == 0 {
+		line.sending++
+		pm.blockLk.Unlock()
+		return nil
+	}
+	turn := &blockTurn{priority: priority, ready: make(chan struct{})}
+	line.waiting = append(line.waiting, turn)
+	pm.blockLk.Unlock()
+
+	select {
+	case <-turn.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	pm.blockLk.Lock()
+	for i, other := range line.waiting {
+		if other == turn {
+			line.waiting = append(line.waiting[:i], line.waiting[i+1:]...)
+			pm.blockLk.Unlock()
+			return ctx.Err()
+		}
+	}
+	pm.blockLk.Unlock()
+
+	// it was our turn already, hand it on
+	pm.passBlockTurn(p)
+	return ctx.Err()
+}
+
+// passBlockTurn counts a block sent to p as done. Once none are under way,
+// the waiting blocks with the highest priority are let through together.
+func (pm *WantManager) passBlockTurn(p peer.ID) {
+	pm.blockLk.Lock()
+	defer pm.blockLk.Unlock()
+	line := pm.blockLines[p]
+	if line.sending--; line.sending > 0 {
+		return
+	}
+	if len(line.waiting) == 0 {
+		delete(pm.blockLines, p)
+		return
+	}
+
+	line.priority = line.waiting[0].priority
+	for _, turn := range line.waiting {
+		if turn.priority > line.priority {
+			line.priority = turn.priority
+		}
+	}
+	var rest []*blockTurn
+	for _, turn := range line.waiting {
+		if turn.priority != line.priority {
+			rest = append(rest, turn)
+			continue
+		}
+		line.sending++
+		close(turn.ready)
+	}
+	line.waiting = rest
+}
+
+// PeerCancelled is told that peer p cancelled its wants for ks. Blocks
+// among ks still being sent to p by SendBlock are aborted.
+func (pm *WantManager) PeerCancelled(p peer.ID, ks []*cid.Cid) {
+	pm.blockLk.Lock()
+	defer pm.blockLk.Unlock()
+	for _, c := range ks {
+		for _, ba := range pm.blockSends[blockSend{p: p, k: c.KeyString()}] {
+			ba.aborted = true
+			ba.cancel()
+		}
+	}
+}
+
+// PeerWantlistReceived is told about the wantlist changes in msg, received
+// from p, to keep track of what peers want for NetworkDemand.
+func (pm *WantManager) PeerWantlistReceived(p peer.ID, msg bsmsg.BitSwapMessage) {
+	entries := msg.Wantlist()
+	if len(entries) == 0 && !msg.Full() {
+		return
+	}
+
+	pm.demandLk.Lock()
+	defer pm.demandLk.Unlock()
+	wants, ok := pm.peerWants[p]
+	if !ok || msg.Full() {
+		wants = make(map[string]*cid.Cid)
+		pm.peerWants[p] = wants
+	}
+	for _, e := range entries {
+		if e.Cancel {
+			delete(wants, e.Cid.KeyString())
+		} else {
+			wants[e.Cid.KeyString()] = e.Cid
+		}
+	}
+	if len(wants) == 0 {
+		delete(pm.peerWants, p)
+	}
+}
+
+// NetworkDemand returns, for every cid wanted by us or by a connected peer,
+// how many of these parties want it. Peers are counted from the wantlists
+// they sent us, see PeerWantlistReceived, so the counts are approximate and
+// only meant as a hint, e.g. to favour popular blocks. The wantlists of
+// peers that are not connected are forgotten.
+func (pm *WantManager) NetworkDemand() map[*cid.Cid]int {
+	demand := make(map[*cid.Cid]int)
+	pm.runSync(func() {
+		byKey := make(map[string]*cid.Cid)
+		count := func(c *cid.Cid) {
+			k := c.KeyString()
+			if known, ok := byKey[k]; ok {
+				demand[known]++
+				return
+			}
+			byKey[k] = c
+			demand[c] = 1
+		}
+
+		for _, e := range pm.wl.Entries() {
+			count(e.Cid)
+		}
+		pm.demandLk.Lock()
+		defer pm.demandLk.Unlock()
+		for p, wants := range pm.peerWants {
+			if _, ok := pm.peers[p]; !ok {
+				// sent before the peer connected or after it left
+				delete(pm.peerWants, p)
+				continue
+			}
+			for _, c := range wants {
+				count(c)
+			}
+		}
+	})
+	return demand
+}
+
+// forgetPeerWants drops what p told us it wants, once it is gone.
+func (pm *WantManager) forgetPeerWants(p peer.ID) {
+	pm.demandLk.Lock()
+	defer pm.demandLk.Unlock()
+	delete(pm.peerWants, p)
+}
+
+// sendGateRetry is how often a block held back by the send gate is offered
+// to it again.
+var sendGateRetry = delay.Fixed(100 * time.Millisecond)
+
+// waitSendGate blocks until the send gate, if any, allows env to be sent.
+func (pm *WantManager) waitSendGate(ctx context.Context, env *engine.Envelope) error {
+	if pm.sendGate == nil {
+		return nil
+	}
+	for !pm.sendGate.Allow(env) {
+		select {
+		case <-time.After(sendGateRetry.Get()):
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-pm.runCtx().Done():
+			return pm.runCtx().Err()
+		}
+	}
+	return nil
+}
+
+// SendBlockToPeers sends blk to every peer in peers, once to each. The
+// message is built once and sent to all peers concurrently, each send
+// going the way of SendBlock's. Like SendBlock, it blocks until every send
+// completed or was given up on to maintain backpressure. It returns the
+// error of each peer the block could not be sent to, nil if it was sent to
+// all of them.
+func (pm *WantManager) SendBlockToPeers(ctx context.Context, blk blocks.Block, peers []peer.ID) map[peer.ID]error {
+	msg := bsmsg.New(false)
+	msg.AddBlock(blk)
+
+	var lk sync.Mutex
+	var errs map[peer.ID]error
+	var wg sync.WaitGroup
+	seen := make(map[peer.ID]bool, len(peers))
+	for _, p := range peers {
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer wg.Done()
+			env := &engine.Envelope{Peer: p, Block: blk, Sent: func() {}}
+			err := pm.sendBlockMessage(ctx, env, defaultBlockPriority, msg)
+			if err == nil {
+				return
+			}
+			lk.Lock()
+			defer lk.Unlock()
+			if errs == nil {
+				errs = make(map[peer.ID]error)
+			}
+			errs[p] = err
+		}(p)
+	}
+	wg.Wait()
+	return errs
+}
+
+func (pm *WantManager) startPeerHandler(p peer.ID) *msgQueue {
+	return pm.startPeerWith(p, pm.seedEntries)
+}
+
+// startPeerWith is startPeerHandler getting what to seed a new queue with
+// from seed, which returns entries like seedEntries does.
+func (pm *WantManager) startPeerWith(p peer.ID, seed func() []*wantlist.Entry) *msgQueue {
+	mq, ok := pm.peers[p]
+	if ok {
+		mq.refcnt++
+		return nil
+	}
+
+	if lq, ok := pm.lingering[p]; ok {
+		delete(pm.lingering, p)
+		lq.mq.refcnt = 1
+		pm.peers[p] = lq.mq
+		if pm.rebroadcastMode == RebroadcastOnReconnectOnly {
+			pm.resendTo(p)
+		} else {
+			pm.catchUp(lq.mq)
+		}
+		return lq.mq
+	}
+
+	mq, warm := pm.warm[p]
+	if warm {
+		delete(pm.warm, p)
+	} else {
+		mq = pm.newMsgQueue(p)
+	}
+
+	entries := seed()
+	for _, e := range entries {
+		mq.wl.AddEntry(&wantlist.Entry{Cid: e.Cid, Priority: e.Priority, Flags: e.Flags, RefCnt: 1})
+	}
+	if pm.recentlySeeded(p) {
+		log.Debugf("not resending unchanged wantlist to %s", p)
+		delete(pm.pending, p)
+	} else {
+		pm.seedQueue(mq, entries)
+	}
+
+	pm.peers[p] = mq
+	mq.setTier(pm.peerTiers[p])
+	if !warm || mq.wake() {
+		pm.startQueue(mq)
+	}
+	if d, ok := pm.peerRebroadcast[p]; ok {
+		mq.rebroadcastDue = time.Now().Add(d)
+		pm.rebroadcastPeers()
+	}
+	return mq
+}
+
+// seedEntries returns the entries of our wantlist a newly connected peer is
+// seeded with, most important first.
+func (pm *WantManager) seedEntries() []*wantlist.Entry {
+	var entries []*wantlist.Entry
+	for _, e := range pm.wl.SortedEntries() {
+		if !pm.restricted(e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// seedQueue queues our full wantlist, entries, to a new peer. Large
+// wantlists are sent in chunks, most important entries first, so the peer
+// can start working on them right away.
+func (pm *WantManager) seedQueue(mq *msgQueue, entries []*wantlist.Entry) {
+	if pm.reseedWindow > 0 {
+		pm.lastSeed[mq.p] = seedRecord{version: pm.version, at: time.Now()}
+	}
+
+	n := len(entries)
+	if pm.seedChunkSize > 0 && n > pm.seedChunkSize {
+		n = pm.seedChunkSize
+	}
+
+	fullwantlist := bsmsg.New(true)
+	for _, e := range entries[:n] {
+		fullwantlist.AddAnnotatedEntry(e.Cid, e.Priority, e.Flags)
+	}
+	for _, e := range entries {
+		pm.countSendAttempt(e.Cid)
+	}
+	mq.outlk.Lock()
+	mq.out = fullwantlist
+	mq.seed = entries[n:]
+	mq.seeding = true
+	mq.wantsQueued += len(entries)
+	mq.seedBytes = 0
+	mq.version = pm.version
+
+	// wants held back for the peer go out with the first message. They
+	// are already in our wantlist unless they were cancelled since.
+	for _, e := range pm.pending[mq.p] {
+		if _, ok := pm.wl.Contains(e.Cid); ok && !e.Cancel {
+			fullwantlist.AddAnnotatedEntry(e.Cid, e.Priority, e.Flags)
+			mq.removeSeed(e.Cid)
+		}
+	}
+	delete(pm.pending, mq.p)
+	mq.accountOut()
+	mq.outlk.Unlock()
+	mq.signalWork()
+}
+
+// reviveQueues restarts the peer queues whose runQueue returned while the
+// peer is still connected. Whatever the queue held is replaced by our full
+// wantlist.
+func (pm *WantManager) reviveQueues() {
+	for p, mq := range pm.peers {
+		mq.outlk.Lock()
+		// parked queues are started by the next change queued for them
+		exited := mq.exited && !mq.parked
+		mq.outlk.Unlock()
+		if !exited {
+			continue
+		}
+
+		log.Warningf("message queue for %s stopped, restarting it", p)
+		pm.restartQueue(mq)
+	}
+}
+
+// restartQueue starts mq again after it stopped, sending the peer our full
+// wantlist again.
+func (pm *WantManager) restartQueue(mq *msgQueue) {
+	mq.outlk.Lock()
+	mq.exited = false
+	mq.parked = false
+	mq.resetSenders()
+	mq.seed = nil
+	mq.outlk.Unlock()
+
+	// restricted wants are only sent to peers that were told about them
+	told := mq.wl
+	mq.replaceWantlist()
+	var entries []*wantlist.Entry
+	for _, e := range pm.wl.SortedEntries() {
+		if _, ok := told.Contains(e.Cid); ok || !pm.restricted(e) {
+			entries = append(entries, e)
+		}
+	}
+	for _, e := range entries {
+		mq.wl.AddEntry(&wantlist.Entry{Cid: e.Cid, Priority: e.Priority, Flags: e.Flags, RefCnt: 1})
+	}
+	pm.seedQueue(mq, entries)
+	pm.startQueue(mq)
+}
+
+// recentlySeeded returns whether p was sent our current wantlist within the
+// reseed window.
+func (pm *WantManager) recentlySeeded(p peer.ID) bool {
+	last, ok := pm.lastSeed[p]
+	if !ok {
+		return false
+	}
+	if last.version != pm.version || time.Since(last.at) >= pm.reseedWindow {
+		delete(pm.lastSeed, p)
+		return false
+	}
+	return true
+}
+
+// WarmPeer opens a message sender to p ahead of time, without sending it
+// anything, so that the first real send to p does not have to wait for the
+// peer to be found and dialed. The queue is handed over to p once it
+// connects.
+func (pm *WantManager) WarmPeer(p peer.ID) {
+	pm.runSync(func() {
+		if _, ok := pm.peers[p]; ok {
+			return
+		}
+		if _, ok := pm.warm[p]; ok {
+			return
+		}
+
+		mq := pm.newMsgQueue(p)
+		mq.refcnt = 0
+		pm.warm[p] = mq
+		pm.startQueue(mq)
+
+		// an empty queue only opens the sender
+		mq.signalWork()
+	})
+}
+
+// BoostPeer resends the wants we told p about with their priorities raised
+// by delta, so p moves them ahead of other peers' wants. Other peers are not
+// affected.
+func (pm *WantManager) BoostPeer(p peer.ID, delta int) {
+	pm.runSync(func() {
+		mq, ok := pm.peers[p]
+		if !ok {
+			return
+		}
+
+		var es []*bsmsg.Entry
+		for _, e := range mq.wl.Entries() {
+			prio := e.Priority + delta
+			if delta > 0 && prio < e.Priority || prio > kMaxPriority {
+				prio = kMaxPriority
+			}
+			es = append(es, &bsmsg.Entry{
+				Entry: &wantlist.Entry{Cid: e.Cid, Priority: prio, Flags: e.Flags, RefCnt: 1},
+			})
+			// dropped so the boosted priority is recorded below
+			mq.wl.Remove(e.Cid)
+		}
+		mq.addMessage(es)
+	})
+}
+
+// EffectivePriority returns the priority p was told for c, which differs
+// from that in our wantlist once p was boosted, and whether p was told
+// about c at all.
+func (pm *WantManager) EffectivePriority(p peer.ID, c *cid.Cid) (int, bool) {
+	var priority int
+	var ok bool
+	pm.runSync(func() {
+		mq, connected := pm.peers[p]
+		if !connected {
+			return
+		}
+		var e *wantlist.Entry
+		if e, ok = mq.wl.Contains(c); ok {
+			priority = e.Priority
+		}
+	})
+	return priority, ok
+}
+
+// CancelWantsForPeer stops asking p for ks, without touching our wantlist
+// or what other peers were told.
+func (pm *WantManager) CancelWantsForPeer(p peer.ID, ks []*cid.Cid) {
+	log.Infof("cancel wants: %s for %s", ks, p)
+	pm.runSync(func() {
+		mq, ok := pm.peers[p]
+		if !ok {
+			return
+		}
+
+		var es []*bsmsg.Entry
+		for _, e := range newEntries(ks, true) {
+			if _, ok := mq.wl.Contains(e.Cid); ok {
+				es = append(es, e)
+			}
+		}
+		if len(es) > 0 {
+			mq.addMessage(es)
+		}
+	})
+}
+
+// ResetAllPeers tears down the queues of all peers, closing their senders,
+// while keeping our wantlist. Peers are sent the full wantlist again when
+// they next connect. This is meant for when the network was reset and all
+// senders are stale.
+func (pm *WantManager) ResetAllPeers() {
+	pm.runSync(func() {
+		for p, mq := range pm.peers {
+			mq.shutdown()
+			delete(pm.peers, p)
+			pm.forgetDeparted(p)
+			pm.forgetPeerWants(p)
+		}
+		for p, mq := range pm.warm {
+			mq.shutdown()
+			delete(pm.warm, p)
+		}
+		for p, lq := range pm.lingering {
+			lq.mq.shutdown()
+			delete(pm.lingering, p)
+		}
+		pm.lastSeed = make(map[peer.ID]seedRecord, pm.expectedPeers)
+		pm.updatePeersGauge()
+	})
+}
+
+func (pm *WantManager) stopPeerHandler(p peer.ID) {
+	pq, ok := pm.peers[p]
+	if !ok {
+		if wq, ok := pm.warm[p]; ok {
+			wq.shutdown()
+			delete(pm.warm, p)
+		}
+		// TODO: log error?
+		pm.forgetDeparted(p)
+		pm.forgetPeerWants(p)
+		return
+	}
+
+	pq.refcnt--
+	if pq.refcnt > 0 {
+		// p is still connected, the queue must not take the notification
+		// for the connection that went away as p being gone
+		pm.forgetDeparted(p)
+		return
+	}
+
+	delete(pm.peers, p)
+	delete(pm.peerGroups, p)
+	delete(pm.peerTiers, p)
+	pm.forgetDeparted(p)
+	pm.forgetPeerWants(p)
+	if pm.linger > 0 {
+		pm.lingering[p] = &lingeringQueue{mq: pq, due: time.Now().Add(pm.linger)}
+		if pm.lingerTimer == nil {
+			pm.lingerTimer = time.After(pm.linger)
+		}
+		return
+	}
+	pm.teardown(pq)
+}
+
+// teardown shuts down the queue of a peer that is gone and makes sure the
+// wants it held are not lost.
+func (pm *WantManager) teardown(pq *msgQueue) {
+	if pm.teardownGrace > 0 {
+		pq.settle(pm.teardownGrace)
+	}
+	stranded := pq.shutdown()
+
+	if pm.requeueOnDisconnect {
+		pm.requeue(pq)
+		return
+	}
+
+	// wants that never made it out to p go to the peers that have not
+	// heard of them, so they are not lost with the queue
+	var es []*bsmsg.Entry
+	for _, e := range stranded {
+		if _, ok := pm.wl.Contains(e.Cid); ok && !e.Cancel {
+			es = append(es, e)
+		}
+	}
+	pm.resendMissing(es)
+}
+
+// lingeringQueue is the queue of a disconnected peer, kept until due.
+type lingeringQueue struct {
+	mq  *msgQueue
+	due time.Time
+}
+
+// expireLingering tears down the lingering queues that are due.
+func (pm *WantManager) expireLingering() {
+	pm.lingerTimer = nil
+	now := time.Now()
+	var next time.Time
+	for p, lq := range pm.lingering {
+		if lq.due.After(now) {
+			if next.IsZero() || lq.due.Before(next) {
+				next = lq.due
+			}
+			continue
+		}
+
+		delete(pm.lingering, p)
+		pm.teardown(lq.mq)
+	}
+	if !next.IsZero() {
+		pm.lingerTimer = time.After(next.Sub(now))
+	}
+}
+
+// catchUp tells a queue that lingered while its peer was disconnected about
+// the wantlist changes it missed. Like a new peer, it is not told about
+// restricted wants.
+func (pm *WantManager) catchUp(mq *msgQueue) {
+	var es []*bsmsg.Entry
+	for _, e := range mq.wl.Entries() {
+		if _, ok := pm.wl.Contains(e.Cid); !ok {
+			es = append(es, &bsmsg.Entry{Entry: e, Cancel: true})
+		}
+	}
+	for _, e := range pm.wl.SortedEntries() {
+		if pm.restricted(e) {
+			continue
+		}
+		if _, ok := mq.wl.Contains(e.Cid); !ok {
+			es = append(es, &bsmsg.Entry{Entry: e})
+		}
+	}
+	if len(es) > 0 {
+		mq.addMessage(es)
+	}
+}
+
+// requeue sends the wants we had told a departed peer about to the remaining
+// peers that have not heard of them yet, instead of leaving them until the
+// next rebroadcast.
+func (pm *WantManager) requeue(gone *msgQueue) {
+	var es []*bsmsg.Entry
+	for _, e := range gone.wl.SortedEntries() {
+		if _, ok := pm.wl.Contains(e.Cid); ok {
+			es = append(es, &bsmsg.Entry{Entry: e})
+		}
+	}
+	pm.resendMissing(es)
+}
+
+// resendMissing sends each of es to the peers we have not told about it.
+func (pm *WantManager) resendMissing(es []*bsmsg.Entry) {
+	if len(es) == 0 {
+		return
+	}
+
+	for _, mq := range pm.peers {
+		var missing []*bsmsg.Entry
+		for _, e := range es {
+			if pm.restricted(e.Entry) {
+				continue
+			}
+			if _, ok := mq.wl.Contains(e.Cid); !ok {
+				missing = append(missing, e)
+			}
+		}
+		if len(missing) > 0 {
+			mq.addMessage(missing)
+		}
+	}
+}
+
+func (mq *msgQueue) runQueue(ctx context.Context) {
+	parked := false
+	defer func() {
+		if mq.recoverCrash {
+			if r := recover(); r != nil {
+				log.Errorf("message queue for %s crashed: %s", mq.p, r)
+			}
+		}
+		// a parked queue closed its senders already
+		if !parked {
+			mq.closeSenders()
+			mq.outlk.Lock()
+			mq.exited = true
+			mq.outlk.Unlock()
+		}
+		if mq.goroutines != nil {
+			atomic.AddInt32(mq.goroutines, -1)
+		}
+	}()
+	for {
+		var idle <-chan time.Time
+		var idleTimer *time.Timer
+		if mq.idleTimeout > 0 {
+			idleTimer = time.NewTimer(mq.idleTimeout)
+			idle = idleTimer.C
+		}
+
+		select {
+		case <-idle:
+			if parked = mq.park(); parked {
+				log.Debugf("parked idle message queue for %s", mq.p)
+				return
+			}
+		case <-mq.work: // there is work to be done
+			if mq.batching() && !mq.batch(ctx) {
+				return
+			}
+			mq.doWork(ctx)
+			mq.outlk.Lock()
+			mq.checkDrained()
+			mq.outlk.Unlock()
+		case <-mq.done:
+			return
+		case <-ctx.Done():
+			return
+		}
+		if idleTimer != nil {
+			idleTimer.Stop()
+		}
+	}
+}
+
+// idle returns whether the queue has nothing left to send. outlk must be
+// held.
+func (mq *msgQueue) idle() bool {
+	return !mq.closed && mq.out == nil && len(mq.seed) == 0 && len(mq.inflight) == 0 && len(mq.drained) == 0
+}
+
+// park closes the senders of the idle queue and marks it parked, for
+// runQueue to return. It returns false if the queue had work to do after
+// all.
+func (mq *msgQueue) park() bool {
+	mq.outlk.Lock()
+	idle := mq.idle()
+	mq.outlk.Unlock()
+	if !idle {
+		return false
+	}
+
+	mq.closeSenders()
+	mq.outlk.Lock()
+	defer mq.outlk.Unlock()
+	// senders are opened again as needed, should work have come in
+	// while they were closed
+	mq.resetSenders()
+	if !mq.idle() {
+		return false
+	}
+	mq.parked = true
+	mq.exited = true
+	return true
+}
+
+// wake clears parked, for the queue to be started again. It returns whether
+// the queue was parked.
+func (mq *msgQueue) wake() bool {
+	mq.outlk.Lock()
+	defer mq.outlk.Unlock()
+	if !mq.parked {
+		return false
+	}
+	mq.parked = false
+	mq.exited = false
+	return true
+}
+
+// resetSenders forgets the closed senders of the queue, for new ones to be
+// opened. outlk must be held.
+func (mq *msgQueue) resetSenders() {
+	mq.sender = nil
+	mq.stopped = false
+	if mq.slots != nil {
+		mq.slots = make(chan bsnet.MessageSender, cap(mq.slots))
+		for i := 0; i < cap(mq.slots); i++ {
+			mq.slots <- nil
+		}
+	}
+}
+
+// startQueue runs mq in a goroutine of its own, or on the shared workers
+// once maxQueueGoroutines queues have one. A queue that ran on the shared
+// workers before stays there.
+func (pm *WantManager) startQueue(mq *msgQueue) {
+	if mq.pool == nil && pm.pool != nil && atomic.LoadInt32(&pm.queueGoroutines) >= int32(pm.maxQueueGoroutines) {
+		mq.pool = pm.pool
+	}
+	if mq.pool != nil {
+		mq.signalWork()
+		return
+	}
+
+	if pm.pool != nil {
+		atomic.AddInt32(&pm.queueGoroutines, 1)
+		mq.goroutines = &pm.queueGoroutines
+	}
+	go mq.runQueue(pm.runCtx())
+}
+
+// queuePoolWorkers is how many goroutines run the queues that do not have
+// one of their own.
+const queuePoolWorkers = 4
+
+type poolState int
+
+const (
+	poolIdle poolState = iota
+	poolScheduled
+	poolRunning
+	// running, and to be run again once done
+	poolRerun
+)
+
+// queuePool runs queues on a few shared workers. A queue is never run by
+// two workers at once.
+type queuePool struct {
+	lk    sync.Mutex
+	ready []*msgQueue
+
+	// holds a token for as many workers as should look at ready
+	wake chan struct{}
+
+	// holds a token for each queue that waits in a goroutine of its own
+	// instead of on a worker
+	waiting chan struct{}
+}
+
+func newQueuePool() *queuePool {
+	return &queuePool{
+		wake:    make(chan struct{}, queuePoolWorkers),
+		waiting: make(chan struct{}, queuePoolWorkers),
+	}
+}
+
+// schedule has mq run by a worker.
+func (qp *queuePool) schedule(mq *msgQueue) {
+	qp.lk.Lock()
+	switch mq.poolState {
+	case poolIdle:
+		mq.poolState = poolScheduled
+		qp.ready = append(qp.ready, mq)
+	case poolRunning:
+		mq.poolState = poolRerun
+	}
+	qp.lk.Unlock()
+
+	select {
+	case qp.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the next queue to run, or nil if there is none.
+func (qp *queuePool) next() *msgQueue {
+	qp.lk.Lock()
+	defer qp.lk.Unlock()
+	if len(qp.ready) == 0 {
+		return nil
+	}
+	mq := qp.ready[0]
+	qp.ready[0] = nil
+	qp.ready = qp.ready[1:]
+	mq.poolState = poolRunning
+	return mq
+}
+
+// ran is called once a worker is done running mq.
+func (qp *queuePool) ran(mq *msgQueue) {
+	qp.lk.Lock()
+	defer qp.lk.Unlock()
+	if mq.poolState == poolRerun {
+		mq.poolState = poolScheduled
+		qp.ready = append(qp.ready, mq)
+		return
+	}
+	mq.poolState = poolIdle
+}
+
+// work runs the scheduled queues until ctx is done.
+func (qp *queuePool) work(ctx context.Context) {
+	for {
+		mq := qp.next()
+		if mq == nil {
+			select {
+			case <-qp.wake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if mq.pooledRunBlocks() {
+			select {
+			case qp.waiting <- struct{}{}:
+				go func(mq *msgQueue) {
+					mq.runPooled(ctx)
+					<-qp.waiting
+					qp.ran(mq)
+				}(mq)
+				continue
+			default:
+				// as many queues as allowed wait on their own already
+			}
+		}
+		mq.runPooled(ctx)
+		qp.ran(mq)
+	}
+}
+
+// pooledRunBlocks returns whether running the pooled queue may have to
+// wait, for a dial, a batch window or a send slot, instead of only sending.
+func (mq *msgQueue) pooledRunBlocks() bool {
+	mq.outlk.Lock()
+	wait := mq.sender == nil || mq.slots != nil
+	mq.outlk.Unlock()
+	return wait || mq.batching() && mq.batchDelay() > 0
+}
+
+// runPooled does the work queued for mq, like an iteration of runQueue
+// does. Once the queue is shut down, its senders are closed.
+func (mq *msgQueue) runPooled(ctx context.Context) {
+	defer func() {
+		if !mq.recoverCrash {
+			return
+		}
+		if r := recover(); r != nil {
+			log.Errorf("message queue for %s crashed: %s", mq.p, r)
+			mq.closeSenders()
+			mq.outlk.Lock()
+			mq.exited = true
+			mq.outlk.Unlock()
+		}
+	}()
+
+	select {
+	case <-mq.done:
+		mq.outlk.Lock()
+		exited := mq.exited
+		mq.exited = true
+		mq.outlk.Unlock()
+		if !exited {
+			mq.closeSenders()
+		}
+		return
+	case <-ctx.Done():
+		return
+	case <-mq.work:
+	default:
+		return
+	}
+
+	if mq.batching() && !mq.batch(ctx) {
+		return
+	}
+	mq.doWork(ctx)
+	mq.outlk.Lock()
+	mq.checkDrained()
+	mq.outlk.Unlock()
+}
+
+// maxCancelBatchDelay is the longest a cancel waits for other changes to be
+// batched with it.
+const maxCancelBatchDelay = 10 * time.Millisecond
+
+// batch waits for more changes to be queued before the next message is sent.
+// It returns false if the queue stopped meanwhile.
+func (mq *msgQueue) batch(ctx context.Context) bool {
+	start := time.Now()
+	for {
+		wait := mq.batchDelay() - time.Since(start)
+		if wait <= 0 {
+			return true
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+			return true
+		case <-mq.work:
+			// more changes were queued, they may include a cancel
+			timer.Stop()
+		case <-mq.done:
+			timer.Stop()
+			return false
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+// batchDelay returns how long the queued changes may be held back for.
+// Full wantlists and queues being drained are not held back.
+func (mq *msgQueue) batchDelay() time.Duration {
+	window := mq.batchWindow
+	if atomic.LoadInt32(&mq.lowPriority) != 0 && window < lowPriorityBatchWindow {
+		window = lowPriorityBatchWindow
+	}
+
+	mq.outlk.Lock()
+	defer mq.outlk.Unlock()
+	if mq.out == nil || mq.out.Full() || len(mq.drained) > 0 {
+		return 0
+	}
+	for _, e := range mq.out.Wantlist() {
+		if e.Cancel && window > maxCancelBatchDelay {
+			return maxCancelBatchDelay
+		}
+	}
+	return window
+}
+
+// batching returns whether changes are held back for more to be batched
+// with them.
+func (mq *msgQueue) batching() bool {
+	return mq.batchWindow > 0 || atomic.LoadInt32(&mq.lowPriority) != 0
+}
+
+// checkDrained wakes up the DrainPeer callers once nothing is left to send.
+// outlk must be held.
+func (mq *msgQueue) checkDrained() {
+	if len(mq.drained) == 0 || mq.out != nil || len(mq.seed) > 0 || len(mq.inflight) > 0 {
+		return
+	}
+	for _, ch := range mq.drained {
+		close(ch)
+	}
+	mq.drained = nil
+}
+
+func (mq *msgQueue) closeSenders() {
+	if mq.sender != nil {
+		mq.closeSender(mq.sender, SenderClosed)
+	}
+	if mq.slots == nil {
+		return
+	}
+
+	// senders still in use are closed when their message is done
+	mq.outlk.Lock()
+	mq.stopped = true
+	mq.outlk.Unlock()
+	for {
+		select {
+		case s := <-mq.slots:
+			if s != nil {
+				mq.closeSender(s, SenderClosed)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (mq *msgQueue) doWork(ctx context.Context) {
+	mq.working <- struct{}{}
+	defer func() { <-mq.working }()
+
+	if mq.quarantined() || atomic.LoadInt32(mq.paused) != 0 {
+		return
+	}
+
+	if mq.sender == nil && mq.slots == nil {
+		err := mq.openSender(ctx)
+		if err != nil {
+			log.Infof("cant open message sender to peer %s: %s", mq.p, err)
+			// TODO: cant connect, what now?
+			return
+		}
+	}
+
+	// grab outgoing message
+	mq.outlk.Lock()
+	wlm := mq.out
+	mq.out = nil
+	if wlm != nil && wlm.Full() && mq.caps != nil && mq.caps.NoFullWantlist {
+		wlm = mq.seedIncrementally(wlm)
+	}
+	if wlm != nil && len(mq.deadlines) > 0 {
+		// changes without a deadline stay queued for the next message
+		wlm, mq.out = mq.splitByDeadline(wlm)
+	}
+	mq.deadlines = nil
+	seeding := wlm != nil && wlm.Full()
+	if (wlm == nil || wlm.Empty()) && len(mq.seed) > 0 {
+		wlm = mq.nextSeedChunk()
+		seeding = true
+	}
+	var oversized []oversizedEntry
+	if wlm != nil && mq.maxSize > 0 {
+		wlm, oversized = mq.splitBySize(wlm, seeding)
+	}
+	moreSeed := len(mq.seed) > 0 || mq.out != nil
+	version := mq.version
+	mq.accountOut()
+	wlm = mq.filterCodecs(wlm)
+	mq.outlk.Unlock()
+
+	mq.dropOversized(oversized)
+
+	if wlm == nil || wlm.Empty() {
+		// an empty wantlist leaves nothing to seed the peer with
+		mq.seedSent()
+		if moreSeed {
+			mq.signalWork()
+		}
+		return
+	}
+
+	if mq.slots != nil {
+		mq.dispatch(ctx, wlm, version)
+		if moreSeed {
+			mq.signalWork()
+		}
+		return
+	}
+
+	// send wantlist updates
+	for { // try to send this message until we fail.
+		start := time.Now()
+		aborted, err := mq.sendAbortable(ctx, mq.sender, wlm)
+		if aborted {
+			// the stream may be left with half a message on it
+			mq.closeSender(mq.sender, SenderReset)
+			mq.outlk.Lock()
+			mq.sender = nil
+			mq.outlk.Unlock()
+			return
+		}
+		if err == nil {
+			mq.recordSend(start, version, wlm)
+			mq.traceSent(wlm)
+			mq.seedSent()
+
+			if moreSeed {
+				mq.signalWork()
+			}
+			return
+		}
+
+		log.Infof("bitswap send error: %s", err)
+		mq.onSendError()
+		if mq.sendFailed(wlm) {
+			mq.closeSender(mq.sender, SenderClosed)
+			mq.outlk.Lock()
+			mq.sender = nil
+			mq.outlk.Unlock()
+			return
+		}
+		decision := mq.classifyErr(err)
+		if decision == SendGiveUp {
+			log.Infof("dropping message to %s after permanent error", mq.p)
+			mq.onGiveUp(wlm, err)
+			return
+		}
+
+		mq.closeSender(mq.sender, closeEvent(decision))
+		mq.outlk.Lock()
+		mq.sender = nil
+		mq.outlk.Unlock()
+
+		if decision == SendResetSender {
+			log.Infof("dropping message to %s and resetting sender", mq.p)
+			mq.onGiveUp(wlm, err)
+			return
+		}
+
+		if mq.pool != nil {
+			// the message is retried by a later run, leaving the worker
+			// to the other queues meanwhile
+			mq.outlk.Lock()
+			mq.putBack(wlm)
+			mq.outlk.Unlock()
+			time.AfterFunc(mq.disconnectDelay, mq.signalWork)
+			return
+		}
+
+		select {
+		case <-mq.done:
+			return
+		case <-ctx.Done():
+			return
+		case <-mq.departed():
+			return
+		case <-time.After(mq.disconnectDelay):
+			// wait in case disconnect notifications are still propogating
+			log.Warning("SendMsg errored but neither 'done' nor context.Done() were set")
+		}
+
+		err = mq.openSender(ctx)
+		if err != nil {
+			log.Errorf("couldnt open sender again after SendMsg(%s) failed: %s", mq.p, err)
+			// TODO(why): what do we do now?
+			// I think the *right* answer is to probably put the message we're
+			// trying to send back, and then return to waiting for new work or
+			// a disconnect.
+			return
+		}
+
+		// TODO: Is this the same instance for the remote peer?
+		// If its not, we should resend our entire wantlist to them
+		/*
+			if mq.sender.InstanceID() != mq.lastSeenInstanceID {
+				wlm = mq.getFullWantlistMessage()
+			}
+		*/
+	}
+}
+
+// dispatch sends wlm in the background once a send slot is free. It first
+// waits for the in-flight messages that share cids with wlm.
+func (mq *msgQueue) dispatch(ctx context.Context, wlm bsmsg.BitSwapMessage, version uint64) {
+	// the slots are replaced when a crashed queue is revived, senders go
+	// back to the slots they were taken from
+	slots := mq.slots
+	var s bsnet.MessageSender
+	select {
+	case s = <-slots:
+	case <-mq.done:
+		return
+	case <-ctx.Done():
+		return
+	}
+
+	done := make(chan struct{})
+	var deps []chan struct{}
+	mq.outlk.Lock()
+	for _, e := range wlm.Wantlist() {
+		k := e.Cid.KeyString()
+		if prev, ok := mq.inflight[k]; ok {
+			deps = append(deps, prev)
+		}
+		mq.inflight[k] = done
+	}
+	mq.outlk.Unlock()
+
+	go func() {
+		for _, d := range deps {
+			<-d
+		}
+		s = mq.sendFrom(ctx, s, wlm, version)
+
+		mq.outlk.Lock()
+		for _, e := range wlm.Wantlist() {
+			k := e.Cid.KeyString()
+			if mq.inflight[k] == done {
+				delete(mq.inflight, k)
+			}
+		}
+		close(done)
+		mq.checkDrained()
+
+		stopped := mq.stopped
+		if !stopped {
+			slots <- s
+		}
+		mq.outlk.Unlock()
+
+		if stopped && s != nil {
+			mq.closeSender(s, SenderClosed)
+		}
+	}()
+}
+
+// sendFrom sends wlm over s, opening a new sender if s is nil, and retries
+// like doWork does. It returns the sender to reuse, or nil if there is none.
+func (mq *msgQueue) sendFrom(ctx context.Context, s bsnet.MessageSender, wlm bsmsg.BitSwapMessage, version uint64) bsnet.MessageSender {
+	for {
+		if s == nil {
+			var err error
+			s, err = mq.newSender(ctx)
+			if err != nil {
+				log.Infof("cant open message sender to peer %s: %s", mq.p, err)
+				return nil
+			}
+		}
+
+		start := time.Now()
+		aborted, err := mq.sendAbortable(ctx, s, wlm)
+		if aborted {
+			mq.closeSender(s, SenderReset)
+			return nil
+		}
+		if err == nil {
+			mq.recordSend(start, version, wlm)
+			mq.traceSent(wlm)
+			mq.seedSent()
+			return s
+		}
+
+		log.Infof("bitswap send error: %s", err)
+		mq.onSendError()
+		if mq.sendFailed(wlm) {
+			mq.closeSender(s, SenderClosed)
+			return nil
+		}
+		decision := mq.classifyErr(err)
+		if decision == SendGiveUp {
+			log.Infof("dropping message to %s after permanent error", mq.p)
+			mq.onGiveUp(wlm, err)
+			return s
+		}
+
+		mq.closeSender(s, closeEvent(decision))
+		s = nil
+		if decision == SendResetSender {
+			log.Infof("dropping message to %s and resetting sender", mq.p)
+			mq.onGiveUp(wlm, err)
+			return nil
+		}
+
+		select {
+		case <-mq.done:
+			return nil
+		case <-ctx.Done():
+			return nil
+		case <-mq.departed():
+			return nil
+		case <-time.After(mq.disconnectDelay):
+		}
+	}
+}
+
+// sendFailed counts a failed send of wlm, and quarantines the queue once
+// errorThreshold sends in a row failed. wlm is then queued again. It
+// returns whether the queue was quarantined.
+func (mq *msgQueue) sendFailed(wlm bsmsg.BitSwapMessage) bool {
+	mq.outlk.Lock()
+	mq.sendErrors++
+	if mq.errorThreshold <= 0 || mq.sendErrors < mq.errorThreshold {
+		mq.outlk.Unlock()
+		return false
+	}
+	until := time.Now().Add(mq.quarantine)
+	mq.quarantinedUntil = until
+	mq.putBack(wlm)
+	mq.outlk.Unlock()
+
+	log.Warningf("quarantining %s until %s after %d failed sends", mq.p, until, mq.errorThreshold)
+	time.AfterFunc(mq.quarantine, mq.signalWork)
+	mq.onQuarantined(until)
+	return true
+}
+
+// putBack queues wlm, which could not be sent, again. The changes queued
+// since are applied on top of it. outlk must be held.
+func (mq *msgQueue) putBack(wlm bsmsg.BitSwapMessage) {
+	if mq.out != nil && mq.out.Full() {
+		// supersedes wlm
+		return
+	}
+	if mq.out != nil {
+		for _, e := range mq.out.Wantlist() {
+			if e.Cancel {
+				wlm.Cancel(e.Cid)
+			} else {
+				wlm.AddAnnotatedEntry(e.Cid, e.Priority, e.Flags)
+			}
+		}
+	}
+	mq.out = wlm
+	mq.accountOut()
+}
+
+// quarantined returns whether the queue is quarantined, lifting the
+// quarantine once it is over.
+func (mq *msgQueue) quarantined() bool {
+	mq.outlk.Lock()
+	defer mq.outlk.Unlock()
+	if mq.quarantinedUntil.IsZero() {
+		return false
+	}
+	if time.Now().Before(mq.quarantinedUntil) {
+		return true
+	}
+
+	log.Infof("lifting quarantine of %s", mq.p)
+	mq.quarantinedUntil = time.Time{}
+	mq.sendErrors = 0
+	return false
+}
+
+// latencyWeight is how much each new sample moves the send latency average.
+const latencyWeight = 0.2
+
+// recordSend records the successful send of wlm, which started at start and
+// brings the peer up to version of our wantlist.
+func (mq *msgQueue) recordSend(start time.Time, version uint64, wlm bsmsg.BitSwapMessage) {
+	now := time.Now()
+	took := now.Sub(start)
+	size := uint64(bsmsg.EstimateSize(wlm))
+
+	mq.outlk.Lock()
+	defer mq.outlk.Unlock()
+	mq.bytesSent += size
+	mq.msgsSent++
+	if int(size) > mq.maxSentSize {
+		mq.maxSentSize = int(size)
+	}
+	if mq.seeding {
+		mq.seedBytes += int(size)
+	}
+	mq.sendErrors = 0
+	if version > mq.sentVersion {
+		mq.sentVersion = version
+	}
+	mq.lastSend = now
+	if mq.latency == 0 {
+		mq.latency = took
+	} else {
+		mq.latency += time.Duration(latencyWeight * float64(took-mq.latency))
+	}
+}
+
+// seedSent calls onSeeded, from a new goroutine, if the last of the full
+// wantlist the queue was seeded with has just been sent.
+func (mq *msgQueue) seedSent() {
+	mq.outlk.Lock()
+	done := mq.seeding && len(mq.seed) == 0 && (mq.out == nil || !mq.out.Full())
+	size := mq.seedBytes
+	if done {
+		mq.seeding = false
+		mq.seedBytes = 0
+	}
+	mq.outlk.Unlock()
+	if done {
+		go mq.onSeeded(size)
+	}
+}
+
+// traceSent traces the wants in wlm as sent to the peer.
+func (mq *msgQueue) traceSent(wlm bsmsg.BitSwapMessage) {
+	if mq.onWantSent == nil {
+		return
+	}
+	for _, e := range wlm.Wantlist() {
+		if !e.Cancel {
+			mq.onWantSent(e.Cid)
+		}
+	}
+}
+
+func (mq *msgQueue) classifyErr(err error) RetryDecision {
+	if mq.classify == nil {
+		return SendRetry
+	}
+	return mq.classify(err)
+}
+
+// send sends msg over s using the encoding preferred by the peer, if any.
+func (mq *msgQueue) send(ctx context.Context, s bsnet.MessageSender, msg bsmsg.BitSwapMessage) error {
+	es, ok := s.(bsnet.EncodingMessageSender)
+	if !ok {
+		return s.SendMsg(ctx, msg)
+	}
+
+	var buf bytes.Buffer
+	err := bsmsg.Encode(msg, es.Encoding(), &buf)
+	if err == bsmsg.ErrUnknownEncoding {
+		log.Warningf("peer %s wants unknown encoding %q", mq.p, es.Encoding())
+		return s.SendMsg(ctx, msg)
+	}
+	if err != nil {
+		return err
+	}
+	return es.SendEncoded(ctx, buf.Bytes())
+}
+
+// abortableSend is a wantlist message being sent. Once all the wants in it
+// are cancelled, the send is aborted through cancel.
+type abortableSend struct {
+	wants   map[string]struct{}
+	cancel  context.CancelFunc
+	aborted bool
+}
+
+// sendAbortable sends msg over s like send, but aborts the send if all the
+// wants in msg are cancelled meanwhile. It returns whether the send was
+// aborted, in which case the error is of no interest. Full wantlists,
+// messages without wants and messages carrying cancels, which would be
+// lost with them, are never aborted.
+func (mq *msgQueue) sendAbortable(ctx context.Context, s bsnet.MessageSender, msg bsmsg.BitSwapMessage) (bool, error) {
+	as := &abortableSend{wants: make(map[string]struct{})}
+	if !msg.Full() {
+		for _, e := range msg.Wantlist() {
+			if e.Cancel {
+				as.wants = nil
+				break
+			}
+			as.wants[e.Cid.KeyString()] = struct{}{}
+		}
+	}
+	if len(as.wants) == 0 {
+		return false, mq.send(ctx, s, msg)
+	}
+
+	ctx, as.cancel = context.WithCancel(ctx)
+	mq.outlk.Lock()
+	if mq.abortable == nil {
+		mq.abortable = make(map[*abortableSend]struct{})
+	}
+	mq.abortable[as] = struct{}{}
+	mq.outlk.Unlock()
+
+	err := mq.send(ctx, s, msg)
+
+	mq.outlk.Lock()
+	delete(mq.abortable, as)
+	aborted := as.aborted && err != nil
+	mq.outlk.Unlock()
+	as.cancel()
+
+	if aborted {
+		log.Infof("aborted sending cancelled wants to %s", mq.p)
+	}
+	return aborted, err
+}
+
+// abortCancelled aborts the sends whose wants were all cancelled now that
+// c is. outlk must be held.
+func (mq *msgQueue) abortCancelled(c *cid.Cid) {
+	k := c.KeyString()
+	for as := range mq.abortable {
+		if _, ok := as.wants[k]; !ok {
+			continue
+		}
+		delete(as.wants, k)
+		if len(as.wants) == 0 {
+			as.aborted = true
+			as.cancel()
+		}
+	}
+}
+
+// incrementalSeedSize is the most entries sent at once to peers that do not
+// want our full wantlist.
+const incrementalSeedSize = 16
+
+// markDeadline records deadline for the wants in entries. outlk must not be
+// held.
+func (mq *msgQueue) markDeadline(entries []*bsmsg.Entry, deadline time.Time) {
+	mq.outlk.Lock()
+	defer mq.outlk.Unlock()
+	if mq.out == nil {
+		return
+	}
+
+	for _, e := range entries {
+		if e.Cancel {
+			continue
+		}
+		if mq.deadlines == nil {
+			mq.deadlines = make(map[string]time.Time)
+		}
+		mq.deadlines[e.Cid.KeyString()] = deadline
+	}
+}
+
+// splitByDeadline splits wlm into the wants that have a deadline and the
+// remaining changes. rest is nil if there is nothing to split off. outlk
+// must be held.
+func (mq *msgQueue) splitByDeadline(wlm bsmsg.BitSwapMessage) (urgent, rest bsmsg.BitSwapMessage) {
+	if wlm.Full() {
+		return wlm, nil
+	}
+
+	urgent = bsmsg.New(false)
+	rest = bsmsg.New(false)
+	for _, e := range wlm.Wantlist() {
+		switch _, ok := mq.deadlines[e.Cid.KeyString()]; {
+		case e.Cancel:
+			rest.Cancel(e.Cid)
+		case ok:
+			urgent.AddAnnotatedEntry(e.Cid, e.Priority, e.Flags)
+		default:
+			rest.AddAnnotatedEntry(e.Cid, e.Priority, e.Flags)
+		}
+	}
+
+	if urgent.Empty() || rest.Empty() {
+		return wlm, nil
+	}
+	return urgent, rest
+}
+
+// oversizedEntry is an entry too large for any message, and the size of a
+// message holding only it.
+type oversizedEntry struct {
+	entry bsmsg.Entry
+	size  int
+}
+
+// splitBySize returns the part of wlm that fits in a message of maxSize
+// bytes and queues the rest again. Entries too large for any message are
+// returned in oversized, unless the policy is to send them anyway, in which
+// case the first of them is returned alone. Wants returned in oversized
+// before are left out until they are cancelled. If wlm is seeding the peer
+// with our wantlist, the rest is queued as seed. outlk must be held.
+func (mq *msgQueue) splitBySize(wlm bsmsg.BitSwapMessage, seeding bool) (msg bsmsg.BitSwapMessage, oversized []oversizedEntry) {
+	if bsmsg.EstimateSize(wlm) <= mq.maxSize {
+		return wlm, nil
+	}
+
+	empty := bsmsg.EstimateSize(bsmsg.New(wlm.Full()))
+	var fit, rest []bsmsg.Entry
+	size := empty
+	for _, e := range wlm.Wantlist() {
+		k := e.Cid.KeyString()
+		if _, dropped := mq.droppedOversized[k]; dropped {
+			if !e.Cancel {
+				continue
+			}
+			delete(mq.droppedOversized, k)
+		}
+		one := entryMessage(false, []bsmsg.Entry{e})
+		cost := bsmsg.EstimateSize(one) - empty
+		switch {
+		case empty+cost > mq.maxSize:
+			oversized = append(oversized, oversizedEntry{e, bsmsg.EstimateSize(one)})
+		case size+cost <= mq.maxSize:
+			fit = append(fit, e)
+			size += cost
+		default:
+			rest = append(rest, e)
+		}
+	}
+
+	if len(oversized) > 0 && mq.oversized == OversizedSendAnyway {
+		for _, o := range oversized[1:] {
+			rest = append(rest, o.entry)
+		}
+		rest = append(rest, fit...)
+		fit = []bsmsg.Entry{oversized[0].entry}
+		oversized = nil
+	} else {
+		for _, o := range oversized {
+			if o.entry.Cancel {
+				continue
+			}
+			if mq.droppedOversized == nil {
+				mq.droppedOversized = make(map[string]struct{})
+			}
+			mq.droppedOversized[o.entry.Cid.KeyString()] = struct{}{}
+		}
+		// the costs leave out the length prefixes growing as entries
+		// are added, which may take a few more bytes
+		for len(fit) > 0 && bsmsg.EstimateSize(entryMessage(wlm.Full(), fit)) > mq.maxSize {
+			rest = append(rest, fit[len(fit)-1])
+			fit = fit[:len(fit)-1]
+		}
+	}
+
+	switch {
+	case len(rest) == 0:
+	case seeding:
+		// ahead of what is left of the seed
+		wl := wantlist.New()
+		for _, e := range rest {
+			if !e.Cancel {
+				wl.AddEntry(&wantlist.Entry{Cid: e.Cid, Priority: e.Priority, Flags: e.Flags, RefCnt: 1})
+			}
+		}
+		mq.seed = append(wl.SortedEntries(), mq.seed...)
+	default:
+		mq.putBack(entryMessage(false, rest))
+	}
+	return entryMessage(wlm.Full(), fit), oversized
+}
+
+// entryMessage returns a message holding entries.
+func entryMessage(full bool, entries []bsmsg.Entry) bsmsg.BitSwapMessage {
+	msg := bsmsg.New(full)
+	for _, e := range entries {
+		if e.Cancel {
+			msg.Cancel(e.Cid)
+		} else {
+			msg.AddAnnotatedEntry(e.Cid, e.Priority, e.Flags)
+		}
+	}
+	return msg
+}
+
+// dropOversized forgets the oversized entries that are not sent to the
+// peer, and logs or reports them according to the policy.
+func (mq *msgQueue) dropOversized(oversized []oversizedEntry) {
+	for _, o := range oversized {
+		if !o.entry.Cancel {
+			mq.wl.Remove(o.entry.Cid)
+		}
+		if mq.oversized == OversizedReport {
+			mq.onOversized(o.entry.Cid, o.size)
+		} else {
+			log.Warningf("not sending %s to %s, a message of it alone takes %d bytes", o.entry.Cid, mq.p, o.size)
+		}
+	}
+}
+
+// seedIncrementally turns full, a full wantlist message, back into seed
+// entries that are sent in small non-full chunks. It returns the cancels to
+// send ahead of them, nil if there are none. outlk must be held.
+func (mq *msgQueue) seedIncrementally(full bsmsg.BitSwapMessage) bsmsg.BitSwapMessage {
+	wl := wantlist.New()
+	cancels := bsmsg.New(false)
+	for _, e := range full.Wantlist() {
+		if e.Cancel {
+			cancels.Cancel(e.Cid)
+		} else {
+			wl.AddEntry(&wantlist.Entry{Cid: e.Cid, Priority: e.Priority, Flags: e.Flags, RefCnt: 1})
+		}
+	}
+	// the chunks do not replace the wantlist of the peer, so what the
+	// full wantlist leaves out is cancelled explicitly
+	for _, c := range mq.replaced {
+		if _, ok := wl.Contains(c); !ok {
+			cancels.Cancel(c)
+		}
+	}
+	mq.replaced = nil
+
+	mq.seed = append(wl.SortedEntries(), mq.seed...)
+	if mq.chunkSize == 0 || mq.chunkSize > incrementalSeedSize {
+		mq.chunkSize = incrementalSeedSize
+	}
+	if cancels.Empty() {
+		return nil
+	}
+	return cancels
+}
+
+// replaceWantlist starts wl afresh, for a full wantlist to be sent to the
+// peer in place of what is queued. Peers that do not take full wantlists
+// are sent cancels for the wants they were told about, or were about to be
+// told were cancelled, that the full wantlist leaves out, see
+// seedIncrementally.
+func (mq *msgQueue) replaceWantlist() {
+	told := mq.wl.Entries()
+	mq.outlk.Lock()
+	if mq.caps != nil && mq.caps.NoFullWantlist {
+		if mq.replaced == nil {
+			mq.replaced = make(map[string]*cid.Cid, len(told))
+		}
+		for _, e := range told {
+			mq.replaced[e.Cid.KeyString()] = e.Cid
+		}
+		if mq.out != nil {
+			for _, e := range mq.out.Wantlist() {
+				if e.Cancel {
+					mq.replaced[e.Cid.KeyString()] = e.Cid
+				}
+			}
+		}
+	}
+	mq.outlk.Unlock()
+	mq.wl = wantlist.NewThreadSafe()
+}
+
+// filterCodecs drops the entries of wlm whose codec the peer is not
+// interested in. outlk must be held.
+func (mq *msgQueue) filterCodecs(wlm bsmsg.BitSwapMessage) bsmsg.BitSwapMessage {
+	if wlm == nil || mq.caps == nil || len(mq.caps.Codecs) == 0 {
+		return wlm
+	}
+
+	filtered := bsmsg.New(wlm.Full())
+	for _, e := range wlm.Wantlist() {
+		if !mq.wantsCodec(e.Cid.Type()) {
+			mq.wl.Remove(e.Cid)
+			continue
+		}
+		if e.Cancel {
+			filtered.Cancel(e.Cid)
+		} else {
+			filtered.AddAnnotatedEntry(e.Cid, e.Priority, e.Flags)
+		}
+	}
+	return filtered
+}
+
+func (mq *msgQueue) wantsCodec(codec uint64) bool {
+	for _, c := range mq.caps.Codecs {
+		if c == codec {
+			return true
+		}
+	}
+	return false
+}
+
+// nextSeedChunk pops the next chunk of the initial wantlist into a new
+// message. outlk must be held.
+func (mq *msgQueue) nextSeedChunk() bsmsg.BitSwapMessage {
+	n := len(mq.seed)
+	if mq.chunkSize > 0 && n > mq.chunkSize {
+		n = mq.chunkSize
+	}
+
+	msg := bsmsg.New(false)
+	for _, e := range mq.seed[:n] {
+		msg.AddAnnotatedEntry(e.Cid, e.Priority, e.Flags)
+	}
+	mq.seed = mq.seed[n:]
+	return msg
+}
+
+// signalWork wakes up runQueue. Dropping the signal when one is already
+// pending is safe: the pending signal is consumed before doWork grabs
+// mq.out, so any entries added before this call are picked up by that run.
+func (mq *msgQueue) signalWork() {
+	if mq.wake() {
+		mq.restart()
+	}
+	select {
+	case mq.work <- struct{}{}:
+	default:
+	}
+	if mq.pool != nil {
+		mq.pool.schedule(mq)
+	}
+}
+
+func (mq *msgQueue) openSender(ctx context.Context) error {
+	nsender, err := mq.newSender(ctx)
+	if err != nil {
+		return err
+	}
+
+	mq.outlk.Lock()
+	mq.sender = nsender
+	mq.outlk.Unlock()
+	return nil
+}
+
+var errQueueStopped = errors.New("message queue stopped")
+
+func (mq *msgQueue) newSender(ctx context.Context) (bsnet.MessageSender, error) {
+	if mq.dials != nil {
+		select {
+		case mq.dials <- struct{}{}:
+			defer func() { <-mq.dials }()
+		case <-mq.done:
+			return nil, errQueueStopped
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	s, err := mq.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if cs, ok := s.(bsnet.CapabilityMessageSender); ok {
+		caps := cs.Capabilities()
+		mq.outlk.Lock()
+		mq.caps = &caps
+		mq.outlk.Unlock()
+	}
+	mq.onSenderEvent(SenderOpened)
+	return s, nil
+}
+
+// dial connects to the peer and opens a sender to it, or has the sender
+// factory open one.
+func (mq *msgQueue) dial(ctx context.Context) (bsnet.MessageSender, error) {
+	if mq.senderFactory != nil {
+		return mq.senderFactory(mq.p)
+	}
+
+	// allow ten minutes for connections this includes looking them up in the
+	// dht dialing them, and handshaking
+	conctx, cancel := context.WithTimeout(ctx, time.Minute*10)
+	defer cancel()
+
+	err := mq.network.ConnectTo(conctx, mq.p)
+	if err != nil {
+		return nil, err
+	}
+
+	return mq.network.NewMessageSender(ctx, mq.p)
+}
+
+// closeSender closes s and reports event. outlk must not be held.
+func (mq *msgQueue) closeSender(s bsnet.MessageSender, event SenderEvent) {
+	s.Close()
+	mq.onSenderEvent(event)
+}
+
+// closeEvent returns how closing a sender after a failed send is reported.
+func closeEvent(decision RetryDecision) SenderEvent {
+	if decision == SendResetSender {
+		return SenderReset
+	}
+	return SenderClosed
+}
+
+func (pm *WantManager) Connected(p peer.ID) {
+	select {
+	case pm.connect <- p:
+	case <-pm.runCtx().Done():
+	}
+}
+
+// ConnectedBatch is like calling Connected for each of ps, but connects
+// them all in one go, putting together the wantlist they are seeded with
+// only once. Connects beyond the admission rate are held back as with
+// Connected, see WithConnectAdmissionRate. It returns once the peers that
+// were not held back are connected.
+func (pm *WantManager) ConnectedBatch(ps []peer.ID) {
+	pm.runSync(func() {
+		pm.handleBuffered()
+
+		entries := pm.seedEntries()
+		// every queue keeps its own copy, see removeSeed
+		seed := func() []*wantlist.Entry {
+			return append([]*wantlist.Entry(nil), entries...)
+		}
+		for _, p := range ps {
+			if pm.holdConnect(p) {
+				continue
+			}
+			pm.lastAdmit = time.Now()
+			pm.logOp(Operation{Kind: OpConnect, Peer: p})
+			pm.connectedCounter.Inc()
+			pm.startPeerWith(p, seed)
+		}
+		pm.updatePeersGauge()
+		pm.releaseDeferred()
+	})
+}
+
+func (pm *WantManager) Disconnected(p peer.ID) {
+	pm.departLk.Lock()
+	ch, ok := pm.departing[p]
+	if !ok {
+		ch = make(chan struct{})
+		pm.departing[p] = ch
+	}
+	select {
+	case <-ch:
+	default:
+		close(ch)
+	}
+	pm.departLk.Unlock()
+
+	select {
+	case pm.disconnect <- p:
+	case <-pm.runCtx().Done():
+	}
+}
+
+// departed returns a channel that is closed once p is reported
+// disconnected.
+func (pm *WantManager) departed(p peer.ID) <-chan struct{} {
+	pm.departLk.Lock()
+	defer pm.departLk.Unlock()
+	ch, ok := pm.departing[p]
+	if !ok {
+		ch = make(chan struct{})
+		pm.departing[p] = ch
+	}
+	return ch
+}
+
+// forgetDeparted drops the disconnect notification for p once its queue is
+// gone, so a new connection starts afresh.
+func (pm *WantManager) forgetDeparted(p peer.ID) {
+	pm.departLk.Lock()
+	defer pm.departLk.Unlock()
+	delete(pm.departing, p)
+}
+
+// admit starts the queue of p, which connected.
+func (pm *WantManager) admit(p peer.ID) {
+	// changes made before the connect go out with the seed, not after it,
+	// whichever the select picked first
+	pm.handleBuffered()
+
+	pm.lastAdmit = time.Now()
+	pm.logOp(Operation{Kind: OpConnect, Peer: p})
+	pm.connectedCounter.Inc()
+	pm.startPeerHandler(p)
+	pm.updatePeersGauge()
+	pm.releaseDeferred()
+}
+
+// admitInterval is how long apart peers are taken in under the admission
+// rate.
+func (pm *WantManager) admitInterval() time.Duration {
+	return time.Second / time.Duration(pm.admissionRate)
+}
+
+// holdConnect holds back the connect of p if a peer was taken in too
+// recently or others are waiting already. It returns whether it did.
+func (pm *WantManager) holdConnect(p peer.ID) bool {
+	if pm.admissionRate <= 0 {
+		return false
+	}
+	wait := pm.admitInterval() - time.Since(pm.lastAdmit)
+	if len(pm.admitting) == 0 && wait <= 0 {
+		return false
+	}
+
+	pm.admitting = append(pm.admitting, p)
+	if pm.admitTimer == nil {
+		pm.admitTimer = time.After(wait)
+	}
+	return true
+}
+
+// admitNext takes in the connect that waited longest.
+func (pm *WantManager) admitNext() {
+	pm.admitTimer = nil
+	if len(pm.admitting) == 0 {
+		return
+	}
+
+	p := pm.admitting[0]
+	pm.admitting = pm.admitting[1:]
+	pm.admit(p)
+	if len(pm.admitting) > 0 {
+		pm.admitTimer = time.After(pm.admitInterval())
+	}
+}
+
+// dropHeldConnect forgets a connect of p still held back by the admission
+// rate, as p disconnected before it was taken in. It returns whether there
+// was one.
+func (pm *WantManager) dropHeldConnect(p peer.ID) bool {
+	for i, held := range pm.admitting {
+		if held == p {
+			pm.admitting = append(pm.admitting[:i], pm.admitting[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// TODO: use goprocess here once i trust it
 func (pm *WantManager) Run() {
+	pm.runLk.Lock()
+	defer pm.runLk.Unlock()
+
 	tock := time.NewTicker(rebroadcastDelay.Get())
 	defer tock.Stop()
-	for {
-		select {
-		case entries := <-pm.incoming:
 
-			// add changes to our wantlist
-			var filtered []*bsmsg.Entry
-			for _, e := range entries {
-				if e.Cancel {
-					if pm.wl.Remove(e.Cid) {
-						pm.wantlistGauge.Dec()
-						filtered = append(filtered, e)
-					}
-				} else {
-					if pm.wl.AddEntry(e.Entry) {
-						pm.wantlistGauge.Inc()
-						filtered = append(filtered, e)
-					}
+	var watchdog <-chan time.Time
+	if pm.watchdogInterval > 0 {
+		t := time.NewTicker(pm.watchdogInterval)
+		defer t.Stop()
+		watchdog = t.C
+	}
+
+	if pm.mirror != nil {
+		go pm.mirror.runQueue(pm.runCtx())
+	}
+	if pm.tracer != nil {
+		go pm.deliverTraces(pm.runCtx())
+	}
+	if pm.pool != nil {
+		for i := 0; i < queuePoolWorkers; i++ {
+			go pm.pool.work(pm.runCtx())
+		}
+	}
+
+	for pm.handleEvent(tock.C, watchdog) {
+	}
+}
+
+// runCtx returns the context the WantManager runs in.
+func (pm *WantManager) runCtx() context.Context {
+	pm.ctxLk.RLock()
+	defer pm.ctxLk.RUnlock()
+	return pm.ctx
+}
+
+var errNotStopped = errors.New("WantManager is still running")
+
+// Restart brings a WantManager whose context is done back to life under
+// ctx, running it again in a goroutine of its own. Our wantlist, the peers
+// that were connected, and the options, hooks and counters survive. Each
+// peer gets a new queue seeded with our full wantlist, as if it just
+// connected, so changes that were queued for it but not sent are not lost,
+// and so does the mirror peer. Warm and lingering queues are dropped.
+// Restart waits for Run to return first, and fails if the context of the
+// WantManager is not done, or another Restart brought it back already.
+func (pm *WantManager) Restart(ctx context.Context) error {
+	pm.restartLk.Lock()
+	defer pm.restartLk.Unlock()
+	if pm.runCtx().Err() == nil {
+		return errNotStopped
+	}
+	pm.runLk.Lock()
+	defer func() {
+		pm.runLk.Unlock()
+		go pm.Run()
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	pm.ctxLk.Lock()
+	pm.ctx, pm.cancel = ctx, cancel
+	pm.ctxLk.Unlock()
+
+	for p, mq := range pm.warm {
+		mq.shutdown()
+		delete(pm.warm, p)
+	}
+	for p, lq := range pm.lingering {
+		lq.mq.shutdown()
+		delete(pm.lingering, p)
+	}
+	pm.lastSeed = make(map[peer.ID]seedRecord, pm.expectedPeers)
+
+	// the old mirror queue may still be on its way out, Run starts a new
+	// one, sent our full wantlist
+	if pm.mirror != nil {
+		pm.mirror.shutdown()
+		pm.mirror = pm.newMsgQueue(pm.mirrorPeer)
+		pm.mirror.idleTimeout = 0
+		pm.mirrorWantlist()
+	}
+
+	old := make([]*msgQueue, 0, len(pm.peers))
+	for p, mq := range pm.peers {
+		mq.shutdown()
+		delete(pm.peers, p)
+		old = append(old, mq)
+	}
+	for _, mq := range old {
+		pm.startPeerHandler(mq.p).refcnt = mq.refcnt
+	}
+	return nil
+}
+
+// StepRun handles a single event like an iteration of Run does, waiting
+// for one if there is none yet. Rebroadcasts and the other periodic work
+// driven by tickers are left out. It returns false once the WantManager is
+// stopped. StepRun must not be used while Run is running; it is meant for
+// tests that need events handled in a precise order.
+func (pm *WantManager) StepRun() bool {
+	return pm.handleEvent(nil, nil)
+}
+
+// handleEvent waits for the next event of the Run loop and handles it. It
+// returns false once Run should return.
+func (pm *WantManager) handleEvent(tock, watchdog <-chan time.Time) bool {
+	// sampled before every event, so a loop falling behind shows
+	pm.incomingGauge.Set(float64(len(pm.incoming)))
+
+	select {
+	case ws := <-pm.incoming:
+		pm.handleWantSet(ws)
+
+	case <-tock:
+		if pm.rebroadcastMode == RebroadcastPeriodic {
+			pm.rebroadcast()
+		} else {
+			pm.widenFanout()
+		}
+		pm.updateRefcntGauge()
+		pm.pruneLastChange()
+		pm.pruneLastSeed()
+		for _, mq := range pm.peers {
+			mq.pruneCancels()
+		}
+	case <-pm.settle:
+		pm.settleDebounced()
+	case <-pm.lingerTimer:
+		pm.expireLingering()
+	case <-pm.rebroadcastTimer:
+		pm.rebroadcastPeers()
+	case <-watchdog:
+		pm.reviveQueues()
+	case p := <-pm.connect:
+		if pm.holdConnect(p) {
+			break
+		}
+		pm.admit(p)
+	case <-pm.admitTimer:
+		pm.admitNext()
+	case p := <-pm.disconnect:
+		pm.logOp(Operation{Kind: OpDisconnect, Peer: p})
+		pm.disconnectedCounter.Inc()
+		if !pm.dropHeldConnect(p) {
+			pm.stopPeerHandler(p)
+		}
+		pm.updatePeersGauge()
+	case req := <-pm.peerReqs:
+		var peers []peer.ID
+		for p := range pm.peers {
+			peers = append(peers, p)
+		}
+		req <- peers
+	case req := <-pm.runReqs:
+		req()
+	case <-pm.runCtx().Done():
+		if pm.drainTimeout > 0 {
+			pm.drainIncoming()
+		}
+		return false
+	}
+	return true
+}
+
+// rebroadcast resends our wantlist to every peer. By default the entire
+// wantlist is sent, replacing what peers have. With a rebroadcast chunk
+// size set, only the next chunk of the wantlist (in priority order) is
+// sent, so that the whole wantlist is covered over several calls.
+func (pm *WantManager) rebroadcast() {
+	pm.widenFanout()
+	if pm.sendsPaused() {
+		return
+	}
+
+	// resend entire wantlist every so often (REALLY SHOULDNT BE NECESSARY)
+	if pm.rebroadcastChunk > 0 && pm.wl.Len() > pm.rebroadcastChunk {
+		pm.rebroadcastNextChunk()
+		return
+	}
+
+	es, restricted := pm.rebroadcastEntries()
+	for _, mq := range pm.rebroadcastTargets() {
+		pm.rebroadcastTo(mq, es, restricted)
+	}
+}
+
+// rebroadcastTo resends our wantlist to p for a periodic rebroadcast, as
+// the rebroadcast hook has it if one is set.
+func (pm *WantManager) rebroadcastTo(p *msgQueue, es, restricted []*bsmsg.Entry) {
+	if pm.rebroadcastHook == nil {
+		pm.resendWantlist(p, es, restricted)
+		return
+	}
+
+	all := append(append([]*bsmsg.Entry(nil), es...), p.keptRestricted(restricted)...)
+	copies := make([]*bsmsg.Entry, 0, len(all))
+	for _, e := range all {
+		cp := *e.Entry
+		copies = append(copies, &bsmsg.Entry{Entry: &cp, Cancel: e.Cancel})
+	}
+	es = pm.rebroadcastHook(p.p, copies)
+	pm.traceEntries(es, p.p, WantRebroadcast)
+	p.addMessage(es)
+}
+
+// rebroadcastTargets returns the queues of the peers to rebroadcast our
+// wantlist to. With a fanout cap, those are the next peers in ID order
+// after the last one rebroadcast to, wrapping around.
+func (pm *WantManager) rebroadcastTargets() []*msgQueue {
+	var all []*msgQueue
+	var ids []string
+	for p, mq := range pm.peers {
+		if _, ok := pm.peerRebroadcast[p]; ok || mq.upToDate() {
+			continue
+		}
+		all = append(all, mq)
+		ids = append(ids, string(p))
+	}
+	if pm.rebroadcastFanoutCap <= 0 || len(all) <= pm.rebroadcastFanoutCap {
+		return all
+	}
+
+	sort.Strings(ids)
+	start := sort.Search(len(ids), func(i int) bool { return ids[i] > string(pm.lastRebroadcast) })
+	targets := make([]*msgQueue, pm.rebroadcastFanoutCap)
+	for i := range targets {
+		p := peer.ID(ids[(start+i)%len(ids)])
+		targets[i] = pm.peers[p]
+		pm.lastRebroadcast = p
+	}
+	return targets
+}
+
+// WantlistAcked is told that p acknowledged the last wantlist message we
+// sent it. Peers whose capabilities say they send acknowledgements are
+// left out of rebroadcasts while they acknowledged all we told them.
+func (pm *WantManager) WantlistAcked(p peer.ID) {
+	pm.runSync(func() {
+		mq, ok := pm.peers[p]
+		if !ok {
+			return
+		}
+		mq.outlk.Lock()
+		mq.ackedVersion = mq.sentVersion
+		mq.acked = true
+		mq.outlk.Unlock()
+	})
+}
+
+// upToDate returns whether the peer acknowledged the latest version of our
+// wantlist queued for it, with nothing more left to send.
+func (mq *msgQueue) upToDate() bool {
+	mq.outlk.Lock()
+	defer mq.outlk.Unlock()
+	if mq.caps == nil || !mq.caps.WantlistAcks || !mq.acked {
+		return false
+	}
+	return mq.ackedVersion == mq.version && mq.out == nil && len(mq.seed) == 0
+}
+
+// rebroadcastEntries splits our wantlist into the entries to resend to
+// every peer and those restricted to the peers already told about them.
+func (pm *WantManager) rebroadcastEntries() (es, restricted []*bsmsg.Entry) {
+	for _, e := range pm.wl.Entries() {
+		if pm.restricted(e) {
+			restricted = append(restricted, &bsmsg.Entry{Entry: e})
+		} else {
+			es = append(es, &bsmsg.Entry{Entry: e})
+		}
+	}
+	return es, restricted
+}
+
+// resendTo resends our whole wantlist to p, if it is still connected.
+func (pm *WantManager) resendTo(p peer.ID) {
+	mq, ok := pm.peers[p]
+	if !ok {
+		return
+	}
+	es, restricted := pm.rebroadcastEntries()
+	pm.resendWantlist(mq, es, restricted)
+}
+
+// resendWantlist replaces the wantlist of p with a full one.
+func (pm *WantManager) resendWantlist(p *msgQueue, es, restricted []*bsmsg.Entry) {
+	if kept := p.keptRestricted(restricted); len(kept) > 0 {
+		es = append(append([]*bsmsg.Entry(nil), es...), kept...)
+	}
+
+	p.replaceWantlist()
+	p.outlk.Lock()
+	p.out = bsmsg.New(true)
+	p.seed = nil
+	p.outlk.Unlock()
+
+	pm.traceEntries(es, p.p, WantRebroadcast)
+	p.addMessage(es)
+}
+
+// keptRestricted returns the entries of restricted the peer was told about.
+// Wants that are not broadcast are only kept for the peers they were sent
+// to.
+func (mq *msgQueue) keptRestricted(restricted []*bsmsg.Entry) []*bsmsg.Entry {
+	var kept []*bsmsg.Entry
+	for _, e := range restricted {
+		if _, ok := mq.wl.Contains(e.Cid); ok {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// SetPeerRebroadcastInterval makes our wantlist be rebroadcast to p every d
+// instead of along with the other peers. A peer with its own interval is
+// sent the full wantlist every time, even with a rebroadcast chunk size
+// set. A d of zero or less goes back to the global interval.
+func (pm *WantManager) SetPeerRebroadcastInterval(p peer.ID, d time.Duration) {
+	pm.runSync(func() {
+		if d <= 0 {
+			delete(pm.peerRebroadcast, p)
+		} else {
+			pm.peerRebroadcast[p] = d
+		}
+
+		if mq, ok := pm.peers[p]; ok {
+			mq.rebroadcastDue = time.Time{}
+			if d > 0 {
+				mq.rebroadcastDue = time.Now().Add(d)
+			}
+		}
+		pm.rebroadcastPeers()
+	})
+}
+
+// rebroadcastPeers rebroadcasts our wantlist to the peers with their own
+// interval that are due, and arms rebroadcastTimer for the next one.
+func (pm *WantManager) rebroadcastPeers() {
+	pm.rebroadcastTimer = nil
+	now := time.Now()
+	var next time.Time
+	for p, mq := range pm.peers {
+		if mq.rebroadcastDue.IsZero() {
+			continue
+		}
+		if !mq.rebroadcastDue.After(now) && pm.sendsPaused() {
+			// skipped while paused
+			mq.rebroadcastDue = now.Add(pm.peerRebroadcast[p])
+		}
+		if !mq.rebroadcastDue.After(now) && !mq.upToDate() {
+			es, restricted := pm.rebroadcastEntries()
+			pm.rebroadcastTo(mq, es, restricted)
+			mq.rebroadcastDue = now.Add(pm.peerRebroadcast[p])
+		}
+		if next.IsZero() || mq.rebroadcastDue.Before(next) {
+			next = mq.rebroadcastDue
+		}
+	}
+	if !next.IsZero() {
+		pm.rebroadcastTimer = time.After(next.Sub(now))
+	}
+}
+
+// belowFloor returns whether e must not be broadcast.
+func (pm *WantManager) belowFloor(e *wantlist.Entry) bool {
+	return pm.hasBroadcastFloor && e.Priority < pm.broadcastFloor
+}
+
+// restricted returns whether e may only be sent to the peers we already
+// told about it, instead of to every peer.
+func (pm *WantManager) restricted(e *wantlist.Entry) bool {
+	if pm.belowFloor(e) {
+		return true
+	}
+	_, fanning := pm.fanout[e.Cid.KeyString()]
+	return fanning
+}
+
+// fanoutWant is a want that was only sent to width peers so far.
+type fanoutWant struct {
+	entry *bsmsg.Entry
+	width int
+}
+
+// fanOut sends the wants in entries to a limited number of peers: new
+// wants to the initialFanout peers with the least pending work, and wants
+// that are being fanned out to the peers told about them so far. It returns
+// the entries to send to every peer. It is only meant for changes to our
+// wantlist, wants that are rebroadcast go through sendFanning alone.
+func (pm *WantManager) fanOut(entries []*bsmsg.Entry) []*bsmsg.Entry {
+	var rest []*bsmsg.Entry
+	var peers []peer.ID
+	perPeer := make(map[*msgQueue][]*bsmsg.Entry)
+	for _, e := range pm.sendFanning(entries) {
+		k := e.Cid.KeyString()
+		if e.Cancel || len(pm.peers) <= pm.initialFanout {
+			rest = append(rest, e)
+			continue
+		}
+
+		if peers == nil {
+			peers = pm.peersByPendingWork()
+		}
+		pm.fanout[k] = &fanoutWant{entry: e, width: pm.initialFanout}
+		for _, p := range peers[:pm.initialFanout] {
+			mq := pm.peers[p]
+			perPeer[mq] = append(perPeer[mq], e)
+		}
+	}
+
+	for mq, es := range perPeer {
+		mq.addMessage(es)
+	}
+	return rest
+}
+
+// sendFanning sends the wants in entries that are being fanned out to the
+// peers told about them so far. It returns the other entries.
+func (pm *WantManager) sendFanning(entries []*bsmsg.Entry) []*bsmsg.Entry {
+	var rest []*bsmsg.Entry
+	perPeer := make(map[*msgQueue][]*bsmsg.Entry)
+	for _, e := range entries {
+		if _, ok := pm.fanout[e.Cid.KeyString()]; !ok || e.Cancel {
+			rest = append(rest, e)
+			continue
+		}
+		for _, mq := range pm.peers {
+			if _, told := mq.wl.Contains(e.Cid); told {
+				perPeer[mq] = append(perPeer[mq], e)
+			}
+		}
+	}
+
+	for mq, es := range perPeer {
+		mq.addMessage(es)
+	}
+	return rest
+}
+
+// widenFanout tells twice as many peers as before about each want being
+// fanned out, picking those with the least pending work. Once all peers
+// know about a want it is no longer fanned out.
+func (pm *WantManager) widenFanout() {
+	if len(pm.fanout) == 0 {
+		return
+	}
+
+	peers := pm.peersByPendingWork()
+	perPeer := make(map[*msgQueue][]*bsmsg.Entry)
+	for k, fw := range pm.fanout {
+		fw.width *= 2
+		if fw.width >= len(peers) {
+			delete(pm.fanout, k)
+		}
+
+		var told int
+		var missing []*msgQueue
+		for _, p := range peers {
+			mq := pm.peers[p]
+			if _, ok := mq.wl.Contains(fw.entry.Cid); ok {
+				told++
+			} else {
+				missing = append(missing, mq)
+			}
+		}
+		for _, mq := range missing {
+			if told >= fw.width {
+				break
+			}
+			perPeer[mq] = append(perPeer[mq], fw.entry)
+			told++
+		}
+	}
+
+	for mq, es := range perPeer {
+		mq.addMessage(es)
+	}
+}
+
+func (pm *WantManager) rebroadcastNextChunk() {
+	entries := pm.wl.SortedEntries()
+	if pm.rebroadcastCursor >= len(entries) {
+		pm.rebroadcastCursor = 0
+	}
+
+	end := pm.rebroadcastCursor + pm.rebroadcastChunk
+	if end > len(entries) {
+		end = len(entries)
+	}
+
+	var es []*bsmsg.Entry
+	for _, e := range entries[pm.rebroadcastCursor:end] {
+		es = append(es, &bsmsg.Entry{Entry: e})
+	}
+	pm.rebroadcastCursor = end
+
+	pm.forEachPeer(func(p peer.ID, _ *msgQueue) {
+		pm.traceEntries(es, p, WantRebroadcast)
+	})
+	// wants still being fanned out go to the peers told about them so far,
+	// widenFanout decides when more peers are told
+	toAll := es
+	if pm.initialFanout > 0 {
+		toAll = pm.sendFanning(es)
+	}
+	pm.broadcast(toAll)
+	// broadcast leaves out the wants for low priority peers, which are
+	// only for rebroadcasts like this one. Like other peers, they are
+	// not sent the restricted wants they were not told about.
+	for p, tier := range pm.peerTiers {
+		mq, ok := pm.peers[p]
+		if !ok || tier != PeerTierLowPriority {
+			continue
+		}
+		var kept []*bsmsg.Entry
+		for _, e := range es {
+			if _, told := mq.wl.Contains(e.Cid); told || !pm.restricted(e.Entry) {
+				kept = append(kept, e)
+			}
+		}
+		if len(kept) > 0 {
+			mq.addMessage(kept)
+		}
+	}
+}
+
+func (pm *WantManager) handleWantSet(ws *wantSet) {
+	if ws.peerCancel {
+		pm.cancelForPeers(ws.entries, ws.targets)
+		return
+	}
+	if ws.ifPeers != nil {
+		registered := len(pm.peers) > 0
+		ws.ifPeers <- registered
+		if !registered {
+			log.Infof("no peers to want %d blocks from, not adding them", len(ws.entries))
+			return
+		}
+	}
+	if ws.replace {
+		ws.entries = pm.replacementEntries(ws.entries)
+	}
+	if ws.cancelAll {
+		ws.entries = pm.cancelAllEntries(ws.addedBefore)
+	}
+	if ws.group != "" {
+		ws.targets = pm.groupMembers(ws.group)
+	}
+	pm.logWantSet(ws)
+
+	// add changes to our wantlist
+	var filtered []*bsmsg.Entry
+	for _, e := range ws.entries {
+		if e.Cancel {
+			if added, ok := pm.wantAdded[e.Cid.KeyString()]; ok && ws.from != "" {
+				pm.wantSatisfied(e.Cid, ws.from, time.Since(added))
+				pm.trace(e.Cid, ws.from, WantSatisfied)
+			}
+			if ws.unpin {
+				if _, ok := pm.pinned[e.Cid.KeyString()]; !ok {
+					continue
+				}
+				delete(pm.pinned, e.Cid.KeyString())
+			} else if pm.pinHolds(e.Cid) {
+				continue
+			}
+			delete(pm.hints, e.Cid.KeyString())
+			if pm.wl.Remove(e.Cid) {
+				pm.wantlistGauge.Dec()
+				atomic.AddInt64(&pm.stats.wantlist, -1)
+				pm.wantsCancelled++
+				pm.recordOutcome(wantOutcome{
+					satisfied: ws.from != "",
+					latency:   time.Since(pm.wantAdded[e.Cid.KeyString()]),
+				})
+				delete(pm.wantAdded, e.Cid.KeyString())
+				delete(pm.sendAttempts, e.Cid.KeyString())
+				delete(pm.fanout, e.Cid.KeyString())
+				pm.trace(e.Cid, "", WantCancelled)
+				filtered = append(filtered, e)
+			}
+		} else {
+			if ws.pin {
+				if _, ok := pm.pinned[e.Cid.KeyString()]; ok {
+					continue
+				}
+				pm.pinned[e.Cid.KeyString()] = struct{}{}
+			}
+			if pm.wl.AddEntry(e.Entry) {
+				pm.wantlistGauge.Inc()
+				atomic.AddInt64(&pm.stats.wantlist, 1)
+				pm.wantsAdded++
+				pm.wantAdded[e.Cid.KeyString()] = time.Now()
+				pm.trace(e.Cid, "", WantAdded)
+				filtered = append(filtered, e)
+			}
+		}
+	}
+
+	if len(filtered) > 0 {
+		pm.snapshot = nil
+		pm.version++
+		pm.mirrorWantlist()
+	}
+	if ws.added != nil {
+		var added []*cid.Cid
+		for _, e := range filtered {
+			if !e.Cancel {
+				added = append(added, e.Cid)
+			}
+		}
+		ws.added <- added
+	}
+	for k, hinted := range ws.hints {
+		if _, wanted := pm.wantAdded[k]; wanted {
+			pm.hints[k] = hinted
+		}
+	}
+
+	if ws.group != "" && len(ws.targets) == 0 {
+		log.Infof("no peers in group %s to send wants to", ws.group)
+		pm.markDeadline(ws.entries, ws.deadline)
+		return
+	}
+	filtered = pm.trackOscillation(filtered, ws.targets)
+	if len(ws.targets) == 0 {
+		filtered = pm.sendHinted(filtered)
+	}
+	pm.sendEntries(filtered, ws.targets)
+	pm.markDeadline(ws.entries, ws.deadline)
+}
+
+// mirrorWantlist queues our full wantlist for the mirror peer, replacing
+// whatever is still queued for it.
+func (pm *WantManager) mirrorWantlist() {
+	if pm.mirror == nil {
+		return
+	}
+
+	full := bsmsg.New(true)
+	for _, e := range pm.wl.Entries() {
+		full.AddAnnotatedEntry(e.Cid, e.Priority, e.Flags)
+	}
+	pm.mirror.outlk.Lock()
+	pm.mirror.out = full
+	pm.mirror.accountOut()
+	pm.mirror.outlk.Unlock()
+	pm.mirror.signalWork()
+}
+
+// markDeadline tells the peer queues that the wants in entries they were
+// just given came with deadline.
+func (pm *WantManager) markDeadline(entries []*bsmsg.Entry, deadline time.Time) {
+	if !pm.deadlineOrdering || deadline.IsZero() {
+		return
+	}
+	for _, mq := range pm.peers {
+		mq.markDeadline(entries, deadline)
+	}
+}
+
+// replacementEntries returns the changes that turn our wantlist into
+// desired.
+func (pm *WantManager) replacementEntries(desired []*bsmsg.Entry) []*bsmsg.Entry {
+	var es []*bsmsg.Entry
+	keep := make(map[string]bool, len(desired))
+	for _, e := range desired {
+		keep[e.Cid.KeyString()] = true
+		if _, ok := pm.wl.Contains(e.Cid); !ok {
+			es = append(es, e)
+		}
+	}
+	for _, e := range pm.wl.Entries() {
+		if !keep[e.Cid.KeyString()] {
+			es = append(es, &bsmsg.Entry{
+				Cancel: true,
+				Entry:  &wantlist.Entry{Cid: e.Cid, Priority: e.Priority, RefCnt: 1},
+			})
+		}
+	}
+	return es
+}
+
+// cancelAllEntries returns the cancels that drop the wants added before
+// before from our wantlist, or all wants if before is zero. There is one for
+// every time each want was added.
+func (pm *WantManager) cancelAllEntries(before time.Time) []*bsmsg.Entry {
+	var es []*bsmsg.Entry
+	for _, e := range pm.wl.Entries() {
+		if !before.IsZero() && !pm.wantAdded[e.Cid.KeyString()].Before(before) {
+			continue
+		}
+		for i := 0; i < e.RefCnt; i++ {
+			es = append(es, &bsmsg.Entry{
+				Cancel: true,
+				Entry:  &wantlist.Entry{Cid: e.Cid, Priority: e.Priority, RefCnt: 1},
+			})
+		}
+	}
+	return es
+}
+
+// pinHolds returns whether c is pinned and the pin is the last reference
+// to it, which a cancel must not drop.
+func (pm *WantManager) pinHolds(c *cid.Cid) bool {
+	if _, ok := pm.pinned[c.KeyString()]; !ok {
+		return false
+	}
+	e, ok := pm.wl.Contains(c)
+	return ok && e.RefCnt <= 1
+}
+
+// sendHinted sends the wants in entries that have hinted peers connected to
+// just those peers, and returns the remaining entries.
+func (pm *WantManager) sendHinted(entries []*bsmsg.Entry) []*bsmsg.Entry {
+	if len(pm.hints) == 0 {
+		return entries
+	}
+
+	var rest []*bsmsg.Entry
+	perPeer := make(map[*msgQueue][]*bsmsg.Entry)
+	for _, e := range entries {
+		var hinted bool
+		if !e.Cancel {
+			for _, p := range pm.hints[e.Cid.KeyString()] {
+				if mq, ok := pm.peers[p]; ok {
+					perPeer[mq] = append(perPeer[mq], e)
+					hinted = true
+				}
+			}
+		}
+		if !hinted {
+			rest = append(rest, e)
+		}
+	}
+
+	for mq, es := range perPeer {
+		mq.addMessage(es)
+	}
+	return rest
+}
+
+// deferredWants are wantlist changes held back until all their targets are
+// connected.
+type deferredWants struct {
+	entries []*bsmsg.Entry
+	targets []peer.ID
+}
+
+func (pm *WantManager) allConnected(peers []peer.ID) bool {
+	for _, p := range peers {
+		if _, ok := pm.peers[p]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// releaseDeferred sends the deferred wantlist changes whose targets are now
+// all connected. Changes undone since they were deferred are dropped.
+func (pm *WantManager) releaseDeferred() {
+	var still []*deferredWants
+	for _, d := range pm.deferred {
+		if !pm.allConnected(d.targets) {
+			still = append(still, d)
+			continue
+		}
+
+		var es []*bsmsg.Entry
+		for _, e := range d.entries {
+			if _, wanted := pm.wl.Contains(e.Cid); wanted != e.Cancel {
+				es = append(es, e)
+			}
+		}
+		if len(es) == 0 {
+			continue
+		}
+		for _, t := range d.targets {
+			pm.peers[t].addMessage(es)
+		}
+	}
+	pm.deferred = still
+}
+
+// sendEntries sends wantlist changes to targets, or to every peer if there
+// are no targets.
+func (pm *WantManager) sendEntries(filtered []*bsmsg.Entry, targets []peer.ID) {
+	// broadcast those wantlist changes
+	if len(targets) == 0 {
+		pm.broadcastChanges(filtered)
+		return
+	}
+
+	if pm.targetDelivery == AllOrNothing && !pm.allConnected(targets) {
+		pm.deferred = append(pm.deferred, &deferredWants{entries: filtered, targets: targets})
+		return
+	}
+
+	var sent bool
+	for _, t := range targets {
+		p, ok := pm.peers[t]
+		if !ok {
+			switch pm.unknownTarget {
+			case UnknownTargetConnect:
+				p = pm.startPeerHandler(t)
+				p.refcnt = 0
+				pm.updatePeersGauge()
+			case UnknownTargetQueue:
+				pm.pending[t] = append(pm.pending[t], filtered...)
+				continue
+			default:
+				log.Infof("tried sending wantlist change to non-partner peer: %s", t)
+				continue
+			}
+		}
+		p.addMessage(filtered)
+		sent = true
+	}
+
+	if !sent && pm.targetFallback {
+		log.Infof("none of the targets %s are connected, broadcasting instead", targets)
+		pm.broadcastChanges(filtered)
+	}
+}
+
+// broadcastChanges broadcasts changes to our wantlist, fanning new wants out
+// to a few peers first if initialFanout is set.
+func (pm *WantManager) broadcastChanges(entries []*bsmsg.Entry) {
+	if pm.initialFanout > 0 {
+		entries = pm.fanOut(entries)
+	}
+	pm.broadcast(entries)
+}
+
+// cancelForPeers sends the cancels in entries to those of targets told
+// about the wants, and drops the wants held back for the others.
+func (pm *WantManager) cancelForPeers(entries []*bsmsg.Entry, targets []peer.ID) {
+	cancelled := make(map[string]bool)
+	for _, e := range entries {
+		cancelled[e.Cid.KeyString()] = true
+	}
+
+	for _, t := range targets {
+		mq, ok := pm.peers[t]
+		if !ok {
+			var kept []*bsmsg.Entry
+			for _, e := range pm.pending[t] {
+				if !cancelled[e.Cid.KeyString()] {
+					kept = append(kept, e)
 				}
 			}
+			if len(kept) == 0 {
+				delete(pm.pending, t)
+			} else {
+				pm.pending[t] = kept
+			}
+			continue
+		}
 
-			// broadcast those wantlist changes
-			for _, p := range pm.peers {
-				p.addMessage(filtered)
+		var es []*bsmsg.Entry
+		for _, e := range entries {
+			if _, told := mq.wl.Contains(e.Cid); told {
+				es = append(es, e)
 			}
+		}
+		if len(es) > 0 {
+			mq.addMessage(es)
+		}
+	}
+}
+
+// oscillationWindow is the window within which a want must be reversed
+// twice to count as oscillating, when no debounce window is set.
+const oscillationWindow = time.Second
+
+// changeTimes holds when a cid was last changed, and when it was changed
+// before that.
+type changeTimes struct {
+	last, prev time.Time
+}
+
+type debouncedEntry struct {
+	entry   *bsmsg.Entry
+	targets []peer.ID
+
+	// whether peers were last told that we want the cid
+	wasWanted bool
+	due       time.Time
+}
+
+// trackOscillation counts changes to cids that reverse them for the second
+// time within the last window, so a want satisfied soon after it was added
+// is not mistaken for flipping. When debouncing, those changes are taken out
+// of entries and held back until they settle.
+func (pm *WantManager) trackOscillation(entries []*bsmsg.Entry, targets []peer.ID) []*bsmsg.Entry {
+	window := pm.debounce
+	if window == 0 {
+		window = oscillationWindow
+	}
+
+	now := time.Now()
+	var out []*bsmsg.Entry
+	for _, e := range entries {
+		k := e.Cid.KeyString()
+		ct := pm.lastChange[k]
+		pm.lastChange[k] = changeTimes{last: now, prev: ct.last}
+		oscillating := !ct.prev.IsZero() && now.Sub(ct.prev) < window
+		if oscillating {
+			pm.oscillationCounter.Inc()
+		}
+
+		if pm.debounce == 0 {
+			out = append(out, e)
+			continue
+		}
+
+		if d, ok := pm.debounced[k]; ok {
+			d.entry, d.targets, d.due = e, targets, now.Add(window)
+			continue
+		}
+		if !oscillating {
+			out = append(out, e)
+			continue
+		}
+
+		// the previous change went out, so peers think the opposite of e
+		pm.debounced[k] = &debouncedEntry{
+			entry:     e,
+			targets:   targets,
+			wasWanted: e.Cancel,
+			due:       now.Add(window),
+		}
+		if pm.settle == nil {
+			pm.settle = time.After(window)
+		}
+	}
+	return out
+}
 
-		case <-tock.C:
-			// resend entire wantlist every so often (REALLY SHOULDNT BE NECESSARY)
-			var es []*bsmsg.Entry
-			for _, e := range pm.wl.Entries() {
-				es = append(es, &bsmsg.Entry{Entry: e})
+// settleDebounced sends the net state of the held back changes that are
+// due, unless it matches what peers were last told.
+func (pm *WantManager) settleDebounced() {
+	pm.settle = nil
+	now := time.Now()
+	var next time.Time
+	for k, d := range pm.debounced {
+		if d.due.After(now) {
+			if next.IsZero() || d.due.Before(next) {
+				next = d.due
 			}
+			continue
+		}
+
+		delete(pm.debounced, k)
+		if wanted := !d.entry.Cancel; wanted == d.wasWanted {
+			continue
+		}
+		pm.sendEntries([]*bsmsg.Entry{d.entry}, d.targets)
+	}
+	if !next.IsZero() {
+		pm.settle = time.After(next.Sub(now))
+	}
+}
+
+// pruneLastSeed forgets seeds that no longer suppress reseeding.
+func (pm *WantManager) pruneLastSeed() {
+	for p, last := range pm.lastSeed {
+		if last.version != pm.version || time.Since(last.at) >= pm.reseedWindow {
+			delete(pm.lastSeed, p)
+		}
+	}
+}
+
+// pruneLastChange forgets changes too old to count towards oscillation.
+func (pm *WantManager) pruneLastChange() {
+	window := pm.debounce
+	if window == 0 {
+		window = oscillationWindow
+	}
+	for k, ct := range pm.lastChange {
+		if time.Since(ct.last) >= window {
+			delete(pm.lastChange, k)
+		}
+	}
+}
+
+// handleBuffered applies the wantlist changes already waiting in incoming.
+// Changes queued meanwhile are left for the Run loop.
+func (pm *WantManager) handleBuffered() {
+	for n := len(pm.incoming); n > 0; n-- {
+		pm.handleWantSet(<-pm.incoming)
+	}
+}
+
+// drainIncoming applies the wantlist changes still buffered when the
+// WantManager shuts down, and flushes the peer queues, so that cancels
+// issued right before shutdown are not lost. It gives up after
+// drainTimeout.
+func (pm *WantManager) drainIncoming() {
+	deadline := time.Now().Add(pm.drainTimeout)
+	timeout := time.NewTimer(pm.drainTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case ws := <-pm.incoming:
+			pm.handleWantSet(ws)
+			continue
+		case <-timeout.C:
+			log.Warningf("gave up draining %d wantlist changes on shutdown", len(pm.incoming))
+			return
+		default:
+		}
+		break
+	}
+	pm.flushQueues(deadline)
+}
 
-			for _, p := range pm.peers {
-				p.outlk.Lock()
-				p.out = bsmsg.New(true)
-				p.outlk.Unlock()
+// flushQueues sends what is queued for each peer straight over the
+// network, the queues having stopped along with the WantManager. It gives
+// up once deadline passes.
+func (pm *WantManager) flushQueues(deadline time.Time) {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
 
-				p.addMessage(es)
+	var wg sync.WaitGroup
+	for p, mq := range pm.peers {
+		wg.Add(1)
+		go func(p peer.ID, mq *msgQueue) {
+			defer wg.Done()
+			// wait for a send under way, it has what it took from out
+			select {
+			case mq.working <- struct{}{}:
+				defer func() { <-mq.working }()
+			case <-ctx.Done():
+				return
 			}
-		case p := <-pm.connect:
-			pm.startPeerHandler(p)
-		case p := <-pm.disconnect:
-			pm.stopPeerHandler(p)
-		case req := <-pm.peerReqs:
-			var peers []peer.ID
-			for p := range pm.peers {
-				peers = append(peers, p)
+
+			mq.outlk.Lock()
+			out := mq.out
+			mq.out = nil
+			mq.accountOut()
+			mq.outlk.Unlock()
+			if out == nil || out.Empty() {
+				return
+			}
+			if err := pm.network.SendMessage(ctx, p, out); err != nil {
+				log.Infof("could not flush wantlist changes to %s on shutdown: %s", p, err)
 			}
-			req <- peers
-		case <-pm.ctx.Done():
+		}(p, mq)
+	}
+	wg.Wait()
+}
+
+func (pm *WantManager) broadcast(entries []*bsmsg.Entry) {
+	if pm.hasBroadcastFloor {
+		var es []*bsmsg.Entry
+		for _, e := range entries {
+			if e.Cancel || !pm.belowFloor(e.Entry) {
+				es = append(es, e)
+			}
+		}
+		entries = es
+	}
+	pm.forEachPeer(func(p peer.ID, mq *msgQueue) {
+		if pm.peerTiers[p] != PeerTierLowPriority {
+			mq.addMessage(entries)
 			return
 		}
+
+		// new wants wait for the next rebroadcast, so only cancels for
+		// the wants the peer was told about are sent
+		var cancels []*bsmsg.Entry
+		for _, e := range entries {
+			if _, told := mq.wl.Contains(e.Cid); told && e.Cancel {
+				cancels = append(cancels, e)
+			}
+		}
+		if len(cancels) > 0 {
+			mq.addMessage(cancels)
+		}
+	})
+}
+
+// forEachPeer calls fn with each connected peer and its queue, in the order
+// broadcasts go out in.
+func (pm *WantManager) forEachPeer(fn func(peer.ID, *msgQueue)) {
+	if !pm.sortedBroadcast {
+		for p, mq := range pm.peers {
+			fn(p, mq)
+		}
+		return
+	}
+
+	ids := make([]string, 0, len(pm.peers))
+	for p := range pm.peers {
+		ids = append(ids, string(p))
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		p := peer.ID(id)
+		fn(p, pm.peers[p])
 	}
 }
 
 func (wm *WantManager) newMsgQueue(p peer.ID) *msgQueue {
-	return &msgQueue{
-		done:    make(chan struct{}),
-		work:    make(chan struct{}, 1),
-		network: wm.network,
-		p:       p,
-		refcnt:  1,
+	mq := &msgQueue{
+		done:      make(chan struct{}),
+		work:      make(chan struct{}, 1),
+		wl:        wantlist.NewThreadSafe(),
+		network:   wm.network,
+		p:         p,
+		refcnt:    1,
+		started:   time.Now(),
+		chunkSize: wm.seedChunkSize,
+		classify:  wm.errorClassifier,
+		onGiveUp:  func(wlm bsmsg.BitSwapMessage, err error) { wm.sendGivenUp(p, wlm, err) },
+
+		senderFactory: wm.senderFactory,
+
+		onSendError: wm.recordSendError,
+		dials:       wm.dials,
+
+		onSenderEvent: func(ev SenderEvent) { wm.senderEvent(p, ev) },
+
+		budget:    wm.pendingBudget,
+		onDropped: func(n int) { wm.shedCounter.Add(float64(n)) },
+
+		combine:         wm.combine,
+		onWantQueued:    wm.countSendAttempt,
+		onWantSent:      wm.wantSentTracer(p),
+		wantlistVersion: func() uint64 { return wm.version },
+
+		errorThreshold: wm.errorThreshold,
+		quarantine:     wm.quarantine,
+		onQuarantined:  func(until time.Time) { wm.peerQuarantined(p, until) },
+
+		onSeeded: func(size int) { wm.peerSeeded(p, size) },
+
+		maxSize:     wm.maxMessageSize,
+		oversized:   wm.oversizedPolicy,
+		onOversized: func(c *cid.Cid, size int) { wm.oversizedEntry(p, c, size) },
+
+		disconnectDelay: wm.disconnectDelay,
+		departed:        func() <-chan struct{} { return wm.departed(p) },
+
+		batchWindow: wm.batchWindow,
+
+		paused: &wm.paused,
+
+		working: make(chan struct{}, 1),
+
+		idleTimeout: wm.idleTimeout,
+
+		recoverCrash: wm.watchdogInterval > 0,
+	}
+	mq.unpark = func() { wm.restartQueue(mq) }
+	mq.restart = func() { wm.startQueue(mq) }
+	if wm.sendConcurrency > 1 {
+		mq.slots = make(chan bsnet.MessageSender, wm.sendConcurrency)
+		for i := 0; i < wm.sendConcurrency; i++ {
+			mq.slots <- nil
+		}
+		mq.inflight = make(map[string]chan struct{})
 	}
+	return mq
 }
 
-func (mq *msgQueue) addMessage(entries []*bsmsg.Entry) {
+// addMessage queues entries to be sent to the peer. It returns false,
+// leaving the entries to the caller, if the queue was shut down.
+func (mq *msgQueue) addMessage(entries []*bsmsg.Entry) bool {
 	mq.outlk.Lock()
+	if mq.closed {
+		mq.outlk.Unlock()
+		return false
+	}
+	if mq.parked {
+		// started again, seeded with our full wantlist. parked is
+		// cleared first so signalWork does not start it as well
+		mq.parked = false
+		mq.outlk.Unlock()
+		mq.unpark()
+		mq.outlk.Lock()
+	}
 	defer func() {
 		mq.outlk.Unlock()
-		select {
-		case mq.work <- struct{}{}:
-		default:
-		}
+		mq.signalWork()
 	}()
 
 	// if we have no message held allocate a new one
@@ -369,11 +6323,280 @@ func (mq *msgQueue) addMessage(entries []*bsmsg.Entry) {
 	// TODO: add a msg.Combine(...) method
 	// otherwise, combine the one we are holding with the
 	// one passed in
-	for _, e := range entries {
+	var pending map[string]int
+	if mq.combine != CombineLatest {
+		pending = make(map[string]int)
+		for _, e := range mq.out.Wantlist() {
+			if !e.Cancel {
+				pending[e.Cid.KeyString()] = e.Priority
+			}
+		}
+	}
+	for _, e := range coalesceEntries(entries) {
+		if !e.Cancel && mq.superseded(e, pending) {
+			continue
+		}
+		delete(mq.deadlines, e.Cid.KeyString())
 		if e.Cancel {
+			mq.cancelsQueued++
+			delete(pending, e.Cid.KeyString())
+			if _, told := mq.wl.Contains(e.Cid); told {
+				mq.rememberCancel(e.Cid)
+			}
+			mq.abortCancelled(e.Cid)
 			mq.out.Cancel(e.Cid)
+			mq.removeSeed(e.Cid)
+			mq.wl.Remove(e.Cid)
+		} else {
+			mq.wantsQueued++
+			mq.out.AddAnnotatedEntry(e.Cid, e.Priority, e.Flags)
+			mq.onWantQueued(e.Cid)
+			delete(mq.cancelled, e.Cid.KeyString())
+			if pending != nil {
+				pending[e.Cid.KeyString()] = e.Priority
+			}
+			// out now carries the want, a stale priority must not
+			// follow it with the rest of the initial wantlist
+			mq.removeSeed(e.Cid)
+			told, ok := mq.wl.Contains(e.Cid)
+			if ok && (told.Priority != e.Priority || told.Flags != e.Flags) {
+				// recorded anew so rebroadcasts, and for
+				// CombineRejectDowngrade later downgrades, go by
+				// the priority sent last
+				mq.wl.Remove(e.Cid)
+				ok = false
+			}
+			if !ok {
+				mq.wl.AddEntry(&wantlist.Entry{Cid: e.Cid, Priority: e.Priority, Flags: e.Flags, RefCnt: 1})
+			}
+		}
+	}
+	mq.version = mq.wantlistVersion()
+	mq.accountOut()
+	if mq.budget.exceeded() {
+		mq.shedWants()
+	}
+	return true
+}
+
+// superseded returns whether want e is dropped by the combine strategy in
+// favour of the want for its cid in pending, the wants of out by priority,
+// or for CombineRejectDowngrade the one the peer was already sent.
+func (mq *msgQueue) superseded(e *bsmsg.Entry, pending map[string]int) bool {
+	switch mq.combine {
+	case CombineMaxPriority:
+		prio, ok := pending[e.Cid.KeyString()]
+		return ok && prio > e.Priority
+	case CombineRejectDowngrade:
+		if prio, ok := pending[e.Cid.KeyString()]; ok {
+			return prio > e.Priority
+		}
+		told, ok := mq.wl.Contains(e.Cid)
+		return ok && told.Priority > e.Priority
+	}
+	return false
+}
+
+// pendingBudget tracks the size of the messages queued for all peers
+// against max. used is accessed atomically.
+type pendingBudget struct {
+	used int64
+	max  int64
+}
+
+func (b *pendingBudget) exceeded() bool {
+	return b != nil && atomic.LoadInt64(&b.used) > b.max
+}
+
+// entryBytes is how much e counts towards the pending bytes budget.
+func entryBytes(e bsmsg.Entry) int64 {
+	return int64(len(e.Cid.Bytes()))
+}
+
+// accountOut updates the budget with the current size of out. outlk must be
+// held.
+func (mq *msgQueue) accountOut() {
+	if mq.budget == nil {
+		return
+	}
+	var n int64
+	if mq.out != nil {
+		for _, e := range mq.out.Wantlist() {
+			n += entryBytes(e)
+		}
+	}
+	atomic.AddInt64(&mq.budget.used, n-mq.outBytes)
+	mq.outBytes = n
+}
+
+// shedWants drops the lowest priority wants from out until the budget is
+// met again, or no wants are left. Dropped wants are forgotten in wl, so
+// they go out again with a later rebroadcast. outlk must be held.
+func (mq *msgQueue) shedWants() {
+	var wants []bsmsg.Entry
+	kept := bsmsg.New(mq.out.Full())
+	room := mq.budget.max - (atomic.LoadInt64(&mq.budget.used) - mq.outBytes)
+	for _, e := range mq.out.Wantlist() {
+		if e.Cancel {
+			kept.Cancel(e.Cid)
+			room -= entryBytes(e)
 		} else {
-			mq.out.AddEntry(e.Cid, e.Priority)
+			wants = append(wants, e)
+		}
+	}
+
+	sort.Sort(byEntryPriority(wants))
+	var dropped int
+	for _, e := range wants {
+		if n := entryBytes(e); n <= room {
+			kept.AddAnnotatedEntry(e.Cid, e.Priority, e.Flags)
+			room -= n
+			continue
+		}
+		mq.wl.Remove(e.Cid)
+		delete(mq.deadlines, e.Cid.KeyString())
+		dropped++
+	}
+	if dropped == 0 {
+		return
+	}
+
+	log.Infof("dropped %d queued wants for %s, over the pending bytes budget", dropped, mq.p)
+	mq.out = kept
+	mq.accountOut()
+	mq.onDropped(dropped)
+}
+
+// byEntryPriority sorts message entries by priority, highest first.
+type byEntryPriority []bsmsg.Entry
+
+func (es byEntryPriority) Len() int           { return len(es) }
+func (es byEntryPriority) Swap(i, j int)      { es[i], es[j] = es[j], es[i] }
+func (es byEntryPriority) Less(i, j int) bool { return es[i].Priority > es[j].Priority }
+
+const (
+	// maxCancelResends is how many times a cancel is sent again to a peer
+	// that keeps sending us the block.
+	maxCancelResends = 3
+
+	// cancelMemory is how long a cancel sent to a peer is remembered.
+	cancelMemory = time.Minute
+)
+
+// sentCancel records a cancel sent to a peer, and how many times it was
+// sent again since.
+type sentCancel struct {
+	at     time.Time
+	resent int
+}
+
+// rememberCancel records that c was cancelled at the peer. outlk must be
+// held.
+func (mq *msgQueue) rememberCancel(c *cid.Cid) {
+	if mq.cancelled == nil {
+		mq.cancelled = make(map[string]*sentCancel)
+	}
+	mq.cancelled[c.KeyString()] = &sentCancel{at: time.Now()}
+}
+
+// lostCancels returns cancels to send again for the cids in ks we already
+// cancelled at the peer.
+func (mq *msgQueue) lostCancels(ks []*cid.Cid) []*bsmsg.Entry {
+	mq.outlk.Lock()
+	defer mq.outlk.Unlock()
+
+	var es []*bsmsg.Entry
+	for _, k := range ks {
+		sc, ok := mq.cancelled[k.KeyString()]
+		if !ok || sc.resent >= maxCancelResends {
+			continue
+		}
+		sc.resent++
+		es = append(es, &bsmsg.Entry{
+			Cancel: true,
+			Entry:  &wantlist.Entry{Cid: k, RefCnt: 1},
+		})
+	}
+	return es
+}
+
+// pruneCancels forgets cancels sent longer than cancelMemory ago.
+func (mq *msgQueue) pruneCancels() {
+	mq.outlk.Lock()
+	defer mq.outlk.Unlock()
+	for k, sc := range mq.cancelled {
+		if time.Since(sc.at) >= cancelMemory {
+			delete(mq.cancelled, k)
+		}
+	}
+}
+
+// settle waits up to d for the queue to finish the send in progress, if any.
+func (mq *msgQueue) settle(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case mq.working <- struct{}{}:
+		<-mq.working
+	case <-timer.C:
+		log.Debugf("send to %s still in progress after %s, tearing down anyway", mq.p, d)
+	}
+}
+
+// shutdown stops the queue and returns the entries it had not sent yet.
+// Entries added afterwards are refused by addMessage.
+func (mq *msgQueue) shutdown() []*bsmsg.Entry {
+	mq.outlk.Lock()
+	defer mq.outlk.Unlock()
+
+	mq.closed = true
+	close(mq.done)
+	if mq.pool != nil {
+		// a worker closes the senders
+		mq.pool.schedule(mq)
+	}
+	if mq.out == nil {
+		return nil
+	}
+
+	var stranded []*bsmsg.Entry
+	for _, e := range mq.out.Wantlist() {
+		e := e
+		stranded = append(stranded, &e)
+	}
+	mq.out = nil
+	mq.accountOut()
+	return stranded
+}
+
+// coalesceEntries keeps only the last entry for each cid in entries, so
+// that an add and a cancel for the same cid in one batch net out to
+// whichever came last instead of both being sent.
+func coalesceEntries(entries []*bsmsg.Entry) []*bsmsg.Entry {
+	last := make(map[string]int, len(entries))
+	for i, e := range entries {
+		last[e.Cid.KeyString()] = i
+	}
+	if len(last) == len(entries) {
+		return entries
+	}
+
+	out := make([]*bsmsg.Entry, 0, len(last))
+	for i, e := range entries {
+		if last[e.Cid.KeyString()] == i {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// removeSeed drops c from the part of the initial wantlist we have not sent
+// yet. outlk must be held.
+func (mq *msgQueue) removeSeed(c *cid.Cid) {
+	for i, e := range mq.seed {
+		if e.Cid.Equals(c) {
+			mq.seed = append(mq.seed[:i], mq.seed[i+1:]...)
+			return
 		}
 	}
 }
@@ -0,0 +1,6156 @@
+package bitswap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-ipfs/blocks"
+	blocksutil "github.com/ipfs/go-ipfs/blocks/blocksutil"
+	engine "github.com/ipfs/go-ipfs/exchange/bitswap/decision"
+	bsmsg "github.com/ipfs/go-ipfs/exchange/bitswap/message"
+	pb "github.com/ipfs/go-ipfs/exchange/bitswap/message/pb"
+	bsnet "github.com/ipfs/go-ipfs/exchange/bitswap/network"
+	wantlist "github.com/ipfs/go-ipfs/exchange/bitswap/wantlist"
+	testutil "github.com/ipfs/go-ipfs/thirdparty/testutil"
+
+	metrics "gx/ipfs/QmRg1gKTHzc3CZXSKzem8aR4E3TubFhbgXwfVuWnSK5CC5/go-metrics-interface"
+	cid "gx/ipfs/QmYhQaCYEcaPPjxJX7YcPcVKkQfRy6sJ7B3XmGFk82XYdQ/go-cid"
+	ggio "gx/ipfs/QmZ4Qi3GaRbjcx28Sme5eMH7RQjGkt8wHxt2a65oLaeFEV/gogo-protobuf/io"
+	peer "gx/ipfs/QmdS9KpbDyPrieswibZhkod1oXqRwZJrUPzxCofAMWpFGq/go-libp2p-peer"
+)
+
+// fakeNetwork is a BitSwapNetwork that records every message sent through it
+type fakeNetwork struct {
+	lk   sync.Mutex
+	msgs map[peer.ID][]bsmsg.BitSwapMessage
+
+	// optional hooks to make dialing or sending slow or fail
+	connectHook func(context.Context, peer.ID) error
+	sendHook    func(context.Context, peer.ID, bsmsg.BitSwapMessage) error
+
+	// wire encodings requested by peers, and what was sent to them
+	encodings map[peer.ID]bsmsg.Encoding
+	encoded   map[peer.ID][][]byte
+
+	// number of senders opened to each peer
+	senders map[peer.ID]int
+
+	// capabilities advertised by peers
+	caps map[peer.ID]bsnet.PeerCapabilities
+}
+
+func newFakeNetwork() *fakeNetwork {
+	return &fakeNetwork{
+		msgs:    make(map[peer.ID][]bsmsg.BitSwapMessage),
+		senders: make(map[peer.ID]int),
+	}
+}
+
+func (n *fakeNetwork) SendMessage(ctx context.Context, p peer.ID, msg bsmsg.BitSwapMessage) error {
+	if n.sendHook != nil {
+		if err := n.sendHook(ctx, p, msg); err != nil {
+			return err
+		}
+	}
+	n.record(p, msg)
+	return nil
+}
+
+func (n *fakeNetwork) SetDelegate(bsnet.Receiver) {}
+
+func (n *fakeNetwork) ConnectTo(ctx context.Context, p peer.ID) error {
+	if n.connectHook != nil {
+		return n.connectHook(ctx, p)
+	}
+	return nil
+}
+
+func (n *fakeNetwork) NewMessageSender(ctx context.Context, p peer.ID) (bsnet.MessageSender, error) {
+	n.lk.Lock()
+	n.senders[p]++
+	n.lk.Unlock()
+
+	if caps, ok := n.caps[p]; ok {
+		return &fakeCapabilitySender{fakeSender{net: n, p: p}, caps}, nil
+	}
+	if enc, ok := n.encodings[p]; ok {
+		return &fakeEncodingSender{fakeSender{net: n, p: p}, enc}, nil
+	}
+	return &fakeSender{net: n, p: p}, nil
+}
+
+func (n *fakeNetwork) FindProvidersAsync(context.Context, *cid.Cid, int) <-chan peer.ID {
+	out := make(chan peer.ID)
+	close(out)
+	return out
+}
+
+func (n *fakeNetwork) Provide(context.Context, *cid.Cid) error {
+	return nil
+}
+
+func (n *fakeNetwork) record(p peer.ID, msg bsmsg.BitSwapMessage) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	n.msgs[p] = append(n.msgs[p], msg)
+}
+
+func (n *fakeNetwork) openedSenders(p peer.ID) int {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	return n.senders[p]
+}
+
+func (n *fakeNetwork) messages(p peer.ID) []bsmsg.BitSwapMessage {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	return append([]bsmsg.BitSwapMessage(nil), n.msgs[p]...)
+}
+
+// waitMessages waits until at least count messages were sent to p
+func (n *fakeNetwork) waitMessages(t *testing.T, p peer.ID, count int) []bsmsg.BitSwapMessage {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		msgs := n.messages(p)
+		if len(msgs) >= count {
+			return msgs
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d messages to %s, got %d", count, p, len(msgs))
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+}
+
+type fakeSender struct {
+	net *fakeNetwork
+	p   peer.ID
+}
+
+func (s *fakeSender) SendMsg(ctx context.Context, msg bsmsg.BitSwapMessage) error {
+	return s.net.SendMessage(ctx, s.p, msg)
+}
+
+func (s *fakeSender) Close() error {
+	return nil
+}
+
+type fakeCapabilitySender struct {
+	fakeSender
+	caps bsnet.PeerCapabilities
+}
+
+func (s *fakeCapabilitySender) Capabilities() bsnet.PeerCapabilities {
+	return s.caps
+}
+
+type fakeEncodingSender struct {
+	fakeSender
+	enc bsmsg.Encoding
+}
+
+func (s *fakeEncodingSender) Encoding() bsmsg.Encoding {
+	return s.enc
+}
+
+func (s *fakeEncodingSender) SendEncoded(ctx context.Context, data []byte) error {
+	s.net.lk.Lock()
+	defer s.net.lk.Unlock()
+	if s.net.encoded == nil {
+		s.net.encoded = make(map[peer.ID][][]byte)
+	}
+	s.net.encoded[s.p] = append(s.net.encoded[s.p], data)
+	return nil
+}
+
+func newTestWantManager(net bsnet.BitSwapNetwork, opts ...WantManagerOption) (*WantManager, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wm := NewWantManager(ctx, net, opts...)
+	go wm.Run()
+	return wm, cancel
+}
+
+func testCids(n int) []*cid.Cid {
+	bgen := blocksutil.NewBlockGenerator()
+	var out []*cid.Cid
+	for _, b := range bgen.Blocks(n) {
+		out = append(out, b.Cid())
+	}
+	return out
+}
+
+// waitFor polls cond until it is true or a timeout expires
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for " + what)
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+}
+
+// waitIdle waits until the Run loop has picked up every buffered event
+func waitIdle(t *testing.T, wm *WantManager) {
+	waitFor(t, "buffered events", func() bool {
+		return len(wm.incoming) == 0 && len(wm.connect) == 0 && len(wm.disconnect) == 0
+	})
+}
+
+func TestSeedWantlistInChunks(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithSeedChunkSize(10))
+	defer cancel()
+
+	ks := testCids(35)
+	wm.WantBlocks(context.Background(), ks)
+	waitFor(t, "wantlist", func() bool { return wm.wl.Len() == len(ks) })
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+
+	msgs := net.waitMessages(t, p, 4)
+	if len(msgs) != 4 {
+		t.Fatalf("expected 4 seed messages, got %d", len(msgs))
+	}
+
+	seen := cid.NewSet()
+	lastPriority := -1
+	for i, msg := range msgs {
+		if msg.Full() != (i == 0) {
+			t.Fatalf("only the first seed message should be full (msg %d)", i)
+		}
+		entries := msg.Wantlist()
+		if len(entries) > 10 {
+			t.Fatalf("message %d has %d entries, more than the chunk size", i, len(entries))
+		}
+
+		lowest := -1
+		for _, e := range entries {
+			if lastPriority >= 0 && e.Priority >= lastPriority {
+				t.Fatalf("message %d contains priority %d, not below the previous chunk", i, e.Priority)
+			}
+			if lowest < 0 || e.Priority < lowest {
+				lowest = e.Priority
+			}
+			seen.Add(e.Cid)
+		}
+		lastPriority = lowest
+	}
+
+	if seen.Len() != len(ks) {
+		t.Fatalf("expected all %d wants to be seeded, got %d", len(ks), seen.Len())
+	}
+}
+
+func TestOnPeerSeeded(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithSeedChunkSize(2))
+	defer cancel()
+
+	seeded := make(chan peer.ID, 4)
+	wm.OnPeerSeeded(func(p peer.ID) { seeded <- p })
+
+	ks := testCids(6)
+	wm.WantBlocks(context.Background(), ks[:5])
+	waitFor(t, "wantlist", func() bool { return wm.wl.Len() == 5 })
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+
+	select {
+	case sp := <-seeded:
+		if sp != p {
+			t.Fatalf("expected %s to be seeded, got %s", p, sp)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the seed to complete")
+	}
+	if msgs := net.messages(p); len(msgs) != 3 {
+		t.Fatalf("expected all 3 seed messages sent before the callback, got %d", len(msgs))
+	}
+
+	// later updates are not seeds
+	wm.WantBlocks(context.Background(), ks[5:])
+	net.waitSent(t, p, ks[5])
+	waitIdle(t, wm)
+	select {
+	case <-seeded:
+		t.Fatal("an update was reported as a seed")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestLeakedPeers(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithLeakThresholds(3, 0))
+	defer cancel()
+
+	leaky := testutil.RandPeerIDFatal(t)
+	fine := testutil.RandPeerIDFatal(t)
+	for i := 0; i < 5; i++ {
+		wm.Connected(leaky)
+	}
+	wm.Connected(fine)
+	wm.Connected(fine)
+	wm.Disconnected(fine)
+	waitIdle(t, wm)
+
+	leaked := wm.LeakedPeers()
+	if len(leaked) != 1 || leaked[0] != leaky {
+		t.Fatalf("expected only %s to be reported as leaked, got %v", leaky, leaked)
+	}
+
+	for i := 0; i < 3; i++ {
+		wm.Disconnected(leaky)
+	}
+	waitIdle(t, wm)
+	if leaked := wm.LeakedPeers(); len(leaked) != 0 {
+		t.Fatalf("expected no leaked peers after disconnecting, got %v", leaked)
+	}
+}
+
+func TestLeakedPeersIdle(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithLeakThresholds(0, time.Millisecond*50))
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+	if leaked := wm.LeakedPeers(); len(leaked) != 0 {
+		t.Fatalf("freshly connected peer reported as leaked: %v", leaked)
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	leaked := wm.LeakedPeers()
+	if len(leaked) != 1 || leaked[0] != p {
+		t.Fatalf("expected idle peer to be reported as leaked, got %v", leaked)
+	}
+}
+
+func TestSendBlockToPeers(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	bgen := blocksutil.NewBlockGenerator()
+	blk := bgen.Next()
+
+	var peers []peer.ID
+	for i := 0; i < 5; i++ {
+		peers = append(peers, testutil.RandPeerIDFatal(t))
+	}
+	other := testutil.RandPeerIDFatal(t)
+
+	// a peer named twice is sent the block once
+	if errs := wm.SendBlockToPeers(context.Background(), blk, append(peers, peers[0])); errs != nil {
+		t.Fatal(errs)
+	}
+
+	for _, p := range peers {
+		msgs := net.messages(p)
+		if len(msgs) != 1 {
+			t.Fatalf("expected exactly one message to %s, got %d", p, len(msgs))
+		}
+		blks := msgs[0].Blocks()
+		if len(blks) != 1 || !blks[0].Cid().Equals(blk.Cid()) {
+			t.Fatalf("peer %s did not receive the block", p)
+		}
+	}
+	if msgs := net.messages(other); len(msgs) != 0 {
+		t.Fatal("block sent to a peer that was not asked for")
+	}
+}
+
+func TestSendBlockToPeersErrors(t *testing.T) {
+	errSend := errors.New("send failed")
+	bad := testutil.RandPeerIDFatal(t)
+	net := newFakeNetwork()
+	net.sendHook = func(_ context.Context, p peer.ID, _ bsmsg.BitSwapMessage) error {
+		if p == bad {
+			return errSend
+		}
+		return nil
+	}
+	good := testutil.RandPeerIDFatal(t)
+	gate := &fakeSendGate{blocked: map[peer.ID]bool{good: true, bad: true}}
+	wm, cancel := newTestWantManager(net, WithSendGate(gate))
+	defer cancel()
+
+	bgen := blocksutil.NewBlockGenerator()
+	blk := bgen.Next()
+
+	// the sends wait for the gate like SendBlock's
+	ctx, cancelSend := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelSend()
+	errs := wm.SendBlockToPeers(ctx, blk, []peer.ID{good, bad})
+	if len(errs) != 2 || errs[good] != context.DeadlineExceeded {
+		t.Fatalf("expected both sends to be held by the gate, got %v", errs)
+	}
+	if len(net.messages(good)) != 0 {
+		t.Fatal("expected nothing sent past the gate")
+	}
+
+	gate.unblock(good)
+	gate.unblock(bad)
+	errs = wm.SendBlockToPeers(context.Background(), blk, []peer.ID{good, bad})
+	if len(errs) != 1 || errs[bad] != errSend {
+		t.Fatalf("expected only the error of the failing peer, got %v", errs)
+	}
+	if len(net.messages(good)) != 1 {
+		t.Fatal("expected the block to be sent to the other peer")
+	}
+}
+
+func TestNoLostWakeupUnderConcurrentAdds(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	net := newFakeNetwork()
+	wm := NewWantManager(ctx, net)
+	p := testutil.RandPeerIDFatal(t)
+	mq := wm.newMsgQueue(p)
+	go mq.runQueue(ctx)
+
+	const adders = 8
+	const perAdder = 200
+	ks := testCids(adders * perAdder)
+
+	var wg sync.WaitGroup
+	for i := 0; i < adders; i++ {
+		wg.Add(1)
+		go func(ks []*cid.Cid) {
+			defer wg.Done()
+			for _, k := range ks {
+				mq.addMessage([]*bsmsg.Entry{{
+					Entry: &wantlist.Entry{Cid: k, Priority: 1},
+				}})
+			}
+		}(ks[i*perAdder : (i+1)*perAdder])
+	}
+	wg.Wait()
+
+	waitFor(t, "all entries to be sent", func() bool {
+		seen := cid.NewSet()
+		for _, msg := range net.messages(p) {
+			for _, e := range msg.Wantlist() {
+				seen.Add(e.Cid)
+			}
+		}
+		return seen.Len() == len(ks)
+	})
+}
+
+func TestDumpPeerQueues(t *testing.T) {
+	stuck := testutil.RandPeerIDFatal(t)
+	healthy := testutil.RandPeerIDFatal(t)
+
+	net := newFakeNetwork()
+	net.connectHook = func(ctx context.Context, p peer.ID) error {
+		if p == stuck {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	ks := testCids(3)
+	wm.WantBlocks(context.Background(), ks)
+	waitFor(t, "wantlist", func() bool { return wm.wl.Len() == len(ks) })
+
+	wm.Connected(stuck)
+	wm.Connected(healthy)
+	net.waitMessages(t, healthy, 1)
+	waitIdle(t, wm)
+
+	dump := wm.DumpPeerQueues()
+	if len(dump) != 2 {
+		t.Fatalf("expected two peers in dump, got %d", len(dump))
+	}
+
+	d := dump[stuck]
+	if len(d.Pending) != len(ks) || len(d.Wantlist) != len(ks) {
+		t.Fatalf("stuck peer: expected %d pending and wanted, got %d and %d",
+			len(ks), len(d.Pending), len(d.Wantlist))
+	}
+	if d.SenderOpen || d.RefCount != 1 {
+		t.Fatalf("stuck peer: unexpected sender state %v or refcount %d", d.SenderOpen, d.RefCount)
+	}
+
+	waitFor(t, "healthy queue to drain", func() bool {
+		d := wm.DumpPeerQueues(healthy)[healthy]
+		return len(d.Pending) == 0 && d.SenderOpen
+	})
+	if d := wm.DumpPeerQueues(healthy); len(d) != 1 || len(d[healthy].Wantlist) != len(ks) {
+		t.Fatalf("expected only the healthy peer with %d wants, got %v", len(ks), d)
+	}
+}
+
+func TestAllPeerWantlists(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	ps := []peer.ID{testutil.RandPeerIDFatal(t), testutil.RandPeerIDFatal(t), testutil.RandPeerIDFatal(t)}
+	for _, p := range ps {
+		wm.Connected(p)
+	}
+	waitIdle(t, wm)
+
+	ks := testCids(4)
+	wm.WantBlocks(context.Background(), ks[:1])
+	wm.WantBlocksFrom(context.Background(), ks[1:2], ps[:1])
+	wm.WantBlocksFrom(context.Background(), ks[2:], ps[1:2])
+	waitIdle(t, wm)
+
+	expected := map[peer.ID][]*cid.Cid{
+		ps[0]: {ks[0], ks[1]},
+		ps[1]: {ks[0], ks[2], ks[3]},
+		ps[2]: {ks[0]},
+	}
+	all := wm.AllPeerWantlists(0)
+	if len(all) != len(ps) {
+		t.Fatalf("expected the wantlists of %d peers, got %d", len(ps), len(all))
+	}
+	for p, want := range expected {
+		got := cid.NewSet()
+		for _, e := range all[p] {
+			got.Add(e.Cid)
+		}
+		if got.Len() != len(want) {
+			t.Fatalf("expected %d wants for %s, got %d", len(want), p, got.Len())
+		}
+		for _, c := range want {
+			if !got.Has(c) {
+				t.Fatalf("expected %s to be wanted from %s", c, p)
+			}
+		}
+	}
+
+	// the limit keeps the highest priority wants of each peer
+	limited := wm.AllPeerWantlists(1)
+	if es := limited[ps[1]]; len(es) != 1 || es[0].Priority != all[ps[1]][0].Priority {
+		t.Fatalf("expected only the highest priority want, got %v", es)
+	}
+
+	// the result is a copy
+	wm.CancelWants(ks)
+	waitIdle(t, wm)
+	if len(all[ps[1]]) != 3 || len(wm.AllPeerWantlists(0)[ps[1]]) != 0 {
+		t.Fatal("expected the earlier result to be left alone by cancels")
+	}
+}
+
+func TestWarmPeer(t *testing.T) {
+	var lk sync.Mutex
+	dials := make(map[peer.ID]int)
+
+	net := newFakeNetwork()
+	net.connectHook = func(ctx context.Context, p peer.ID) error {
+		lk.Lock()
+		defer lk.Unlock()
+		dials[p]++
+		return nil
+	}
+	dialsTo := func(p peer.ID) int {
+		lk.Lock()
+		defer lk.Unlock()
+		return dials[p]
+	}
+
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.WarmPeer(p)
+	waitFor(t, "sender to be opened", func() bool { return dialsTo(p) == 1 })
+
+	if msgs := net.messages(p); len(msgs) != 0 {
+		t.Fatal("warming a peer should not send it anything")
+	}
+	if peers := wm.ConnectedPeers(); len(peers) != 0 {
+		t.Fatal("warmed peer should not count as connected")
+	}
+
+	wm.Connected(p)
+	wm.WantBlocks(context.Background(), testCids(1))
+	net.waitMessages(t, p, 1)
+
+	if dialsTo(p) != 1 {
+		t.Fatalf("expected the warmed sender to be reused, dialed %d times", dialsTo(p))
+	}
+}
+
+// sentCids returns every cid that was wanted in a message sent to p
+func (n *fakeNetwork) sentCids(p peer.ID) *cid.Set {
+	set := cid.NewSet()
+	for _, msg := range n.messages(p) {
+		for _, e := range msg.Wantlist() {
+			if !e.Cancel {
+				set.Add(e.Cid)
+			}
+		}
+	}
+	return set
+}
+
+// waitSent waits until c was wanted in a message sent to p
+func (n *fakeNetwork) waitSent(t *testing.T, p peer.ID, c *cid.Cid) {
+	waitFor(t, "want to be sent", func() bool {
+		return n.sentCids(p).Has(c)
+	})
+}
+
+func TestTargetFallbackBroadcast(t *testing.T) {
+	for _, fallback := range []bool{false, true} {
+		net := newFakeNetwork()
+		var opts []WantManagerOption
+		if fallback {
+			opts = append(opts, WithTargetFallbackBroadcast())
+		}
+		wm, cancel := newTestWantManager(net, opts...)
+
+		a := testutil.RandPeerIDFatal(t)
+		b := testutil.RandPeerIDFatal(t)
+		gone := testutil.RandPeerIDFatal(t)
+		wm.Connected(a)
+		wm.Connected(b)
+		waitIdle(t, wm)
+
+		ks := testCids(2)
+		wm.WantBlocksFrom(context.Background(), ks[:1], []peer.ID{gone})
+		// an untargeted want afterwards tells us when the first was handled
+		wm.WantBlocks(context.Background(), ks[1:])
+
+		for _, p := range []peer.ID{a, b} {
+			net.waitSent(t, p, ks[1])
+			if net.sentCids(p).Has(ks[0]) != fallback {
+				t.Fatalf("fallback %v: unexpected delivery of targeted want", fallback)
+			}
+		}
+		cancel()
+	}
+}
+
+func TestNewWantManagerNilNetwork(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a nil network to be rejected")
+		}
+	}()
+	NewWantManager(context.Background(), nil)
+}
+
+func TestNoopNetwork(t *testing.T) {
+	wm, cancel := newTestWantManager(bsnet.NoopNetwork{})
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	wm.WantBlocks(context.Background(), testCids(2))
+	waitIdle(t, wm)
+	if err := wm.DrainPeer(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+
+	bgen := blocksutil.NewBlockGenerator()
+	env := &engine.Envelope{Peer: p, Block: bgen.Next(), Sent: func() {}}
+	if err := wm.SendBlockErr(context.Background(), env); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendBlockErr(t *testing.T) {
+	errSend := errors.New("send failed")
+	net := newFakeNetwork()
+	net.sendHook = func(context.Context, peer.ID, bsmsg.BitSwapMessage) error {
+		return errSend
+	}
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	bgen := blocksutil.NewBlockGenerator()
+	var sent int
+	env := &engine.Envelope{
+		Peer:  testutil.RandPeerIDFatal(t),
+		Block: bgen.Next(),
+		Sent:  func() { sent++ },
+	}
+
+	if err := wm.SendBlockErr(context.Background(), env); err != errSend {
+		t.Fatalf("expected send error to be returned, got %v", err)
+	}
+	if sent != 1 {
+		t.Fatalf("expected Sent to be called once, got %d", sent)
+	}
+
+	net.sendHook = nil
+	if err := wm.SendBlockErr(context.Background(), env); err != nil {
+		t.Fatal(err)
+	}
+	if sent != 2 {
+		t.Fatalf("expected Sent to be called once per send, got %d", sent)
+	}
+}
+
+func TestSendBlockWithPriority(t *testing.T) {
+	p := testutil.RandPeerIDFatal(t)
+	bgen := blocksutil.NewBlockGenerator()
+	first, low, high := bgen.Next(), bgen.Next(), bgen.Next()
+
+	// the first block holds up the others until released
+	release := make(chan struct{})
+	var lk sync.Mutex
+	var order []*cid.Cid
+	net := newFakeNetwork()
+	net.sendHook = func(_ context.Context, _ peer.ID, msg bsmsg.BitSwapMessage) error {
+		blk := msg.Blocks()[0]
+		if blk.Cid().Equals(first.Cid()) {
+			<-release
+		}
+		lk.Lock()
+		order = append(order, blk.Cid())
+		lk.Unlock()
+		return nil
+	}
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	waiting := func(n int) {
+		waitFor(t, "blocks to wait their turn", func() bool {
+			wm.blockLk.Lock()
+			defer wm.blockLk.Unlock()
+			line, ok := wm.blockLines[p]
+			return ok && len(line.waiting) == n
+		})
+	}
+
+	var wg sync.WaitGroup
+	send := func(blk blocks.Block, priority int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			env := &engine.Envelope{Peer: p, Block: blk, Sent: func() {}}
+			if err := wm.SendBlockWithPriority(context.Background(), env, priority); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	send(first, 0)
+	waiting(0)
+	send(low, 1)
+	waiting(1)
+	send(high, 5)
+	waiting(2)
+	close(release)
+	wg.Wait()
+
+	want := []*cid.Cid{first.Cid(), high.Cid(), low.Cid()}
+	if fmt.Sprint(order) != fmt.Sprint(want) {
+		t.Fatalf("expected blocks sent in order %v, got %v", want, order)
+	}
+	if _, ok := wm.blockLines[p]; ok {
+		t.Fatal("expected the line of the peer to be gone once all blocks were sent")
+	}
+}
+
+func TestSendBlockConcurrent(t *testing.T) {
+	p := testutil.RandPeerIDFatal(t)
+	bgen := blocksutil.NewBlockGenerator()
+
+	// each send is held up until both are under way
+	var inflight sync.WaitGroup
+	inflight.Add(2)
+	both := make(chan struct{})
+	go func() {
+		inflight.Wait()
+		close(both)
+	}()
+	net := newFakeNetwork()
+	net.sendHook = func(context.Context, peer.ID, bsmsg.BitSwapMessage) error {
+		inflight.Done()
+		select {
+		case <-both:
+			return nil
+		case <-time.After(5 * time.Second):
+			return errors.New("blocks to the same peer were not sent side by side")
+		}
+	}
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		env := &engine.Envelope{Peer: p, Block: bgen.Next(), Sent: func() {}}
+		go func() { errs <- wm.SendBlockErr(context.Background(), env) }()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPerPeerEncoding(t *testing.T) {
+	// two made up encodings that are easy to tell apart
+	encA := bsmsg.Encoding("test/a")
+	encB := bsmsg.Encoding("test/b")
+	for _, enc := range []bsmsg.Encoding{encA, encB} {
+		enc := enc
+		bsmsg.RegisterEncoder(enc, func(m bsmsg.BitSwapMessage, w io.Writer) error {
+			for _, e := range m.Wantlist() {
+				fmt.Fprintf(w, "%s:%s;", enc, e.Cid)
+			}
+			return nil
+		})
+	}
+
+	a := testutil.RandPeerIDFatal(t)
+	b := testutil.RandPeerIDFatal(t)
+	net := newFakeNetwork()
+	net.encodings = map[peer.ID]bsmsg.Encoding{a: encA, b: encB}
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	wm.Connected(a)
+	wm.Connected(b)
+	waitIdle(t, wm)
+
+	k := testCids(1)[0]
+	wm.WantBlocks(context.Background(), []*cid.Cid{k})
+
+	for p, enc := range net.encodings {
+		expected := []byte(fmt.Sprintf("%s:%s;", enc, k))
+		waitFor(t, "encoded message", func() bool {
+			net.lk.Lock()
+			defer net.lk.Unlock()
+			for _, data := range net.encoded[p] {
+				if bytes.Equal(data, expected) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+}
+
+func TestDiffPeerWantlist(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+
+	ks := testCids(4)
+	wm.WantBlocks(context.Background(), ks[:3])
+	net.waitSent(t, p, ks[2])
+
+	// the peer lost ks[0] and still holds on to ks[3] we never asked for
+	missing, extra := wm.DiffPeerWantlist(p, []*cid.Cid{ks[1], ks[2], ks[3]})
+	if len(missing) != 1 || !missing[0].Equals(ks[0]) {
+		t.Fatalf("expected %s to be missing, got %v", ks[0], missing)
+	}
+	if len(extra) != 1 || !extra[0].Equals(ks[3]) {
+		t.Fatalf("expected %s to be extra, got %v", ks[3], extra)
+	}
+
+	missing, extra = wm.DiffPeerWantlist(p, ks[:3])
+	if len(missing) != 0 || len(extra) != 0 {
+		t.Fatalf("expected no difference, got %v and %v", missing, extra)
+	}
+}
+
+func TestReconcilePeer(t *testing.T) {
+	ks := testCids(3)
+
+	// the update with ks[1] is dropped, so the peer never learns about it
+	var lk sync.Mutex
+	dropped := false
+	net := newFakeNetwork()
+	net.sendHook = func(_ context.Context, _ peer.ID, msg bsmsg.BitSwapMessage) error {
+		lk.Lock()
+		defer lk.Unlock()
+		for _, e := range msg.Wantlist() {
+			if e.Cid.Equals(ks[1]) && !dropped {
+				dropped = true
+				return errors.New("send failed")
+			}
+		}
+		return nil
+	}
+	giveUp := func(error) RetryDecision { return SendGiveUp }
+	wm, cancel := newTestWantManager(net, WithErrorClassifier(giveUp))
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+	wm.WantBlocks(context.Background(), ks[:1])
+	net.waitSent(t, p, ks[0])
+	wm.WantBlocks(context.Background(), ks[1:2])
+	waitFor(t, "update to be dropped", func() bool {
+		lk.Lock()
+		defer lk.Unlock()
+		return dropped
+	})
+	if err := wm.DrainPeer(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	sent := len(net.messages(p))
+
+	// the peer also holds on to ks[2] we never asked it for
+	wm.ReconcilePeer(p, []*cid.Cid{ks[0], ks[2]})
+	msgs := net.waitMessages(t, p, sent+1)
+	delta := msgs[len(msgs)-1].Wantlist()
+	if len(delta) != 2 {
+		t.Fatalf("expected two corrections, got %d", len(delta))
+	}
+	for _, e := range delta {
+		switch {
+		case e.Cid.Equals(ks[1]) && !e.Cancel:
+		case e.Cid.Equals(ks[2]) && e.Cancel:
+		default:
+			t.Fatalf("unexpected correction for %s, cancel %t", e.Cid, e.Cancel)
+		}
+	}
+
+	// nothing is sent once in sync
+	wm.ReconcilePeer(p, ks[:2])
+	if err := wm.DrainPeer(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	if len(net.messages(p)) != sent+1 {
+		t.Fatal("expected no corrections for a peer in sync")
+	}
+}
+
+func TestPeerBytesSent(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+
+	ks := testCids(3)
+	wm.WantBlocks(context.Background(), ks[:1])
+	net.waitSent(t, p, ks[0])
+	wm.WantBlocks(context.Background(), ks[1:])
+	wm.CancelWants(ks[:1])
+	net.waitSent(t, p, ks[2])
+	if err := wm.DrainPeer(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+
+	var size uint64
+	for _, msg := range net.messages(p) {
+		var buf bytes.Buffer
+		if err := msg.ToNetV1(&buf); err != nil {
+			t.Fatal(err)
+		}
+		size += uint64(buf.Len())
+	}
+	if sent := wm.PeerBytesSent(p); sent != size {
+		t.Fatalf("expected %d bytes sent, got %d", size, sent)
+	}
+	if sent := wm.PeerBytesSent(testutil.RandPeerIDFatal(t)); sent != 0 {
+		t.Fatalf("expected nothing sent to an unknown peer, got %d", sent)
+	}
+}
+
+func TestResendFullWantlist(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+
+	ks := testCids(3)
+	wm.WantBlocks(context.Background(), ks)
+	net.waitSent(t, p, ks[2])
+	if err := wm.DrainPeer(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	sent := len(net.messages(p))
+
+	if err := wm.ResendFullWantlist(p); err != nil {
+		t.Fatal(err)
+	}
+	msgs := net.waitMessages(t, p, sent+1)
+	if last := msgs[len(msgs)-1]; !last.Full() || len(last.Wantlist()) != len(ks) {
+		t.Fatal("expected the full wantlist to be resent")
+	}
+
+	if err := wm.ResendFullWantlist(testutil.RandPeerIDFatal(t)); err != errUnknownPeer {
+		t.Fatalf("expected errUnknownPeer for an unknown peer, got %v", err)
+	}
+}
+
+func TestShutdownDrain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wm := NewWantManager(ctx, newFakeNetwork(), WithShutdownDrain(time.Second))
+
+	ks := testCids(cap(wm.incoming) - 1)
+	for _, k := range ks {
+		wm.WantBlocks(context.Background(), []*cid.Cid{k})
+	}
+	wm.CancelWants(ks[:1])
+	cancel()
+
+	// Run returns right away as the context is already cancelled
+	wm.Run()
+
+	if wm.wl.Len() != len(ks)-1 {
+		t.Fatalf("expected %d wants after draining, got %d", len(ks)-1, wm.wl.Len())
+	}
+	if _, ok := wm.wl.Contains(ks[0]); ok {
+		t.Fatal("cancel issued before shutdown was lost")
+	}
+}
+
+func TestSentHistogramBuckets(t *testing.T) {
+	created := make(map[string][]float64)
+	orig := newHistogram
+	newHistogram = func(ctx context.Context, name, help string, buckets []float64) metrics.Histogram {
+		created[name] = buckets
+		return orig(ctx, name, help, buckets)
+	}
+	defer func() { newHistogram = orig }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	NewWantManager(ctx, newFakeNetwork())
+	if len(created["sent_all_blocks_bytes"]) != len(metricsBuckets) {
+		t.Fatal("expected default buckets to be used")
+	}
+
+	custom := []float64{1 << 20, 1 << 24, 1 << 28}
+	NewWantManager(ctx, newFakeNetwork(), WithSentHistogramBuckets(custom))
+	buckets := created["sent_all_blocks_bytes"]
+	if len(buckets) != len(custom) {
+		t.Fatalf("expected custom buckets, got %v", buckets)
+	}
+	for i := range custom {
+		if buckets[i] != custom[i] {
+			t.Fatalf("expected custom buckets, got %v", buckets)
+		}
+	}
+}
+
+// fakeHistogram records the values it observes.
+type fakeHistogram struct {
+	lk     sync.Mutex
+	values []float64
+}
+
+func (h *fakeHistogram) Observe(v float64) {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+	h.values = append(h.values, v)
+}
+
+func (h *fakeHistogram) observed() []float64 {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+	return append([]float64(nil), h.values...)
+}
+
+func TestSeedHistogram(t *testing.T) {
+	seeds := new(fakeHistogram)
+	orig := newHistogram
+	newHistogram = func(ctx context.Context, name, help string, buckets []float64) metrics.Histogram {
+		if name == "peer_seed_bytes" {
+			return seeds
+		}
+		return orig(ctx, name, help, buckets)
+	}
+	defer func() { newHistogram = orig }()
+
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithSeedChunkSize(2))
+	defer cancel()
+
+	ks := testCids(5)
+	wm.WantBlocks(context.Background(), ks)
+	waitIdle(t, wm)
+
+	// the seed goes out in three chunks, observed as one
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	msgs := net.waitMessages(t, p, 3)
+	var size int
+	for _, msg := range msgs {
+		size += bsmsg.EstimateSize(msg)
+	}
+	waitFor(t, "seed to be observed", func() bool { return len(seeds.observed()) == 1 })
+	if v := seeds.observed()[0]; v != float64(size) {
+		t.Fatalf("expected a seed of %d bytes, got %v", size, v)
+	}
+
+	// later updates are not seeds
+	wm.WantBlocks(context.Background(), testCids(6)[5:])
+	net.waitMessages(t, p, 4)
+	if err := wm.DrainPeer(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	if obs := seeds.observed(); len(obs) != 1 {
+		t.Fatalf("expected only the seed to be observed, got %v", obs)
+	}
+}
+
+func TestTotalPending(t *testing.T) {
+	stuck := make(map[peer.ID]bool)
+	for i := 0; i < 3; i++ {
+		stuck[testutil.RandPeerIDFatal(t)] = true
+	}
+	healthy := testutil.RandPeerIDFatal(t)
+
+	net := newFakeNetwork()
+	net.connectHook = func(ctx context.Context, p peer.ID) error {
+		if stuck[p] {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	ks := testCids(2)
+	wm.WantBlocks(context.Background(), ks)
+	waitFor(t, "wantlist", func() bool { return wm.wl.Len() == len(ks) })
+
+	for p := range stuck {
+		wm.Connected(p)
+	}
+	wm.Connected(healthy)
+	net.waitMessages(t, healthy, 1)
+	waitIdle(t, wm)
+
+	if n := wm.TotalPendingMessages(); n != len(stuck) {
+		t.Fatalf("expected %d peers with pending messages, got %d", len(stuck), n)
+	}
+	if n := wm.TotalPendingEntries(); n != len(stuck)*len(ks) {
+		t.Fatalf("expected %d pending entries, got %d", len(stuck)*len(ks), n)
+	}
+}
+
+func TestRebroadcastChunks(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithRebroadcastChunkSize(3))
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	ks := testCids(10)
+	wm.WantBlocks(context.Background(), ks)
+	sent := len(net.waitMessages(t, p, 1))
+
+	covered := cid.NewSet()
+	for tick := 0; tick < 4; tick++ {
+		wm.runSync(wm.rebroadcast)
+		msgs := net.waitMessages(t, p, sent+1)
+		sent = len(msgs)
+
+		entries := msgs[len(msgs)-1].Wantlist()
+		if len(entries) > 3 {
+			t.Fatalf("rebroadcast %d sent %d entries, more than the chunk size", tick, len(entries))
+		}
+		for _, e := range entries {
+			covered.Add(e.Cid)
+		}
+	}
+
+	if covered.Len() != len(ks) {
+		t.Fatalf("expected rebroadcasts to cover all %d wants, covered %d", len(ks), covered.Len())
+	}
+}
+
+func TestRebroadcastFanoutCap(t *testing.T) {
+	tracer := new(recordingTracer)
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithRebroadcastFanoutCap(3), WithWantTracer(tracer))
+	defer cancel()
+
+	ps := make([]peer.ID, 10)
+	for i := range ps {
+		ps[i] = testutil.RandPeerIDFatal(t)
+		wm.Connected(ps[i])
+	}
+	ks := testCids(1)
+	wm.WantBlocks(context.Background(), ks)
+	waitIdle(t, wm)
+
+	// each refreshed peer is traced once, as there is a single want
+	rebroadcasts := func() []string {
+		var out []string
+		for _, stage := range tracer.stages(ks[0]) {
+			if strings.HasPrefix(stage, fmt.Sprintf("%d ", WantRebroadcast)) {
+				out = append(out, stage)
+			}
+		}
+		return out
+	}
+
+	refreshed := make(map[string]int)
+	for tick := 0; tick < 4; tick++ {
+		wm.runSync(wm.rebroadcast)
+		waitFor(t, "rebroadcast to be traced", func() bool { return len(rebroadcasts()) >= 3*(tick+1) })
+		rs := rebroadcasts()
+		if len(rs) != 3*(tick+1) {
+			t.Fatalf("tick %d: expected 3 more peers refreshed, got %d", tick, len(rs)-3*tick)
+		}
+		for _, r := range rs[3*tick:] {
+			refreshed[r]++
+		}
+	}
+
+	// 12 refreshes over 10 peers: everyone once, two of them twice
+	if len(refreshed) != len(ps) {
+		t.Fatalf("expected all %d peers to be refreshed, got %d", len(ps), len(refreshed))
+	}
+	for r, n := range refreshed {
+		if n > 2 {
+			t.Fatalf("%s was refreshed %d times", r, n)
+		}
+	}
+}
+
+// fakeMetric is a Counter and Gauge whose value, and the highest value it
+// had, can be read by tests.
+type fakeMetric struct {
+	lk   sync.Mutex
+	val  float64
+	peak float64
+}
+
+func (m *fakeMetric) Add(v float64) { m.update(func() { m.val += v }) }
+func (m *fakeMetric) Set(v float64) { m.update(func() { m.val = v }) }
+func (m *fakeMetric) Sub(v float64) { m.Add(-v) }
+func (m *fakeMetric) Inc()          { m.Add(1) }
+func (m *fakeMetric) Dec()          { m.Add(-1) }
+
+func (m *fakeMetric) update(f func()) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	f()
+	if m.val > m.peak {
+		m.peak = m.val
+	}
+}
+
+func (m *fakeMetric) value() float64 {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return m.val
+}
+
+func (m *fakeMetric) peakValue() float64 {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return m.peak
+}
+
+func TestMetricsLabel(t *testing.T) {
+	var names []string
+	origHistogram, origGauge, origCounter := newHistogram, newGauge, newCounter
+	newHistogram = func(ctx context.Context, name, help string, buckets []float64) metrics.Histogram {
+		names = append(names, metrics.CtxGetScope(ctx)+"."+name)
+		return origHistogram(ctx, name, help, buckets)
+	}
+	newGauge = func(ctx context.Context, name, help string) metrics.Gauge {
+		names = append(names, metrics.CtxGetScope(ctx)+"."+name)
+		return origGauge(ctx, name, help)
+	}
+	newCounter = func(ctx context.Context, name, help string) metrics.Counter {
+		names = append(names, metrics.CtxGetScope(ctx)+"."+name)
+		return origCounter(ctx, name, help)
+	}
+	defer func() { newHistogram, newGauge, newCounter = origHistogram, origGauge, origCounter }()
+
+	ctx, cancel := context.WithCancel(metrics.CtxScope(context.Background(), "ipfs"))
+	defer cancel()
+	created := func(opts ...WantManagerOption) []string {
+		names = nil
+		NewWantManager(ctx, newFakeNetwork(), opts...)
+		return names
+	}
+
+	plain := created()
+	tcp := created(WithMetricsLabel("tcp"))
+	quic := created(WithMetricsLabel("quic"))
+	if len(tcp) != len(plain) || len(quic) != len(plain) {
+		t.Fatalf("expected every manager to create %d metrics, got %d and %d", len(plain), len(tcp), len(quic))
+	}
+	for i := range plain {
+		if !strings.HasPrefix(plain[i], "ipfs.") || strings.Contains(plain[i], "tcp") {
+			t.Fatalf("expected %s in the scope of the context", plain[i])
+		}
+		if tcp[i] != strings.Replace(plain[i], "ipfs.", "ipfs.tcp.", 1) {
+			t.Fatalf("expected %s to be labelled tcp, got %s", plain[i], tcp[i])
+		}
+		if quic[i] != strings.Replace(plain[i], "ipfs.", "ipfs.quic.", 1) {
+			t.Fatalf("expected %s to be labelled quic, got %s", plain[i], quic[i])
+		}
+	}
+}
+
+func TestPeerConnectionMetrics(t *testing.T) {
+	created := make(map[string]*fakeMetric)
+	origGauge, origCounter := newGauge, newCounter
+	newGauge = func(ctx context.Context, name, help string) metrics.Gauge {
+		created[name] = &fakeMetric{}
+		return created[name]
+	}
+	newCounter = func(ctx context.Context, name, help string) metrics.Counter {
+		created[name] = &fakeMetric{}
+		return created[name]
+	}
+	defer func() { newGauge, newCounter = origGauge, origCounter }()
+
+	wm, cancel := newTestWantManager(newFakeNetwork())
+	defer cancel()
+
+	check := func(connected, disconnected, current float64) {
+		waitIdle(t, wm)
+		wm.runSync(func() {})
+		if v := created["peers_connected_total"].value(); v != connected {
+			t.Fatalf("expected %v connects, got %v", connected, v)
+		}
+		if v := created["peers_disconnected_total"].value(); v != disconnected {
+			t.Fatalf("expected %v disconnects, got %v", disconnected, v)
+		}
+		if v := created["peers_current"].value(); v != current {
+			t.Fatalf("expected %v current peers, got %v", current, v)
+		}
+	}
+
+	a := testutil.RandPeerIDFatal(t)
+	b := testutil.RandPeerIDFatal(t)
+
+	wm.Connected(a)
+	wm.Connected(a)
+	check(2, 0, 1)
+
+	wm.Connected(b)
+	check(3, 0, 2)
+
+	// a is still connected once
+	wm.Disconnected(a)
+	check(3, 1, 2)
+
+	wm.Disconnected(a)
+	wm.Disconnected(b)
+	check(3, 3, 0)
+}
+
+func TestUnknownTargetPolicy(t *testing.T) {
+	ks := testCids(6)
+	target := ks[0]
+
+	setup := func(policy UnknownTargetPolicy) (*fakeNetwork, *WantManager, peer.ID, func()) {
+		net := newFakeNetwork()
+		wm, cancel := newTestWantManager(net, WithUnknownTargetPolicy(policy), WithSeedChunkSize(1))
+		wm.WantBlocks(context.Background(), ks[1:])
+
+		p := testutil.RandPeerIDFatal(t)
+		wm.WantBlocksFrom(context.Background(), []*cid.Cid{target}, []peer.ID{p})
+		waitIdle(t, wm)
+		wm.runSync(func() {})
+		return net, wm, p, cancel
+	}
+
+	t.Run("drop", func(t *testing.T) {
+		net, wm, p, cancel := setup(UnknownTargetDrop)
+		defer cancel()
+
+		if len(net.messages(p)) != 0 {
+			t.Fatal("expected nothing to be sent to the unknown peer")
+		}
+		if len(wm.pending) != 0 {
+			t.Fatal("expected the want not to be held back")
+		}
+	})
+
+	t.Run("connect", func(t *testing.T) {
+		net, wm, p, cancel := setup(UnknownTargetConnect)
+		defer cancel()
+
+		net.waitSent(t, p, target)
+		if len(wm.ConnectedPeers()) != 1 {
+			t.Fatal("expected a queue to be started for the target")
+		}
+
+		// the queue only counts as a connection once the peer connects
+		wm.Connected(p)
+		wm.Disconnected(p)
+		waitIdle(t, wm)
+		waitFor(t, "peer to be removed", func() bool { return len(wm.ConnectedPeers()) == 0 })
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		net, wm, p, cancel := setup(UnknownTargetQueue)
+		defer cancel()
+
+		if len(net.messages(p)) != 0 {
+			t.Fatal("expected nothing to be sent before the peer connects")
+		}
+
+		wm.Connected(p)
+		msgs := net.waitMessages(t, p, 1)
+		var found bool
+		for _, e := range msgs[0].Wantlist() {
+			found = found || e.Cid.Equals(target)
+		}
+		if !found {
+			t.Fatal("expected the held back want in the first message")
+		}
+		var left int
+		wm.runSync(func() { left = len(wm.pending) })
+		if left != 0 {
+			t.Fatal("expected held back wants to be cleared")
+		}
+	})
+}
+
+func TestBoostPeer(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	a := testutil.RandPeerIDFatal(t)
+	b := testutil.RandPeerIDFatal(t)
+	wm.Connected(a)
+	wm.Connected(b)
+
+	ks := testCids(3)
+	wm.WantBlocks(context.Background(), ks)
+	net.waitSent(t, a, ks[2])
+	net.waitSent(t, b, ks[2])
+
+	before := make(map[string]int)
+	for _, e := range wm.wl.Entries() {
+		before[e.Cid.KeyString()] = e.Priority
+	}
+	sentA, sentB := len(net.messages(a)), len(net.messages(b))
+
+	wm.BoostPeer(a, -10)
+	msgs := net.waitMessages(t, a, sentA+1)
+	boosted := msgs[len(msgs)-1].Wantlist()
+	if len(boosted) != len(ks) {
+		t.Fatalf("expected all %d wants to be resent, got %d", len(ks), len(boosted))
+	}
+	for _, e := range boosted {
+		if e.Priority != before[e.Cid.KeyString()]-10 {
+			t.Fatalf("expected priority %d, got %d", before[e.Cid.KeyString()]-10, e.Priority)
+		}
+	}
+
+	// boosts add up, and b is untouched
+	wm.BoostPeer(a, 5)
+	msgs = net.waitMessages(t, a, sentA+2)
+	for _, e := range msgs[len(msgs)-1].Wantlist() {
+		if e.Priority != before[e.Cid.KeyString()]-5 {
+			t.Fatalf("expected boosts to add up, got priority %d", e.Priority)
+		}
+	}
+	if len(net.messages(b)) != sentB {
+		t.Fatal("expected no messages to the other peer")
+	}
+}
+
+func TestEffectivePriority(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	a := testutil.RandPeerIDFatal(t)
+	b := testutil.RandPeerIDFatal(t)
+	wm.Connected(a)
+	wm.Connected(b)
+	waitIdle(t, wm)
+
+	ks := testCids(2)
+	wm.WantBlocks(context.Background(), ks[:1])
+	wm.WantBlocksFrom(context.Background(), ks[1:], []peer.ID{b})
+	waitIdle(t, wm)
+	wm.runSync(func() {})
+
+	global, _ := wm.wl.Contains(ks[0])
+	wm.BoostPeer(a, -10)
+
+	if prio, ok := wm.EffectivePriority(a, ks[0]); !ok || prio != global.Priority-10 {
+		t.Fatalf("expected the boosted peer to see priority %d, got %d", global.Priority-10, prio)
+	}
+	if prio, ok := wm.EffectivePriority(b, ks[0]); !ok || prio != global.Priority {
+		t.Fatalf("expected the other peer to see priority %d, got %d", global.Priority, prio)
+	}
+	if _, ok := wm.EffectivePriority(a, ks[1]); ok {
+		t.Fatal("expected a want the peer was not told about to be absent")
+	}
+	if _, ok := wm.EffectivePriority(testutil.RandPeerIDFatal(t), ks[0]); ok {
+		t.Fatal("expected nothing for a peer we are not connected to")
+	}
+}
+
+func TestOperationLog(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithOperationLog(4))
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	ks := testCids(3)
+	wm.Connected(p)
+	waitIdle(t, wm)
+	wm.WantBlocks(context.Background(), ks[:2])
+	waitIdle(t, wm)
+	wm.CancelWants(ks[:1])
+	waitIdle(t, wm)
+
+	ops := wm.OperationLog()
+	if len(ops) != 3 {
+		t.Fatalf("expected 3 operations, got %d", len(ops))
+	}
+	if ops[0].Kind != OpConnect || ops[0].Peer != p {
+		t.Fatal("expected the connect first")
+	}
+	if ops[1].Kind != OpWant || len(ops[1].Cids) != 2 || !ops[1].Cids[1].Equals(ks[1]) {
+		t.Fatal("expected the wants second")
+	}
+	if ops[2].Kind != OpCancel || len(ops[2].Cids) != 1 || !ops[2].Cids[0].Equals(ks[0]) {
+		t.Fatal("expected the cancel third")
+	}
+	for i := 1; i < len(ops); i++ {
+		if ops[i].Time.Before(ops[i-1].Time) {
+			t.Fatal("expected operations in order")
+		}
+	}
+
+	// the oldest operations are evicted once the log is full
+	wm.WantBlocks(context.Background(), ks[2:])
+	waitIdle(t, wm)
+	wm.Disconnected(p)
+	waitIdle(t, wm)
+	ops = wm.OperationLog()
+	var kinds []OperationKind
+	for _, op := range ops {
+		kinds = append(kinds, op.Kind)
+	}
+	want := []OperationKind{OpWant, OpCancel, OpWant, OpDisconnect}
+	if fmt.Sprint(kinds) != fmt.Sprint(want) {
+		t.Fatalf("expected operations %v, got %v", want, kinds)
+	}
+
+	plain, cancelPlain := newTestWantManager(net)
+	defer cancelPlain()
+	if plain.OperationLog() != nil {
+		t.Fatal("expected no log unless enabled")
+	}
+}
+
+func TestWantSetOrdering(t *testing.T) {
+	wm, cancel := newTestWantManager(newFakeNetwork(), WithOperationLog(1000))
+	defer cancel()
+
+	ks := testCids(6)
+	mine, others := ks[:3], ks[3:]
+
+	// another goroutine competing for the incoming channel
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			wm.WantBlocks(context.Background(), others)
+			wm.CancelWants(others)
+		}
+	}()
+
+	// were any cancel to overtake its add, the cancel would find nothing
+	// to remove and the add would be left over
+	for i := 0; i < 100; i++ {
+		wm.WantBlocks(context.Background(), mine)
+		wm.CancelWants(mine)
+	}
+	wm.WantBlocks(context.Background(), mine[:1])
+	<-done
+	waitIdle(t, wm)
+
+	if snap := wm.Snapshot(); snap.Len() != 1 || !snap.Contains(mine[0]) {
+		t.Fatalf("expected only %s to be wanted, got %d wants", mine[0], snap.Len())
+	}
+
+	// the changes of each goroutine are applied in the order they were made
+	last := make(map[string]uint64)
+	for _, op := range wm.OperationLog() {
+		if op.Kind != OpWant && op.Kind != OpCancel {
+			continue
+		}
+		for _, c := range op.Cids {
+			k := c.KeyString()
+			if op.Seq <= last[k] {
+				t.Fatalf("change %d applied after change %d", op.Seq, last[k])
+			}
+			last[k] = op.Seq
+		}
+	}
+	if len(last) != len(ks) {
+		t.Fatalf("expected changes to all %d cids to be logged, got %d", len(ks), len(last))
+	}
+}
+
+func TestOldestPendingWant(t *testing.T) {
+	wm, cancel := newTestWantManager(newFakeNetwork())
+	defer cancel()
+
+	if c, _ := wm.OldestPendingWant(); c != nil {
+		t.Fatal("expected no pending want on an empty wantlist")
+	}
+
+	ks := testCids(3)
+	for _, k := range ks {
+		wm.WantBlocks(context.Background(), []*cid.Cid{k})
+		waitIdle(t, wm)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c, age := wm.OldestPendingWant()
+	if c == nil || !c.Equals(ks[0]) {
+		t.Fatalf("expected %s to be the oldest want, got %v", ks[0], c)
+	}
+	if age < 30*time.Millisecond {
+		t.Fatalf("expected the oldest want to be at least 30ms old, got %s", age)
+	}
+
+	wm.CancelWants(ks[:1])
+	waitIdle(t, wm)
+	if c, _ := wm.OldestPendingWant(); c == nil || !c.Equals(ks[1]) {
+		t.Fatalf("expected %s to be the oldest want after a cancel, got %v", ks[1], c)
+	}
+}
+
+func TestAddMessageCoalescesEntries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wm := NewWantManager(ctx, newFakeNetwork())
+	mq := wm.newMsgQueue(testutil.RandPeerIDFatal(t))
+
+	ks := testCids(3)
+	entry := func(c *cid.Cid, cancel bool) *bsmsg.Entry {
+		return &bsmsg.Entry{Cancel: cancel, Entry: &wantlist.Entry{Cid: c, Priority: 1}}
+	}
+	mq.addMessage([]*bsmsg.Entry{
+		entry(ks[0], false),
+		entry(ks[1], true),
+		entry(ks[0], true),
+		entry(ks[2], false),
+		entry(ks[1], false),
+		entry(ks[0], false),
+		entry(ks[2], true),
+	})
+
+	want := map[string]bool{
+		ks[0].KeyString(): false,
+		ks[1].KeyString(): false,
+		ks[2].KeyString(): true,
+	}
+	entries := mq.out.Wantlist()
+	if len(entries) != len(want) {
+		t.Fatalf("expected %d entries, got %d", len(want), len(entries))
+	}
+	for _, e := range entries {
+		if e.Cancel != want[e.Cid.KeyString()] {
+			t.Fatalf("expected cancel=%v for %s", want[e.Cid.KeyString()], e.Cid)
+		}
+	}
+	for i, k := range ks {
+		if _, ok := mq.wl.Contains(k); ok == want[k.KeyString()] {
+			t.Fatalf("unexpected peer wantlist state for entry %d", i)
+		}
+	}
+}
+
+func TestCombineStrategy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := testCids(1)[0]
+	want := func(priority int) []*bsmsg.Entry {
+		return []*bsmsg.Entry{{Entry: &wantlist.Entry{Cid: c, Priority: priority}}}
+	}
+	pending := func(mq *msgQueue) int {
+		es := mq.out.Wantlist()
+		if len(es) != 1 {
+			return -1
+		}
+		return es[0].Priority
+	}
+
+	for _, tc := range []struct {
+		strategy CombineStrategy
+		// pending priority after queueing 5, 8 then 3
+		combined int
+		// whether 3 is queued after 8 went out
+		afterSend bool
+	}{
+		{CombineLatest, 3, true},
+		{CombineMaxPriority, 8, true},
+		{CombineRejectDowngrade, 8, false},
+	} {
+		wm := NewWantManager(ctx, newFakeNetwork(), WithCombineStrategy(tc.strategy))
+		mq := wm.newMsgQueue(testutil.RandPeerIDFatal(t))
+
+		mq.addMessage(want(5))
+		mq.addMessage(want(8))
+		mq.addMessage(want(3))
+		if got := pending(mq); got != tc.combined {
+			t.Fatalf("strategy %d: expected priority %d, got %d", tc.strategy, tc.combined, got)
+		}
+
+		// as if the message went out with priority 8
+		mq.out = nil
+		mq.addMessage(want(8))
+		mq.out = nil
+		mq.addMessage(want(3))
+		if queued := !mq.out.Empty(); queued != tc.afterSend {
+			t.Fatalf("strategy %d: expected the lower priority queued %t, got %t",
+				tc.strategy, tc.afterSend, queued)
+		}
+	}
+}
+
+func TestErrorClassifierGiveUp(t *testing.T) {
+	errTooLarge := errors.New("message too large")
+	ks := testCids(2)
+
+	var lk sync.Mutex
+	attempts := 0
+	net := newFakeNetwork()
+	net.sendHook = func(_ context.Context, _ peer.ID, msg bsmsg.BitSwapMessage) error {
+		for _, e := range msg.Wantlist() {
+			if e.Cid.Equals(ks[0]) {
+				lk.Lock()
+				attempts++
+				lk.Unlock()
+				return errTooLarge
+			}
+		}
+		return nil
+	}
+	classify := func(err error) RetryDecision {
+		if err == errTooLarge {
+			return SendGiveUp
+		}
+		return SendRetry
+	}
+	wm, cancel := newTestWantManager(net, WithErrorClassifier(classify))
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+
+	wm.WantBlocks(context.Background(), ks[:1])
+	waitFor(t, "failed send", func() bool {
+		lk.Lock()
+		defer lk.Unlock()
+		return attempts > 0
+	})
+
+	// a retried message would hold up the queue
+	wm.WantBlocks(context.Background(), ks[1:])
+	net.waitSent(t, p, ks[1])
+
+	lk.Lock()
+	defer lk.Unlock()
+	if attempts != 1 {
+		t.Fatalf("expected a single attempt to send the message, got %d", attempts)
+	}
+}
+
+func TestWantlistSnapshot(t *testing.T) {
+	wm, cancel := newTestWantManager(newFakeNetwork())
+	defer cancel()
+
+	ks := testCids(4)
+	wm.WantBlocks(context.Background(), ks[:2])
+	waitIdle(t, wm)
+
+	snap := wm.Snapshot()
+	if snap.Len() != 2 || !snap.Contains(ks[0]) || !snap.Contains(ks[1]) {
+		t.Fatal("expected the snapshot to hold the first two wants")
+	}
+	if wm.Snapshot() != snap {
+		t.Fatal("expected the snapshot to be reused while the wantlist is unchanged")
+	}
+
+	wm.WantBlocks(context.Background(), ks[2:])
+	wm.CancelWants(ks[:1])
+	waitIdle(t, wm)
+
+	if snap.Len() != 2 || !snap.Contains(ks[0]) || snap.Contains(ks[2]) {
+		t.Fatal("expected the snapshot not to change with the wantlist")
+	}
+	if len(snap.Entries()) != 2 {
+		t.Fatalf("expected 2 entries in the snapshot, got %d", len(snap.Entries()))
+	}
+
+	fresh := wm.Snapshot()
+	if fresh.Len() != 3 || fresh.Contains(ks[0]) || !fresh.Contains(ks[3]) {
+		t.Fatal("expected a new snapshot to reflect the changes")
+	}
+}
+
+func TestPerPeerSendConcurrency(t *testing.T) {
+	ks := testCids(2)
+	a, b := ks[0], ks[1]
+
+	var lk sync.Mutex
+	var events []string
+	running, maxRunning := 0, 0
+	net := newFakeNetwork()
+	net.sendHook = func(_ context.Context, _ peer.ID, msg bsmsg.BitSwapMessage) error {
+		var name string
+		for _, e := range msg.Wantlist() {
+			if e.Cid.Equals(a) {
+				name = fmt.Sprintf("cancel=%v", e.Cancel)
+			}
+		}
+
+		lk.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		events = append(events, "start "+name)
+		lk.Unlock()
+
+		time.Sleep(50 * time.Millisecond)
+
+		lk.Lock()
+		running--
+		events = append(events, "end "+name)
+		lk.Unlock()
+		return nil
+	}
+	started := func(n int) func() bool {
+		return func() bool {
+			lk.Lock()
+			defer lk.Unlock()
+			return len(events) >= n
+		}
+	}
+
+	wm, cancel := newTestWantManager(net, WithPerPeerSendConcurrency(3))
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+
+	wm.WantBlocks(context.Background(), []*cid.Cid{a})
+	waitFor(t, "first send", started(1))
+	wm.WantBlocks(context.Background(), []*cid.Cid{b})
+	waitFor(t, "second send", started(2))
+	wm.CancelWants([]*cid.Cid{a})
+	net.waitMessages(t, p, 3)
+
+	lk.Lock()
+	defer lk.Unlock()
+	if maxRunning < 2 {
+		t.Fatalf("expected sends to overlap, at most %d ran at once", maxRunning)
+	}
+
+	// the cancel must not start before the want it cancels was sent
+	order := make(map[string]int)
+	for i, e := range events {
+		order[e] = i
+	}
+	if order["start cancel=true"] < order["end cancel=false"] {
+		t.Fatalf("cancel overtook the want: %v", events)
+	}
+}
+
+func TestWantDebounce(t *testing.T) {
+	var oscillations *fakeMetric
+	orig := newCounter
+	newCounter = func(ctx context.Context, name, help string) metrics.Counter {
+		if name == "want_oscillation_total" {
+			oscillations = &fakeMetric{}
+			return oscillations
+		}
+		return orig(ctx, name, help)
+	}
+	defer func() { newCounter = orig }()
+
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithWantDebounce(100*time.Millisecond))
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+
+	ks := testCids(2)
+	c := ks[:1]
+	wm.WantBlocks(context.Background(), c)
+	net.waitSent(t, p, c[0])
+
+	// a single reversal goes out right away
+	wm.CancelWants(c)
+	msgs := net.waitMessages(t, p, 2)
+	entries := msgs[1].Wantlist()
+	if len(entries) != 1 || !entries[0].Cancel {
+		t.Fatal("expected the first cancel to be sent")
+	}
+
+	wm.WantBlocks(context.Background(), c)
+	wm.CancelWants(c)
+	wm.WantBlocks(context.Background(), c)
+	wm.WantBlocks(context.Background(), ks[1:])
+
+	msgs = net.waitMessages(t, p, 4)
+	time.Sleep(300 * time.Millisecond)
+	if msgs = net.messages(p); len(msgs) != 4 {
+		t.Fatalf("expected the flips to be sent as one want, got %d messages", len(msgs))
+	}
+
+	entries = msgs[3].Wantlist()
+	if len(entries) != 1 || !entries[0].Cid.Equals(c[0]) || entries[0].Cancel {
+		t.Fatal("expected the settled message to want the flipping cid again")
+	}
+	for _, e := range msgs[2].Wantlist() {
+		if e.Cid.Equals(c[0]) {
+			t.Fatal("expected the flips to be held back")
+		}
+	}
+
+	if v := oscillations.value(); v != 3 {
+		t.Fatalf("expected 3 oscillations, got %v", v)
+	}
+}
+
+func TestWantSatisfiedNotOscillating(t *testing.T) {
+	var oscillations *fakeMetric
+	orig := newCounter
+	newCounter = func(ctx context.Context, name, help string) metrics.Counter {
+		if name == "want_oscillation_total" {
+			oscillations = &fakeMetric{}
+			return oscillations
+		}
+		return orig(ctx, name, help)
+	}
+	defer func() { newCounter = orig }()
+
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithWantDebounce(time.Minute))
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+
+	c := testCids(1)
+	wm.WantBlocks(context.Background(), c)
+	wm.CancelWants(c)
+
+	var cancelled bool
+	waitFor(t, "the cancel to be sent", func() bool {
+		for _, m := range net.messages(p) {
+			for _, e := range m.Wantlist() {
+				cancelled = cancelled || e.Cancel && e.Cid.Equals(c[0])
+			}
+		}
+		return cancelled
+	})
+	if v := oscillations.value(); v != 0 {
+		t.Fatalf("expected a single add and cancel not to count as oscillating, got %v", v)
+	}
+}
+
+func TestMetricsSnapshot(t *testing.T) {
+	errSend := errors.New("send failed")
+	bad := testutil.RandPeerIDFatal(t)
+	net := newFakeNetwork()
+	net.sendHook = func(_ context.Context, p peer.ID, _ bsmsg.BitSwapMessage) error {
+		if p == bad {
+			return errSend
+		}
+		return nil
+	}
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	good := testutil.RandPeerIDFatal(t)
+	wm.Connected(good)
+	wm.Connected(testutil.RandPeerIDFatal(t))
+	ks := testCids(3)
+	wm.WantBlocks(context.Background(), ks)
+	wm.CancelWants(ks[:1])
+	waitIdle(t, wm)
+	wm.runSync(func() {})
+
+	bgen := blocksutil.NewBlockGenerator()
+	blk := bgen.Next()
+	for _, p := range []peer.ID{good, bad} {
+		wm.SendBlockErr(context.Background(), &engine.Envelope{Peer: p, Block: blk, Sent: func() {}})
+	}
+
+	snap := wm.MetricsSnapshot()
+	want := map[string]float64{
+		"wantlist_total":          2,
+		"sent_blocks_bytes_total": float64(2 * len(blk.RawData())),
+		"send_errors_total":       1,
+		"peers_current":           2,
+	}
+	for name, v := range want {
+		if snap[name] != v {
+			t.Fatalf("expected %s to be %v, got %v", name, v, snap[name])
+		}
+	}
+}
+
+func TestStrictSendAccounting(t *testing.T) {
+	bad := testutil.RandPeerIDFatal(t)
+	good := testutil.RandPeerIDFatal(t)
+	net := newFakeNetwork()
+	net.sendHook = func(ctx context.Context, p peer.ID, msg bsmsg.BitSwapMessage) error {
+		if p == bad {
+			return errors.New("send failed")
+		}
+		return nil
+	}
+
+	// send returns which callbacks of the envelope were called
+	send := func(wm *WantManager, p peer.ID, withFailed bool) (sent, failed bool) {
+		bgen := blocksutil.NewBlockGenerator()
+		env := &engine.Envelope{Peer: p, Block: bgen.Next(), Sent: func() { sent = true }}
+		if withFailed {
+			env.Failed = func() { failed = true }
+		}
+		wm.SendBlockErr(context.Background(), env)
+		return sent, failed
+	}
+
+	strict, cancel := newTestWantManager(net, WithStrictSendAccounting())
+	defer cancel()
+	if sent, failed := send(strict, bad, true); sent || !failed {
+		t.Fatalf("expected only Failed for a failed send, got sent %v and failed %v", sent, failed)
+	}
+	if sent, failed := send(strict, good, true); !sent || failed {
+		t.Fatalf("expected only Sent for a successful send, got sent %v and failed %v", sent, failed)
+	}
+	if sent, _ := send(strict, bad, false); !sent {
+		t.Fatal("expected Sent for a failed send without Failed")
+	}
+
+	plain, cancelPlain := newTestWantManager(net)
+	defer cancelPlain()
+	if sent, failed := send(plain, bad, true); !sent || failed {
+		t.Fatalf("expected Sent for a failed send by default, got sent %v and failed %v", sent, failed)
+	}
+}
+
+func TestSentSizeSummary(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	for _, size := range []int{10, 300, 42} {
+		blk := blocks.NewBlock(bytes.Repeat([]byte{'a'}, size))
+		wm.SendBlock(context.Background(), &engine.Envelope{Peer: p, Block: blk, Sent: func() {}})
+	}
+
+	count, total, max := wm.SentSizeSummary()
+	if count != 3 || total != 352 || max != 300 {
+		t.Fatalf("expected 3 blocks, 352 bytes and a largest block of 300, got %d, %d and %d", count, total, max)
+	}
+
+	wm.ResetSentStats()
+	count, total, max = wm.SentSizeSummary()
+	if count != 0 || total != 0 || max != 0 {
+		t.Fatal("expected the summary to be reset")
+	}
+
+	wm.SendBlock(context.Background(), &engine.Envelope{Peer: p, Block: blocks.NewBlock([]byte("block")), Sent: func() {}})
+	if count, total, max = wm.SentSizeSummary(); count != 1 || total != 5 || max != 5 {
+		t.Fatalf("expected only the block sent after the reset, got %d, %d and %d", count, total, max)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	before := time.Now()
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+
+	ks := testCids(4)
+	wm.WantBlocks(context.Background(), ks)
+	wm.CancelWants(ks[:1])
+	// not in our wantlist any more, so not counted
+	wm.CancelWants(ks[:1])
+	wm.WantBlocks(context.Background(), ks[:1])
+	wm.CancelWants(ks[1:2])
+	waitIdle(t, wm)
+
+	wm.ResetSentStats()
+	for i := 0; i < 2; i++ {
+		blk := blocks.NewBlock([]byte(fmt.Sprintf("block %d", i)))
+		wm.SendBlock(context.Background(), &engine.Envelope{Peer: p, Block: blk, Sent: func() {}})
+		// the summary is not affected by resets
+		wm.ResetSentStats()
+	}
+
+	s := wm.Summary()
+	if s.Started.Before(before) || s.Started.After(time.Now()) {
+		t.Fatalf("unexpected start time %s", s.Started)
+	}
+	if s.WantsAdded != 5 || s.WantsCancelled != 2 || s.BlocksSent != 2 {
+		t.Fatalf("expected 5 wants added, 2 cancelled and 2 blocks sent, got %+v", s)
+	}
+	if s.Wantlist != 3 || s.Peers != 1 {
+		t.Fatalf("expected 3 wants and 1 peer, got %+v", s)
+	}
+}
+
+func TestAbortCancelledSends(t *testing.T) {
+	net := newFakeNetwork()
+	started := make(chan struct{}, 1)
+	aborted := make(chan error, 1)
+	net.sendHook = func(ctx context.Context, _ peer.ID, msg bsmsg.BitSwapMessage) error {
+		wants := len(msg.Blocks()) > 0
+		for _, e := range msg.Wantlist() {
+			wants = wants || !e.Cancel
+		}
+		if !wants {
+			return nil
+		}
+		started <- struct{}{}
+		<-ctx.Done()
+		aborted <- ctx.Err()
+		return ctx.Err()
+	}
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+
+	ks := testCids(2)
+	wm.WantBlocks(context.Background(), ks)
+	<-started
+	wm.CancelWants(ks[:1])
+	select {
+	case <-aborted:
+		t.Fatal("expected the send to go on while it still carries a want")
+	case <-time.After(20 * time.Millisecond):
+	}
+	wm.CancelWants(ks[1:])
+	if err := <-aborted; err != context.Canceled {
+		t.Fatalf("expected the send to be aborted, got %v", err)
+	}
+
+	blk := blocks.NewBlock([]byte("large block"))
+	errs := make(chan error, 1)
+	go func() {
+		errs <- wm.SendBlockErr(context.Background(), &engine.Envelope{Peer: p, Block: blk, Sent: func() {}})
+	}()
+	<-started
+	wm.PeerCancelled(p, []*cid.Cid{blk.Cid()})
+	<-aborted
+	if err := <-errs; err != context.Canceled {
+		t.Fatalf("expected sending the block to be aborted, got %v", err)
+	}
+
+	if n := wm.MetricsSnapshot()["send_errors_total"]; n != 0 {
+		t.Fatalf("expected aborted sends not to count as errors, got %v", n)
+	}
+}
+
+func TestPriorityHistogram(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	ks := testCids(7)
+	add := func(k *cid.Cid, priority int) {
+		wm.queueWantSet(context.Background(), &wantSet{entries: []*bsmsg.Entry{{
+			Entry: &wantlist.Entry{Cid: k, Priority: priority, RefCnt: 1},
+		}}})
+	}
+	for i, priority := range []int{1, 1, 1, 5, 5, 9} {
+		add(ks[i], priority)
+	}
+	waitIdle(t, wm)
+	wm.runSync(func() {})
+
+	hist := wm.PriorityHistogram()
+	want := map[int]int{1: 3, 5: 2, 9: 1}
+	if len(hist) != len(want) {
+		t.Fatalf("expected %v, got %v", want, hist)
+	}
+	for p, n := range want {
+		if hist[p] != n {
+			t.Fatalf("expected %v, got %v", want, hist)
+		}
+	}
+
+	// a wide range of priorities is bucketed
+	add(ks[6], 1+priorityBuckets*100)
+	waitIdle(t, wm)
+	wm.runSync(func() {})
+	hist = wm.PriorityHistogram()
+	if len(hist) != 2 || hist[1] != 6 {
+		t.Fatalf("expected the low priorities to share a bucket, got %v", hist)
+	}
+	var total int
+	for _, n := range hist {
+		total += n
+	}
+	if total != 7 {
+		t.Fatalf("expected all 7 wants counted, got %d", total)
+	}
+}
+
+func TestMirrorPeer(t *testing.T) {
+	net := newFakeNetwork()
+	mirror := testutil.RandPeerIDFatal(t)
+	wm, cancel := newTestWantManager(net, WithMirrorPeer(mirror))
+	defer cancel()
+
+	a := testutil.RandPeerIDFatal(t)
+	wm.Connected(a)
+	waitIdle(t, wm)
+
+	// mirrored tells whether the last message the mirror peer got is our
+	// full wantlist, ks
+	mirrored := func(ks ...*cid.Cid) func() bool {
+		return func() bool {
+			msgs := net.messages(mirror)
+			if len(msgs) == 0 {
+				return false
+			}
+			last := msgs[len(msgs)-1]
+			if !last.Full() || len(last.Wantlist()) != len(ks) {
+				return false
+			}
+			got := cid.NewSet()
+			for _, e := range last.Wantlist() {
+				got.Add(e.Cid)
+			}
+			for _, k := range ks {
+				if !got.Has(k) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+
+	ks := testCids(3)
+	wm.WantBlocksFrom(context.Background(), ks[:2], []peer.ID{a})
+	waitFor(t, "the targeted wants to be mirrored", mirrored(ks[0], ks[1]))
+
+	wm.WantBlocks(context.Background(), ks[2:])
+	waitFor(t, "the new want to be mirrored", mirrored(ks...))
+
+	wm.CancelWants(ks[:1])
+	waitFor(t, "the cancel to be mirrored", mirrored(ks[1], ks[2]))
+
+	if net.sentCids(a).Len() != 3 {
+		t.Fatal("expected the regular peer to be sent the wants as usual")
+	}
+}
+
+func TestMaxQueueGoroutines(t *testing.T) {
+	// dials take a while, so the peers are dialled at the same time. A
+	// dial holds up a goroutine, so their number is bounded like that of
+	// the goroutines
+	var dialling, most int32
+	net := newFakeNetwork()
+	net.connectHook = func(context.Context, peer.ID) error {
+		n := atomic.AddInt32(&dialling, 1)
+		defer atomic.AddInt32(&dialling, -1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		return nil
+	}
+	wm, cancel := newTestWantManager(net, WithMaxQueueGoroutines(5))
+	defer cancel()
+	ks := testCids(3)
+	wm.WantBlocks(context.Background(), ks)
+	waitIdle(t, wm)
+	before := runtime.NumGoroutine()
+
+	// every peer is dialled and sent the wants as it connects
+	var peers []peer.ID
+	for i := 0; i < 50; i++ {
+		p := testutil.RandPeerIDFatal(t)
+		peers = append(peers, p)
+		wm.Connected(p)
+	}
+	for _, p := range peers {
+		net.waitSent(t, p, ks[2])
+	}
+	// the queues with a goroutine of their own, the pooled queues waiting
+	// in one and those waiting on a worker
+	if n := atomic.LoadInt32(&most); n > 5+2*queuePoolWorkers {
+		t.Fatalf("expected at most %d dials at once, got %d", 5+2*queuePoolWorkers, n)
+	}
+	waitFor(t, "the pooled queues to be done", func() bool {
+		return runtime.NumGoroutine()-before <= 5
+	})
+
+	for _, p := range peers {
+		wm.Disconnected(p)
+	}
+	waitIdle(t, wm)
+	waitFor(t, "the queue goroutines to return", func() bool {
+		return atomic.LoadInt32(&wm.queueGoroutines) == 0
+	})
+}
+
+func TestSendAttempts(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	a := testutil.RandPeerIDFatal(t)
+	b := testutil.RandPeerIDFatal(t)
+	wm.Connected(a)
+	wm.Connected(b)
+	waitIdle(t, wm)
+
+	ks := testCids(1)
+	wm.WantBlocks(context.Background(), ks)
+	waitIdle(t, wm)
+	wm.runSync(func() {})
+	if n := wm.SendAttempts(ks[0]); n != 2 {
+		t.Fatalf("expected the want to be sent to both peers, got %d attempts", n)
+	}
+
+	wm.runSync(wm.rebroadcast)
+	wm.runSync(wm.rebroadcast)
+	if n := wm.SendAttempts(ks[0]); n != 6 {
+		t.Fatalf("expected every rebroadcast to count, got %d attempts", n)
+	}
+
+	// a new peer is sent the want with our wantlist
+	wm.Connected(testutil.RandPeerIDFatal(t))
+	waitIdle(t, wm)
+	wm.runSync(func() {})
+	if n := wm.SendAttempts(ks[0]); n != 7 {
+		t.Fatalf("expected the new peer to count, got %d attempts", n)
+	}
+
+	wm.CancelWants(ks)
+	waitIdle(t, wm)
+	wm.runSync(func() {})
+	if n := wm.SendAttempts(ks[0]); n != 0 {
+		t.Fatalf("expected the count to be dropped on cancel, got %d", n)
+	}
+}
+
+func TestRebroadcastSkipsAckedPeers(t *testing.T) {
+	acking := testutil.RandPeerIDFatal(t)
+	plain := testutil.RandPeerIDFatal(t)
+	net := newFakeNetwork()
+	net.caps = map[peer.ID]bsnet.PeerCapabilities{
+		acking: {WantlistAcks: true},
+	}
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	wm.Connected(acking)
+	wm.Connected(plain)
+	waitIdle(t, wm)
+
+	// rebroadcast reports whether each peer was sent our wantlist again
+	rebroadcast := func() (toAcking, toPlain bool) {
+		before := map[peer.ID]int{
+			acking: len(net.messages(acking)),
+			plain:  len(net.messages(plain)),
+		}
+		wm.runSync(wm.rebroadcast)
+		for _, p := range []peer.ID{acking, plain} {
+			if err := wm.DrainPeer(context.Background(), p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return len(net.messages(acking)) > before[acking], len(net.messages(plain)) > before[plain]
+	}
+
+	ks := testCids(2)
+	wm.WantBlocks(context.Background(), ks[:1])
+	net.waitSent(t, acking, ks[0])
+	net.waitSent(t, plain, ks[0])
+	if err := wm.DrainPeer(context.Background(), acking); err != nil {
+		t.Fatal(err)
+	}
+
+	if toAcking, toPlain := rebroadcast(); !toAcking || !toPlain {
+		t.Fatal("expected peers that did not acknowledge to be rebroadcast to")
+	}
+
+	wm.WantlistAcked(acking)
+	if toAcking, toPlain := rebroadcast(); toAcking || !toPlain {
+		t.Fatal("expected only the peer that acknowledged to be skipped")
+	}
+
+	// the acknowledgement is stale once the wantlist changed
+	wm.WantBlocks(context.Background(), ks[1:])
+	net.waitSent(t, acking, ks[1])
+	if toAcking, _ := rebroadcast(); !toAcking {
+		t.Fatal("expected a peer with a stale acknowledgement to be rebroadcast to")
+	}
+}
+
+func TestPeerQuarantine(t *testing.T) {
+	var attempts, failing int32 = 0, 1
+	net := newFakeNetwork()
+	net.sendHook = func(context.Context, peer.ID, bsmsg.BitSwapMessage) error {
+		atomic.AddInt32(&attempts, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			return errors.New("send failed")
+		}
+		return nil
+	}
+	cooldown := 100 * time.Millisecond
+	wm, cancel := newTestWantManager(net,
+		WithPeerErrorThreshold(3, cooldown),
+		WithDisconnectPropagationDelay(time.Millisecond))
+	defer cancel()
+
+	quarantined := make(chan time.Time, 1)
+	wm.OnPeerQuarantined(func(_ peer.ID, until time.Time) {
+		quarantined <- until
+	})
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+
+	ks := testCids(2)
+	wm.WantBlocks(context.Background(), ks[:1])
+	var until time.Time
+	select {
+	case until = <-quarantined:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the peer to be quarantined")
+	}
+	if n := atomic.LoadInt32(&attempts); n != 3 {
+		t.Fatalf("expected 3 failed sends before the quarantine, got %d", n)
+	}
+
+	// nothing is sent during the quarantine, changes queue up meanwhile
+	atomic.StoreInt32(&failing, 0)
+	wm.WantBlocks(context.Background(), ks[1:])
+	time.Sleep(cooldown / 2)
+	if n := atomic.LoadInt32(&attempts); n != 3 {
+		t.Fatalf("expected no sends during the quarantine, got %d", n-3)
+	}
+
+	net.waitSent(t, p, ks[0])
+	net.waitSent(t, p, ks[1])
+	if time.Now().Before(until) {
+		t.Fatal("expected sending to resume after the cooldown")
+	}
+}
+
+func TestRequeueOnDisconnect(t *testing.T) {
+	for _, requeue := range []bool{false, true} {
+		net := newFakeNetwork()
+		var opts []WantManagerOption
+		if requeue {
+			opts = append(opts, WithRequeueOnDisconnect())
+		}
+		wm, cancel := newTestWantManager(net, opts...)
+
+		gone := testutil.RandPeerIDFatal(t)
+		other := testutil.RandPeerIDFatal(t)
+		wm.Connected(gone)
+		wm.Connected(other)
+		waitIdle(t, wm)
+
+		ks := testCids(2)
+		wm.WantBlocksFrom(context.Background(), ks[:1], []peer.ID{gone})
+		net.waitSent(t, gone, ks[0])
+
+		wm.Disconnected(gone)
+		// a want sent afterwards tells us when the disconnect was handled
+		wm.WantBlocks(context.Background(), ks[1:])
+		net.waitSent(t, other, ks[1])
+
+		if net.sentCids(other).Has(ks[0]) != requeue {
+			t.Fatalf("requeue %v: unexpected delivery of the departed peer's want", requeue)
+		}
+		cancel()
+	}
+}
+
+func TestMaxConcurrentDials(t *testing.T) {
+	var lk sync.Mutex
+	dialing, maxDialing, dialed := 0, 0, 0
+	net := newFakeNetwork()
+	net.connectHook = func(context.Context, peer.ID) error {
+		lk.Lock()
+		dialing++
+		if dialing > maxDialing {
+			maxDialing = dialing
+		}
+		lk.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		lk.Lock()
+		dialing--
+		dialed++
+		lk.Unlock()
+		return nil
+	}
+	wm, cancel := newTestWantManager(net, WithMaxConcurrentDials(2))
+	defer cancel()
+
+	const peers = 8
+	for i := 0; i < peers; i++ {
+		wm.Connected(testutil.RandPeerIDFatal(t))
+	}
+	waitFor(t, "all dials", func() bool {
+		lk.Lock()
+		defer lk.Unlock()
+		return dialed == peers
+	})
+
+	lk.Lock()
+	defer lk.Unlock()
+	if maxDialing > 2 {
+		t.Fatalf("expected at most 2 concurrent dials, got %d", maxDialing)
+	}
+}
+
+func TestReseedWindow(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithReseedWindow(time.Minute))
+	defer cancel()
+
+	ks := testCids(3)
+	wm.WantBlocks(context.Background(), ks[:2])
+	waitIdle(t, wm)
+
+	fullSeeds := func(p peer.ID) int {
+		n := 0
+		for _, m := range net.messages(p) {
+			if m.Full() {
+				n++
+			}
+		}
+		return n
+	}
+
+	p := testutil.RandPeerIDFatal(t)
+	for i := 0; i < 5; i++ {
+		wm.Connected(p)
+		net.waitSent(t, p, ks[0])
+		waitIdle(t, wm)
+		wm.Disconnected(p)
+		waitIdle(t, wm)
+	}
+	waitIdle(t, wm)
+	wm.runSync(func() {})
+	if n := fullSeeds(p); n != 1 {
+		t.Fatalf("expected a single full wantlist for a flapping peer, got %d", n)
+	}
+
+	// once the wantlist changed, the peer is seeded again
+	wm.WantBlocks(context.Background(), ks[2:])
+	waitIdle(t, wm)
+	wm.Connected(p)
+	waitFor(t, "second seed", func() bool { return fullSeeds(p) == 2 })
+}
+
+// fakeSendGate holds back blocks to blocked peers.
+type fakeSendGate struct {
+	lk      sync.Mutex
+	blocked map[peer.ID]bool
+}
+
+func (g *fakeSendGate) Allow(env *engine.Envelope) bool {
+	g.lk.Lock()
+	defer g.lk.Unlock()
+	return !g.blocked[env.Peer]
+}
+
+func (g *fakeSendGate) unblock(p peer.ID) {
+	g.lk.Lock()
+	defer g.lk.Unlock()
+	delete(g.blocked, p)
+}
+
+func TestSendGate(t *testing.T) {
+	orig := sendGateRetry.Get()
+	sendGateRetry.Set(5 * time.Millisecond)
+	defer sendGateRetry.Set(orig)
+
+	deferred := testutil.RandPeerIDFatal(t)
+	allowed := testutil.RandPeerIDFatal(t)
+	gate := &fakeSendGate{blocked: map[peer.ID]bool{deferred: true}}
+
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithSendGate(gate))
+	defer cancel()
+
+	bgen := blocksutil.NewBlockGenerator()
+	blk := bgen.Next()
+	sent := make(chan peer.ID, 2)
+	for _, p := range []peer.ID{deferred, allowed} {
+		go func(p peer.ID) {
+			env := &engine.Envelope{Peer: p, Block: blk, Sent: func() {}}
+			if err := wm.SendBlockErr(context.Background(), env); err != nil {
+				t.Error(err)
+			}
+			sent <- p
+		}(p)
+	}
+
+	if p := <-sent; p != allowed {
+		t.Fatal("expected the allowed peer to be sent the block first")
+	}
+	select {
+	case <-sent:
+		t.Fatal("expected the block to the deferred peer to be held back")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if len(net.messages(deferred)) != 0 {
+		t.Fatal("expected nothing to be sent to the deferred peer")
+	}
+
+	gate.unblock(deferred)
+	<-sent
+	if len(net.messages(deferred)) != 1 {
+		t.Fatal("expected the block to be sent once allowed")
+	}
+}
+
+func TestResetAllPeers(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	ks := testCids(2)
+	wm.WantBlocks(context.Background(), ks)
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	net.waitMessages(t, p, 1)
+
+	wm.ResetAllPeers()
+	if len(wm.ConnectedPeers()) != 0 {
+		t.Fatal("expected no peers after reset")
+	}
+	if wm.wl.Len() != len(ks) {
+		t.Fatal("expected our wantlist to survive the reset")
+	}
+
+	wm.Connected(p)
+	msgs := net.waitMessages(t, p, 2)
+	if !msgs[1].Full() || len(msgs[1].Wantlist()) != len(ks) {
+		t.Fatal("expected the full wantlist to be sent again on reconnect")
+	}
+	if n := net.openedSenders(p); n != 2 {
+		t.Fatalf("expected a new sender to be opened on reconnect, got %d senders", n)
+	}
+}
+
+func TestWantBlocksWithHints(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	a := testutil.RandPeerIDFatal(t)
+	b := testutil.RandPeerIDFatal(t)
+	offline := testutil.RandPeerIDFatal(t)
+	wm.Connected(a)
+	wm.Connected(b)
+	waitIdle(t, wm)
+
+	ks := testCids(3)
+	hints := map[string][]peer.ID{
+		ks[0].KeyString(): {b},
+		ks[1].KeyString(): {offline},
+	}
+	wm.WantBlocksWithHints(context.Background(), ks, hints)
+
+	for _, p := range []peer.ID{a, b} {
+		net.waitSent(t, p, ks[1])
+		net.waitSent(t, p, ks[2])
+	}
+	if net.sentCids(a).Has(ks[0]) {
+		t.Fatal("expected the hinted want to go to the hinted peer only")
+	}
+	if !net.sentCids(b).Has(ks[0]) {
+		t.Fatal("expected the hinted peer to be sent the hinted want")
+	}
+
+	wm.CancelWants(ks[:1])
+	waitIdle(t, wm)
+	var left int
+	wm.runSync(func() { left = len(wm.hints) })
+	if left != 1 {
+		t.Fatalf("expected the cancelled want's hints to be dropped, %d left", left)
+	}
+}
+
+func TestAddMessageDuringShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wm := NewWantManager(ctx, newFakeNetwork())
+	mq := wm.newMsgQueue(testutil.RandPeerIDFatal(t))
+
+	ks := testCids(200)
+	refused := make(chan *cid.Cid, len(ks))
+	var wg sync.WaitGroup
+	for _, k := range ks {
+		wg.Add(1)
+		go func(k *cid.Cid) {
+			defer wg.Done()
+			e := &bsmsg.Entry{Entry: &wantlist.Entry{Cid: k, Priority: 1}}
+			if !mq.addMessage([]*bsmsg.Entry{e}) {
+				refused <- k
+			}
+		}(k)
+	}
+	stranded := mq.shutdown()
+	wg.Wait()
+	close(refused)
+
+	// every entry was either refused or handed back by shutdown
+	seen := cid.NewSet()
+	for k := range refused {
+		seen.Add(k)
+	}
+	for _, e := range stranded {
+		if seen.Has(e.Cid) {
+			t.Fatalf("%s was both refused and accepted", e.Cid)
+		}
+		seen.Add(e.Cid)
+	}
+	if seen.Len() != len(ks) {
+		t.Fatalf("lost %d entries during shutdown", len(ks)-seen.Len())
+	}
+}
+
+func TestStrandedWantsRedistributed(t *testing.T) {
+	net := newFakeNetwork()
+	block := make(chan struct{})
+	gone := testutil.RandPeerIDFatal(t)
+	net.connectHook = func(_ context.Context, p peer.ID) error {
+		if p == gone {
+			<-block
+		}
+		return nil
+	}
+	defer close(block)
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	other := testutil.RandPeerIDFatal(t)
+	wm.Connected(gone)
+	wm.Connected(other)
+	waitIdle(t, wm)
+
+	// gone is stuck dialing, so the want is still queued when it leaves
+	ks := testCids(1)
+	wm.WantBlocksFrom(context.Background(), ks, []peer.ID{gone})
+	waitIdle(t, wm)
+	wm.Disconnected(gone)
+
+	net.waitSent(t, other, ks[0])
+}
+
+func TestPeerSendLatency(t *testing.T) {
+	const took = 30 * time.Millisecond
+	net := newFakeNetwork()
+	net.sendHook = func(context.Context, peer.ID, bsmsg.BitSwapMessage) error {
+		time.Sleep(took)
+		return nil
+	}
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+	if l := wm.PeerSendLatency(p); l != 0 {
+		t.Fatalf("expected no latency before sending, got %s", l)
+	}
+
+	ks := testCids(3)
+	for _, k := range ks {
+		wm.WantBlocks(context.Background(), []*cid.Cid{k})
+		net.waitSent(t, p, k)
+	}
+
+	l := wm.PeerSendLatency(p)
+	if l < took || l > 3*took {
+		t.Fatalf("expected latency close to %s, got %s", took, l)
+	}
+}
+
+func TestPeerCapabilities(t *testing.T) {
+	limited := testutil.RandPeerIDFatal(t)
+	net := newFakeNetwork()
+	net.caps = map[peer.ID]bsnet.PeerCapabilities{
+		limited: {NoFullWantlist: true, Codecs: []uint64{cid.Raw}},
+	}
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	var raw, pb []*cid.Cid
+	for _, c := range testCids(40) {
+		pb = append(pb, c)
+		raw = append(raw, cid.NewCidV1(cid.Raw, c.Hash()))
+	}
+	wm.WantBlocks(context.Background(), append(raw, pb...))
+	waitFor(t, "wantlist", func() bool { return wm.wl.Len() == len(raw)+len(pb) })
+
+	wm.Connected(limited)
+	for _, c := range raw {
+		net.waitSent(t, limited, c)
+	}
+
+	msgs := net.messages(limited)
+	if len(msgs) < len(raw)/incrementalSeedSize {
+		t.Fatalf("expected the wantlist to be sent in increments, got %d messages", len(msgs))
+	}
+	for _, m := range msgs {
+		if m.Full() {
+			t.Fatal("expected no full wantlist to be sent")
+		}
+		if len(m.Wantlist()) > incrementalSeedSize {
+			t.Fatalf("expected at most %d entries per message, got %d", incrementalSeedSize, len(m.Wantlist()))
+		}
+		for _, e := range m.Wantlist() {
+			if e.Cid.Type() != cid.Raw {
+				t.Fatalf("expected only raw cids, got %s", e.Cid)
+			}
+		}
+	}
+}
+
+func TestWantBlocksReport(t *testing.T) {
+	wm, cancel := newTestWantManager(newFakeNetwork())
+	defer cancel()
+
+	ks := testCids(5)
+	added, err := wm.WantBlocksReport(context.Background(), ks[:3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 3 {
+		t.Fatalf("expected 3 new wants, got %d", len(added))
+	}
+
+	added, err = wm.WantBlocksReport(context.Background(), ks[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 2 || !added[0].Equals(ks[3]) || !added[1].Equals(ks[4]) {
+		t.Fatalf("expected only the last 2 wants to be new, got %v", added)
+	}
+}
+
+func TestDisconnectSkipsRetryWait(t *testing.T) {
+	errSend := errors.New("stream reset")
+	ks := testCids(2)
+	failed := make(chan struct{}, 10)
+	net := newFakeNetwork()
+	net.sendHook = func(_ context.Context, _ peer.ID, msg bsmsg.BitSwapMessage) error {
+		for _, e := range msg.Wantlist() {
+			if e.Cid.Equals(ks[0]) {
+				failed <- struct{}{}
+				return errSend
+			}
+		}
+		return nil
+	}
+	wm, cancel := newTestWantManager(net, WithDisconnectPropagationDelay(time.Minute))
+	defer cancel()
+
+	// connected twice, so the queue outlives the first disconnect
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	wm.Connected(p)
+	waitIdle(t, wm)
+
+	wm.WantBlocks(context.Background(), ks[:1])
+	<-failed
+	wm.Disconnected(p)
+
+	// the queue would be stuck waiting for a minute otherwise
+	wm.WantBlocks(context.Background(), ks[1:])
+	net.waitSent(t, p, ks[1])
+}
+
+func TestPeersSortedByPendingWork(t *testing.T) {
+	// dialing never finishes, so everything stays queued
+	block := make(chan struct{})
+	defer close(block)
+	net := newFakeNetwork()
+	net.connectHook = func(context.Context, peer.ID) error {
+		<-block
+		return nil
+	}
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	var peers []peer.ID
+	for i := 0; i < 4; i++ {
+		p := testutil.RandPeerIDFatal(t)
+		peers = append(peers, p)
+		wm.Connected(p)
+	}
+	waitIdle(t, wm)
+
+	// peers[0] and peers[1] get nothing, peers[2] three wants, peers[3] one
+	ks := testCids(4)
+	wm.WantBlocksFrom(context.Background(), ks[:3], peers[2:3])
+	wm.WantBlocksFrom(context.Background(), ks[3:], peers[3:])
+	waitIdle(t, wm)
+
+	idle := peers[:2]
+	if idle[1] < idle[0] {
+		idle[0], idle[1] = idle[1], idle[0]
+	}
+	expected := []peer.ID{idle[0], idle[1], peers[3], peers[2]}
+	sorted := wm.PeersSortedByPendingWork()
+	if len(sorted) != len(expected) {
+		t.Fatalf("expected %d peers, got %d", len(expected), len(sorted))
+	}
+	for i := range expected {
+		if sorted[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, sorted)
+		}
+	}
+}
+
+func TestCancelWantsForPeer(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	a := testutil.RandPeerIDFatal(t)
+	b := testutil.RandPeerIDFatal(t)
+	wm.Connected(a)
+	wm.Connected(b)
+	waitIdle(t, wm)
+
+	ks := testCids(2)
+	wm.WantBlocks(context.Background(), ks)
+	net.waitSent(t, a, ks[1])
+	net.waitSent(t, b, ks[1])
+	sentB := len(net.messages(b))
+
+	wm.CancelWantsForPeer(a, ks[:1])
+	msgs := net.waitMessages(t, a, 2)
+	entries := msgs[len(msgs)-1].Wantlist()
+	if len(entries) != 1 || !entries[0].Cancel || !entries[0].Cid.Equals(ks[0]) {
+		t.Fatal("expected a cancel for the want to be sent to the peer")
+	}
+
+	dump := wm.DumpPeerQueues(a, b)
+	if len(dump[a].Wantlist) != 1 || len(dump[b].Wantlist) != 2 {
+		t.Fatal("expected only the peer's wantlist to lose the want")
+	}
+	if _, ok := wm.wl.Contains(ks[0]); !ok {
+		t.Fatal("expected our wantlist to keep the want")
+	}
+	if len(net.messages(b)) != sentB {
+		t.Fatal("expected no cancel to be sent to other peers")
+	}
+}
+
+func TestQueueWatchdog(t *testing.T) {
+	var once sync.Once
+	net := newFakeNetwork()
+	net.sendHook = func(context.Context, peer.ID, bsmsg.BitSwapMessage) error {
+		once.Do(func() { panic("send crashed") })
+		return nil
+	}
+	wm, cancel := newTestWantManager(net, WithQueueWatchdog(10*time.Millisecond))
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+
+	// the first send kills the queue, the watchdog has to bring it back
+	ks := testCids(2)
+	wm.WantBlocks(context.Background(), ks[:1])
+	wm.WantBlocks(context.Background(), ks[1:])
+	net.waitSent(t, p, ks[0])
+	net.waitSent(t, p, ks[1])
+}
+
+func TestQueueCrashWithoutWatchdog(t *testing.T) {
+	net := newFakeNetwork()
+	net.sendHook = func(context.Context, peer.ID, bsmsg.BitSwapMessage) error {
+		panic("send crashed")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wm := NewWantManager(ctx, net)
+
+	p := testutil.RandPeerIDFatal(t)
+	mq := wm.newMsgQueue(p)
+	mq.addMessage(newEntries(testCids(1), false))
+
+	crashed := make(chan interface{}, 1)
+	go func() {
+		defer func() { crashed <- recover() }()
+		mq.runQueue(ctx)
+	}()
+	select {
+	case r := <-crashed:
+		if r == nil {
+			t.Fatal("expected the panic to propagate without a watchdog")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the queue to crash")
+	}
+}
+
+// mapBackend is a WantlistBackend independent of the wantlist package
+type mapBackend struct {
+	lk      sync.Mutex
+	entries map[string]*wantlist.Entry
+}
+
+func newMapBackend() *mapBackend {
+	return &mapBackend{entries: make(map[string]*wantlist.Entry)}
+}
+
+func (b *mapBackend) Add(c *cid.Cid, priority int) bool {
+	return b.AddEntry(&wantlist.Entry{Cid: c, Priority: priority, RefCnt: 1})
+}
+
+func (b *mapBackend) AddEntry(e *wantlist.Entry) bool {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	if cur, ok := b.entries[e.Cid.KeyString()]; ok {
+		cur.RefCnt++
+		return false
+	}
+	b.entries[e.Cid.KeyString()] = e
+	return true
+}
+
+func (b *mapBackend) Remove(c *cid.Cid) bool {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	e, ok := b.entries[c.KeyString()]
+	if !ok {
+		return false
+	}
+	e.RefCnt--
+	if e.RefCnt <= 0 {
+		delete(b.entries, c.KeyString())
+		return true
+	}
+	return false
+}
+
+func (b *mapBackend) Contains(c *cid.Cid) (*wantlist.Entry, bool) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	e, ok := b.entries[c.KeyString()]
+	return e, ok
+}
+
+func (b *mapBackend) Entries() []*wantlist.Entry {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	var es []*wantlist.Entry
+	for _, e := range b.entries {
+		es = append(es, e)
+	}
+	return es
+}
+
+func (b *mapBackend) SortedEntries() []*wantlist.Entry {
+	es := b.Entries()
+	sort.Sort(byPriority(es))
+	return es
+}
+
+func (b *mapBackend) Len() int {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	return len(b.entries)
+}
+
+type byPriority []*wantlist.Entry
+
+func (es byPriority) Len() int           { return len(es) }
+func (es byPriority) Swap(i, j int)      { es[i], es[j] = es[j], es[i] }
+func (es byPriority) Less(i, j int) bool { return es[i].Priority > es[j].Priority }
+
+func TestWantlistBackend(t *testing.T) {
+	ks := testCids(4)
+
+	// run the same changes against a WantManager and return what its
+	// wantlist holds and what a peer connecting afterwards is sent
+	run := func(opts ...WantManagerOption) ([]string, []string) {
+		net := newFakeNetwork()
+		wm, cancel := newTestWantManager(net, opts...)
+		defer cancel()
+
+		a := testutil.RandPeerIDFatal(t)
+		wm.Connected(a)
+		waitIdle(t, wm)
+
+		wm.WantBlocks(context.Background(), ks)
+		wm.WantBlocks(context.Background(), ks[:1])
+		wm.CancelWants(ks[:2])
+		waitIdle(t, wm)
+		net.waitSent(t, a, ks[3])
+
+		b := testutil.RandPeerIDFatal(t)
+		wm.Connected(b)
+		seed := net.waitMessages(t, b, 1)[0]
+
+		var have, sent []string
+		for _, e := range wm.wl.SortedEntries() {
+			have = append(have, e.Cid.String())
+		}
+		for _, e := range seed.Wantlist() {
+			sent = append(sent, e.Cid.String())
+		}
+		// messages do not keep the order of their entries
+		sort.Strings(sent)
+		return have, sent
+	}
+
+	wantHave, wantSent := run()
+	have, sent := run(WithWantlistBackend(newMapBackend()))
+
+	if len(wantHave) != 3 || fmt.Sprint(have) != fmt.Sprint(wantHave) {
+		t.Fatalf("expected the wantlist to hold %v, got %v", wantHave, have)
+	}
+	if fmt.Sprint(sent) != fmt.Sprint(wantSent) {
+		t.Fatalf("expected a new peer to be sent %v, got %v", wantSent, sent)
+	}
+}
+
+func TestDeadlineOrdering(t *testing.T) {
+	ks := testCids(3)
+	sending := make(chan struct{})
+	release := make(chan struct{})
+	net := newFakeNetwork()
+	net.sendHook = func(_ context.Context, _ peer.ID, msg bsmsg.BitSwapMessage) error {
+		for _, e := range msg.Wantlist() {
+			if e.Cid.Equals(ks[0]) {
+				close(sending)
+				<-release
+			}
+		}
+		return nil
+	}
+	wm, cancel := newTestWantManager(net, WithDeadlineOrdering())
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+
+	// hold up the queue so the next wants are queued together
+	wm.WantBlocks(context.Background(), ks[:1])
+	<-sending
+
+	ctx, cancelCtx := context.WithTimeout(context.Background(), time.Minute)
+	defer cancelCtx()
+	wm.WantBlocks(context.Background(), ks[1:2])
+	wm.WantBlocks(ctx, ks[2:])
+	waitIdle(t, wm)
+	close(release)
+
+	msgs := net.waitMessages(t, p, 3)
+	urgent, rest := msgs[1].Wantlist(), msgs[2].Wantlist()
+	if len(urgent) != 1 || !urgent[0].Cid.Equals(ks[2]) {
+		t.Fatal("expected the want with a deadline to be sent first")
+	}
+	if len(rest) != 1 || !rest[0].Cid.Equals(ks[1]) {
+		t.Fatal("expected the want without a deadline to be sent next")
+	}
+}
+
+func TestOnWantSatisfied(t *testing.T) {
+	wm, cancel := newTestWantManager(newFakeNetwork())
+	defer cancel()
+
+	type satisfied struct {
+		c       *cid.Cid
+		from    peer.ID
+		latency time.Duration
+	}
+	calls := make(chan satisfied, 10)
+	wm.OnWantSatisfied(func(c *cid.Cid, from peer.ID, latency time.Duration) {
+		calls <- satisfied{c, from, latency}
+	})
+
+	ks := testCids(2)
+	wm.WantBlocks(context.Background(), ks[:1])
+	waitIdle(t, wm)
+	time.Sleep(20 * time.Millisecond)
+
+	// blocks we did not want are not reported
+	p := testutil.RandPeerIDFatal(t)
+	wm.ReceivedBlocks(ks[1:], p)
+	wm.ReceivedBlocks(ks[:1], p)
+	waitIdle(t, wm)
+
+	select {
+	case call := <-calls:
+		if !call.c.Equals(ks[0]) || call.from != p {
+			t.Fatal("expected the callback to report the block and who sent it")
+		}
+		if call.latency < 20*time.Millisecond || call.latency > time.Minute {
+			t.Fatalf("implausible latency %s", call.latency)
+		}
+	default:
+		t.Fatal("expected the callback to fire")
+	}
+	if len(calls) != 0 {
+		t.Fatal("expected a single callback")
+	}
+	if wm.wl.Len() != 0 {
+		t.Fatal("expected the want to be cancelled")
+	}
+}
+
+func TestTargetDeliveryMode(t *testing.T) {
+	ks := testCids(1)
+
+	setup := func(mode TargetDeliveryMode) (*fakeNetwork, *WantManager, peer.ID, peer.ID, func()) {
+		net := newFakeNetwork()
+		wm, cancel := newTestWantManager(net, WithTargetDeliveryMode(mode))
+
+		a := testutil.RandPeerIDFatal(t)
+		b := testutil.RandPeerIDFatal(t)
+		wm.Connected(a)
+		waitIdle(t, wm)
+
+		wm.WantBlocksFrom(context.Background(), ks, []peer.ID{a, b})
+		waitIdle(t, wm)
+		wm.runSync(func() {})
+		return net, wm, a, b, cancel
+	}
+
+	t.Run("best effort", func(t *testing.T) {
+		net, _, a, b, cancel := setup(BestEffort)
+		defer cancel()
+
+		net.waitSent(t, a, ks[0])
+		if len(net.messages(b)) != 0 {
+			t.Fatal("expected nothing to be sent to the missing target")
+		}
+	})
+
+	t.Run("all or nothing", func(t *testing.T) {
+		net, wm, a, b, cancel := setup(AllOrNothing)
+		defer cancel()
+
+		if net.sentCids(a).Has(ks[0]) {
+			t.Fatal("expected the want to be held back while a target is missing")
+		}
+
+		wm.Connected(b)
+		net.waitSent(t, a, ks[0])
+		net.waitSent(t, b, ks[0])
+		var left int
+		wm.runSync(func() { left = len(wm.deferred) })
+		if left != 0 {
+			t.Fatal("expected the deferred wants to be released")
+		}
+	})
+}
+
+func TestWantReach(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	var peers []peer.ID
+	for i := 0; i < 3; i++ {
+		p := testutil.RandPeerIDFatal(t)
+		wm.Connected(p)
+		peers = append(peers, p)
+	}
+	waitIdle(t, wm)
+
+	ks := testCids(3)
+	wm.WantBlocks(context.Background(), ks[:1])
+	wm.WantBlocksFrom(context.Background(), ks[1:2], peers[:1])
+	waitIdle(t, wm)
+	wm.runSync(func() {})
+
+	if n := wm.WantReach(ks[0]); n != 3 {
+		t.Fatalf("expected the broadcast want to reach 3 peers, got %d", n)
+	}
+	if n := wm.WantReach(ks[1]); n != 1 {
+		t.Fatalf("expected the targeted want to reach 1 peer, got %d", n)
+	}
+	if n := wm.WantReach(ks[2]); n != 0 {
+		t.Fatalf("expected an unknown cid to reach no peers, got %d", n)
+	}
+}
+
+func TestOnBackpressure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wm := NewWantManager(ctx, newFakeNetwork(), WithBackpressureThreshold(50*time.Millisecond))
+
+	var lk sync.Mutex
+	var counts []int
+	wm.OnBackpressure(func(count int) {
+		lk.Lock()
+		counts = append(counts, count)
+		lk.Unlock()
+	})
+
+	// Run is not started yet, so the buffer fills up
+	ks := testCids(cap(wm.incoming) + 3)
+	for _, k := range ks[:cap(wm.incoming)] {
+		wm.WantBlocks(context.Background(), []*cid.Cid{k})
+	}
+
+	var wg sync.WaitGroup
+	for _, k := range ks[cap(wm.incoming):] {
+		wg.Add(1)
+		go func(k *cid.Cid) {
+			defer wg.Done()
+			wm.WantBlocks(context.Background(), []*cid.Cid{k})
+		}(k)
+	}
+	waitFor(t, "backpressure to be reported", func() bool {
+		lk.Lock()
+		defer lk.Unlock()
+		return len(counts) == 3
+	})
+
+	go wm.Run()
+	wg.Wait()
+	waitIdle(t, wm)
+	wm.runSync(func() {})
+
+	lk.Lock()
+	defer lk.Unlock()
+	for _, n := range counts {
+		if n < 1 || n > 3 {
+			t.Fatalf("expected between 1 and 3 blocked callers, got %d", n)
+		}
+	}
+	if wm.wl.Len() != len(ks) {
+		t.Fatal("expected every want to be added in the end")
+	}
+}
+
+func TestDrainPeer(t *testing.T) {
+	net := newFakeNetwork()
+	net.sendHook = func(context.Context, peer.ID, bsmsg.BitSwapMessage) error {
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	a := testutil.RandPeerIDFatal(t)
+	b := testutil.RandPeerIDFatal(t)
+	wm.Connected(a)
+	wm.Connected(b)
+	waitIdle(t, wm)
+	if err := wm.DrainPeer(context.Background(), a); err != nil {
+		t.Fatal(err)
+	}
+	if err := wm.DrainPeer(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+	sentB := len(net.messages(b))
+
+	ks := testCids(1)
+	wm.WantBlocksFrom(context.Background(), ks, []peer.ID{a})
+	waitIdle(t, wm)
+	wm.runSync(func() {})
+
+	if err := wm.DrainPeer(context.Background(), a); err != nil {
+		t.Fatal(err)
+	}
+	if !net.sentCids(a).Has(ks[0]) {
+		t.Fatal("expected the want to be sent once the peer is drained")
+	}
+	if len(net.messages(b)) != sentB {
+		t.Fatal("expected nothing to be sent to other peers")
+	}
+
+	if err := wm.DrainPeer(context.Background(), testutil.RandPeerIDFatal(t)); err != errUnknownPeer {
+		t.Fatalf("expected errUnknownPeer for an unknown peer, got %v", err)
+	}
+}
+
+func TestDisconnectLinger(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithDisconnectLinger(time.Minute))
+	defer cancel()
+
+	ks := testCids(3)
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+	wm.WantBlocks(context.Background(), ks[:2])
+	net.waitSent(t, p, ks[1])
+	sent := len(net.messages(p))
+
+	var mq *msgQueue
+	wm.runSync(func() { mq = wm.peers[p] })
+
+	wm.Disconnected(p)
+	waitIdle(t, wm)
+	wm.CancelWants(ks[:1])
+	wm.WantBlocks(context.Background(), ks[2:])
+	waitIdle(t, wm)
+	wm.Connected(p)
+	waitIdle(t, wm)
+
+	var reused *msgQueue
+	wm.runSync(func() { reused = wm.peers[p] })
+	if reused != mq {
+		t.Fatal("expected the queue to be reused")
+	}
+
+	msgs := net.waitMessages(t, p, sent+1)
+	catchUp := msgs[len(msgs)-1]
+	if catchUp.Full() || len(catchUp.Wantlist()) != 2 {
+		t.Fatal("expected only the missed changes to be sent")
+	}
+	for _, e := range catchUp.Wantlist() {
+		if e.Cid.Equals(ks[0]) != e.Cancel {
+			t.Fatal("expected a cancel for the dropped want and the new want")
+		}
+	}
+	if net.openedSenders(p) != 1 {
+		t.Fatal("expected the sender to be reused")
+	}
+}
+
+func TestDisconnectLingerRestricted(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithDisconnectLinger(time.Minute),
+		WithBroadcastPriorityFloor(kMaxPriority-1))
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+	wm.Disconnected(p)
+	waitIdle(t, wm)
+
+	// the third want falls below the floor
+	ks := testCids(3)
+	wm.WantBlocks(context.Background(), ks)
+	waitIdle(t, wm)
+	wm.Connected(p)
+	waitIdle(t, wm)
+
+	net.waitSent(t, p, ks[1])
+	if err := wm.DrainPeer(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	if net.sentCids(p).Has(ks[2]) {
+		t.Fatal("expected the low priority want not to be sent to a lingering peer")
+	}
+}
+
+func TestDisconnectLingerExpires(t *testing.T) {
+	wm, cancel := newTestWantManager(newFakeNetwork(), WithDisconnectLinger(20*time.Millisecond))
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+	wm.Disconnected(p)
+	waitIdle(t, wm)
+
+	waitFor(t, "queue to be torn down", func() bool {
+		var left int
+		wm.runSync(func() { left = len(wm.lingering) })
+		return left == 0
+	})
+	if len(wm.ConnectedPeers()) != 0 {
+		t.Fatal("expected no peers")
+	}
+}
+
+func TestStreamWantlist(t *testing.T) {
+	wm, cancel := newTestWantManager(newFakeNetwork())
+	defer cancel()
+
+	ks := testCids(5)
+	wm.WantBlocks(context.Background(), ks)
+	wm.CancelWants(ks[2:3])
+	waitIdle(t, wm)
+
+	var buf bytes.Buffer
+	if err := wm.StreamWantlist(context.Background(), &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []*cid.Cid
+	var prios []int
+	r := ggio.NewDelimitedReader(&buf, 1<<20)
+	for {
+		var e pb.Message_Wantlist_Entry
+		err := r.ReadMsg(&e)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := cid.Cast([]byte(e.GetBlock()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, c)
+		prios = append(prios, int(e.GetPriority()))
+	}
+
+	want := []int{0, 1, 3, 4}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d entries, got %d", len(want), len(got))
+	}
+	for i, j := range want {
+		if !got[i].Equals(ks[j]) || prios[i] != kMaxPriority-j {
+			t.Fatal("expected the wanted entries in priority order")
+		}
+	}
+}
+
+func TestStreamWantlistFlags(t *testing.T) {
+	wm, cancel := newTestWantManager(newFakeNetwork())
+	defer cancel()
+
+	ks := testCids(2)
+	wm.WantBlocks(context.Background(), ks[:1])
+	wm.WantBlocksAnnotated(context.Background(), ks[1:], 0x5)
+	waitIdle(t, wm)
+
+	var buf bytes.Buffer
+	if err := wm.StreamWantlist(context.Background(), &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	flags := make(map[string]*uint32)
+	r := ggio.NewDelimitedReader(&buf, 1<<20)
+	for {
+		var e pb.Message_Wantlist_Entry
+		err := r.ReadMsg(&e)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		flags[e.GetBlock()] = e.Flags
+	}
+
+	if f := flags[ks[0].KeyString()]; f != nil {
+		t.Fatal("expected no flags on an unannotated want")
+	}
+	if f := flags[ks[1].KeyString()]; f == nil || *f != 0x5 {
+		t.Fatal("expected the annotation to be streamed")
+	}
+}
+
+func TestBroadcastPriorityFloor(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithBroadcastPriorityFloor(kMaxPriority-1))
+	defer cancel()
+
+	a := testutil.RandPeerIDFatal(t)
+	wm.Connected(a)
+	waitIdle(t, wm)
+
+	// the third want of each call falls below the floor
+	ks := testCids(6)
+	wm.WantBlocks(context.Background(), ks[:3])
+	wm.WantBlocksFrom(context.Background(), ks[3:], []peer.ID{a})
+	net.waitSent(t, a, ks[5])
+	if net.sentCids(a).Has(ks[2]) {
+		t.Fatal("expected the low priority want not to be broadcast")
+	}
+
+	b := testutil.RandPeerIDFatal(t)
+	wm.Connected(b)
+	seed := net.waitMessages(t, b, 1)[0]
+	if len(seed.Wantlist()) != 4 {
+		t.Fatalf("expected a new peer to be sent the 4 wants above the floor, got %d", len(seed.Wantlist()))
+	}
+
+	sentA := len(net.messages(a))
+	wm.runSync(wm.rebroadcast)
+	msgs := net.waitMessages(t, a, sentA+1)
+	full := cid.NewSet()
+	for _, e := range msgs[len(msgs)-1].Wantlist() {
+		full.Add(e.Cid)
+	}
+	if full.Len() != 5 || full.Has(ks[2]) || !full.Has(ks[5]) {
+		t.Fatal("expected the rebroadcast to skip only untargeted low priority wants")
+	}
+	if wm.wl.Len() != 6 {
+		t.Fatal("expected all wants in our wantlist")
+	}
+}
+
+func TestInitialFanout(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithInitialFanout(2))
+	defer cancel()
+
+	for i := 0; i < 6; i++ {
+		wm.Connected(testutil.RandPeerIDFatal(t))
+	}
+	waitIdle(t, wm)
+
+	ks := testCids(1)
+	wm.WantBlocks(context.Background(), ks)
+	waitIdle(t, wm)
+	wm.runSync(func() {})
+	if n := wm.WantReach(ks[0]); n != 2 {
+		t.Fatalf("expected a new want to reach 2 peers, got %d", n)
+	}
+
+	wm.runSync(wm.rebroadcast)
+	if n := wm.WantReach(ks[0]); n != 4 {
+		t.Fatalf("expected the rebroadcast to widen the want to 4 peers, got %d", n)
+	}
+
+	wm.runSync(wm.rebroadcast)
+	if n := wm.WantReach(ks[0]); n != 6 {
+		t.Fatalf("expected the want to reach all peers, got %d", n)
+	}
+	wm.runSync(func() {
+		if len(wm.fanout) != 0 {
+			t.Error("expected the want to no longer be fanned out")
+		}
+	})
+}
+
+func TestInitialFanoutChunkedRebroadcast(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithInitialFanout(2), WithRebroadcastChunkSize(1))
+	defer cancel()
+
+	for i := 0; i < 6; i++ {
+		wm.Connected(testutil.RandPeerIDFatal(t))
+	}
+	waitIdle(t, wm)
+
+	// chunks of one want, so the wantlist is rebroadcast in chunks
+	ks := testCids(2)
+	wm.WantBlocks(context.Background(), ks)
+	waitIdle(t, wm)
+	wm.runSync(wm.rebroadcast)
+	for _, c := range ks {
+		if n := wm.WantReach(c); n != 4 {
+			t.Fatalf("expected the chunks to go only to the peers the wants were widened to, got %d", n)
+		}
+	}
+
+	// once all peers know about the wants, chunks do not fan them out anew
+	for i := 0; i < 3; i++ {
+		wm.runSync(wm.rebroadcast)
+	}
+	wm.runSync(func() {
+		if len(wm.fanout) != 0 {
+			t.Error("expected the wants to no longer be fanned out")
+		}
+	})
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	net.waitSent(t, p, ks[0])
+	net.waitSent(t, p, ks[1])
+}
+
+func TestPeerRebroadcastInterval(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	fast := testutil.RandPeerIDFatal(t)
+	slow := testutil.RandPeerIDFatal(t)
+	wm.Connected(fast)
+	wm.Connected(slow)
+	waitIdle(t, wm)
+
+	ks := testCids(2)
+	wm.WantBlocks(context.Background(), ks)
+	net.waitSent(t, fast, ks[1])
+	net.waitSent(t, slow, ks[1])
+	sentFast := len(net.messages(fast))
+	sentSlow := len(net.messages(slow))
+
+	wm.SetPeerRebroadcastInterval(fast, 10*time.Millisecond)
+	msgs := net.waitMessages(t, fast, sentFast+3)
+	for _, m := range msgs[sentFast:] {
+		if !m.Full() || len(m.Wantlist()) != 2 {
+			t.Fatal("expected the full wantlist to be rebroadcast")
+		}
+	}
+	if len(net.messages(slow)) != sentSlow {
+		t.Fatal("expected the other peer not to be rebroadcast to")
+	}
+
+	// the global rebroadcast leaves the peer with its own interval out
+	wm.SetPeerRebroadcastInterval(fast, time.Hour)
+	waitIdle(t, wm)
+	sentFast = len(net.messages(fast))
+	wm.runSync(wm.rebroadcast)
+	net.waitMessages(t, slow, sentSlow+1)
+	waitIdle(t, wm)
+	if len(net.messages(fast)) != sentFast {
+		t.Fatal("expected the global rebroadcast to skip the peer with its own interval")
+	}
+}
+
+func TestReplaceWants(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+
+	ks := testCids(5)
+	wm.WantBlocks(context.Background(), ks[:3])
+	net.waitSent(t, p, ks[2])
+	sent := len(net.messages(p))
+
+	if err := wm.ReplaceWants(context.Background(), ks[1:]); err != nil {
+		t.Fatal(err)
+	}
+	msgs := net.waitMessages(t, p, sent+1)
+	if len(msgs) != sent+1 {
+		t.Fatal("expected the replacement to be sent in one message")
+	}
+
+	changes := make(map[string]bool)
+	for _, e := range msgs[sent].Wantlist() {
+		changes[e.Cid.KeyString()] = e.Cancel
+	}
+	if len(changes) != 3 || !changes[ks[0].KeyString()] {
+		t.Fatal("expected a cancel for the dropped want")
+	}
+	for _, k := range ks[3:] {
+		if isCancel, ok := changes[k.KeyString()]; !ok || isCancel {
+			t.Fatal("expected the new wants to be added")
+		}
+	}
+
+	if wm.wl.Len() != 4 {
+		t.Fatalf("expected 4 wants, got %d", wm.wl.Len())
+	}
+	if _, ok := wm.wl.Contains(ks[0]); ok {
+		t.Fatal("expected the dropped want to be removed")
+	}
+}
+
+func TestLostCancelsResent(t *testing.T) {
+	lost := &fakeMetric{}
+	origCounter := newCounter
+	newCounter = func(ctx context.Context, name, help string) metrics.Counter {
+		if name == "lost_cancels_resent_total" {
+			return lost
+		}
+		return origCounter(ctx, name, help)
+	}
+	defer func() { newCounter = origCounter }()
+
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+
+	ks := testCids(2)
+	wm.WantBlocks(context.Background(), ks[:1])
+	net.waitSent(t, p, ks[0])
+	wm.CancelWants(ks[:1])
+	net.waitMessages(t, p, 2)
+
+	// the peer ignores the cancel and keeps sending the block, along with
+	// a block we never asked it for
+	for i := 0; i < maxCancelResends; i++ {
+		wm.ReceivedUnwanted(ks, p)
+		msgs := net.waitMessages(t, p, 3+i)
+		resent := msgs[2+i].Wantlist()
+		if len(resent) != 1 || !resent[0].Cancel || !resent[0].Cid.Equals(ks[0]) {
+			t.Fatal("expected the cancel to be sent again")
+		}
+	}
+
+	wm.ReceivedUnwanted(ks, p)
+	if v := lost.value(); v != maxCancelResends {
+		t.Fatalf("expected %d resent cancels, got %v", maxCancelResends, v)
+	}
+}
+
+func TestPerPeerBatchWindow(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithPerPeerBatchWindow(100*time.Millisecond))
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+
+	ks := testCids(4)
+	for _, k := range ks[:3] {
+		wm.WantBlocks(context.Background(), []*cid.Cid{k})
+	}
+	msgs := net.waitMessages(t, p, 1)
+	time.Sleep(150 * time.Millisecond)
+	if len(net.messages(p)) != 1 || len(msgs[0].Wantlist()) != 3 {
+		t.Fatal("expected the wants to be batched into one message")
+	}
+}
+
+func TestPerPeerBatchWindowCancel(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithPerPeerBatchWindow(time.Minute))
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+
+	// the cancel cuts the wait short for the whole batch
+	ks := testCids(2)
+	wm.WantBlocks(context.Background(), ks)
+	wm.CancelWants(ks[:1])
+	msgs := net.waitMessages(t, p, 1)
+	if len(msgs[0].Wantlist()) != 2 {
+		t.Fatal("expected the want and the cancel to be sent together")
+	}
+}
+
+func TestOnSenderEvent(t *testing.T) {
+	errReset := errors.New("stream reset")
+	errFlaky := errors.New("temporary failure")
+	ks := testCids(4)
+
+	var lk sync.Mutex
+	failed := make(map[string]bool)
+	net := newFakeNetwork()
+	net.sendHook = func(_ context.Context, _ peer.ID, msg bsmsg.BitSwapMessage) error {
+		lk.Lock()
+		defer lk.Unlock()
+		for _, e := range msg.Wantlist() {
+			k := e.Cid.KeyString()
+			switch {
+			case failed[k]:
+			case e.Cid.Equals(ks[1]):
+				failed[k] = true
+				return errReset
+			case e.Cid.Equals(ks[3]):
+				failed[k] = true
+				return errFlaky
+			}
+		}
+		return nil
+	}
+	classify := func(err error) RetryDecision {
+		if err == errReset {
+			return SendResetSender
+		}
+		return SendRetry
+	}
+	wm, cancel := newTestWantManager(net, WithErrorClassifier(classify),
+		WithDisconnectPropagationDelay(10*time.Millisecond))
+	defer cancel()
+
+	var events []SenderEvent
+	wm.OnSenderEvent(func(_ peer.ID, event SenderEvent) {
+		lk.Lock()
+		events = append(events, event)
+		lk.Unlock()
+	})
+	waitEvents := func(n int) {
+		waitFor(t, "sender events", func() bool {
+			lk.Lock()
+			defer lk.Unlock()
+			return len(events) >= n
+		})
+	}
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+
+	// opened, then reset after the first failure
+	wm.WantBlocks(context.Background(), ks[:1])
+	net.waitSent(t, p, ks[0])
+	wm.WantBlocks(context.Background(), ks[1:2])
+	waitEvents(2)
+
+	// opened again, closed after the second failure and reopened to retry
+	wm.WantBlocks(context.Background(), ks[2:3])
+	net.waitSent(t, p, ks[2])
+	wm.WantBlocks(context.Background(), ks[3:])
+	net.waitSent(t, p, ks[3])
+
+	wm.Disconnected(p)
+	waitEvents(6)
+
+	want := []SenderEvent{SenderOpened, SenderReset, SenderOpened, SenderClosed, SenderOpened, SenderClosed}
+	lk.Lock()
+	defer lk.Unlock()
+	if fmt.Sprint(events) != fmt.Sprint(want) {
+		t.Fatalf("expected events %v, got %v", want, events)
+	}
+}
+
+func TestIncomingQueueDepth(t *testing.T) {
+	depth := &fakeMetric{}
+	origGauge := newGauge
+	newGauge = func(ctx context.Context, name, help string) metrics.Gauge {
+		if name == "incoming_queue_depth" {
+			return depth
+		}
+		return origGauge(ctx, name, help)
+	}
+	defer func() { newGauge = origGauge }()
+
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	// hold up the run loop while the incoming channel fills up
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	go wm.runSync(func() {
+		close(blocked)
+		<-release
+	})
+	<-blocked
+	ks := testCids(cap(wm.incoming))
+	for _, k := range ks {
+		wm.WantBlocks(context.Background(), []*cid.Cid{k})
+	}
+	close(release)
+
+	waitIdle(t, wm)
+	wm.runSync(func() {})
+	if wm.wl.Len() != len(ks) {
+		t.Fatal("expected all wants to be handled")
+	}
+	if peak := depth.peakValue(); peak < float64(len(ks)-1) {
+		t.Fatalf("expected the gauge to show the backlog, peaked at %v", peak)
+	}
+	if d := depth.value(); d != 0 {
+		t.Fatalf("expected the gauge to drop back to 0, got %v", d)
+	}
+}
+
+func TestMaxPendingBytes(t *testing.T) {
+	dropped := &fakeMetric{}
+	origCounter := newCounter
+	newCounter = func(ctx context.Context, name, help string) metrics.Counter {
+		if name == "pending_wants_dropped_total" {
+			return dropped
+		}
+		return origCounter(ctx, name, help)
+	}
+	defer func() { newCounter = origCounter }()
+
+	ks := testCids(6)
+	sending := make(chan struct{})
+	release := make(chan struct{})
+	net := newFakeNetwork()
+	net.sendHook = func(_ context.Context, _ peer.ID, msg bsmsg.BitSwapMessage) error {
+		for _, e := range msg.Wantlist() {
+			if e.Cid.Equals(ks[0]) {
+				close(sending)
+				<-release
+			}
+		}
+		return nil
+	}
+	budget := len(ks[1].Bytes()) + len(ks[2].Bytes())
+	wm, cancel := newTestWantManager(net, WithMaxPendingBytes(budget))
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+
+	// the send of the first want hangs, so the others pile up
+	wm.WantBlocks(context.Background(), ks[:1])
+	<-sending
+	wm.WantBlocks(context.Background(), ks[1:])
+	waitIdle(t, wm)
+	wm.runSync(func() {})
+
+	if v := dropped.value(); v != 3 {
+		t.Fatalf("expected 3 wants to be dropped, got %v", v)
+	}
+	if used := atomic.LoadInt64(&wm.pendingBudget.used); used > int64(budget) {
+		t.Fatalf("expected at most %d pending bytes, got %d", budget, used)
+	}
+	if wm.WantReach(ks[3]) != 0 || wm.WantReach(ks[1]) != 1 {
+		t.Fatal("expected the lowest priority wants to be dropped")
+	}
+	if wm.wl.Len() != len(ks) {
+		t.Fatal("expected dropped wants to stay in our wantlist")
+	}
+
+	close(release)
+	net.waitSent(t, p, ks[2])
+	waitFor(t, "budget to be released", func() bool {
+		return atomic.LoadInt64(&wm.pendingBudget.used) == 0
+	})
+	if net.sentCids(p).Has(ks[5]) {
+		t.Fatal("expected dropped wants not to be sent")
+	}
+}
+
+func TestStepRun(t *testing.T) {
+	net := newFakeNetwork()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wm := NewWantManager(ctx, net)
+
+	step := func() {
+		if !wm.StepRun() {
+			t.Fatal("expected StepRun to handle an event")
+		}
+	}
+
+	a := testutil.RandPeerIDFatal(t)
+	b := testutil.RandPeerIDFatal(t)
+	ks := testCids(2)
+
+	// a want added before a peer connects goes out with its full wantlist
+	wm.WantBlocks(ctx, ks[:1])
+	step()
+	wm.Connected(a)
+	step()
+	seed := net.waitMessages(t, a, 1)[0]
+	if !seed.Full() || len(seed.Wantlist()) != 1 {
+		t.Fatal("expected the want in the full wantlist sent to a")
+	}
+
+	// a connects twice, so the first disconnect keeps its queue
+	wm.Connected(a)
+	step()
+	wm.Disconnected(a)
+	step()
+	if _, ok := wm.peers[a]; !ok {
+		t.Fatal("expected a to stay connected")
+	}
+
+	wm.Connected(b)
+	step()
+	wm.WantBlocks(ctx, ks[1:])
+	step()
+	for _, p := range []peer.ID{a, b} {
+		if _, ok := wm.peers[p].wl.Contains(ks[1]); !ok {
+			t.Fatal("expected the want to be queued for both peers")
+		}
+	}
+
+	wm.Disconnected(a)
+	step()
+	if _, ok := wm.peers[a]; ok || len(wm.peers) != 1 {
+		t.Fatal("expected only b to be left")
+	}
+
+	cancel()
+	if wm.StepRun() {
+		t.Fatal("expected StepRun to report the WantManager stopped")
+	}
+}
+
+func TestRebroadcastMode(t *testing.T) {
+	prev := rebroadcastDelay.Set(20 * time.Millisecond)
+	defer func() { rebroadcastDelay.Set(prev) }()
+
+	errReset := errors.New("stream reset")
+	classify := func(error) RetryDecision { return SendResetSender }
+	countFull := func(msgs []bsmsg.BitSwapMessage) int {
+		n := 0
+		for _, msg := range msgs {
+			if msg.Full() {
+				n++
+			}
+		}
+		return n
+	}
+
+	for _, mode := range []RebroadcastMode{RebroadcastPeriodic, RebroadcastOnReconnectOnly, RebroadcastOff} {
+		ks := testCids(2)
+
+		// the first message with ks[1] is lost with a reset sender
+		var lk sync.Mutex
+		failed := false
+		net := newFakeNetwork()
+		net.sendHook = func(_ context.Context, _ peer.ID, msg bsmsg.BitSwapMessage) error {
+			lk.Lock()
+			defer lk.Unlock()
+			for _, e := range msg.Wantlist() {
+				if e.Cid.Equals(ks[1]) && !failed {
+					failed = true
+					return errReset
+				}
+			}
+			return nil
+		}
+		wm, cancel := newTestWantManager(net, WithRebroadcastMode(mode),
+			WithErrorClassifier(classify), WithDisconnectLinger(time.Minute))
+
+		p := testutil.RandPeerIDFatal(t)
+		wm.Connected(p)
+		waitIdle(t, wm)
+		wm.WantBlocks(context.Background(), ks[:1])
+		net.waitSent(t, p, ks[0])
+		wm.WantBlocks(context.Background(), ks[1:])
+
+		if mode == RebroadcastOff {
+			time.Sleep(100 * time.Millisecond)
+			if net.sentCids(p).Has(ks[1]) {
+				t.Fatalf("mode %d: expected the lost want not to be resent", mode)
+			}
+		} else {
+			net.waitSent(t, p, ks[1])
+		}
+
+		// only periodic rebroadcasts keep sending full wantlists
+		full := countFull(net.messages(p))
+		time.Sleep(100 * time.Millisecond)
+		rebroadcast := countFull(net.messages(p)) > full
+		if rebroadcast != (mode == RebroadcastPeriodic) {
+			t.Fatalf("mode %d: expected periodic rebroadcast %t, got %t",
+				mode, mode == RebroadcastPeriodic, rebroadcast)
+		}
+
+		if mode != RebroadcastPeriodic {
+			sent := len(net.messages(p))
+			wm.Disconnected(p)
+			waitIdle(t, wm)
+			wm.Connected(p)
+			waitIdle(t, wm)
+			wm.runSync(func() {})
+
+			if mode == RebroadcastOnReconnectOnly {
+				msgs := net.waitMessages(t, p, sent+1)
+				if !msgs[len(msgs)-1].Full() || len(msgs[len(msgs)-1].Wantlist()) != 2 {
+					t.Fatal("expected the whole wantlist to be resent on reconnect")
+				}
+			} else {
+				time.Sleep(50 * time.Millisecond)
+				if len(net.messages(p)) != sent {
+					t.Fatal("expected nothing to be resent on reconnect")
+				}
+			}
+		}
+		cancel()
+	}
+}
+
+func TestWantBlocksAnnotated(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	ks := testCids(2)
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+
+	flagsSent := func(p peer.ID) map[string]uint8 {
+		flags := make(map[string]uint8)
+		for _, msg := range net.messages(p) {
+			for _, e := range msg.Wantlist() {
+				flags[e.Cid.KeyString()] = e.Flags
+			}
+		}
+		return flags
+	}
+
+	// both end up combined in the queue of p
+	wm.WantBlocksAnnotated(context.Background(), ks[:1], 1)
+	wm.WantBlocks(context.Background(), ks[1:])
+	net.waitSent(t, p, ks[1])
+	if flags := flagsSent(p); flags[ks[0].KeyString()] != 1 || flags[ks[1].KeyString()] != 0 {
+		t.Fatalf("expected only the annotated want to carry flags, got %v", flags)
+	}
+
+	// and the flags are kept in our wantlist for new peers
+	p2 := testutil.RandPeerIDFatal(t)
+	wm.Connected(p2)
+	net.waitSent(t, p2, ks[1])
+	if flags := flagsSent(p2); flags[ks[0].KeyString()] != 1 || flags[ks[1].KeyString()] != 0 {
+		t.Fatalf("expected the seeded wantlist to carry flags, got %v", flags)
+	}
+}
+
+func TestConnectAfterWantSeedsIt(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		net := newFakeNetwork()
+		ctx, cancel := context.WithCancel(context.Background())
+		wm := NewWantManager(ctx, net)
+
+		// the want and the connect wait for the Run loop at the same time
+		ks := testCids(1)
+		p := testutil.RandPeerIDFatal(t)
+		wm.WantBlocks(ctx, ks)
+		go wm.Connected(p)
+		time.Sleep(5 * time.Millisecond)
+		for len(wm.peers) == 0 {
+			if !wm.StepRun() {
+				t.Fatal("expected StepRun to handle an event")
+			}
+		}
+
+		seed := net.waitMessages(t, p, 1)[0]
+		if !seed.Full() || len(seed.Wantlist()) != 1 {
+			t.Fatal("expected the want in the full wantlist sent on connect")
+		}
+		cancel()
+	}
+}
+
+func TestPinWant(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+
+	ks := testCids(2)
+	wanted := func(c *cid.Cid) bool {
+		waitIdle(t, wm)
+		wm.runSync(func() {})
+		_, ok := wm.wl.Contains(c)
+		return ok
+	}
+	cancelled := func(c *cid.Cid) bool {
+		for _, msg := range net.messages(p) {
+			for _, e := range msg.Wantlist() {
+				if e.Cancel && e.Cid.Equals(c) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	wm.PinWant(context.Background(), ks[0])
+	wm.WantBlocks(context.Background(), ks)
+	net.waitSent(t, p, ks[1])
+
+	wm.CancelAll()
+	if !wanted(ks[0]) || wanted(ks[1]) {
+		t.Fatal("expected CancelAll to cancel all but the pinned want")
+	}
+	wm.CancelWants(ks[:1])
+	if !wanted(ks[0]) {
+		t.Fatal("expected the pinned want to survive a cancel")
+	}
+	if err := wm.DrainPeer(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	if cancelled(ks[0]) || !cancelled(ks[1]) {
+		t.Fatal("expected only the unpinned want to be cancelled at the peer")
+	}
+
+	wm.UnpinWant(ks[0])
+	if wanted(ks[0]) {
+		t.Fatal("expected UnpinWant to remove the want")
+	}
+	waitFor(t, "cancel to be sent", func() bool { return cancelled(ks[0]) })
+}
+
+type recordingTracer struct {
+	lk     sync.Mutex
+	traces []WantTrace
+}
+
+func TestCancelWantsOlderThan(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+
+	ks := testCids(3)
+	wm.WantBlocks(context.Background(), ks[:1])
+	wm.PinWant(context.Background(), ks[1])
+	waitIdle(t, wm)
+	time.Sleep(50 * time.Millisecond)
+	wm.WantBlocks(context.Background(), ks[2:])
+	net.waitSent(t, p, ks[2])
+
+	wm.CancelWantsOlderThan(25 * time.Millisecond)
+	waitIdle(t, wm)
+	wm.runSync(func() {})
+	for i, wanted := range []bool{false, true, true} {
+		if _, ok := wm.wl.Contains(ks[i]); ok != wanted {
+			t.Fatalf("expected want %d in the wantlist: %t", i, wanted)
+		}
+	}
+
+	if err := wm.DrainPeer(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	var cancels []*cid.Cid
+	for _, msg := range net.messages(p) {
+		for _, e := range msg.Wantlist() {
+			if e.Cancel {
+				cancels = append(cancels, e.Cid)
+			}
+		}
+	}
+	if len(cancels) != 1 || !cancels[0].Equals(ks[0]) {
+		t.Fatalf("expected only the old want to be cancelled, got %v", cancels)
+	}
+}
+
+func (r *recordingTracer) TraceWant(trace WantTrace) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.traces = append(r.traces, trace)
+}
+
+func (r *recordingTracer) stages(c *cid.Cid) []string {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	var stages []string
+	for _, t := range r.traces {
+		if t.Cid.Equals(c) {
+			stages = append(stages, fmt.Sprintf("%d %s", t.Stage, t.Peer))
+		}
+	}
+	return stages
+}
+
+func TestWantTracer(t *testing.T) {
+	tracer := new(recordingTracer)
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithWantTracer(tracer))
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+
+	ks := testCids(1)
+	wm.WantBlocks(context.Background(), ks)
+	net.waitSent(t, p, ks[0])
+	waitFor(t, "want to be traced as sent", func() bool { return len(tracer.stages(ks[0])) == 2 })
+
+	wm.runSync(wm.rebroadcast)
+	if err := wm.DrainPeer(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "rebroadcast to be traced", func() bool { return len(tracer.stages(ks[0])) == 4 })
+
+	wm.ReceivedBlocks(ks, p)
+	want := []string{
+		fmt.Sprintf("%d %s", WantAdded, peer.ID("")),
+		fmt.Sprintf("%d %s", WantSent, p),
+		fmt.Sprintf("%d %s", WantRebroadcast, p),
+		fmt.Sprintf("%d %s", WantSent, p),
+		fmt.Sprintf("%d %s", WantSatisfied, p),
+		fmt.Sprintf("%d %s", WantCancelled, peer.ID("")),
+	}
+	waitFor(t, "want to be traced as satisfied", func() bool { return len(tracer.stages(ks[0])) == len(want) })
+	if got := tracer.stages(ks[0]); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expected stages %v, got %v", want, got)
+	}
+}
+
+// countingBackend counts how often the sorted wantlist is put together.
+type countingBackend struct {
+	WantlistBackend
+	sorted int32
+}
+
+func (b *countingBackend) SortedEntries() []*wantlist.Entry {
+	atomic.AddInt32(&b.sorted, 1)
+	return b.WantlistBackend.SortedEntries()
+}
+
+func TestConnectedBatch(t *testing.T) {
+	backend := &countingBackend{WantlistBackend: wantlist.NewThreadSafe()}
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithWantlistBackend(backend))
+	defer cancel()
+
+	ks := testCids(3)
+	wm.WantBlocks(context.Background(), ks)
+	waitIdle(t, wm)
+	wm.runSync(func() {})
+
+	ps := make([]peer.ID, 4)
+	for i := range ps {
+		ps[i] = testutil.RandPeerIDFatal(t)
+	}
+	before := atomic.LoadInt32(&backend.sorted)
+	wm.ConnectedBatch(ps)
+	if built := atomic.LoadInt32(&backend.sorted) - before; built != 1 {
+		t.Fatalf("expected the wantlist to be put together once, got %d times", built)
+	}
+
+	for _, p := range ps {
+		seed := net.waitMessages(t, p, 1)[0]
+		if !seed.Full() || len(seed.Wantlist()) != len(ks) {
+			t.Fatalf("expected %s to be sent the full wantlist", p)
+		}
+	}
+	if peers := wm.ConnectedPeers(); len(peers) != len(ps) {
+		t.Fatalf("expected %d peers, got %d", len(ps), len(peers))
+	}
+}
+
+func TestOversizedEntryPolicy(t *testing.T) {
+	ks := testCids(4)
+
+	// every plain want fits a message on its own, an annotated one does not
+	one := bsmsg.New(false)
+	one.AddEntry(ks[0], math.MaxInt32)
+	maxSize := bsmsg.EstimateSize(one)
+
+	run := func(t *testing.T, policy OversizedEntryPolicy, opts ...WantManagerOption) (*fakeNetwork, peer.ID) {
+		net := newFakeNetwork()
+		opts = append(opts, WithMaxMessageSize(maxSize), WithOversizedEntryPolicy(policy))
+		wm, cancel := newTestWantManager(net, opts...)
+		defer cancel()
+
+		p := testutil.RandPeerIDFatal(t)
+		wm.Connected(p)
+		waitIdle(t, wm)
+
+		wm.WantBlocks(context.Background(), ks[:2])
+		wm.WantBlocksAnnotated(context.Background(), ks[2:3], 0xff)
+		wm.WantBlocks(context.Background(), ks[3:])
+		for _, c := range []*cid.Cid{ks[0], ks[1], ks[3]} {
+			net.waitSent(t, p, c)
+		}
+		if err := wm.DrainPeer(context.Background(), p); err != nil {
+			t.Fatal(err)
+		}
+		return net, p
+	}
+
+	t.Run("drop", func(t *testing.T) {
+		net, p := run(t, OversizedDrop)
+		for _, msg := range net.messages(p) {
+			if size := bsmsg.EstimateSize(msg); size > maxSize {
+				t.Fatalf("sent a message of %d bytes, more than %d", size, maxSize)
+			}
+		}
+		if net.sentCids(p).Has(ks[2]) {
+			t.Fatal("the oversized want should not be sent")
+		}
+	})
+
+	t.Run("send anyway", func(t *testing.T) {
+		net, p := run(t, OversizedSendAnyway)
+		net.waitSent(t, p, ks[2])
+		for _, msg := range net.messages(p) {
+			size := bsmsg.EstimateSize(msg)
+			if size <= maxSize {
+				continue
+			}
+			if wl := msg.Wantlist(); len(wl) != 1 || !wl[0].Cid.Equals(ks[2]) {
+				t.Fatalf("only the oversized want should be sent in a message of %d bytes", size)
+			}
+		}
+	})
+
+	t.Run("report", func(t *testing.T) {
+		var lk sync.Mutex
+		reported := make(map[string]int)
+		net := newFakeNetwork()
+		wm, cancel := newTestWantManager(net, WithMaxMessageSize(maxSize), WithOversizedEntryPolicy(OversizedReport))
+		defer cancel()
+		wm.OnOversizedEntry(func(p peer.ID, c *cid.Cid, size int) {
+			lk.Lock()
+			defer lk.Unlock()
+			reported[c.KeyString()] = size
+		})
+
+		p := testutil.RandPeerIDFatal(t)
+		wm.Connected(p)
+		waitIdle(t, wm)
+		wm.WantBlocksAnnotated(context.Background(), ks[2:3], 0xff)
+		wm.WantBlocks(context.Background(), ks[3:])
+		net.waitSent(t, p, ks[3])
+		if err := wm.DrainPeer(context.Background(), p); err != nil {
+			t.Fatal(err)
+		}
+
+		if net.sentCids(p).Has(ks[2]) {
+			t.Fatal("the oversized want should not be sent")
+		}
+		lk.Lock()
+		defer lk.Unlock()
+		if size, ok := reported[ks[2].KeyString()]; !ok || size <= maxSize || len(reported) != 1 {
+			t.Fatalf("expected only the oversized want to be reported, got %v", reported)
+		}
+	})
+
+	t.Run("report once", func(t *testing.T) {
+		var reports int32
+		net := newFakeNetwork()
+		wm, cancel := newTestWantManager(net, WithMaxMessageSize(maxSize), WithOversizedEntryPolicy(OversizedReport))
+		defer cancel()
+		wm.OnOversizedEntry(func(peer.ID, *cid.Cid, int) {
+			atomic.AddInt32(&reports, 1)
+		})
+
+		p := testutil.RandPeerIDFatal(t)
+		wm.Connected(p)
+		waitIdle(t, wm)
+		wm.WantBlocksAnnotated(context.Background(), ks[2:3], 0xff)
+		wm.WantBlocks(context.Background(), ks[3:])
+		net.waitSent(t, p, ks[3])
+		for i := 0; i < 2; i++ {
+			sent := len(net.messages(p))
+			wm.runSync(wm.rebroadcast)
+			net.waitMessages(t, p, sent+1)
+		}
+		if err := wm.DrainPeer(context.Background(), p); err != nil {
+			t.Fatal(err)
+		}
+
+		if net.sentCids(p).Has(ks[2]) {
+			t.Fatal("the oversized want should not be sent")
+		}
+		if n := atomic.LoadInt32(&reports); n != 1 {
+			t.Fatalf("expected the oversized want to be reported once, got %d reports", n)
+		}
+	})
+}
+
+// scriptedSenders opens senders for WithSenderFactory. The first failOpens
+// opens and the first failSends sends, across all senders, fail. Other
+// sends are recorded in net.
+type scriptedSenders struct {
+	net       *fakeNetwork
+	failOpens int
+	failSends int
+
+	lk     sync.Mutex
+	opens  int
+	sends  int
+	closes int
+}
+
+func (s *scriptedSenders) open(p peer.ID) (bsnet.MessageSender, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.opens++
+	if s.opens <= s.failOpens {
+		return nil, errors.New("scripted open failure")
+	}
+	return &scriptedSender{s, p}, nil
+}
+
+func (s *scriptedSenders) counts() (opens, sends, closes int) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.opens, s.sends, s.closes
+}
+
+type scriptedSender struct {
+	script *scriptedSenders
+	p      peer.ID
+}
+
+func (s *scriptedSender) SendMsg(ctx context.Context, msg bsmsg.BitSwapMessage) error {
+	s.script.lk.Lock()
+	s.script.sends++
+	fail := s.script.sends <= s.script.failSends
+	s.script.lk.Unlock()
+	if fail {
+		return errors.New("scripted send failure")
+	}
+	return s.script.net.SendMessage(ctx, s.p, msg)
+}
+
+func (s *scriptedSender) Close() error {
+	s.script.lk.Lock()
+	defer s.script.lk.Unlock()
+	s.script.closes++
+	return nil
+}
+
+func TestSenderFactoryOpenFailures(t *testing.T) {
+	net := newFakeNetwork()
+	script := &scriptedSenders{net: net, failOpens: 2}
+	wm, cancel := newTestWantManager(net, WithSenderFactory(script.open))
+	defer cancel()
+
+	opens := func() int {
+		n, _, _ := script.counts()
+		return n
+	}
+
+	// every failed open leaves the changes queued for the next attempt
+	ks := testCids(2)
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitFor(t, "first open", func() bool { return opens() == 1 })
+	wm.WantBlocks(context.Background(), ks[:1])
+	waitFor(t, "second open", func() bool { return opens() == 2 })
+	wm.WantBlocks(context.Background(), ks[1:])
+	net.waitSent(t, p, ks[1])
+
+	msgs := net.messages(p)
+	if len(msgs) != 1 || !msgs[0].Full() || len(msgs[0].Wantlist()) != 2 {
+		t.Fatalf("expected a single full wantlist with both wants, got %v", msgs)
+	}
+	if n := opens(); n != 3 {
+		t.Fatalf("expected 3 opens, got %d", n)
+	}
+	if n := net.openedSenders(p); n != 0 {
+		t.Fatalf("expected the network not to be asked for senders, got %d", n)
+	}
+}
+
+func TestSenderFactorySendFailures(t *testing.T) {
+	net := newFakeNetwork()
+	script := &scriptedSenders{net: net, failSends: 2}
+	wm, cancel := newTestWantManager(net, WithSenderFactory(script.open),
+		WithDisconnectPropagationDelay(time.Millisecond))
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+
+	// each failed send closes the sender and retries on a new one
+	ks := testCids(1)
+	wm.WantBlocks(context.Background(), ks)
+	net.waitSent(t, p, ks[0])
+	if opens, sends, closes := script.counts(); opens != 3 || sends != 3 || closes != 2 {
+		t.Fatalf("expected 3 opens, 3 sends and 2 closes, got %d, %d and %d", opens, sends, closes)
+	}
+	if msgs := net.messages(p); len(msgs) != 1 {
+		t.Fatalf("expected the want to be sent once, got %d messages", len(msgs))
+	}
+}
+
+func TestPauseAll(t *testing.T) {
+	tracer := new(recordingTracer)
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithWantTracer(tracer))
+	defer cancel()
+
+	wm.PauseAll()
+	ps := []peer.ID{testutil.RandPeerIDFatal(t), testutil.RandPeerIDFatal(t)}
+	for _, p := range ps {
+		wm.Connected(p)
+	}
+	ks := testCids(3)
+	wm.WantBlocks(context.Background(), ks[:2])
+	wm.CancelWants(ks[:1])
+	wm.WantBlocks(context.Background(), ks[2:])
+	waitIdle(t, wm)
+	wm.runSync(wm.rebroadcast)
+
+	time.Sleep(20 * time.Millisecond)
+	for _, p := range ps {
+		if msgs := net.messages(p); len(msgs) != 0 {
+			t.Fatalf("expected nothing sent to %s while paused, got %d messages", p, len(msgs))
+		}
+	}
+	for _, stage := range tracer.stages(ks[1]) {
+		if strings.HasPrefix(stage, fmt.Sprintf("%d ", WantRebroadcast)) {
+			t.Fatal("expected no rebroadcast while paused")
+		}
+	}
+
+	// what was queued meanwhile goes out in one go
+	wm.ResumeAll()
+	for _, p := range ps {
+		net.waitSent(t, p, ks[2])
+		msgs := net.messages(p)
+		if len(msgs) != 1 || !msgs[0].Full() || len(msgs[0].Wantlist()) != 2 {
+			t.Fatalf("expected one full wantlist for %s, got %v", p, msgs)
+		}
+	}
+}
+
+func TestCancelWantsFromPeers(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	ps := []peer.ID{testutil.RandPeerIDFatal(t), testutil.RandPeerIDFatal(t), testutil.RandPeerIDFatal(t)}
+	for _, p := range ps {
+		wm.Connected(p)
+	}
+	waitIdle(t, wm)
+
+	ks := testCids(3)
+	wm.WantBlocks(context.Background(), ks)
+	for _, p := range ps {
+		net.waitSent(t, p, ks[2])
+	}
+
+	wm.CancelWantsFromPeers(ks[:2], ps[:2])
+	for _, p := range ps {
+		if err := wm.DrainPeer(context.Background(), p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cancelsTo := func(p peer.ID) *cid.Set {
+		cancels := cid.NewSet()
+		for _, msg := range net.messages(p) {
+			for _, e := range msg.Wantlist() {
+				if e.Cancel {
+					cancels.Add(e.Cid)
+				}
+			}
+		}
+		return cancels
+	}
+	for _, p := range ps[:2] {
+		if cancels := cancelsTo(p); cancels.Len() != 2 || !cancels.Has(ks[0]) || !cancels.Has(ks[1]) {
+			t.Fatalf("expected %s to be sent cancels for the first two wants, got %d cancels", p, cancels.Len())
+		}
+	}
+	if cancels := cancelsTo(ps[2]); cancels.Len() != 0 {
+		t.Fatalf("expected no cancels for the other peer, got %d", cancels.Len())
+	}
+
+	all := wm.AllPeerWantlists(0)
+	for _, p := range ps[:2] {
+		if es := all[p]; len(es) != 1 || !es[0].Cid.Equals(ks[2]) {
+			t.Fatalf("expected %s to keep only the last want, got %v", p, es)
+		}
+	}
+	if len(all[ps[2]]) != len(ks) {
+		t.Fatalf("expected the other peer to keep all %d wants, got %d", len(ks), len(all[ps[2]]))
+	}
+	if snap := wm.Snapshot(); snap.Len() != len(ks) {
+		t.Fatalf("expected our wantlist to be left alone, got %d wants", snap.Len())
+	}
+}
+
+func TestNetworkDemand(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	ps := []peer.ID{testutil.RandPeerIDFatal(t), testutil.RandPeerIDFatal(t), testutil.RandPeerIDFatal(t)}
+	for _, p := range ps[:2] {
+		wm.Connected(p)
+	}
+	ks := testCids(4)
+	wm.WantBlocks(context.Background(), ks[:1])
+	waitIdle(t, wm)
+
+	inbound := func(p peer.ID, full bool, want, cancel []*cid.Cid) {
+		msg := bsmsg.New(full)
+		for _, c := range want {
+			msg.AddEntry(c, 1)
+		}
+		for _, c := range cancel {
+			msg.Cancel(c)
+		}
+		wm.PeerWantlistReceived(p, msg)
+	}
+	inbound(ps[0], true, ks[:3], nil)
+	inbound(ps[1], false, ks[1:2], nil)
+	// never connected, so not counted
+	inbound(ps[2], true, ks, nil)
+
+	demandFor := func() map[string]int {
+		counts := make(map[string]int)
+		for c, n := range wm.NetworkDemand() {
+			counts[c.KeyString()] = n
+		}
+		return counts
+	}
+	expect := func(want map[*cid.Cid]int) {
+		got := demandFor()
+		if len(got) != len(want) {
+			t.Fatalf("expected demand for %d cids, got %d", len(want), len(got))
+		}
+		for c, n := range want {
+			if got[c.KeyString()] != n {
+				t.Fatalf("expected demand %d for %s, got %d", n, c, got[c.KeyString()])
+			}
+		}
+	}
+	expect(map[*cid.Cid]int{ks[0]: 2, ks[1]: 2, ks[2]: 1})
+
+	// a cancel drops the want, a full wantlist replaces the old one
+	inbound(ps[1], false, nil, ks[1:2])
+	inbound(ps[0], true, ks[3:], nil)
+	expect(map[*cid.Cid]int{ks[0]: 1, ks[3]: 1})
+
+	wm.Disconnected(ps[0])
+	waitIdle(t, wm)
+	expect(map[*cid.Cid]int{ks[0]: 1})
+
+	// wantlists of peers that are not connected are not kept around
+	inbound(ps[0], true, ks[1:2], nil)
+	wm.Disconnected(ps[2])
+	waitIdle(t, wm)
+	expect(map[*cid.Cid]int{ks[0]: 1})
+	wm.demandLk.Lock()
+	defer wm.demandLk.Unlock()
+	if len(wm.peerWants) != 0 {
+		t.Fatalf("expected the wantlists of peers that left or never connected to be dropped, %d kept", len(wm.peerWants))
+	}
+}
+
+func TestPeerTeardownGrace(t *testing.T) {
+	net := newFakeNetwork()
+	started, release := make(chan struct{}), make(chan struct{})
+	var sent int32
+	net.sendHook = func(context.Context, peer.ID, bsmsg.BitSwapMessage) error {
+		close(started)
+		<-release
+		atomic.StoreInt32(&sent, 1)
+		return nil
+	}
+	wm, cancel := newTestWantManager(net, WithPeerTeardownGrace(time.Second))
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	wm.WantBlocks(context.Background(), testCids(1))
+	<-started
+
+	// the send is held up past the disconnect, teardown waits for it
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+	start := time.Now()
+	wm.Disconnected(p)
+	wm.runSync(func() {})
+	if atomic.LoadInt32(&sent) != 1 {
+		t.Fatal("expected the send in progress to complete before teardown")
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("expected teardown within the grace, took %s", took)
+	}
+}
+
+func TestPeerTeardownGraceExpires(t *testing.T) {
+	net := newFakeNetwork()
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	net.sendHook = func(context.Context, peer.ID, bsmsg.BitSwapMessage) error {
+		close(started)
+		<-release
+		return nil
+	}
+	grace := 50 * time.Millisecond
+	wm, cancel := newTestWantManager(net, WithPeerTeardownGrace(grace))
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	wm.WantBlocks(context.Background(), testCids(1))
+	<-started
+
+	// a send that outlasts the grace does not hold up teardown for good
+	start := time.Now()
+	wm.Disconnected(p)
+	wm.runSync(func() {})
+	if took := time.Since(start); took < grace || took > 10*grace {
+		t.Fatalf("expected teardown after the grace of %s, took %s", grace, took)
+	}
+}
+
+func TestSatisfactionRate(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	if rate := wm.SatisfactionRate(time.Hour); rate != 0 {
+		t.Fatalf("expected no rate before any want left the wantlist, got %f", rate)
+	}
+
+	p := testutil.RandPeerIDFatal(t)
+	ks := testCids(4)
+	wm.WantBlocks(context.Background(), ks)
+	wm.ReceivedBlocks(ks[:2], p)
+	wm.CancelWants(ks[2:3])
+	time.Sleep(100 * time.Millisecond)
+	wm.ReceivedBlocks(ks[3:], p)
+	waitFor(t, "wants to leave the wantlist", func() bool {
+		return wm.wl.Len() == 0
+	})
+
+	// the abandoned want counts against the rate, as does the late one
+	// within a window it missed
+	if rate := wm.SatisfactionRate(time.Hour); rate != 0.75 {
+		t.Fatalf("expected a rate of 0.75 within an hour, got %f", rate)
+	}
+	if rate := wm.SatisfactionRate(50 * time.Millisecond); rate != 0.5 {
+		t.Fatalf("expected a rate of 0.5 within 50ms, got %f", rate)
+	}
+}
+
+func TestConnectAdmissionRate(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithConnectAdmissionRate(20))
+	defer cancel()
+
+	ks := testCids(1)
+	wm.WantBlocks(context.Background(), ks)
+	waitIdle(t, wm)
+
+	var ps []peer.ID
+	for i := 0; i < 5; i++ {
+		ps = append(ps, testutil.RandPeerIDFatal(t))
+	}
+	start := time.Now()
+	for _, p := range ps {
+		wm.Connected(p)
+	}
+	waitIdle(t, wm)
+	if n := len(wm.ConnectedPeers()); n > 2 {
+		t.Fatalf("expected the burst of connects to be held back, %d peers were taken in", n)
+	}
+
+	// a peer leaving before it is taken in is never started
+	wm.Disconnected(ps[4])
+	for _, p := range ps[:4] {
+		net.waitSent(t, p, ks[0])
+	}
+	if took := time.Since(start); took < 150*time.Millisecond {
+		t.Fatalf("expected 4 peers to take at least 150ms at 20 a second, took %s", took)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := len(wm.ConnectedPeers()); n != 4 {
+		t.Fatalf("expected 4 peers once all were taken in, got %d", n)
+	}
+	if msgs := net.messages(ps[4]); len(msgs) != 0 {
+		t.Fatalf("expected nothing sent to the peer that left, got %d messages", len(msgs))
+	}
+}
+
+func TestConnectedBatchAdmissionRate(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithConnectAdmissionRate(20))
+	defer cancel()
+
+	ks := testCids(1)
+	wm.WantBlocks(context.Background(), ks)
+	waitIdle(t, wm)
+
+	var ps []peer.ID
+	for i := 0; i < 4; i++ {
+		ps = append(ps, testutil.RandPeerIDFatal(t))
+	}
+	wm.ConnectedBatch(ps)
+	if n := len(wm.ConnectedPeers()); n != 1 {
+		t.Fatalf("expected the batch to be held back but for one peer, %d peers were taken in", n)
+	}
+
+	for _, p := range ps {
+		net.waitSent(t, p, ks[0])
+	}
+	waitFor(t, "all peers to be taken in", func() bool {
+		return len(wm.ConnectedPeers()) == len(ps)
+	})
+}
+
+func TestSendBlockAsync(t *testing.T) {
+	errSend := errors.New("send failed")
+	bgen := blocksutil.NewBlockGenerator()
+	blks := bgen.Blocks(4)
+	net := newFakeNetwork()
+	net.sendHook = func(ctx context.Context, p peer.ID, msg bsmsg.BitSwapMessage) error {
+		for _, b := range msg.Blocks() {
+			if b.Cid().Equals(blks[1].Cid()) {
+				return errSend
+			}
+		}
+		return nil
+	}
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	results := make([]chan error, len(blks))
+	var sent int32
+	for i, b := range blks {
+		results[i] = make(chan error, 1)
+		env := &engine.Envelope{
+			Peer:  p,
+			Block: b,
+			Sent:  func() { atomic.AddInt32(&sent, 1) },
+		}
+		wm.SendBlockAsync(context.Background(), env, func(err error) { results[i] <- err })
+	}
+	for i, res := range results {
+		select {
+		case err := <-res:
+			if i == 1 && err != errSend {
+				t.Fatalf("expected the send error for block %d, got %v", i, err)
+			} else if i != 1 && err != nil {
+				t.Fatalf("expected block %d to be sent, got %v", i, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the callback of block %d", i)
+		}
+	}
+	if n := atomic.LoadInt32(&sent); n != int32(len(blks)) {
+		t.Fatalf("expected Sent to be called for each block, got %d", n)
+	}
+}
+
+func TestSendBlockAsyncBackpressure(t *testing.T) {
+	release := make(chan struct{})
+	net := newFakeNetwork()
+	net.sendHook = func(context.Context, peer.ID, bsmsg.BitSwapMessage) error {
+		<-release
+		return nil
+	}
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	bgen := blocksutil.NewBlockGenerator()
+	results := make(chan error, maxAsyncBlocks+1)
+	send := func(ctx context.Context) {
+		env := &engine.Envelope{Peer: p, Block: bgen.Next(), Sent: func() {}}
+		wm.SendBlockAsync(ctx, env, func(err error) { results <- err })
+	}
+	for i := 0; i < maxAsyncBlocks; i++ {
+		send(context.Background())
+	}
+
+	// the peer has as many blocks in flight as allowed, so the next one
+	// waits for a slot until its context ends
+	ctx, cancelSend := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelSend()
+	send(ctx)
+	if err := <-results; err != context.DeadlineExceeded {
+		t.Fatalf("expected the send beyond the limit to time out, got %v", err)
+	}
+
+	close(release)
+	for i := 0; i < maxAsyncBlocks; i++ {
+		if err := <-results; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWantBlocksToGroup(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	ps := []peer.ID{testutil.RandPeerIDFatal(t), testutil.RandPeerIDFatal(t), testutil.RandPeerIDFatal(t)}
+	for _, p := range ps {
+		wm.Connected(p)
+	}
+	wm.AssignPeerGroup(ps[0], "dc1")
+	wm.AssignPeerGroup(ps[1], "dc1")
+	wm.AssignPeerGroup(ps[2], "dc2")
+
+	ks := testCids(3)
+	wm.WantBlocksToGroup(context.Background(), ks[:1], "dc1")
+	for _, p := range ps[:2] {
+		net.waitSent(t, p, ks[0])
+	}
+	// a want to the other group marks when the first one was handled
+	wm.WantBlocksToGroup(context.Background(), ks[1:2], "dc2")
+	net.waitSent(t, ps[2], ks[1])
+	for _, p := range ps {
+		if err := wm.DrainPeer(context.Background(), p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if net.sentCids(ps[2]).Has(ks[0]) {
+		t.Fatal("expected the group broadcast not to reach other groups")
+	}
+	for _, p := range ps[:2] {
+		if net.sentCids(p).Has(ks[1]) {
+			t.Fatal("expected the group broadcast not to reach other groups")
+		}
+	}
+
+	// a peer leaves its group on disconnect
+	wm.Disconnected(ps[1])
+	wm.WantBlocksToGroup(context.Background(), ks[2:], "dc1")
+	net.waitSent(t, ps[0], ks[2])
+	var members []peer.ID
+	wm.runSync(func() { members = wm.groupMembers("dc1") })
+	if len(members) != 1 || members[0] != ps[0] {
+		t.Fatalf("expected only the connected peer left in the group, got %v", members)
+	}
+}
+
+func TestMemoryEstimate(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	if n := wm.MemoryEstimate(); n != 0 {
+		t.Fatalf("expected nothing held without wants or peers, got %d bytes", n)
+	}
+
+	ks := testCids(10)
+	wm.WantBlocks(context.Background(), ks)
+	waitIdle(t, wm)
+	want := int64(len(ks) * (len(ks[0].Bytes()) + wantEntryOverhead))
+	waitFor(t, "wants to be added", func() bool { return wm.MemoryEstimate() == want })
+
+	// the peers are seeded with the wantlist but cannot send it, so each
+	// holds the wants both as told about and as pending
+	wm.PauseAll()
+	wm.Connected(testutil.RandPeerIDFatal(t))
+	wm.Connected(testutil.RandPeerIDFatal(t))
+	waitIdle(t, wm)
+	min := 3*want + 2*queueOverhead
+	max := min + 2*want
+	if n := wm.MemoryEstimate(); n < min || n > max {
+		t.Fatalf("expected an estimate between %d and %d bytes, got %d", min, max, n)
+	}
+}
+
+func TestResendCancels(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	ks := testCids(2)
+	wm.WantBlocks(context.Background(), ks[:1])
+	net.waitSent(t, p, ks[0])
+
+	// ks[1] was never wanted, so there is no local state for it at all
+	wm.ResendCancels(p, ks)
+	if err := wm.DrainPeer(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+
+	cancels := cid.NewSet()
+	for _, msg := range net.messages(p) {
+		for _, e := range msg.Wantlist() {
+			if e.Cancel {
+				cancels.Add(e.Cid)
+			}
+		}
+	}
+	if cancels.Len() != 2 || !cancels.Has(ks[0]) || !cancels.Has(ks[1]) {
+		t.Fatalf("expected cancels for both cids to be sent, got %d", cancels.Len())
+	}
+	if _, ok := wm.wl.Contains(ks[0]); !ok {
+		t.Fatal("expected our wantlist to be left alone")
+	}
+	wm.runSync(func() {
+		if n := wm.peers[p].wl.Len(); n != 0 {
+			t.Fatalf("expected the peer not to be told about the cids again, it has %d", n)
+		}
+	})
+}
+
+func TestReprioritizePendingSeed(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithSeedChunkSize(1))
+	defer cancel()
+
+	ks := testCids(3)
+	wm.WantBlocks(context.Background(), ks)
+	waitIdle(t, wm)
+
+	// the wantlist is still waiting to go out in chunks when the peer's
+	// priorities change
+	wm.PauseAll()
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+	initial := make(map[string]int)
+	for _, e := range wm.wl.Entries() {
+		initial[e.Cid.KeyString()] = e.Priority
+	}
+	wm.BoostPeer(p, -5)
+	wm.ResumeAll()
+	if err := wm.DrainPeer(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+
+	last := make(map[string]int)
+	for _, msg := range net.messages(p) {
+		for _, e := range msg.Wantlist() {
+			last[e.Cid.KeyString()] = e.Priority
+		}
+	}
+	for _, c := range ks {
+		want := initial[c.KeyString()] - 5
+		if got := last[c.KeyString()]; got != want {
+			t.Fatalf("expected %s to be sent last with priority %d, got %d", c, want, got)
+		}
+		if prio, _ := wm.EffectivePriority(p, c); prio != want {
+			t.Fatalf("expected the peer to be taken to know priority %d for %s, got %d", want, c, prio)
+		}
+	}
+}
+
+func TestPeerIdleTimeout(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithPeerIdleTimeout(50*time.Millisecond))
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	ks := testCids(2)
+	wm.WantBlocks(context.Background(), ks[:1])
+	net.waitSent(t, p, ks[0])
+
+	parked := func() bool {
+		var parked bool
+		wm.runSync(func() {
+			mq := wm.peers[p]
+			mq.outlk.Lock()
+			parked = mq.parked
+			mq.outlk.Unlock()
+		})
+		return parked
+	}
+	waitFor(t, "the idle queue to be parked", parked)
+	if peers := wm.ConnectedPeers(); len(peers) != 1 {
+		t.Fatalf("expected the peer to stay connected, got %d peers", len(peers))
+	}
+
+	// the next want starts the queue again and seeds the peer anew
+	sent := len(net.messages(p))
+	wm.WantBlocks(context.Background(), ks[1:])
+	net.waitSent(t, p, ks[1])
+	if parked() {
+		t.Fatal("expected the queue to be started again")
+	}
+	msgs := net.messages(p)[sent:]
+	if len(msgs) == 0 || !msgs[0].Full() || len(msgs[0].Wantlist()) != 2 {
+		t.Fatal("expected the peer to be sent our full wantlist again")
+	}
+}
+
+func TestPeerSendSizeStats(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	if stats := wm.PeerSendSizeStats(p); stats.Count != 0 || stats.Mean != 0 || stats.Max != 0 {
+		t.Fatalf("expected no stats before anything was sent, got %+v", stats)
+	}
+
+	ks := testCids(6)
+	for _, batch := range [][]*cid.Cid{ks[:1], ks[1:5], ks[5:]} {
+		wm.WantBlocks(context.Background(), batch)
+		net.waitSent(t, p, batch[len(batch)-1])
+		if err := wm.DrainPeer(context.Background(), p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msgs := net.messages(p)
+	var total, max int
+	for _, msg := range msgs {
+		size := bsmsg.EstimateSize(msg)
+		total += size
+		if size > max {
+			max = size
+		}
+	}
+	stats := wm.PeerSendSizeStats(p)
+	if stats.Count != len(msgs) || stats.Max != max {
+		t.Fatalf("expected %d messages of at most %d bytes, got %+v", len(msgs), max, stats)
+	}
+	if mean := float64(total) / float64(len(msgs)); stats.Mean != mean {
+		t.Fatalf("expected a mean of %f bytes, got %f", mean, stats.Mean)
+	}
+	if stats.Max == int(stats.Mean) {
+		t.Fatal("expected the messages to vary in size")
+	}
+}
+
+func TestWantBlocksIfPeers(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	ks := testCids(2)
+	if wm.WantBlocksIfPeers(context.Background(), ks[:1]) {
+		t.Fatal("expected no wants to be added without peers")
+	}
+	if _, ok := wm.wl.Contains(ks[0]); ok {
+		t.Fatal("expected our wantlist to be left alone")
+	}
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	if peers := wm.ConnectedPeers(); len(peers) != 1 {
+		t.Fatalf("expected the peer to be connected, got %d peers", len(peers))
+	}
+	if !wm.WantBlocksIfPeers(context.Background(), ks[1:]) {
+		t.Fatal("expected the wants to be added with a peer connected")
+	}
+	if _, ok := wm.wl.Contains(ks[1]); !ok {
+		t.Fatal("expected the want in our wantlist")
+	}
+	net.waitSent(t, p, ks[1])
+}
+
+func TestRebroadcastHook(t *testing.T) {
+	var lk sync.Mutex
+	var offered int
+	hook := func(p peer.ID, entries []*bsmsg.Entry) []*bsmsg.Entry {
+		lk.Lock()
+		offered = len(entries)
+		lk.Unlock()
+		var kept []*bsmsg.Entry
+		for i, e := range entries {
+			if i%2 == 0 {
+				kept = append(kept, e)
+			}
+		}
+		return kept
+	}
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithRebroadcastHook(hook))
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+	ks := testCids(4)
+	wm.WantBlocks(context.Background(), ks)
+	if err := wm.DrainPeer(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := len(net.messages(p))
+	wm.runSync(wm.rebroadcast)
+	if err := wm.DrainPeer(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	msgs := net.messages(p)[sent:]
+	if len(msgs) != 1 {
+		t.Fatalf("expected one rebroadcast message, got %d", len(msgs))
+	}
+	lk.Lock()
+	defer lk.Unlock()
+	if offered != len(ks) {
+		t.Fatalf("expected the hook to be offered the whole wantlist, got %d entries", offered)
+	}
+	if n := len(msgs[0].Wantlist()); n != len(ks)/2 {
+		t.Fatalf("expected half the wantlist to be rebroadcast, got %d entries", n)
+	}
+	if msgs[0].Full() {
+		t.Fatal("expected the filtered rebroadcast not to replace the peer's wantlist")
+	}
+}
+
+func TestResetCounters(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	ks := testCids(3)
+	wm.WantBlocks(context.Background(), ks)
+	wm.CancelWants(ks[:1])
+	waitIdle(t, wm)
+
+	bgen := blocksutil.NewBlockGenerator()
+	wm.SendBlock(context.Background(), &engine.Envelope{Peer: p, Block: bgen.Next(), Sent: func() {}})
+	net.sendHook = func(context.Context, peer.ID, bsmsg.BitSwapMessage) error {
+		return errors.New("send failed")
+	}
+	wm.SendBlock(context.Background(), &engine.Envelope{Peer: p, Block: bgen.Next(), Sent: func() {}})
+	net.sendHook = nil
+
+	if s := wm.Summary(); s.WantsAdded != 3 || s.WantsCancelled != 1 || s.BlocksSent != 2 {
+		t.Fatalf("expected 3 wants added, 1 cancelled and 2 blocks sent, got %+v", s)
+	}
+
+	wm.ResetCounters()
+	s := wm.Summary()
+	if s.WantsAdded != 0 || s.WantsCancelled != 0 || s.BlocksSent != 0 {
+		t.Fatalf("expected the counters to be zeroed, got %+v", s)
+	}
+	if s.Wantlist != 2 || s.Peers != 1 {
+		t.Fatalf("expected 2 wants and 1 peer, got %+v", s)
+	}
+	if count, total, max := wm.SentSizeSummary(); count != 0 || total != 0 || max != 0 {
+		t.Fatalf("expected the sent sizes to be zeroed, got %d, %d and %d", count, total, max)
+	}
+	m := wm.MetricsSnapshot()
+	if m["sent_blocks_bytes_total"] != 0 || m["send_errors_total"] != 0 {
+		t.Fatalf("expected the cumulative metrics to be zeroed, got %v", m)
+	}
+	if m["wantlist_total"] != 2 || m["peers_current"] != 1 {
+		t.Fatalf("expected the live metrics to be left alone, got %v", m)
+	}
+}
+
+func TestPeerWantBalance(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+	if wants, cancels := wm.PeerWantBalance(p); wants != 0 || cancels != 0 {
+		t.Fatalf("expected nothing queued yet, got %d wants and %d cancels", wants, cancels)
+	}
+
+	ks := testCids(3)
+	wm.WantBlocks(context.Background(), ks)
+	wm.CancelWants(ks[:2])
+	waitIdle(t, wm)
+	if wants, cancels := wm.PeerWantBalance(p); wants != 3 || cancels != 2 {
+		t.Fatalf("expected 3 wants and 2 cancels, got %d and %d", wants, cancels)
+	}
+
+	// the wantlist a peer is seeded with counts too
+	p2 := testutil.RandPeerIDFatal(t)
+	wm.Connected(p2)
+	waitIdle(t, wm)
+	if wants, cancels := wm.PeerWantBalance(p2); wants != 1 || cancels != 0 {
+		t.Fatalf("expected the seeded want to be counted, got %d wants and %d cancels", wants, cancels)
+	}
+	if wants, cancels := wm.PeerWantBalance(testutil.RandPeerIDFatal(t)); wants != 0 || cancels != 0 {
+		t.Fatalf("expected nothing for an unknown peer, got %d wants and %d cancels", wants, cancels)
+	}
+}
+
+func TestSetPeerTier(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	p1 := testutil.RandPeerIDFatal(t)
+	p2 := testutil.RandPeerIDFatal(t)
+	wm.Connected(p1)
+	wm.Connected(p2)
+	waitIdle(t, wm)
+	wm.SetPeerTier(p2, PeerTierLowPriority)
+
+	ks := testCids(2)
+	wm.WantBlocks(context.Background(), ks)
+	for _, p := range []peer.ID{p1, p2} {
+		if err := wm.DrainPeer(context.Background(), p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := net.sentCids(p1).Len(); n != len(ks) {
+		t.Fatalf("expected the normal peer to be sent %d wants, got %d", len(ks), n)
+	}
+	if n := net.sentCids(p2).Len(); n != 0 {
+		t.Fatalf("expected the low priority peer to wait for a rebroadcast, got %d wants", n)
+	}
+
+	wm.runSync(wm.rebroadcast)
+	if err := wm.DrainPeer(context.Background(), p2); err != nil {
+		t.Fatal(err)
+	}
+	if n := net.sentCids(p2).Len(); n != len(ks) {
+		t.Fatalf("expected the rebroadcast to send the low priority peer %d wants, got %d", len(ks), n)
+	}
+
+	// cancels are not held back for rebroadcasts
+	sent := len(net.messages(p2))
+	wm.CancelWants(ks[:1])
+	waitIdle(t, wm)
+	if err := wm.DrainPeer(context.Background(), p2); err != nil {
+		t.Fatal(err)
+	}
+	var cancels int
+	for _, m := range net.messages(p2)[sent:] {
+		for _, e := range m.Wantlist() {
+			if e.Cancel {
+				cancels++
+			}
+		}
+	}
+	if cancels != 1 {
+		t.Fatalf("expected the low priority peer to be sent 1 cancel, got %d", cancels)
+	}
+
+	// but not for wants it was never told about
+	sent = len(net.messages(p2))
+	more := testCids(3)[2:]
+	wm.WantBlocks(context.Background(), more)
+	wm.CancelWants(more)
+	waitIdle(t, wm)
+	if err := wm.DrainPeer(context.Background(), p2); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(net.messages(p2)) - sent; n != 0 {
+		t.Fatalf("expected nothing to be sent to the low priority peer, got %d messages", n)
+	}
+}
+
+func TestLowPriorityPeerChunkRebroadcast(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithRebroadcastChunkSize(1),
+		WithBroadcastPriorityFloor(kMaxPriority-1))
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+	wm.SetPeerTier(p, PeerTierLowPriority)
+
+	// the third want falls below the floor
+	ks := testCids(3)
+	wm.WantBlocks(context.Background(), ks)
+	waitIdle(t, wm)
+	for i := 0; i < len(ks); i++ {
+		wm.runSync(wm.rebroadcast)
+	}
+	if err := wm.DrainPeer(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	if sent := net.sentCids(p); !sent.Has(ks[0]) || !sent.Has(ks[1]) || sent.Has(ks[2]) {
+		t.Fatal("expected the chunks to skip the want below the floor for the low priority peer")
+	}
+}
+
+func TestFailedSends(t *testing.T) {
+	sendErr := errors.New("send failed")
+	net := newFakeNetwork()
+	net.sendHook = func(context.Context, peer.ID, bsmsg.BitSwapMessage) error {
+		return sendErr
+	}
+	giveUp := func(error) RetryDecision { return SendGiveUp }
+	wm, cancel := newTestWantManager(net, WithErrorClassifier(giveUp), WithFailedSendCapture(2))
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+	before := time.Now()
+	ks := testCids(3)
+	for _, batch := range [][]*cid.Cid{ks[:1], ks[1:]} {
+		wm.WantBlocks(context.Background(), batch)
+		waitIdle(t, wm)
+		if err := wm.DrainPeer(context.Background(), p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only the latest two are kept
+	failed := wm.FailedSends()
+	if len(failed) != 2 {
+		t.Fatalf("expected 2 failed sends, got %d", len(failed))
+	}
+	for _, f := range failed {
+		if !f.Cid.Equals(ks[1]) && !f.Cid.Equals(ks[2]) {
+			t.Fatalf("expected only the wants of the last message, got %s", f.Cid)
+		}
+		if f.Peer != p || f.Err != sendErr {
+			t.Fatalf("expected the send to %s to have failed with %q, got %s and %v", p, sendErr, f.Peer, f.Err)
+		}
+		if f.Time.Before(before) {
+			t.Fatalf("expected the failure to be timestamped after %s, got %s", before, f.Time)
+		}
+	}
+	if failed := wm.FailedSends(); len(failed) != 0 {
+		t.Fatalf("expected the failed sends to have been drained, got %d", len(failed))
+	}
+}
+
+func benchmarkConnect(b *testing.B, opts ...WantManagerOption) {
+	peers := make([]peer.ID, 2000)
+	for i := range peers {
+		peers[i] = testutil.RandPeerIDFatal(b)
+	}
+	net := newFakeNetwork()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		wm, cancel := newTestWantManager(net, opts...)
+		for _, p := range peers {
+			wm.Connected(p)
+		}
+		// connects are buffered, ConnectedPeers can overtake the last ones
+		for len(wm.ConnectedPeers()) < len(peers) {
+			runtime.Gosched()
+		}
+		cancel()
+	}
+}
+
+func BenchmarkConnect(b *testing.B) {
+	benchmarkConnect(b)
+}
+
+func BenchmarkConnectExpectedPeers(b *testing.B) {
+	benchmarkConnect(b, WithExpectedPeers(2000))
+}
+
+func TestPeerWantlistVersion(t *testing.T) {
+	net := newFakeNetwork()
+	block := make(chan struct{})
+	net.sendHook = func(context.Context, peer.ID, bsmsg.BitSwapMessage) error {
+		<-block
+		return nil
+	}
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+	wm.WantBlocks(context.Background(), testCids(2))
+	waitIdle(t, wm)
+	version := wm.WantlistVersion()
+	if version == 0 {
+		t.Fatal("expected adding wants to bump the wantlist version")
+	}
+
+	// queued is not sent yet
+	if v := wm.PeerWantlistVersion(p); v != 0 {
+		t.Fatalf("expected the peer to be behind while the send is blocked, got version %d", v)
+	}
+	close(block)
+	if err := wm.DrainPeer(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	if v := wm.PeerWantlistVersion(p); v != version {
+		t.Fatalf("expected the peer to have caught up to version %d, got %d", version, v)
+	}
+	if v := wm.PeerWantlistVersion(testutil.RandPeerIDFatal(t)); v != 0 {
+		t.Fatalf("expected version 0 for an unknown peer, got %d", v)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net)
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+	ks := testCids(3)
+	wm.WantBlocks(context.Background(), ks)
+	if err := wm.DrainPeer(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	if err := wm.Restart(context.Background()); err == nil {
+		t.Fatal("expected restarting a running WantManager to fail")
+	}
+
+	cancel()
+	sent := len(net.messages(p))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := wm.Restart(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if peers := wm.ConnectedPeers(); len(peers) != 1 || peers[0] != p {
+		t.Fatalf("expected %s to still be connected, got %v", p, peers)
+	}
+	if n := wm.wl.Len(); n != len(ks) {
+		t.Fatalf("expected the wantlist of %d to survive, got %d wants", len(ks), n)
+	}
+
+	// the peer is sent our wantlist again by its new queue
+	msgs := net.waitMessages(t, p, sent+1)
+	seed := msgs[sent]
+	if !seed.Full() || len(seed.Wantlist()) != len(ks) {
+		t.Fatalf("expected a full wantlist of %d, got %d entries, full %t", len(ks), len(seed.Wantlist()), seed.Full())
+	}
+
+	more := testCids(4)[3:]
+	wm.WantBlocks(context.Background(), more)
+	net.waitSent(t, p, more[0])
+}
+
+func TestWantDiagnostic(t *testing.T) {
+	p1 := testutil.RandPeerIDFatal(t)
+	p2 := testutil.RandPeerIDFatal(t)
+	net := newFakeNetwork()
+	net.sendHook = func(_ context.Context, p peer.ID, _ bsmsg.BitSwapMessage) error {
+		if p == p2 {
+			return errors.New("send failed")
+		}
+		return nil
+	}
+	giveUp := func(error) RetryDecision { return SendGiveUp }
+	wm, cancel := newTestWantManager(net, WithErrorClassifier(giveUp))
+	defer cancel()
+
+	wm.Connected(p1)
+	wm.Connected(p2)
+	waitIdle(t, wm)
+	c := testCids(1)[0]
+	wm.WantBlocks(context.Background(), []*cid.Cid{c})
+	waitIdle(t, wm)
+	for _, p := range []peer.ID{p1, p2} {
+		if err := wm.DrainPeer(context.Background(), p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	diag := wm.WantDiagnostic(c)
+	e, _ := wm.wl.Contains(c)
+	if !diag.Wanted || diag.Priority != e.Priority {
+		t.Fatalf("expected the want at priority %d, got %+v", e.Priority, diag)
+	}
+	if diag.Reach != 2 || diag.SendAttempts != 2 {
+		t.Fatalf("expected the want to reach 2 peers in 2 attempts, got %+v", diag)
+	}
+	if diag.Age <= 0 {
+		t.Fatalf("expected the want to have an age, got %+v", diag)
+	}
+	if !diag.SendFailed {
+		t.Fatalf("expected the failed send to p2 to show, got %+v", diag)
+	}
+
+	if diag := wm.WantDiagnostic(testCids(2)[1]); diag != (WantDiag{}) {
+		t.Fatalf("expected nothing for a cid not wanted, got %+v", diag)
+	}
+}
+
+func TestMaxConcurrentBlockSends(t *testing.T) {
+	const limit = 3
+	var lk sync.Mutex
+	var inflight, most int
+	net := newFakeNetwork()
+	net.sendHook = func(context.Context, peer.ID, bsmsg.BitSwapMessage) error {
+		lk.Lock()
+		inflight++
+		if inflight > most {
+			most = inflight
+		}
+		lk.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		lk.Lock()
+		inflight--
+		lk.Unlock()
+		return nil
+	}
+	wm, cancel := newTestWantManager(net, WithMaxConcurrentBlockSends(limit))
+	defer cancel()
+
+	var sent int32
+	var wg sync.WaitGroup
+	bgen := blocksutil.NewBlockGenerator()
+	for _, b := range bgen.Blocks(20) {
+		env := &engine.Envelope{
+			Peer:  testutil.RandPeerIDFatal(t),
+			Block: b,
+			Sent:  func() { atomic.AddInt32(&sent, 1) },
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wm.SendBlock(context.Background(), env)
+		}()
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&sent); n != 20 {
+		t.Fatalf("expected all 20 envelopes to be marked sent, got %d", n)
+	}
+	lk.Lock()
+	defer lk.Unlock()
+	if most != limit {
+		t.Fatalf("expected at most %d blocks in flight, and that many at some point, got %d", limit, most)
+	}
+}
+
+func TestDeterministicBroadcastOrder(t *testing.T) {
+	tracer := new(recordingTracer)
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithDeterministicBroadcastOrder(),
+		WithRebroadcastChunkSize(1), WithWantTracer(tracer))
+	defer cancel()
+
+	ps := make([]peer.ID, 5)
+	for i := range ps {
+		ps[i] = testutil.RandPeerIDFatal(t)
+		wm.Connected(ps[i])
+	}
+	wm.WantBlocks(context.Background(), testCids(2))
+	waitIdle(t, wm)
+
+	// rebroadcasting a chunk at a time broadcasts it, tracing each peer
+	// in the order it is queued for
+	rebroadcasts := func() []string {
+		tracer.lk.Lock()
+		defer tracer.lk.Unlock()
+		var out []string
+		for _, tr := range tracer.traces {
+			if tr.Stage == WantRebroadcast {
+				out = append(out, string(tr.Peer))
+			}
+		}
+		return out
+	}
+	for round := 1; round <= 2; round++ {
+		wm.runSync(wm.rebroadcast)
+		waitFor(t, "rebroadcast to be traced", func() bool { return len(rebroadcasts()) == round*len(ps) })
+	}
+
+	rs := rebroadcasts()
+	first, second := rs[:len(ps)], rs[len(ps):]
+	if !sort.StringsAreSorted(first) {
+		t.Fatalf("expected peers in ID order, got %v", first)
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("expected the same order for every broadcast, got %v and %v", first, second)
+		}
+	}
+}
+
+func TestRetryAfterPartialDisconnect(t *testing.T) {
+	var lk sync.Mutex
+	var failed bool
+	net := newFakeNetwork()
+	net.sendHook = func(context.Context, peer.ID, bsmsg.BitSwapMessage) error {
+		lk.Lock()
+		defer lk.Unlock()
+		if !failed {
+			failed = true
+			return errors.New("send failed")
+		}
+		return nil
+	}
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	// p keeps one of its two connections
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	wm.Connected(p)
+	waitIdle(t, wm)
+	wm.Disconnected(p)
+	waitIdle(t, wm)
+	if peers := wm.ConnectedPeers(); len(peers) != 1 {
+		t.Fatalf("expected p to still be connected, got %v", peers)
+	}
+
+	ks := testCids(1)
+	wm.WantBlocks(context.Background(), ks)
+	net.waitSent(t, p, ks[0])
+}
+
+func TestParkedQueue(t *testing.T) {
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithPeerIdleTimeout(50*time.Millisecond),
+		WithBroadcastPriorityFloor(kMaxPriority-1))
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+	// the third want falls below the floor
+	ks := testCids(4)
+	wm.WantBlocks(context.Background(), ks[:3])
+	net.waitSent(t, p, ks[0])
+
+	var mq *msgQueue
+	wm.runSync(func() { mq = wm.peers[p] })
+	waitFor(t, "the idle queue to be parked", func() bool {
+		mq.outlk.Lock()
+		defer mq.outlk.Unlock()
+		return mq.parked
+	})
+
+	// there is nothing to wait for
+	ctx, cancelDrain := context.WithTimeout(context.Background(), time.Second)
+	defer cancelDrain()
+	if err := wm.DrainPeer(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+
+	// signalling work starts the queue again
+	mq.signalWork()
+	waitFor(t, "the queue to be started again", func() bool {
+		mq.outlk.Lock()
+		defer mq.outlk.Unlock()
+		return !mq.exited
+	})
+
+	// the next want restarts the queue, the seed still skipping the want
+	// below the floor
+	waitFor(t, "the idle queue to be parked again", func() bool {
+		mq.outlk.Lock()
+		defer mq.outlk.Unlock()
+		return mq.parked
+	})
+	wm.WantBlocks(context.Background(), ks[3:])
+	net.waitSent(t, p, ks[3])
+	if net.sentCids(p).Has(ks[2]) {
+		t.Fatal("expected the restarted queue not to send the want below the floor")
+	}
+}
+
+func TestCancelsNotAborted(t *testing.T) {
+	var lk sync.Mutex
+	var block bool
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	aborted := make(chan struct{}, 1)
+	net := newFakeNetwork()
+	net.sendHook = func(ctx context.Context, _ peer.ID, msg bsmsg.BitSwapMessage) error {
+		lk.Lock()
+		b := block
+		lk.Unlock()
+		if !b {
+			return nil
+		}
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			aborted <- struct{}{}
+			return ctx.Err()
+		}
+	}
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	waitIdle(t, wm)
+	ks := testCids(2)
+	wm.WantBlocks(context.Background(), ks[:1])
+	net.waitSent(t, p, ks[0])
+
+	// a message cancelling ks[0] and wanting ks[1]
+	lk.Lock()
+	block = true
+	lk.Unlock()
+	wm.PauseAll()
+	wm.CancelWants(ks[:1])
+	wm.WantBlocks(context.Background(), ks[1:])
+	waitIdle(t, wm)
+	wm.ResumeAll()
+	<-started
+
+	wm.CancelWants(ks[1:])
+	select {
+	case <-aborted:
+		t.Fatal("expected the send carrying a cancel not to be aborted")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	waitFor(t, "the cancel to be sent", func() bool {
+		for _, msg := range net.messages(p) {
+			for _, e := range msg.Wantlist() {
+				if e.Cancel && e.Cid.Equals(ks[0]) {
+					return true
+				}
+			}
+		}
+		return false
+	})
+}
+
+func TestIncrementalResendCancels(t *testing.T) {
+	p := testutil.RandPeerIDFatal(t)
+	net := newFakeNetwork()
+	net.caps = map[peer.ID]bsnet.PeerCapabilities{
+		p: {NoFullWantlist: true},
+	}
+	wm, cancel := newTestWantManager(net)
+	defer cancel()
+
+	wm.Connected(p)
+	waitIdle(t, wm)
+	ks := testCids(2)
+	wm.WantBlocks(context.Background(), ks)
+	net.waitSent(t, p, ks[1])
+
+	// the cancel queued for ks[0] is replaced by our full wantlist, which
+	// the peer is sent in increments
+	wm.PauseAll()
+	wm.CancelWants(ks[:1])
+	waitIdle(t, wm)
+	if err := wm.ResendFullWantlist(p); err != nil {
+		t.Fatal(err)
+	}
+	sent := len(net.messages(p))
+	wm.ResumeAll()
+	if err := wm.DrainPeer(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+
+	var cancelled, wanted bool
+	for _, m := range net.messages(p)[sent:] {
+		if m.Full() {
+			t.Fatal("expected no full wantlist to be sent")
+		}
+		for _, e := range m.Wantlist() {
+			cancelled = cancelled || e.Cancel && e.Cid.Equals(ks[0])
+			wanted = wanted || !e.Cancel && e.Cid.Equals(ks[1])
+		}
+	}
+	if !cancelled || !wanted {
+		t.Fatalf("expected ks[0] to be cancelled and ks[1] wanted again, got %t and %t", cancelled, wanted)
+	}
+}
+
+func TestPooledQueuesNotHeldUpByDials(t *testing.T) {
+	stuck := make(map[peer.ID]bool)
+	release := make(chan struct{})
+	net := newFakeNetwork()
+	net.connectHook = func(ctx context.Context, p peer.ID) error {
+		if !stuck[p] {
+			return nil
+		}
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	wm, cancel := newTestWantManager(net, WithMaxQueueGoroutines(1))
+	defer cancel()
+	defer close(release)
+
+	// the first peer gets a goroutine, the others share the workers, more
+	// of which are taken by unreachable peers than there are
+	var ps []peer.ID
+	for i := 0; i < queuePoolWorkers+3; i++ {
+		p := testutil.RandPeerIDFatal(t)
+		stuck[p] = i > 0 && i <= queuePoolWorkers+1
+		ps = append(ps, p)
+	}
+	for _, p := range ps {
+		wm.Connected(p)
+	}
+	waitIdle(t, wm)
+
+	ks := testCids(1)
+	wm.WantBlocks(context.Background(), ks)
+	net.waitSent(t, ps[len(ps)-1], ks[0])
+}
+
+func TestRestartMirrorOnce(t *testing.T) {
+	m := testutil.RandPeerIDFatal(t)
+	net := newFakeNetwork()
+	wm, cancel := newTestWantManager(net, WithMirrorPeer(m), WithPerPeerSendConcurrency(2))
+
+	ks := testCids(2)
+	wm.WantBlocks(context.Background(), ks[:1])
+	net.waitSent(t, m, ks[0])
+	cancel()
+
+	// only one of the calls brings the WantManager back
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- wm.Restart(ctx) }()
+	}
+	var failed int
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Fatalf("expected one of the restarts to fail, %d did", failed)
+	}
+
+	// the mirror sends again after the restart
+	wm.WantBlocks(context.Background(), ks[1:])
+	net.waitSent(t, m, ks[1])
+}
+
+func TestShutdownDrainFlushesQueues(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	net := newFakeNetwork()
+	wm := NewWantManager(ctx, net, WithShutdownDrain(time.Second))
+
+	p := testutil.RandPeerIDFatal(t)
+	wm.Connected(p)
+	wm.StepRun()
+	ks := testCids(1)
+	wm.WantBlocks(context.Background(), ks)
+	wm.StepRun()
+	net.waitSent(t, p, ks[0])
+
+	wm.CancelWants(ks)
+	cancel()
+	// Run returns right away as the context is already cancelled
+	wm.Run()
+
+	var cancelled bool
+	for _, m := range net.messages(p) {
+		for _, e := range m.Wantlist() {
+			cancelled = cancelled || e.Cancel && e.Cid.Equals(ks[0])
+		}
+	}
+	if !cancelled {
+		t.Fatal("expected the cancel issued before shutdown to reach the peer")
+	}
+}